@@ -0,0 +1,402 @@
+// Package client is a Go SDK for the receipt processor API.
+//
+//	c := client.New("http://localhost:8000", client.WithAPIKey(key))
+//	id, err := c.ProcessReceipt(ctx, receipt)
+//	points, err := c.GetPoints(ctx, id)
+//
+// Requests honour the context's deadline and cancellation. Transient
+// failures are retried with exponential backoff; see WithRetries.
+package client
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Item is a line item on a receipt.
+type Item struct {
+	ShortDescription string `json:"shortDescription"`
+	Price            string `json:"price"`
+	Category         string `json:"category,omitempty"`
+}
+
+// Receipt is a receipt to be scored. Amounts are decimal strings with two
+// places, e.g. "6.49"; dates are YYYY-MM-DD and times HH:MM.
+type Receipt struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Items        []Item `json:"items"`
+	Total        string `json:"total"`
+}
+
+// ID identifies a processed receipt.
+type ID string
+
+// StoredReceipt is a processed receipt as returned by the API.
+type StoredReceipt struct {
+	ID          ID        `json:"id"`
+	Receipt     Receipt   `json:"receipt"`
+	Points      int       `json:"points"`
+	ProcessedAt time.Time `json:"processedAt"`
+	Owner       string    `json:"owner,omitempty"`
+	// UserID is the end user the receipt was submitted for, if any.
+	UserID string `json:"userId,omitempty"`
+	// Tier is the user's loyalty tier when the receipt was submitted.
+	Tier string `json:"tier,omitempty"`
+	// Status is "accepted", "needs_review", "rejected" or "pending". Points
+	// are zero until the receipt is accepted.
+	Status string `json:"status,omitempty"`
+	// RulesVersion is the version of the rule set that computed Points.
+	RulesVersion string `json:"rulesVersion,omitempty"`
+	// Flags lists checks the receipt failed but was accepted anyway, such
+	// as "total_mismatch" or "near_duplicate".
+	Flags []string `json:"flags,omitempty"`
+	// FraudScore rates how suspicious the receipt looked, from 0 to 100.
+	FraudScore int `json:"fraudScore,omitempty"`
+}
+
+// ListFilter narrows ListReceipts. Zero fields are ignored; From and To are
+// inclusive purchase dates in YYYY-MM-DD form.
+type ListFilter struct {
+	Retailer string
+	From     string
+	To       string
+}
+
+// Client calls the receipt processor API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+	token      string
+	maxRetries int
+	backoff    time.Duration
+
+	// sessionToken is the last X-Session-Token the server returned. Sending
+	// it back keeps reads served by database replicas from missing the
+	// client's own writes.
+	mu           sync.Mutex
+	sessionToken string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the underlying HTTP client (default: a client with a
+// 30 second timeout).
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithTLSConfig sets the TLS configuration of the default HTTP client, for
+// example to present a client certificate to a server that requires mTLS.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = cfg
+		c.httpClient = &http.Client{Timeout: 30 * time.Second, Transport: t}
+	}
+}
+
+// WithAPIKey authenticates requests with the X-Api-Key header.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithBearerToken authenticates requests with an Authorization bearer token.
+func WithBearerToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithRetries sets how many times a failed request is retried (default 3)
+// and the initial backoff between attempts (default 200ms), which doubles
+// on each retry. A Retry-After header from the server takes precedence.
+func WithRetries(max int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = max
+		c.backoff = backoff
+	}
+}
+
+// New returns a Client for the API at baseURL, e.g. "http://localhost:8000".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		maxRetries: 3,
+		backoff:    200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ProcessReceipt submits r for scoring and returns the ID it was stored under.
+// Each call sends a fresh Idempotency-Key, so retries of the call never store
+// the receipt twice.
+func (c *Client) ProcessReceipt(ctx context.Context, r Receipt) (ID, error) {
+	var out struct {
+		ID ID `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/receipts/process", newIdempotencyKey(), r, &out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+// GetPoints returns the points awarded to the receipt with the given ID.
+// It returns an error matching ErrNotFound if the receipt does not exist.
+func (c *Client) GetPoints(ctx context.Context, id ID) (int, error) {
+	var out struct {
+		Points int `json:"points"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/receipts/"+url.PathEscape(string(id))+"/points", "", nil, &out); err != nil {
+		return 0, err
+	}
+	return out.Points, nil
+}
+
+// GetReceipt returns the receipt with the given ID together with its points.
+// It returns an error matching ErrNotFound if the receipt does not exist.
+func (c *Client) GetReceipt(ctx context.Context, id ID) (StoredReceipt, error) {
+	var out StoredReceipt
+	err := c.do(ctx, http.MethodGet, "/v1/receipts/"+url.PathEscape(string(id)), "", nil, &out)
+	return out, err
+}
+
+// ListReceipts returns the receipts visible to the caller that match f,
+// oldest first.
+func (c *Client) ListReceipts(ctx context.Context, f ListFilter) ([]StoredReceipt, error) {
+	q := url.Values{}
+	if f.Retailer != "" {
+		q.Set("retailer", f.Retailer)
+	}
+	if f.From != "" {
+		q.Set("from", f.From)
+	}
+	if f.To != "" {
+		q.Set("to", f.To)
+	}
+	path := "/v1/receipts"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var out struct {
+		Receipts []StoredReceipt `json:"receipts"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, "", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Receipts, nil
+}
+
+// do sends a request, retrying transient failures, and decodes a successful
+// JSON response into out. A non-empty idempotencyKey is sent as the
+// Idempotency-Key header and makes a POST as safe to retry as a GET.
+func (c *Client) do(ctx context.Context, method, path, idempotencyKey string, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("client: encode request: %w", err)
+		}
+	}
+
+	idempotent := method == http.MethodGet || idempotencyKey != ""
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, idempotencyKey, body)
+		if err != nil {
+			// Other requests are not retried after a transport error because
+			// the server may already have acted on them.
+			if ctx.Err() != nil || attempt >= c.maxRetries || !idempotent {
+				return err
+			}
+			if err := c.wait(ctx, attempt, 0); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil {
+				return nil
+			}
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return fmt.Errorf("client: decode response: %w", err)
+			}
+			return nil
+		}
+
+		apiErr := readError(resp)
+		if attempt >= c.maxRetries || !retryableStatus(idempotent, resp.StatusCode) {
+			return apiErr
+		}
+		if err := c.wait(ctx, attempt, retryAfter(resp)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path, idempotencyKey string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return nil, fmt.Errorf("client: build request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-Api-Key", c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	c.mu.Lock()
+	if c.sessionToken != "" {
+		req.Header.Set("X-Session-Token", c.sessionToken)
+	}
+	c.mu.Unlock()
+	resp, err := c.httpClient.Do(req)
+	if err == nil {
+		if token := resp.Header.Get("X-Session-Token"); token != "" {
+			c.mu.Lock()
+			c.sessionToken = token
+			c.mu.Unlock()
+		}
+	}
+	return resp, err
+}
+
+// wait sleeps before the next attempt: for the server's Retry-After if
+// given, otherwise for an exponentially growing, jittered backoff.
+func (c *Client) wait(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	d := retryAfter
+	if d <= 0 {
+		d = c.backoff << attempt
+		d = d/2 + rand.N(d/2+1)
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryableStatus reports whether a response status is worth retrying.
+// 429 and 503 mean the server turned the request away unprocessed, so
+// they are safe to retry for any request.
+func retryableStatus(idempotent bool, status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// newIdempotencyKey returns a random key for one logical request.
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// retryAfter parses a Retry-After header given in seconds.
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// ErrNotFound matches (via errors.Is) API errors with status 404.
+var ErrNotFound = errors.New("client: not found")
+
+// FieldError describes one invalid field of a rejected receipt.
+type FieldError struct {
+	Field string `json:"field"`
+	// Code classifies the failure, e.g. "REQUIRED" or "INVALID_FORMAT".
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is an error response from the API, decoded from its RFC 7807
+// problem details body.
+type Error struct {
+	StatusCode int    `json:"status"`
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Detail     string `json:"detail"`
+	// RequestID identifies the request in the server's logs; quote it when
+	// reporting a problem.
+	RequestID string `json:"requestId"`
+	// TraceID is the same as RequestID.
+	//
+	// Deprecated: Use RequestID.
+	TraceID string       `json:"traceId"`
+	Fields  []FieldError `json:"fields"`
+}
+
+func (e *Error) Error() string {
+	msg := e.Title
+	if e.Detail != "" {
+		msg = e.Detail
+	}
+	return fmt.Sprintf("client: %d %s (request %s)", e.StatusCode, msg, e.RequestID)
+}
+
+// Is reports whether e matches target; an *Error with status 404 matches
+// ErrNotFound.
+func (e *Error) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// readError consumes resp and builds an *Error from it.
+func readError(resp *http.Response) error {
+	defer resp.Body.Close()
+	apiErr := &Error{}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(data, apiErr) != nil {
+		apiErr.Detail = strings.TrimSpace(string(data))
+	}
+	apiErr.StatusCode = resp.StatusCode
+	// Errors from proxies in front of the server have no body to read the
+	// ID from.
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get("X-Request-Id")
+	}
+	if apiErr.Title == "" {
+		apiErr.Title = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
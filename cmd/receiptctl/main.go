@@ -0,0 +1,274 @@
+// Command receiptctl talks to a running receipt processor instance.
+//
+//	receiptctl [flags] process <file.json>
+//	receiptctl [flags] points <id>
+//	receiptctl [flags] list [-retailer name] [-from date] [-to date]
+//	receiptctl [flags] export [-format json|csv] [-o file]
+//
+// The server address and credentials default to RECEIPTCTL_URL,
+// RECEIPTCTL_API_KEY and RECEIPTCTL_TOKEN.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"fetch_assessment/client"
+)
+
+const usage = `Usage: receiptctl [flags] <command> [args]
+
+Commands:
+  process <file.json>   submit a receipt ("-" reads stdin) and print its ID
+  points <id>           print the points awarded to a receipt
+  list                  list receipts (-retailer, -from, -to)
+  export                dump all receipts with their points (-format json|csv, -o file)
+
+Flags:
+`
+
+func main() {
+	fs := flag.NewFlagSet("receiptctl", flag.ExitOnError)
+	baseURL := fs.String("url", envOr("RECEIPTCTL_URL", "http://localhost:8000"), "base URL of the receipt processor")
+	apiKey := fs.String("api-key", os.Getenv("RECEIPTCTL_API_KEY"), "API key sent as X-Api-Key")
+	token := fs.String("token", os.Getenv("RECEIPTCTL_TOKEN"), "bearer token sent in the Authorization header")
+	certFile := fs.String("cert", os.Getenv("RECEIPTCTL_CERT"), "client certificate (PEM) for servers that require mTLS")
+	keyFile := fs.String("key", os.Getenv("RECEIPTCTL_KEY"), "private key (PEM) of -cert")
+	caFile := fs.String("cacert", os.Getenv("RECEIPTCTL_CACERT"), "CA certificates (PEM) to verify the server against, instead of the system's")
+	timeout := fs.Duration("timeout", 30*time.Second, "overall timeout for the command")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	opts := []client.Option{}
+	if *apiKey != "" {
+		opts = append(opts, client.WithAPIKey(*apiKey))
+	}
+	if *token != "" {
+		opts = append(opts, client.WithBearerToken(*token))
+	}
+	if *certFile != "" || *caFile != "" {
+		tlsCfg, err := clientTLSConfig(*certFile, *keyFile, *caFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "receiptctl:", err)
+			os.Exit(2)
+		}
+		opts = append(opts, client.WithTLSConfig(tlsCfg))
+	}
+	c := client.New(*baseURL, opts...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	var err error
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "process":
+		err = runProcess(ctx, c, args)
+	case "points":
+		err = runPoints(ctx, c, args)
+	case "list":
+		err = runList(ctx, c, args)
+	case "export":
+		err = runExport(ctx, c, args)
+	default:
+		fmt.Fprintf(os.Stderr, "receiptctl: unknown command %q\n\n", cmd)
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		printError(err)
+		os.Exit(1)
+	}
+}
+
+// runProcess handles `process <file.json>`
+func runProcess(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: receiptctl process <file.json>")
+	}
+	var in io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var receipt client.Receipt
+	dec := json.NewDecoder(in)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&receipt); err != nil {
+		return fmt.Errorf("reading %s: %w", args[0], err)
+	}
+
+	id, err := c.ProcessReceipt(ctx, receipt)
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	return nil
+}
+
+// runPoints handles `points <id>`
+func runPoints(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: receiptctl points <id>")
+	}
+	points, err := c.GetPoints(ctx, client.ID(args[0]))
+	if err != nil {
+		return err
+	}
+	fmt.Println(points)
+	return nil
+}
+
+// runList handles `list`
+func runList(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	var f client.ListFilter
+	fs.StringVar(&f.Retailer, "retailer", "", "only receipts from this retailer (case-insensitive)")
+	fs.StringVar(&f.From, "from", "", "only receipts purchased on or after this date (YYYY-MM-DD)")
+	fs.StringVar(&f.To, "to", "", "only receipts purchased on or before this date (YYYY-MM-DD)")
+	fs.Parse(args)
+
+	receipts, err := c.ListReceipts(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tRETAILER\tPURCHASED\tTOTAL\tPOINTS")
+	for _, rec := range receipts {
+		fmt.Fprintf(tw, "%s\t%s\t%s %s\t%s\t%d\n", rec.ID, rec.Receipt.Retailer,
+			rec.Receipt.PurchaseDate, rec.Receipt.PurchaseTime, rec.Receipt.Total, rec.Points)
+	}
+	return tw.Flush()
+}
+
+// runExport handles `export`
+func runExport(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "json", "output format: json or csv")
+	outPath := fs.String("o", "", "write to this file instead of stdout")
+	fs.Parse(args)
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %q, expected json or csv", *format)
+	}
+
+	receipts, err := c.ListReceipts(ctx, client.ListFilter{})
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if *format == "csv" {
+		return writeCSV(out, receipts)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(receipts)
+}
+
+// writeCSV writes one row per receipt; items are embedded as JSON.
+func writeCSV(out io.Writer, receipts []client.StoredReceipt) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"id", "retailer", "purchaseDate", "purchaseTime", "total", "items", "points", "processedAt", "owner"})
+	for _, rec := range receipts {
+		items, err := json.Marshal(rec.Receipt.Items)
+		if err != nil {
+			return err
+		}
+		w.Write([]string{
+			string(rec.ID), rec.Receipt.Retailer, rec.Receipt.PurchaseDate, rec.Receipt.PurchaseTime,
+			rec.Receipt.Total, string(items), strconv.Itoa(rec.Points),
+			rec.ProcessedAt.Format(time.RFC3339Nano), rec.Owner,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// printError reports err on stderr, including field errors for rejected receipts.
+func printError(err error) {
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		fmt.Fprintf(os.Stderr, "receiptctl: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "receiptctl: %s (HTTP %d)\n", apiErr.Title, apiErr.StatusCode)
+	if apiErr.Detail != "" && apiErr.Detail != apiErr.Title {
+		fmt.Fprintf(os.Stderr, "  %s\n", apiErr.Detail)
+	}
+	for _, f := range apiErr.Fields {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", f.Field, f.Message)
+	}
+	if apiErr.RequestID != "" {
+		fmt.Fprintf(os.Stderr, "  request ID: %s\n", apiErr.RequestID)
+	}
+}
+
+// clientTLSConfig loads the client certificate and CA certificates named by
+// the -cert, -key and -cacert flags.
+func clientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("CA certificates: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificates in %s", caFile)
+		}
+	}
+	return cfg, nil
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Statistics that achievements are measured against.
+const (
+	statReceipts = "receipts" // accepted receipts
+	statPoints   = "points"   // points earned from receipts
+	statStreak   = "streak"   // longest run of consecutive days with a receipt
+)
+
+// achievement is a badge a user unlocks when a statistic reaches its
+// threshold.
+type achievement struct {
+	ID        string
+	Name      string
+	Stat      string
+	Threshold int
+}
+
+// achievements is the badge catalog, in display order.
+var achievements = []achievement{
+	{"first-receipt", "First receipt", statReceipts, 1},
+	{"receipts-100", "100 receipts", statReceipts, 100},
+	{"points-10k", "10,000 points", statPoints, 10000},
+	{"streak-7", "7-day streak", statStreak, 7},
+	{"streak-30", "30-day streak", statStreak, 30},
+}
+
+// parseAchievementBonuses reads spec, a comma-separated list of "id=points"
+// entries giving the bonus awarded for each achievement.
+func parseAchievementBonuses(spec string) (map[string]int, error) {
+	out := make(map[string]int)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, v, ok := strings.Cut(entry, "=")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("ACHIEVEMENT_BONUSES: invalid entry %q, expected id=points", entry)
+		}
+		if !slices.ContainsFunc(achievements, func(a achievement) bool { return a.ID == id }) {
+			return nil, fmt.Errorf("ACHIEVEMENT_BONUSES: unknown achievement %q", id)
+		}
+		bonus, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || bonus < 0 {
+			return nil, fmt.Errorf("ACHIEVEMENT_BONUSES: bonus for %q must be a non-negative integer", id)
+		}
+		out[id] = bonus
+	}
+	return out, nil
+}
+
+// userProgress is what a user's ledger says about their activity.
+type userProgress struct {
+	Receipts      int `json:"receipts"`
+	PointsEarned  int `json:"pointsEarned"`
+	CurrentStreak int `json:"currentStreak"`
+	LongestStreak int `json:"longestStreak"`
+
+	unlockedAt map[string]time.Time
+}
+
+// replayProgress works out a user's statistics, and when each achievement
+// was unlocked, from their ledger. Earn entries count as receipts; they
+// and re-scoring adjustments count as points earned. Streaks are counted
+// in UTC days.
+func replayProgress(entries []LedgerEntry, now time.Time) userProgress {
+	p := userProgress{unlockedAt: make(map[string]time.Time)}
+	var lastDay time.Time
+	for _, e := range entries {
+		if !e.earnedFromReceipt() {
+			continue
+		}
+		p.PointsEarned += e.Points
+		if e.Type == ledgerEarn {
+			p.Receipts++
+			day := e.CreatedAt.UTC().Truncate(24 * time.Hour)
+			switch {
+			case day.Equal(lastDay):
+			case day.Equal(lastDay.AddDate(0, 0, 1)):
+				p.CurrentStreak++
+			default:
+				p.CurrentStreak = 1
+			}
+			lastDay = day
+			p.LongestStreak = max(p.LongestStreak, p.CurrentStreak)
+		}
+		for _, a := range achievements {
+			if _, ok := p.unlockedAt[a.ID]; !ok && p.stat(a.Stat) >= a.Threshold {
+				p.unlockedAt[a.ID] = e.CreatedAt
+			}
+		}
+	}
+	// A streak is still current until a whole day passes without a receipt.
+	if today := now.UTC().Truncate(24 * time.Hour); lastDay.Before(today.AddDate(0, 0, -1)) {
+		p.CurrentStreak = 0
+	}
+	return p
+}
+
+func (p userProgress) stat(name string) int {
+	switch name {
+	case statReceipts:
+		return p.Receipts
+	case statPoints:
+		return p.PointsEarned
+	case statStreak:
+		return p.LongestStreak
+	}
+	return 0
+}
+
+// achievementEntryID is the ledger entry ID for user's bonus for
+// achievement id. It is fixed so the bonus can be found again and, on SQL
+// stores, cannot be recorded twice.
+func achievementEntryID(user, id string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(user+"\x00achievement\x00"+id)).String()
+}
+
+// awardAchievements credits user with the bonus for every achievement they
+// have unlocked and not yet been paid for.
+func (s *server) awardAchievements(ctx context.Context, user string) {
+	if len(s.achievementBonuses) == 0 {
+		return
+	}
+	entries, err := s.store.Ledger(ctx, user)
+	if err != nil {
+		log.Printf("Error loading ledger for achievements: %v", err)
+		return
+	}
+	p := replayProgress(entries, time.Now())
+	for _, a := range achievements {
+		bonus := s.achievementBonuses[a.ID]
+		if _, ok := p.unlockedAt[a.ID]; !ok || bonus == 0 {
+			continue
+		}
+		id := achievementEntryID(user, a.ID)
+		if slices.ContainsFunc(entries, func(e LedgerEntry) bool { return e.ID == id }) {
+			continue
+		}
+		_, err := s.store.AddLedgerEntry(ctx, LedgerEntry{
+			ID:        id,
+			UserID:    user,
+			Type:      ledgerBonus,
+			Points:    bonus,
+			Reason:    "Achievement unlocked: " + a.Name,
+			CreatedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			log.Printf("Error awarding achievement %s to %s: %v", a.ID, user, err)
+		}
+	}
+}
+
+// achievementsHandler handles GET /users/{id}/achievements
+func (s *server) achievementsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	entries, err := s.store.Ledger(r.Context(), user)
+	if err != nil {
+		log.Printf("Error loading ledger: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load achievements")
+		return
+	}
+	p := replayProgress(entries, time.Now())
+
+	type badge struct {
+		ID         string     `json:"id"`
+		Name       string     `json:"name"`
+		Stat       string     `json:"stat"`
+		Threshold  int        `json:"threshold"`
+		Progress   int        `json:"progress"`
+		Bonus      int        `json:"bonus"`
+		Unlocked   bool       `json:"unlocked"`
+		UnlockedAt *time.Time `json:"unlockedAt,omitempty"`
+	}
+	badges := make([]badge, 0, len(achievements))
+	for _, a := range achievements {
+		b := badge{
+			ID:        a.ID,
+			Name:      a.Name,
+			Stat:      a.Stat,
+			Threshold: a.Threshold,
+			Progress:  min(p.stat(a.Stat), a.Threshold),
+			Bonus:     s.achievementBonuses[a.ID],
+		}
+		if t, ok := p.unlockedAt[a.ID]; ok {
+			b.Unlocked, b.UnlockedAt, b.Progress = true, &t, a.Threshold
+		}
+		badges = append(badges, b)
+	}
+
+	response := struct {
+		UserID string `json:"userId"`
+		userProgress
+		Achievements []badge `json:"achievements"`
+	}{user, p, badges}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+
+	"fetch_assessment/points"
+)
+
+// requireAdmin limits next to administrators: callers whose API key is
+// listed in ADMIN_API_KEYS or whose client certificate's tenant is listed
+// in ADMIN_CLIENT_CERT_TENANTS, and token callers with the rules:admin
+// scope.
+// Without authentication there is no administrator, so the request is
+// refused.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := identityFrom(r.Context())
+		if !ok {
+			writeProblem(w, r, http.StatusForbidden, "Administration requires authentication to be configured")
+			return
+		}
+		if id.ClientCert != "" && !id.Admin {
+			writeProblem(w, r, http.StatusForbidden, "Client certificate tenant is not an administrator")
+			return
+		}
+		if id.APIKey != "" && !id.Admin {
+			writeProblem(w, r, http.StatusForbidden, "API key is not an administrator")
+			return
+		}
+		if id.APIKey == "" && !slices.Contains(id.Scopes, scopeRulesAdmin) {
+			writeProblem(w, r, http.StatusForbidden, "Token lacks the required scope "+scopeRulesAdmin)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// getRulesHandler handles GET /admin/rules
+func (s *server) getRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.rules.Load().RuleSet())
+}
+
+// putRulesHandler handles PUT /admin/rules
+func (s *server) putRulesHandler(w http.ResponseWriter, r *http.Request) {
+	var rs points.RuleSet
+	if status, err := decodeJSONBody(r, &rs); err != nil {
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	engine, ok := s.replaceRules(w, r, rs, "Rules updated")
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(engine.RuleSet())
+}
+
+// replaceRules compiles rs and makes it the active rule set, writing an
+// error response and returning false if it is invalid. The change is
+// audit-logged with msg. Callers hold s.rulesMu.
+func (s *server) replaceRules(w http.ResponseWriter, r *http.Request, rs points.RuleSet, msg string) (*points.Engine, bool) {
+	engine, err := points.Compile(rs)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid rule set: "+err.Error())
+		return nil, false
+	}
+	// A version must keep meaning one configuration, or receipts scored
+	// under it could not be compared.
+	old := s.rules.Load()
+	if engine.Version() == old.Version() && !reflect.DeepEqual(engine.RuleSet(), old.RuleSet()) {
+		writeProblem(w, r, http.StatusConflict, fmt.Sprintf("Rule set version %q is already active with different rules", engine.Version()))
+		return nil, false
+	}
+
+	// New requests score with the new rules; requests already running
+	// finish with the rules they loaded.
+	s.rules.Store(engine)
+	id, _ := identityFrom(r.Context())
+	slog.Info(msg,
+		"audit", true,
+		"api_key", id.APIKey,
+		"subject", id.Subject,
+		"old_rules_version", old.Version(),
+		"rules_version", engine.Version(),
+		"rules", len(rs.Rules),
+		"promotions", len(rs.Promotions),
+		"categories", len(rs.Categories))
+	return engine, true
+}
+
+// promotionsResponse lists the active promotions.
+type promotionsResponse struct {
+	RulesVersion string             `json:"rulesVersion"`
+	Promotions   []points.Promotion `json:"promotions"`
+}
+
+func writePromotions(w http.ResponseWriter, engine *points.Engine) {
+	rs := engine.RuleSet()
+	if rs.Promotions == nil {
+		rs.Promotions = []points.Promotion{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(promotionsResponse{rs.Version, rs.Promotions})
+}
+
+// getPromotionsHandler handles GET /admin/promotions
+func (s *server) getPromotionsHandler(w http.ResponseWriter, r *http.Request) {
+	writePromotions(w, s.rules.Load())
+}
+
+// putPromotionHandler handles PUT /admin/promotions/{name}
+func (s *server) putPromotionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var p points.Promotion
+	if status, err := decodeJSONBody(r, &p); err != nil {
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	defer r.Body.Close()
+	if p.Name != "" && p.Name != name {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Promotion name %q does not match the path", p.Name))
+		return
+	}
+	p.Name = name
+
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	// Replace the promotion with this name, or add it. The rule set's
+	// version is cleared so that a new one is derived from its content.
+	rs := s.rules.Load().RuleSet()
+	rs.Version = ""
+	i := slices.IndexFunc(rs.Promotions, func(q points.Promotion) bool { return q.Name == name })
+	if i >= 0 {
+		rs.Promotions[i] = p
+	} else {
+		rs.Promotions = append(rs.Promotions, p)
+	}
+	engine, ok := s.replaceRules(w, r, rs, "Promotion updated")
+	if !ok {
+		return
+	}
+	writePromotions(w, engine)
+}
+
+// deletePromotionHandler handles DELETE /admin/promotions/{name}
+func (s *server) deletePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	rs := s.rules.Load().RuleSet()
+	rs.Version = ""
+	i := slices.IndexFunc(rs.Promotions, func(q points.Promotion) bool { return q.Name == name })
+	if i < 0 {
+		writeProblem(w, r, http.StatusNotFound, "Promotion not found")
+		return
+	}
+	rs.Promotions = slices.Delete(rs.Promotions, i, i+1)
+	if _, ok := s.replaceRules(w, r, rs, "Promotion deleted"); !ok {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// categoriesResponse is the active category map.
+type categoriesResponse struct {
+	RulesVersion string            `json:"rulesVersion"`
+	Categories   map[string]string `json:"categories"`
+}
+
+func writeCategories(w http.ResponseWriter, engine *points.Engine) {
+	rs := engine.RuleSet()
+	if rs.Categories == nil {
+		rs.Categories = map[string]string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(categoriesResponse{rs.Version, rs.Categories})
+}
+
+// getCategoriesHandler handles GET /admin/categories
+func (s *server) getCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	writeCategories(w, s.rules.Load())
+}
+
+// putCategoriesHandler handles PUT /admin/categories
+func (s *server) putCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	var categories map[string]string
+	if status, err := decodeJSONBody(r, &categories); err != nil {
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	// Replace the whole map, clearing the version so that a new one is
+	// derived from the content.
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	rs := s.rules.Load().RuleSet()
+	rs.Version, rs.Categories = "", categories
+	engine, ok := s.replaceRules(w, r, rs, "Categories updated")
+	if !ok {
+		return
+	}
+	writeCategories(w, engine)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fetch_assessment/points"
+)
+
+// Groupings accepted by GET /analytics/points.
+var analyticsGroups = []string{"retailer", "day", "month"}
+
+// analyticsBucket is the receipts and points in one group.
+type analyticsBucket struct {
+	Key      string `json:"key"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+// analytics aggregates receipts and points by retailer, purchase day and
+// purchase month. It is rebuilt from the store by refresh and kept up to
+// date in between by add.
+type analytics struct {
+	rules func() *points.Engine // resolves canonical retailer names
+
+	mu        sync.Mutex
+	groups    map[string]map[string]*analyticsBucket // grouping → bucket ID → bucket
+	refreshed time.Time
+}
+
+func newAnalytics(rules func() *points.Engine) *analytics {
+	return &analytics{rules: rules, groups: emptyAnalyticsGroups()}
+}
+
+func emptyAnalyticsGroups() map[string]map[string]*analyticsBucket {
+	groups := make(map[string]map[string]*analyticsBucket, len(analyticsGroups))
+	for _, g := range analyticsGroups {
+		groups[g] = make(map[string]*analyticsBucket)
+	}
+	return groups
+}
+
+// countAnalytics adds receipts and points for rec to groups. Retailers are
+// grouped by canonical name, ignoring case; days and months are purchase
+// dates.
+func countAnalytics(groups map[string]map[string]*analyticsBucket, rules *points.Engine, rec StoredReceipt, receipts, pts int) {
+	retailer := strings.TrimSpace(rules.CanonicalRetailer(rec.Receipt.Retailer))
+	for g, key := range map[string]string{
+		"retailer": retailer,
+		"day":      rec.Receipt.PurchaseDate,
+		"month":    rec.Receipt.PurchaseDate[:min(7, len(rec.Receipt.PurchaseDate))],
+	} {
+		id := key
+		if g == "retailer" {
+			id = strings.ToLower(key)
+		}
+		b, ok := groups[g][id]
+		if !ok {
+			b = &analyticsBucket{Key: key}
+			groups[g][id] = b
+		}
+		b.Receipts += receipts
+		b.Points += pts
+	}
+}
+
+// add counts receipts more of rec's receipt, and pts more points.
+func (a *analytics) add(rec StoredReceipt, receipts, pts int) {
+	rules := a.rules()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	countAnalytics(a.groups, rules, rec, receipts, pts)
+}
+
+// refresh rebuilds the aggregates from every stored receipt.
+func (a *analytics) refresh(ctx context.Context, store ReceiptStore) error {
+	all, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+	rules := a.rules()
+	groups := emptyAnalyticsGroups()
+	for _, rec := range all {
+		countAnalytics(groups, rules, rec, 1, rec.Points)
+	}
+	a.mu.Lock()
+	a.groups, a.refreshed = groups, time.Now().UTC()
+	a.mu.Unlock()
+	return nil
+}
+
+// runAnalyticsRefresh rebuilds a from store every interval until ctx is
+// done, picking up receipts changed by other replicas, deletions and
+// retention.
+func runAnalyticsRefresh(ctx context.Context, a *analytics, store ReceiptStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := a.refresh(ctx, store); err != nil {
+			slog.Error("Error refreshing analytics", "error", err)
+		}
+	}
+}
+
+// buckets returns a copy of the buckets for grouping g: days and months in
+// order, retailers by points, most first.
+func (a *analytics) buckets(g string) ([]analyticsBucket, time.Time) {
+	a.mu.Lock()
+	out := make([]analyticsBucket, 0, len(a.groups[g]))
+	for _, b := range a.groups[g] {
+		out = append(out, *b)
+	}
+	refreshed := a.refreshed
+	a.mu.Unlock()
+
+	if g == "retailer" {
+		slices.SortFunc(out, func(x, y analyticsBucket) int {
+			return cmp.Or(y.Points-x.Points, strings.Compare(x.Key, y.Key))
+		})
+	} else {
+		slices.SortFunc(out, func(x, y analyticsBucket) int { return strings.Compare(x.Key, y.Key) })
+	}
+	return out, refreshed
+}
+
+// analyticsPointsHandler handles GET /analytics/points
+func (s *server) analyticsPointsHandler(w http.ResponseWriter, r *http.Request) {
+	g := r.URL.Query().Get("groupBy")
+	if g == "" {
+		g = "retailer"
+	}
+	if !slices.Contains(analyticsGroups, g) {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("groupBy must be one of %s", strings.Join(analyticsGroups, ", ")))
+		return
+	}
+	buckets, refreshed := s.analytics.buckets(g)
+
+	response := struct {
+		GroupBy     string            `json:"groupBy"`
+		RefreshedAt time.Time         `json:"refreshedAt"`
+		Buckets     []analyticsBucket `json:"buckets"`
+	}{g, refreshed, buckets}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
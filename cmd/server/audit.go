@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Actors recorded for changes not made by an authenticated caller.
+const (
+	auditActorAnonymous = "anonymous"
+	auditActorSystem    = "system"
+)
+
+// auditEntry records one change to the service's data or configuration.
+type auditEntry struct {
+	ID string    `json:"id"`
+	At time.Time `json:"at"`
+	// Actor is who made the change: "apikey:" and the key name, "cert:"
+	// and the tenant of a client certificate, "token:" and the token
+	// subject, "anonymous" when authentication is off, or "system" for
+	// background jobs.
+	Actor string `json:"actor"`
+	// User is the end user the change was made for (see userFrom).
+	User string `json:"user,omitempty"`
+	// Action is the route, such as "DELETE /receipts/{id}", or the job
+	// that made the change.
+	Action string `json:"action"`
+	// Target is the receipt, user or other resource changed, if one.
+	Target string `json:"target,omitempty"`
+	// Status is the HTTP status the request was answered with.
+	Status    int    `json:"status,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	// ClientIP is the caller's address behind any trusted proxies, and
+	// RemoteAddr the address the request arrived from.
+	ClientIP   string `json:"clientIp,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+// auditLog is an append-only record of changes. The SQL and Redis stores
+// keep it alongside the data; other drivers use a file (see newAuditLog).
+type auditLog interface {
+	AppendAudit(ctx context.Context, e auditEntry) error
+	// Audit returns up to limit entries recorded at or after since,
+	// oldest first.
+	Audit(ctx context.Context, since time.Time, limit int) ([]auditEntry, error)
+}
+
+// newAuditLog returns where changes are audited: AUDIT_LOG_FILE if set,
+// else the store if it can hold the log, else a file next to a memory
+// store's snapshots or Raft state. Without any of these the log is only
+// kept in memory, and persistent reports false.
+func newAuditLog(store ReceiptStore, cfg storeConfig) (audit auditLog, persistent bool, err error) {
+	path := os.Getenv("AUDIT_LOG_FILE")
+	if path == "" {
+		if a, ok := store.(auditLog); ok {
+			return a, true, nil
+		}
+		switch {
+		case cfg.MemorySnapshotDir != "":
+			path = filepath.Join(cfg.MemorySnapshotDir, "audit.jsonl")
+		case cfg.Driver == "raft":
+			path = filepath.Join(cfg.RaftDir, "audit.jsonl")
+		}
+	}
+	if path == "" {
+		return &fileAuditLog{}, false, nil
+	}
+	a, err := openFileAuditLog(path)
+	return a, err == nil, err
+}
+
+// fileAuditLog keeps audit entries in memory and, if file is set, appends
+// each to it as a line of JSON before it is listed.
+type fileAuditLog struct {
+	mu      sync.Mutex
+	entries []auditEntry
+	file    *os.File
+}
+
+// openFileAuditLog loads the entries in the file at path, creating it if
+// needed, and appends new ones to it.
+func openFileAuditLog(path string) (*fileAuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	a := &fileAuditLog{file: f}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// Most likely a write cut short by a crash; it stays in the
+			// file, which is never rewritten.
+			slog.Warn("Skipping a damaged audit log entry", "file", path, "line", line, "error", err)
+			continue
+		}
+		a.entries = append(a.entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read audit log: %w", err)
+	}
+	sort.SliceStable(a.entries, func(i, j int) bool { return a.entries[i].At.Before(a.entries[j].At) })
+	return a, nil
+}
+
+func (a *fileAuditLog) AppendAudit(ctx context.Context, e auditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		if err := a.file.Sync(); err != nil {
+			return err
+		}
+	}
+	// Entries recorded concurrently may arrive slightly out of order.
+	i := len(a.entries)
+	for i > 0 && a.entries[i-1].At.After(e.At) {
+		i--
+	}
+	a.entries = append(a.entries, auditEntry{})
+	copy(a.entries[i+1:], a.entries[i:])
+	a.entries[i] = e
+	return nil
+}
+
+func (a *fileAuditLog) Audit(ctx context.Context, since time.Time, limit int) ([]auditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := sort.Search(len(a.entries), func(i int) bool { return !a.entries[i].At.Before(since) })
+	end := min(len(a.entries), i+limit)
+	return append([]auditEntry(nil), a.entries[i:end]...), nil
+}
+
+func (a *fileAuditLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// recordAudit appends e to audit, stamping it with an ID and the time. A
+// failure is logged and counted, but does not undo the change.
+func recordAudit(ctx context.Context, audit auditLog, e auditEntry) {
+	e.ID = uuid.New().String()
+	e.At = time.Now().UTC()
+	if e.Actor == "" {
+		e.Actor = auditActor(ctx)
+	}
+	if e.User == "" {
+		e.User = userFrom(ctx)
+	}
+	if e.RequestID == "" {
+		e.RequestID = requestIDFrom(ctx)
+	}
+	if err := audit.AppendAudit(context.WithoutCancel(ctx), e); err != nil {
+		auditFailures.Add(1)
+		slog.Error("Error writing audit log", "action", e.Action, "target", e.Target, "error", err)
+	}
+}
+
+// auditActor names the caller on ctx for the audit log.
+func auditActor(ctx context.Context) string {
+	id, ok := identityFrom(ctx)
+	switch {
+	case !ok:
+		return auditActorAnonymous
+	case id.ClientCert != "":
+		return "cert:" + id.APIKey
+	case id.APIKey != "":
+		return "apikey:" + id.APIKey
+	default:
+		return "token:" + id.Subject
+	}
+}
+
+// readOnlyRoutes are the routes that use POST without changing anything.
+var readOnlyRoutes = map[string]bool{
+	"POST /receipts/score": true,
+	"POST /rules/simulate": true,
+}
+
+// auditedReads are the GET routes recorded in the audit log anyway.
+var auditedReads = map[string]bool{
+	"GET /users/{id}/export": true,
+}
+
+// audited reports whether requests to the route are recorded in the audit
+// log: those that may change something, and exports of a user's data.
+func audited(method, path string) bool {
+	if method == http.MethodGet {
+		return auditedReads[method+" "+path]
+	}
+	return !readOnlyRoutes[method+" "+path]
+}
+
+type auditDetailKey struct{}
+
+// setAuditDetail adds detail to the audit log entry for the request on
+// ctx.
+func setAuditDetail(ctx context.Context, detail string) {
+	if p, ok := ctx.Value(auditDetailKey{}).(*string); ok {
+		*p = detail
+	}
+}
+
+// withAudit records each request to next in the audit log once it has been
+// answered, whether or not it succeeded. action is the route.
+func (s *server) withAudit(action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		var detail string
+		r = r.WithContext(context.WithValue(r.Context(), auditDetailKey{}, &detail))
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		target := r.PathValue("id")
+		if target == "" {
+			target = r.PathValue("name")
+		}
+		if rl, ok := r.Context().Value(requestLogKey).(*requestLog); ok && target == "" {
+			target = rl.receiptID
+		}
+		recordAudit(r.Context(), s.audit, auditEntry{
+			Action:     action,
+			Target:     target,
+			Status:     rec.status,
+			Detail:     detail,
+			ClientIP:   clientIP(r),
+			RemoteAddr: r.RemoteAddr,
+		})
+	})
+}
+
+// auditAbout returns the entries in audit about user: changes made for
+// them or to their data. It reads the whole log.
+func auditAbout(ctx context.Context, audit auditLog, user string) ([]auditEntry, error) {
+	const page = 1000
+	out := []auditEntry{}
+	var since time.Time
+	// Each page starts at the time the last one ended, so entries from
+	// that instant are read twice.
+	seen := make(map[string]bool)
+	for {
+		entries, err := audit.Audit(ctx, since, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !seen[e.ID] && (e.User == user || e.Target == user) {
+				out = append(out, e)
+			}
+		}
+		if len(entries) < page || entries[len(entries)-1].At.Equal(since) {
+			return out, nil
+		}
+		since = entries[len(entries)-1].At
+		clear(seen)
+		for _, e := range entries {
+			if e.At.Equal(since) {
+				seen[e.ID] = true
+			}
+		}
+	}
+}
+
+// auditHandler handles GET /admin/audit
+func (s *server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := parseSince(v)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "since must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+			return
+		}
+		since = t
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeProblem(w, r, http.StatusBadRequest, "limit must be an integer from 1 to 1000")
+			return
+		}
+		limit = n
+	}
+
+	// One more than asked for shows whether there is another page.
+	entries, err := s.audit.Audit(r.Context(), since, limit+1)
+	if err != nil {
+		log.Printf("Error reading audit log: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to read audit log")
+		return
+	}
+	resp := struct {
+		Entries []auditEntry `json:"entries"`
+		// Next is the since value for the following page. It is the time
+		// of the first entry not returned, so entries recorded at that
+		// same instant may appear on both pages.
+		Next string `json:"next,omitempty"`
+	}{Entries: entries}
+	if len(entries) > limit {
+		resp.Entries = entries[:limit]
+		resp.Next = entries[limit].At.Format(time.RFC3339Nano)
+	}
+	if resp.Entries == nil {
+		resp.Entries = []auditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
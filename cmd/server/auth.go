@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// identity describes the authenticated caller of a request.
+type identity struct {
+	APIKey  string // name of the API key used, or the tenant of a client certificate, for service callers
+	Subject string // token subject, for end users; receipts are scoped to it
+	// ClientCert is the certificate identity the tenant in APIKey was
+	// mapped from, for callers authenticated by mTLS.
+	ClientCert string
+	Scopes     []string
+	// ScopesEnforced is set for tokens from an OIDC provider, whose
+	// scopes gate access to each route.
+	ScopesEnforced bool
+	// Admin is set for API keys named in ADMIN_API_KEYS and tenants named
+	// in ADMIN_CLIENT_CERT_TENANTS, who may use the administration
+	// endpoints.
+	Admin bool
+}
+
+// withIdentity returns a copy of ctx carrying id.
+func withIdentity(ctx context.Context, id identity) context.Context {
+	return context.WithValue(ctx, identityKey, id)
+}
+
+// identityFrom returns the caller's identity and whether the request was authenticated.
+func identityFrom(ctx context.Context) (identity, bool) {
+	id, ok := ctx.Value(identityKey).(identity)
+	return id, ok
+}
+
+// callerScope identifies the caller for state kept per caller, such as
+// idempotency keys and jobs. Unauthenticated callers acting for nobody
+// share the empty scope.
+func callerScope(ctx context.Context) string {
+	user := userFrom(ctx)
+	if id, ok := identityFrom(ctx); ok {
+		return id.Subject + "\x00" + id.APIKey + "\x00" + user
+	}
+	if user != "" {
+		return "\x00\x00" + user
+	}
+	return ""
+}
+
+// apiKeySet maps the SHA-256 of each valid key to its name, so lookups do
+// not compare secrets byte by byte.
+type apiKeySet map[[32]byte]string
+
+// loadAPIKeys reads keys from API_KEYS ("name=key" entries separated by
+// commas) and from the file named by API_KEYS_FILE (one "name=key" per
+// line, "#" comments allowed). A bare key is named after its position.
+func loadAPIKeys() (apiKeySet, error) {
+	keys := make(apiKeySet)
+	add := func(entry, source string) error {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			return nil
+		}
+		name, key, ok := strings.Cut(entry, "=")
+		if !ok {
+			name, key = fmt.Sprintf("key-%d", len(keys)+1), entry
+		}
+		name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+		if key == "" {
+			return fmt.Errorf("%s: empty key for %q", source, name)
+		}
+		keys[sha256.Sum256([]byte(key))] = name
+		return nil
+	}
+
+	for _, entry := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		if err := add(entry, "API_KEYS"); err != nil {
+			return nil, err
+		}
+	}
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("API_KEYS_FILE: %w", err)
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if err := add(sc.Text(), path); err != nil {
+				return nil, err
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("API_KEYS_FILE: %w", err)
+		}
+	}
+	return keys, nil
+}
+
+// loadAdminKeys reads ADMIN_API_KEYS, the comma-separated names of the
+// API keys that are administrators.
+func loadAdminKeys() map[string]bool {
+	admins := make(map[string]bool)
+	for _, name := range splitList(os.Getenv("ADMIN_API_KEYS")) {
+		admins[name] = true
+	}
+	return admins
+}
+
+// has reports whether a key is named name.
+func (k apiKeySet) has(name string) bool {
+	for _, n := range k {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the name of key if it is valid.
+func (k apiKeySet) lookup(key string) (string, bool) {
+	name, ok := k[sha256.Sum256([]byte(key))]
+	return name, ok
+}
+
+// isProbe reports whether r is a health probe, which is always allowed
+// through authentication and rate limiting.
+func isProbe(r *http.Request) bool {
+	return r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+}
+
+// isPublic reports whether r may be served without credentials: health
+// probes and the API documentation.
+func isPublic(r *http.Request) bool {
+	return isProbe(r) || r.URL.Path == "/openapi.json" || r.URL.Path == "/docs"
+}
+
+// authenticator checks the credentials on each request. A request may
+// authenticate with a bearer token (when JWT validation is configured) or
+// an X-Api-Key header (when API keys are configured). With neither
+// configured, requests pass through unauthenticated.
+type authenticator struct {
+	// apiKeys and adminKeys, the names of the administrators' keys, are
+	// replaced by reloadAPIKeys while the server runs.
+	apiKeys    atomic.Pointer[apiKeySet]
+	adminKeys  atomic.Pointer[map[string]bool]
+	jwt        *jwtVerifier
+	introspect *introspector
+	// requireScopes enforces OAuth2 scopes on bearer tokens.
+	requireScopes bool
+	// certs is set when client certificates are verified, and maps them
+	// to tenants. certAdmins are the tenants that are administrators.
+	certs      certTenants
+	certAdmins map[string]bool
+}
+
+// newAuthenticator configures authentication from the environment: API
+// keys, JWT validation and, when OIDC_ISSUER_URL is set, the OIDC
+// provider's keys, introspection endpoint and route scopes.
+func newAuthenticator(ctx context.Context) (*authenticator, error) {
+	a := &authenticator{}
+	if err := a.reloadAPIKeys(); err != nil {
+		return nil, err
+	}
+	var err error
+
+	jwtCfg := jwtConfigFromEnv()
+	if oidcCfg := oidcConfigFromEnv(); oidcCfg.IssuerURL != "" {
+		provider, err := discoverOIDC(ctx, oidcCfg.IssuerURL)
+		if err != nil {
+			return nil, err
+		}
+		if jwtCfg.JWKSURL == "" {
+			jwtCfg.JWKSURL = provider.JWKSURI
+		}
+		if jwtCfg.Issuer == "" {
+			jwtCfg.Issuer = provider.Issuer
+		}
+		if oidcCfg.ClientID != "" && provider.IntrospectionEndpoint != "" {
+			a.introspect = newIntrospector(provider.IntrospectionEndpoint, oidcCfg.ClientID, oidcCfg.ClientSecret, jwtCfg.Audience)
+		}
+		a.requireScopes = true
+	}
+	if jwtCfg.enabled() {
+		if a.jwt, err = newJWTVerifier(jwtCfg); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// reloadAPIKeys reads the API keys, and which are administrators, from
+// the environment again.
+func (a *authenticator) reloadAPIKeys() error {
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return err
+	}
+	admins := loadAdminKeys()
+	a.apiKeys.Store(&keys)
+	a.adminKeys.Store(&admins)
+	return nil
+}
+
+// keys returns the current API keys.
+func (a *authenticator) keys() apiKeySet {
+	return *a.apiKeys.Load()
+}
+
+// admins returns the names of the current administrators' keys.
+func (a *authenticator) admins() map[string]bool {
+	return *a.adminKeys.Load()
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.keys()) > 0 || a.jwt != nil || a.introspect != nil || a.certs != nil
+}
+
+// verifyBearer validates a bearer token: JWTs against the configured keys,
+// anything else through token introspection.
+func (a *authenticator) verifyBearer(ctx context.Context, token string) (identity, error) {
+	id := identity{ScopesEnforced: a.requireScopes}
+	if a.jwt != nil && strings.Count(token, ".") == 2 {
+		claims, err := a.jwt.verify(ctx, token)
+		if err != nil {
+			return identity{}, err
+		}
+		id.Subject, _ = claims.GetSubject()
+		id.Scopes = tokenScopes(claims)
+		return id, nil
+	}
+	if a.introspect != nil {
+		var err error
+		id.Subject, id.Scopes, err = a.introspect.introspect(ctx, token)
+		return id, err
+	}
+	return identity{}, errors.New("token is not a JWT")
+}
+
+// middleware rejects unauthenticated requests with 401 and attaches the
+// caller's identity to the request context.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublic(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, ok := a.authenticate(w, r)
+		if !ok {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+	})
+}
+
+// authenticate resolves the caller's identity, writing a 401 response and
+// returning false when the credentials are missing or invalid.
+func (a *authenticator) authenticate(w http.ResponseWriter, r *http.Request) (identity, bool) {
+	// A verified client certificate takes precedence over headers.
+	if a.certs != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		tenant, ident, ok := a.certs.tenant(r.TLS.VerifiedChains[0][0])
+		if !ok {
+			writeProblem(w, r, http.StatusForbidden, "Client certificate is not mapped to a tenant")
+			return identity{}, false
+		}
+		setLogAPIKey(r.Context(), tenant)
+		return identity{APIKey: tenant, ClientCert: ident, Admin: a.certAdmins[tenant]}, true
+	}
+
+	bearer := a.jwt != nil || a.introspect != nil
+	if bearer {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="receipts"`)
+	}
+
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") && bearer {
+		id, err := a.verifyBearer(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="receipts", error="invalid_token"`)
+			writeProblem(w, r, http.StatusUnauthorized, "Invalid bearer token: "+err.Error())
+			return identity{}, false
+		}
+		w.Header().Del("WWW-Authenticate")
+		setLogSubject(r.Context(), id.Subject)
+		return id, true
+	}
+
+	if key, keys := r.Header.Get("X-Api-Key"), a.keys(); key != "" && len(keys) > 0 {
+		name, ok := keys.lookup(key)
+		if !ok {
+			writeProblem(w, r, http.StatusUnauthorized, "Invalid API key")
+			return identity{}, false
+		}
+		w.Header().Del("WWW-Authenticate")
+		setLogAPIKey(r.Context(), name)
+		return identity{APIKey: name, Admin: a.admins()[name]}, true
+	}
+
+	writeProblem(w, r, http.StatusUnauthorized, "Missing credentials: send a bearer token or X-Api-Key header")
+	return identity{}, false
+}
+
+// canAccess reports whether the caller on ctx may see rec. Requests acting
+// for an end user (see userFrom) only see that user's receipts; other
+// service callers see everything.
+func canAccess(ctx context.Context, rec StoredReceipt) bool {
+	user := userFrom(ctx)
+	return user == "" || rec.belongsTo(user)
+}
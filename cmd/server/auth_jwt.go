@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtConfig configures bearer-token validation. Tokens are accepted when
+// signed with HS256 using HMACSecret, or with RS256 using PublicKeyFile or
+// a key published at JWKSURL.
+type jwtConfig struct {
+	HMACSecret    string
+	PublicKeyFile string
+	JWKSURL       string
+	Issuer        string
+	Audience      string
+}
+
+// jwtConfigFromEnv reads the JWT settings from the environment.
+func jwtConfigFromEnv() jwtConfig {
+	return jwtConfig{
+		HMACSecret:    os.Getenv("JWT_HS256_SECRET"),
+		PublicKeyFile: os.Getenv("JWT_RS256_PUBLIC_KEY_FILE"),
+		JWKSURL:       os.Getenv("JWT_JWKS_URL"),
+		Issuer:        os.Getenv("JWT_ISSUER"),
+		Audience:      os.Getenv("JWT_AUDIENCE"),
+	}
+}
+
+func (c jwtConfig) enabled() bool {
+	return c.HMACSecret != "" || c.PublicKeyFile != "" || c.JWKSURL != ""
+}
+
+// jwtVerifier validates bearer tokens and extracts the subject.
+type jwtVerifier struct {
+	hmacSecret []byte
+	publicKey  *rsa.PublicKey
+	jwks       *jwksCache
+	parser     *jwt.Parser
+}
+
+// newJWTVerifier builds a verifier from cfg, loading the static public key
+// and priming the JWKS cache when configured.
+func newJWTVerifier(cfg jwtConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{hmacSecret: []byte(cfg.HMACSecret)}
+
+	var methods []string
+	if cfg.HMACSecret != "" {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if cfg.PublicKeyFile != "" {
+		data, err := os.ReadFile(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_RS256_PUBLIC_KEY_FILE: %w", err)
+		}
+		if v.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(data); err != nil {
+			return nil, fmt.Errorf("JWT_RS256_PUBLIC_KEY_FILE: %w", err)
+		}
+	}
+	if cfg.JWKSURL != "" {
+		v.jwks = newJWKSCache(cfg.JWKSURL)
+		if err := v.jwks.refresh(context.Background()); err != nil {
+			// The identity provider may come up after us; keys are
+			// fetched again when a token needs them.
+			slog.Warn("Initial JWKS fetch failed", "url", cfg.JWKSURL, "error", err)
+		}
+	}
+	if v.publicKey != nil || v.jwks != nil {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	v.parser = jwt.NewParser(opts...)
+	return v, nil
+}
+
+// verify validates token and returns its claims. The subject is required.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		switch t.Method.Alg() {
+		case jwt.SigningMethodHS256.Alg():
+			return v.hmacSecret, nil
+		case jwt.SigningMethodRS256.Alg():
+			if kid, _ := t.Header["kid"].(string); kid != "" && v.jwks != nil {
+				return v.jwks.key(ctx, kid)
+			}
+			if v.publicKey != nil {
+				return v.publicKey, nil
+			}
+			return nil, errors.New("token has no kid and no static public key is configured")
+		}
+		return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sub, _ := claims.GetSubject(); sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+// jwksCache holds the RSA keys published at a JWKS URL, refreshing them
+// hourly and when a token references an unknown key ID.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+const (
+	jwksMaxAge          = time.Hour
+	jwksMinRefreshDelay = time.Minute
+)
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// key returns the public key for kid, fetching the key set again if it is
+// stale or does not contain kid (at most once per jwksMinRefreshDelay).
+func (c *jwksCache) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	age := time.Since(c.fetchedAt)
+	c.mu.Unlock()
+
+	if (!ok || age > jwksMaxAge) && age > jwksMinRefreshDelay {
+		if err := c.refresh(ctx); err != nil && !ok {
+			return nil, err
+		}
+		c.mu.Lock()
+		key, ok = c.keys[kid]
+		c.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	return key, nil
+}
+
+// refresh downloads and parses the key set, replacing the cached keys.
+func (c *jwksCache) refresh(ctx context.Context) error {
+	c.mu.Lock()
+	c.fetchedAt = time.Now()
+	c.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string   `json:"kty"`
+			Kid string   `json:"kid"`
+			Use string   `json:"use"`
+			N   string   `json:"n"`
+			E   string   `json:"e"`
+			X5c []string `json:"x5c"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		pub, err := parseJWK(k.N, k.E, k.X5c)
+		if err != nil {
+			slog.Warn("Skipping invalid JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return nil
+}
+
+// parseJWK builds an RSA public key from a JWK's modulus and exponent, or
+// from its first X.509 certificate when those are absent.
+func parseJWK(n, e string, x5c []string) (*rsa.PublicKey, error) {
+	if n == "" && len(x5c) > 0 {
+		der, err := base64.StdEncoding.DecodeString(x5c[0])
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("certificate key is not RSA")
+		}
+		return pub, nil
+	}
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("modulus: %w", err)
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, fmt.Errorf("exponent: %w", err)
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("exponent too large")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2 scopes required by the API routes.
+const (
+	scopeReceiptsRead  = "receipts:read"
+	scopeReceiptsWrite = "receipts:write"
+	scopeRulesAdmin    = "rules:admin"
+)
+
+// oidcConfig points the service at an OpenID Connect provider. The
+// provider's discovery document supplies the issuer and JWKS used to
+// validate JWT access tokens; with client credentials, opaque tokens are
+// validated through its introspection endpoint.
+type oidcConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+}
+
+// oidcConfigFromEnv reads the OIDC settings from the environment.
+func oidcConfigFromEnv() oidcConfig {
+	return oidcConfig{
+		IssuerURL:    os.Getenv("OIDC_ISSUER_URL"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+	}
+}
+
+// oidcProvider holds the fields of a discovery document the service uses.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	JWKSURI               string `json:"jwks_uri"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+}
+
+// discoverOIDC fetches the provider's /.well-known/openid-configuration.
+func discoverOIDC(ctx context.Context, issuerURL string) (oidcProvider, error) {
+	var p oidcProvider
+	u := strings.TrimSuffix(issuerURL, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return p, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return p, fmt.Errorf("fetch OIDC discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return p, fmt.Errorf("fetch OIDC discovery document: unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return p, fmt.Errorf("decode OIDC discovery document: %w", err)
+	}
+	if p.Issuer == "" || p.JWKSURI == "" {
+		return p, errors.New("OIDC discovery document lacks issuer or jwks_uri")
+	}
+	return p, nil
+}
+
+// introspectionCacheTTL bounds how long an introspection answer is reused.
+const introspectionCacheTTL = time.Minute
+
+// introspector validates opaque access tokens with RFC 7662 token
+// introspection, caching answers briefly to spare the provider.
+type introspector struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	audience     string
+	client       *http.Client
+
+	mu    sync.Mutex
+	cache map[[32]byte]introspection
+}
+
+// introspection is the part of an introspection response the service uses.
+type introspection struct {
+	Active   bool            `json:"active"`
+	Subject  string          `json:"sub"`
+	Scope    string          `json:"scope"`
+	Exp      int64           `json:"exp"`
+	Audience json.RawMessage `json:"aud"`
+
+	expires time.Time
+}
+
+func newIntrospector(endpoint, clientID, clientSecret, audience string) *introspector {
+	return &introspector{
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		audience:     audience,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		cache:        make(map[[32]byte]introspection),
+	}
+}
+
+// introspect returns the subject and scopes of an active token.
+func (i *introspector) introspect(ctx context.Context, token string) (string, []string, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	i.mu.Lock()
+	res, ok := i.cache[key]
+	i.mu.Unlock()
+	if !ok || now.After(res.expires) {
+		var err error
+		if res, err = i.fetch(ctx, token); err != nil {
+			return "", nil, err
+		}
+		res.expires = now.Add(introspectionCacheTTL)
+		if res.Exp > 0 && time.Unix(res.Exp, 0).Before(res.expires) {
+			res.expires = time.Unix(res.Exp, 0)
+		}
+		i.mu.Lock()
+		if len(i.cache) > 10000 {
+			for k, v := range i.cache {
+				if now.After(v.expires) {
+					delete(i.cache, k)
+				}
+			}
+		}
+		i.cache[key] = res
+		i.mu.Unlock()
+	}
+
+	if !res.Active {
+		return "", nil, errors.New("token is not active")
+	}
+	if res.Subject == "" {
+		return "", nil, errors.New("token has no subject")
+	}
+	if i.audience != "" && !audienceContains(res.Audience, i.audience) {
+		return "", nil, errors.New("token has invalid audience")
+	}
+	return res.Subject, strings.Fields(res.Scope), nil
+}
+
+func (i *introspector) fetch(ctx context.Context, token string) (introspection, error) {
+	var res introspection
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return res, fmt.Errorf("introspect token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("introspect token: unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res, fmt.Errorf("decode introspection response: %w", err)
+	}
+	return res, nil
+}
+
+// audienceContains reports whether an "aud" value (a string or an array of
+// strings) includes want.
+func audienceContains(raw json.RawMessage, want string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == want
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		return slices.Contains(many, want)
+	}
+	return false
+}
+
+// tokenScopes extracts scopes from JWT claims, accepting both the standard
+// space-separated "scope" string and the "scp" array some providers use.
+func tokenScopes(claims map[string]any) []string {
+	if s, ok := claims["scope"].(string); ok {
+		return strings.Fields(s)
+	}
+	switch scp := claims["scp"].(type) {
+	case string:
+		return strings.Fields(scp)
+	case []any:
+		var out []string
+		for _, v := range scp {
+			if s, ok := v.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// requireScope rejects token-authenticated callers whose identity is
+// subject to scope checks but lacks scope, answering 403 with an
+// insufficient_scope challenge. API key callers are not scope-restricted.
+func requireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, _ := identityFrom(r.Context()); id.ScopesEnforced && !slices.Contains(id.Scopes, scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="receipts", error="insufficient_scope", scope=%q`, scope))
+			writeProblem(w, r, http.StatusForbidden, "Token lacks the required scope "+scope)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
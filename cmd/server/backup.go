@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// backupFormatVersion is written to every backup; restores refuse others.
+const backupFormatVersion = 1
+
+// ErrBackupNotFound is returned when the backup bucket has no backup of the
+// requested name.
+var ErrBackupNotFound = errors.New("backup not found")
+
+// backupStore is implemented by stores that can be backed up and restored.
+type backupStore interface {
+	// Backup returns a consistent copy of the store's contents.
+	Backup(ctx context.Context) (storeSnapshot, error)
+	// Restore replaces the store's contents with snap. Unless replace is
+	// set it fails with ErrStoreNotEmpty if the store holds anything.
+	Restore(ctx context.Context, snap storeSnapshot, replace bool) error
+}
+
+// A backup is a gzip-compressed file of three JSON lines: a backupHeader,
+// the storeSnapshot and a backupTrailer.
+type backupHeader struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// backupTrailer records what a backup holds. SHA256 is the hex SHA-256 of
+// the header and snapshot lines.
+type backupTrailer struct {
+	Counts backupCounts `json:"counts"`
+	SHA256 string       `json:"sha256"`
+}
+
+type backupCounts struct {
+	Receipts      int `json:"receipts"`
+	LedgerEntries int `json:"ledgerEntries"`
+	ReferralCodes int `json:"referralCodes"`
+	Referrals     int `json:"referrals"`
+	Reports       int `json:"reports"`
+}
+
+// backupInfo describes a backup that was taken or restored.
+type backupInfo struct {
+	// Name is the backup's object name under BACKUP_S3_PREFIX, for
+	// uploaded backups.
+	Name      string       `json:"name,omitempty"`
+	Size      int64        `json:"size,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+	SHA256    string       `json:"sha256"`
+	Counts    backupCounts `json:"counts"`
+	Restored  bool         `json:"restored,omitempty"`
+}
+
+const (
+	backupNamePrefix     = "receipts-backup-"
+	backupNameSuffix     = ".jsonl.gz"
+	backupNameTimeLayout = "20060102T150405Z"
+)
+
+// backupName is the file or object name of a backup taken at t.
+func backupName(t time.Time) string {
+	return backupNamePrefix + t.UTC().Format(backupNameTimeLayout) + backupNameSuffix
+}
+
+// parseBackupName returns when the backup called name was taken, or false
+// if backupName did not produce name.
+func parseBackupName(name string) (time.Time, bool) {
+	stamp, ok := strings.CutPrefix(name, backupNamePrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	if stamp, ok = strings.CutSuffix(stamp, backupNameSuffix); !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupNameTimeLayout, stamp)
+	return t, err == nil
+}
+
+func countBackup(snap storeSnapshot) backupCounts {
+	c := backupCounts{
+		Receipts:      len(snap.Receipts),
+		ReferralCodes: len(snap.ReferralCodes),
+		Referrals:     len(snap.Referrals),
+		Reports:       len(snap.Reports),
+	}
+	for _, entries := range snap.Ledgers {
+		c.LedgerEntries += len(entries)
+	}
+	return c
+}
+
+// writeBackup writes snap to w as a backup taken at createdAt.
+func writeBackup(w io.Writer, snap storeSnapshot, createdAt time.Time) (backupTrailer, error) {
+	zw := gzip.NewWriter(w)
+	h := sha256.New()
+	enc := json.NewEncoder(io.MultiWriter(zw, h))
+	if err := enc.Encode(backupHeader{Version: backupFormatVersion, CreatedAt: createdAt}); err != nil {
+		return backupTrailer{}, err
+	}
+	if err := enc.Encode(snap); err != nil {
+		return backupTrailer{}, err
+	}
+	t := backupTrailer{Counts: countBackup(snap), SHA256: hex.EncodeToString(h.Sum(nil))}
+	if err := json.NewEncoder(zw).Encode(t); err != nil {
+		return t, err
+	}
+	return t, zw.Close()
+}
+
+// readBackup reads a backup and checks that it is complete, unaltered and
+// self-consistent.
+func readBackup(r io.Reader) (backupHeader, storeSnapshot, backupTrailer, error) {
+	var (
+		header  backupHeader
+		snap    storeSnapshot
+		trailer backupTrailer
+	)
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return header, snap, trailer, fmt.Errorf("not a gzip file: %w", err)
+	}
+	br := bufio.NewReader(zr)
+	var lines [3][]byte
+	for i := range lines {
+		if lines[i], err = br.ReadBytes('\n'); err != nil {
+			if errors.Is(err, io.EOF) {
+				return header, snap, trailer, errors.New("the backup is truncated")
+			}
+			return header, snap, trailer, err
+		}
+	}
+	// Reading to the end also checks the gzip checksum.
+	if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+		if err == nil {
+			err = errors.New("unexpected data after the trailer")
+		}
+		return header, snap, trailer, err
+	}
+
+	if err := json.Unmarshal(lines[0], &header); err != nil {
+		return header, snap, trailer, fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Version != backupFormatVersion {
+		return header, snap, trailer, fmt.Errorf("unsupported backup version %d", header.Version)
+	}
+	if err := json.Unmarshal(lines[2], &trailer); err != nil {
+		return header, snap, trailer, fmt.Errorf("invalid trailer: %w", err)
+	}
+	h := sha256.New()
+	h.Write(lines[0])
+	h.Write(lines[1])
+	if hex.EncodeToString(h.Sum(nil)) != trailer.SHA256 {
+		return header, snap, trailer, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(lines[1], &snap); err != nil {
+		return header, snap, trailer, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	return header, snap, trailer, verifyBackup(snap, trailer.Counts)
+}
+
+// verifyBackup checks that snap holds what its trailer counted, that IDs
+// are unique and that every ledger's balances add up.
+func verifyBackup(snap storeSnapshot, counts backupCounts) error {
+	if countBackup(snap) != counts {
+		return errors.New("the contents do not match the trailer's counts")
+	}
+	ids := make(map[string]bool, len(snap.Receipts))
+	for _, rec := range snap.Receipts {
+		if rec.ID == "" || ids[rec.ID] {
+			return fmt.Errorf("receipt ID %q is missing or repeated", rec.ID)
+		}
+		ids[rec.ID] = true
+	}
+	clear(ids)
+	for user, entries := range snap.Ledgers {
+		balance := 0
+		for _, e := range entries {
+			if e.ID == "" || ids[e.ID] {
+				return fmt.Errorf("ledger entry ID %q is missing or repeated", e.ID)
+			}
+			ids[e.ID] = true
+			balance += e.Points
+			if e.UserID != user || e.Balance != balance {
+				return fmt.Errorf("ledger entry %s does not follow from %s's earlier entries", e.ID, user)
+			}
+		}
+	}
+	codes := make(map[string]bool, len(snap.ReferralCodes))
+	for user, code := range snap.ReferralCodes {
+		if codes[code] {
+			return fmt.Errorf("referral code of %s is repeated", user)
+		}
+		codes[code] = true
+	}
+	referees := make(map[string]bool, len(snap.Referrals))
+	for _, r := range snap.Referrals {
+		if referees[r.Referee] {
+			return fmt.Errorf("%s is referred more than once", r.Referee)
+		}
+		referees[r.Referee] = true
+	}
+	dates := make(map[string]bool, len(snap.Reports))
+	for _, r := range snap.Reports {
+		if dates[r.Date] {
+			return fmt.Errorf("the report for %s is repeated", r.Date)
+		}
+		dates[r.Date] = true
+	}
+	return nil
+}
+
+// uploadBackup backs up bs to bucket and records the outcome in the backup
+// metrics.
+func uploadBackup(ctx context.Context, bs backupStore, bucket *backupBucket) (backupInfo, error) {
+	info, err := putBackup(ctx, bs, bucket)
+	if err != nil {
+		backupFailures.Add(1)
+		return info, err
+	}
+	backupsUploaded.Add(1)
+	lastBackupAt.Set(info.CreatedAt.Unix())
+	return info, nil
+}
+
+// putBackup backs up bs and uploads it to bucket as it is written.
+func putBackup(ctx context.Context, bs backupStore, bucket *backupBucket) (backupInfo, error) {
+	snap, err := bs.Backup(ctx)
+	if err != nil {
+		return backupInfo{}, fmt.Errorf("back up store: %w", err)
+	}
+	info := backupInfo{CreatedAt: time.Now().UTC()}
+	info.Name = backupName(info.CreatedAt)
+	pr, pw := io.Pipe()
+	trailer := make(chan backupTrailer, 1)
+	go func() {
+		t, err := writeBackup(pw, snap, info.CreatedAt)
+		trailer <- t
+		pw.CloseWithError(err)
+	}()
+	info.Size, err = bucket.put(ctx, info.Name, pr)
+	// Unblock the writer if the upload stopped reading early.
+	pr.CloseWithError(errors.New("upload ended"))
+	t := <-trailer
+	if err != nil {
+		return info, fmt.Errorf("upload backup: %w", err)
+	}
+	info.SHA256, info.Counts = t.SHA256, t.Counts
+	return info, nil
+}
+
+// backupHandler handles POST /admin/backup
+func (s *server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	bs, ok := s.store.(backupStore)
+	if !ok {
+		writeProblem(w, r, http.StatusNotImplemented, "The storage driver does not support backups")
+		return
+	}
+	upload, err := boolParam(r, "upload", false)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if upload {
+		if s.backups == nil {
+			writeProblem(w, r, http.StatusBadRequest, "Uploading backups needs BACKUP_S3_BUCKET to be set")
+			return
+		}
+		info, err := uploadBackup(r.Context(), bs, s.backups)
+		if err != nil {
+			log.Printf("Error uploading backup: %v", err)
+			writeProblem(w, r, http.StatusBadGateway, "Failed to upload the backup")
+			return
+		}
+		slog.Info("Backup uploaded", "name", info.Name, "bytes", info.Size, "receipts", info.Counts.Receipts)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+		return
+	}
+
+	snap, err := bs.Backup(r.Context())
+	if err != nil {
+		log.Printf("Error backing up store: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to back up the store")
+		return
+	}
+	createdAt := time.Now().UTC()
+	// Backups of large stores outlast HTTP_WRITE_TIMEOUT.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+backupName(createdAt)+`"`)
+	// The status is sent by now, so a failure can only cut the body short,
+	// which a restore detects.
+	if _, err := writeBackup(w, snap, createdAt); err != nil {
+		log.Printf("Error writing backup: %v", err)
+	}
+}
+
+// restoreHandler handles POST /admin/restore
+func (s *server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	bs, ok := s.store.(backupStore)
+	if !ok {
+		writeProblem(w, r, http.StatusNotImplemented, "The storage driver does not support backups")
+		return
+	}
+	replace, err := boolParam(r, "replace", false)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun, err := boolParam(r, "dryRun", false)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	var body io.Reader = r.Body
+	if name := r.URL.Query().Get("name"); name != "" {
+		if s.backups == nil {
+			writeProblem(w, r, http.StatusBadRequest, "Restoring uploaded backups needs BACKUP_S3_BUCKET to be set")
+			return
+		}
+		obj, err := s.backups.get(r.Context(), name)
+		if errors.Is(err, ErrBackupNotFound) {
+			writeProblem(w, r, http.StatusNotFound, "No backup found for that name")
+			return
+		}
+		if err != nil {
+			log.Printf("Error downloading backup %s: %v", name, err)
+			writeProblem(w, r, http.StatusBadGateway, "Failed to download the backup")
+			return
+		}
+		defer obj.Close()
+		body = obj
+	}
+	// Uploads of large backups outlast HTTP_READ_TIMEOUT.
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	header, snap, trailer, err := readBackup(body)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The backup failed verification: "+err.Error())
+		return
+	}
+	info := backupInfo{CreatedAt: header.CreatedAt, SHA256: trailer.SHA256, Counts: trailer.Counts}
+	if !dryRun {
+		err := bs.Restore(r.Context(), snap, replace)
+		switch {
+		case errors.Is(err, ErrStoreNotEmpty):
+			writeProblem(w, r, http.StatusConflict, "The store is not empty; set replace=true to overwrite it")
+			return
+		case errors.Is(err, ErrStoreFull):
+			writeProblem(w, r, http.StatusInsufficientStorage, "The backup does not fit in the receipt store")
+			return
+		case err != nil:
+			log.Printf("Error restoring backup: %v", err)
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to restore the backup")
+			return
+		}
+		info.Restored = true
+		slog.Info("Backup restored", "created_at", header.CreatedAt, "sha256", trailer.SHA256, "receipts", trailer.Counts.Receipts, "replace", replace)
+		if err := s.analytics.refresh(r.Context(), s.store); err != nil {
+			log.Printf("Error rebuilding analytics after restore: %v", err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
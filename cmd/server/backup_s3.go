@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// backupPartSize is the size of each part of a multipart upload; it bounds
+// the memory an upload of unknown length buffers.
+const backupPartSize = 16 << 20
+
+// backupBucketConfig locates the S3-compatible bucket backups are kept in.
+type backupBucketConfig struct {
+	// Bucket enables uploads; the other settings are optional.
+	Bucket   string
+	Prefix   string
+	Endpoint *url.URL
+	Region   string
+	// AccessKeyID and SecretAccessKey sign requests. Without them the
+	// AWS_* variables and then the instance's IAM role are tried.
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// backupBucketConfigFromEnv reads the backup bucket settings from the
+// environment.
+func backupBucketConfigFromEnv() (backupBucketConfig, error) {
+	cfg := backupBucketConfig{
+		Bucket:          os.Getenv("BACKUP_S3_BUCKET"),
+		Prefix:          os.Getenv("BACKUP_S3_PREFIX"),
+		Region:          os.Getenv("BACKUP_S3_REGION"),
+		AccessKeyID:     os.Getenv("BACKUP_S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("BACKUP_S3_SECRET_ACCESS_KEY"),
+	}
+	endpoint := os.Getenv("BACKUP_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return cfg, fmt.Errorf("BACKUP_S3_ENDPOINT must be an http or https URL without a path")
+	}
+	cfg.Endpoint = u
+	if (cfg.AccessKeyID == "") != (cfg.SecretAccessKey == "") {
+		return cfg, fmt.Errorf("BACKUP_S3_ACCESS_KEY_ID and BACKUP_S3_SECRET_ACCESS_KEY must be set together")
+	}
+	return cfg, nil
+}
+
+// backupBucket stores backups as objects under a prefix of one bucket.
+type backupBucket struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// newBackupBucket returns a client for the bucket in cfg, or nil if none is
+// configured.
+func newBackupBucket(cfg backupBucketConfig) (*backupBucket, error) {
+	if cfg.Bucket == "" {
+		return nil, nil
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.IAM{},
+	})
+	if cfg.AccessKeyID != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+	}
+	client, err := minio.New(cfg.Endpoint.Host, &minio.Options{
+		Creds:  creds,
+		Secure: cfg.Endpoint.Scheme == "https",
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("backup bucket: %w", err)
+	}
+	return &backupBucket{client: client, bucket: cfg.Bucket, prefix: cfg.Prefix}, nil
+}
+
+// put uploads body as the object name, under the prefix, and returns its
+// size.
+func (b *backupBucket) put(ctx context.Context, name string, body io.Reader) (int64, error) {
+	info, err := b.client.PutObject(ctx, b.bucket, b.prefix+name, body, -1, minio.PutObjectOptions{
+		ContentType: "application/gzip",
+		PartSize:    backupPartSize,
+	})
+	return info.Size, err
+}
+
+// get opens the object name under the prefix, returning ErrBackupNotFound
+// if there is none.
+func (b *backupBucket) get(ctx context.Context, name string) (io.ReadCloser, error) {
+	obj, err := b.client.GetObject(ctx, b.bucket, b.prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject only fails once read; Stat surfaces a missing object now.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrBackupNotFound
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+// storedBackup is a backup found in the bucket.
+type storedBackup struct {
+	Name      string
+	CreatedAt time.Time
+	Size      int64
+}
+
+// list returns the backups under the prefix, newest first. Other objects
+// are ignored.
+func (b *backupBucket) list(ctx context.Context) ([]storedBackup, error) {
+	// Cancelling stops the listing if it ends early.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var out []storedBackup
+	for obj := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: b.prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		name := strings.TrimPrefix(obj.Key, b.prefix)
+		if t, ok := parseBackupName(name); ok {
+			out = append(out, storedBackup{Name: name, CreatedAt: t, Size: obj.Size})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// remove deletes the backup name.
+func (b *backupBucket) remove(ctx context.Context, name string) error {
+	return b.client.RemoveObject(ctx, b.bucket, b.prefix+name, minio.RemoveObjectOptions{})
+}
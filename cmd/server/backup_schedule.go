@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// backupScheduleConfig controls automatic backups to the backup bucket.
+type backupScheduleConfig struct {
+	// Schedule is a cron expression, in UTC, for taking backups; nil
+	// disables them.
+	Schedule cron.Schedule
+	// Keep is how many of the newest backups rotation keeps; zero keeps
+	// them all.
+	Keep int
+	// MaxAge is how long backups are kept; zero keeps them until Keep
+	// newer ones exist. The newest backup is never removed.
+	MaxAge time.Duration
+}
+
+// backupScheduleConfigFromEnv reads the automatic backup settings from the
+// environment.
+func backupScheduleConfigFromEnv() (backupScheduleConfig, error) {
+	var cfg backupScheduleConfig
+	var err error
+	if spec := os.Getenv("BACKUP_SCHEDULE"); spec != "" && spec != "off" {
+		if cfg.Schedule, err = cron.ParseStandard(spec); err != nil {
+			return cfg, fmt.Errorf("BACKUP_SCHEDULE: %w", err)
+		}
+	}
+	if cfg.Keep, err = envInt("BACKUP_KEEP", 7); err != nil {
+		return cfg, err
+	}
+	if cfg.Keep < 0 {
+		return cfg, fmt.Errorf("BACKUP_KEEP must not be negative")
+	}
+	if cfg.MaxAge, err = envDuration("BACKUP_MAX_AGE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxAge < 0 {
+		return cfg, fmt.Errorf("BACKUP_MAX_AGE must not be negative")
+	}
+	return cfg, nil
+}
+
+// runBackupScheduler uploads a backup of bs to bucket on cfg.Schedule and
+// then removes the backups rotation no longer keeps.
+func runBackupScheduler(ctx context.Context, bs backupStore, bucket *backupBucket, cfg backupScheduleConfig) {
+	// Start the age metric from the newest existing backup, so a restart
+	// does not hide that backups have stopped.
+	if backups, err := bucket.list(ctx); err != nil {
+		slog.Error("Error listing backups", "error", err)
+	} else if len(backups) > 0 {
+		lastBackupAt.Set(backups[0].CreatedAt.Unix())
+	}
+	for {
+		timer := time.NewTimer(time.Until(cfg.Schedule.Next(time.Now().UTC())))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		info, err := uploadBackup(ctx, bs, bucket)
+		if err != nil {
+			slog.Error("Error taking scheduled backup", "error", err)
+			continue
+		}
+		slog.Info("Scheduled backup uploaded", "name", info.Name, "bytes", info.Size, "receipts", info.Counts.Receipts)
+		if err := pruneBackups(ctx, bucket, cfg, time.Now()); err != nil {
+			slog.Error("Error rotating backups", "error", err)
+		}
+	}
+}
+
+// pruneBackups removes the backups in bucket beyond the newest cfg.Keep or
+// older than cfg.MaxAge at now, always keeping the newest.
+func pruneBackups(ctx context.Context, bucket *backupBucket, cfg backupScheduleConfig, now time.Time) error {
+	backups, err := bucket.list(ctx)
+	if err != nil {
+		return err
+	}
+	for i, b := range backups {
+		if i == 0 {
+			continue
+		}
+		if (cfg.Keep == 0 || i < cfg.Keep) && (cfg.MaxAge == 0 || now.Sub(b.CreatedAt) <= cfg.MaxAge) {
+			continue
+		}
+		if err := bucket.remove(ctx, b.Name); err != nil {
+			return fmt.Errorf("remove %s: %w", b.Name, err)
+		}
+		backupsPruned.Add(1)
+		slog.Info("Old backup removed", "name", b.Name, "created_at", b.CreatedAt)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"reflect"
+
+	"fetch_assessment/points"
+)
+
+// canaryRules scores a share of the receipts that would use the default
+// rules with a candidate rule set instead, so that its effect can be
+// measured before it replaces them. Receipts record the version that
+// scored them, which tells the two groups apart.
+type canaryRules struct {
+	engine *points.Engine
+	// percent of receipts, from 0 to 100, are scored with engine.
+	percent float64
+	// stickyBy is "receipt" to choose by the receipt's content hash, so a
+	// receipt is always scored the same way, or "user" to choose by the
+	// user it was submitted for, so a user sees one rule set throughout.
+	stickyBy string
+}
+
+// canaryRulesFromEnv reads CANARY_RULES_FILE, CANARY_PERCENT and
+// CANARY_STICKY_BY. It returns nil when no canary is configured. The
+// canary must not share the version of active, the default rules.
+func canaryRulesFromEnv(active *points.Engine) (*canaryRules, error) {
+	path := os.Getenv("CANARY_RULES_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	engine, err := loadRules(path)
+	if err != nil {
+		return nil, fmt.Errorf("CANARY_RULES_FILE: %w", err)
+	}
+	if engine.Version() == active.Version() {
+		return nil, fmt.Errorf("CANARY_RULES_FILE: rule set version %q is the version of the default rules; give the canary its own", engine.Version())
+	}
+	c := &canaryRules{engine: engine, stickyBy: "receipt"}
+	if c.percent, err = envFloat("CANARY_PERCENT", 0); err != nil {
+		return nil, err
+	}
+	if c.percent > 100 {
+		return nil, fmt.Errorf("CANARY_PERCENT: must be from 0 to 100, got %v", c.percent)
+	}
+	if v := os.Getenv("CANARY_STICKY_BY"); v != "" {
+		if v != "receipt" && v != "user" {
+			return nil, fmt.Errorf("CANARY_STICKY_BY: must be \"receipt\" or \"user\", got %q", v)
+		}
+		c.stickyBy = v
+	}
+	return c, nil
+}
+
+// selects reports whether the receipt with content hash, submitted for
+// user, falls in the canary's share. Receipts without a user are chosen
+// by hash even when sticky by user.
+func (c *canaryRules) selects(hash, user string) bool {
+	key := "receipt:" + hash
+	if c.stickyBy == "user" && user != "" {
+		key = "user:" + user
+	}
+	sum := sha256.Sum256([]byte(key))
+	// Buckets of a hundredth of a percent.
+	return float64(binary.BigEndian.Uint64(sum[:8])%10000) < c.percent*100
+}
+
+// equal reports whether c and other configure the same canary.
+func (c *canaryRules) equal(other *canaryRules) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+	return c.percent == other.percent && c.stickyBy == other.stickyBy &&
+		reflect.DeepEqual(c.engine.RuleSet(), other.engine.RuleSet())
+}
+
+// withCanary returns the canary rules in place of rules for receipts the
+// canary selects, if rules are the default rules. Rules of an API key
+// are left alone.
+func (s *server) withCanary(rules *points.Engine, hash, user string) *points.Engine {
+	c := s.canary.Load()
+	if c == nil || rules != s.rules.Load() || !c.selects(hash, user) {
+		return rules
+	}
+	return c.engine
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// trustedProxies are the load balancers and proxies in front of the
+// service, whose forwarding headers name the client.
+type trustedProxies []netip.Prefix
+
+// trustedProxiesFromEnv reads TRUSTED_PROXIES, a comma-separated list of
+// CIDR prefixes or addresses.
+func trustedProxiesFromEnv() (trustedProxies, error) {
+	p, err := parsePrefixes(splitList(os.Getenv("TRUSTED_PROXIES")))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	return p, nil
+}
+
+// clientAddr returns the address of the client r comes from. When the peer
+// is a trusted proxy, the client is the last address in the Forwarded
+// header (or, without one, X-Forwarded-For) that is not a trusted proxy
+// too. known is false when that address cannot be told: the peer's
+// address is not an IP, or a trusted proxy forwarded a hop it did not
+// know ("unknown", an obfuscated name or a malformed entry).
+func (t trustedProxies) clientAddr(r *http.Request) (addr netip.Addr, known bool) {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = ap.Addr().Unmap()
+	if !containsAddr(t, addr) {
+		return addr, true
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseForwardedAddr(hops[i])
+		if err != nil {
+			// Nothing before the hop can be attributed.
+			return addr, false
+		}
+		addr = hop
+		if !containsAddr(t, addr) {
+			return addr, true
+		}
+	}
+	return addr, true
+}
+
+// forwardedFor lists the client addresses in h, nearest the client first:
+// the "for" parameters of Forwarded (RFC 7239) if it is present, else the
+// entries of X-Forwarded-For.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if fwd := h.Values("Forwarded"); len(fwd) > 0 {
+		for _, element := range strings.Split(strings.Join(fwd, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(value, `"`))
+				}
+			}
+		}
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseForwardedAddr parses an address from a forwarding header, which may
+// carry a port: "192.0.2.1", "192.0.2.1:4711", "2001:db8::1" or
+// "[2001:db8::1]:4711".
+func parseForwardedAddr(s string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// clientInfo is the client address withClientIP found for a request.
+type clientInfo struct {
+	addr  netip.Addr
+	known bool
+}
+
+// withClientIP resolves the client address of each request behind proxies
+// for clientIP and clientAddrFrom.
+func withClientIP(proxies trustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, known := proxies.clientAddr(r)
+		ctx := context.WithValue(r.Context(), clientIPKey, clientInfo{addr, known})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientAddrFrom returns the client address recorded by withClientIP, and
+// whether it is known.
+func clientAddrFrom(ctx context.Context) (netip.Addr, bool) {
+	c, ok := ctx.Value(clientIPKey).(clientInfo)
+	return c.addr, ok && c.known
+}
+
+// clientIP returns the IP address of the client r comes from, looking
+// past trusted proxies; outside withClientIP it is the connection's peer.
+// Clients on a Unix socket are named by the socket.
+func clientIP(r *http.Request) string {
+	if c, ok := r.Context().Value(clientIPKey).(clientInfo); ok && c.addr.IsValid() {
+		return c.addr.String()
+	}
+	if path := unixSocketFrom(r.Context()); path != "" {
+		return "unix:" + path
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressedBodyPaths accept request bodies sent with Content-Encoding gzip
+// or deflate.
+var compressedBodyPaths = map[string]bool{
+	"/receipts/process/batch": true, "/v1/receipts/process/batch": true,
+	"/receipts/import": true, "/v1/receipts/import": true,
+	"/receipts/stream": true, "/v1/receipts/stream": true,
+}
+
+// compressibleTypes are the media types worth compressing; anything else,
+// such as gzipped backups, is sent as is.
+var compressibleTypes = map[string]bool{
+	"application/json":         true,
+	"application/problem+json": true,
+	"application/x-ndjson":     true,
+	"text/plain":               true,
+	"text/csv":                 true,
+	"text/html":                true,
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() any { return zlib.NewWriter(nil) }}
+)
+
+// withCompression decompresses gzip and deflate request bodies on
+// compressedBodyPaths, refusing encoded bodies elsewhere with 415, and,
+// when enabled, compresses responses of at least minBytes for clients
+// that accept it. Bodies are decompressed before limitBody, so the limit
+// applies to their decompressed size.
+func withCompression(enabled bool, minBytes int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc != "" && enc != "identity" {
+			if !compressedBodyPaths[r.URL.Path] || (enc != "gzip" && enc != "deflate") {
+				w.Header().Set("Accept-Encoding", "identity")
+				if compressedBodyPaths[r.URL.Path] {
+					w.Header().Set("Accept-Encoding", "gzip, deflate")
+				}
+				writeProblem(w, r, http.StatusUnsupportedMediaType, "Content-Encoding "+enc+" is not supported here")
+				return
+			}
+			body, err := decompressBody(enc, r.Body)
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, "Invalid "+enc+" request body")
+				return
+			}
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			r.Body = body
+		}
+
+		// Upgraded connections are left alone.
+		if !enabled || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if enc == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: enc, minBytes: minBytes}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// decompressBody wraps body in a reader for enc.
+func decompressBody(enc string, body io.ReadCloser) (io.ReadCloser, error) {
+	if enc == "deflate" {
+		// "deflate" is zlib-wrapped (RFC 9110), but raw DEFLATE is common
+		// enough to accept too.
+		br := bufio.NewReader(body)
+		if hdr, err := br.Peek(2); err == nil && hdr[0]&0x0f == 8 && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, err
+			}
+			return readCloser{zr, body}, nil
+		}
+		return readCloser{flate.NewReader(br), body}, nil
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{zr, body}, nil
+}
+
+// readCloser reads from a decompressor and closes the underlying body.
+type readCloser struct {
+	io.Reader
+	body io.Closer
+}
+
+func (rc readCloser) Close() error {
+	if c, ok := rc.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return rc.body.Close()
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip at equal quality. It returns "" for neither.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch name {
+		case "*":
+			wildcard = q
+		case "gzip", "x-gzip", "deflate":
+			if name == "x-gzip" {
+				name = "gzip"
+			}
+			if q > bestQ || (q == bestQ && q > 0 && name == "gzip") {
+				best, bestQ = name, q
+			}
+		}
+	}
+	if best == "" && wildcard > 0 {
+		return "gzip"
+	}
+	if bestQ <= 0 {
+		return ""
+	}
+	return best
+}
+
+// compressWriter compresses a response once it is known to be compressible
+// and at least minBytes long, buffering the start of the body until then.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+
+	status  int
+	buf     []byte
+	decided bool
+	w       io.WriteCloser // nil when the response is sent uncompressed
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status != 0 {
+		return
+	}
+	c.status = status
+	// Informational and bodiless responses are not compressed.
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		c.decide(false)
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.decided {
+		if !c.compressible() {
+			c.decide(false)
+		} else if len(c.buf)+len(b) < c.minBytes {
+			c.buf = append(c.buf, b...)
+			return len(b), nil
+		} else {
+			c.decide(true)
+		}
+	}
+	if c.w != nil {
+		return c.w.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// compressible reports whether the response's headers allow compression.
+func (c *compressWriter) compressible() bool {
+	h := c.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && compressibleTypes[mediaType]
+}
+
+// decide sends the header, compressed or not, followed by any buffered
+// body.
+func (c *compressWriter) decide(compress bool) {
+	if c.decided {
+		return
+	}
+	c.decided = true
+	if compress {
+		h := c.Header()
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) && !strings.HasPrefix(etag, "W/") {
+			// A strong tag names one representation, and the compressed
+			// body is another; matchETag accepts either.
+			h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+c.encoding+`"`)
+		}
+		if c.encoding == "gzip" {
+			gw := gzipWriters.Get().(*gzip.Writer)
+			gw.Reset(c.ResponseWriter)
+			c.w = gw
+		} else {
+			zw := zlibWriters.Get().(*zlib.Writer)
+			zw.Reset(c.ResponseWriter)
+			c.w = zw
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	if len(c.buf) > 0 {
+		if c.w != nil {
+			c.w.Write(c.buf)
+		} else {
+			c.ResponseWriter.Write(c.buf)
+		}
+		c.buf = nil
+	}
+}
+
+// FlushError sends what has been written so far, compressing it first if
+// the response is compressed.
+func (c *compressWriter) FlushError() error {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.decided {
+		// A streamed response is compressed whatever its size.
+		c.decide(c.compressible())
+	}
+	if f, ok := c.w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// close finishes the response: a short body is sent uncompressed, and the
+// compressor is flushed and returned to its pool.
+func (c *compressWriter) close() {
+	if c.status == 0 {
+		// Nothing was written; leave the response to the server.
+		return
+	}
+	if !c.decided {
+		c.decide(false)
+	}
+	switch w := c.w.(type) {
+	case *gzip.Writer:
+		w.Close()
+		gzipWriters.Put(w)
+	case *zlib.Writer:
+		w.Close()
+		zlibWriters.Put(w)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultPort is used when neither -addr nor PORT is set.
+const defaultPort = "8000"
+
+// resolveListenAddr determines the address to listen on. The -addr flag
+// wins, and may name a Unix socket (see parseListenerSpec); otherwise
+// BIND_ADDR and PORT from the environment are combined, defaulting to all
+// interfaces on port 8000.
+func resolveListenAddr(flagAddr string) (string, error) {
+	if strings.HasPrefix(flagAddr, "unix://") {
+		return flagAddr, nil
+	}
+	addr := flagAddr
+	if addr == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = defaultPort
+		}
+		addr = net.JoinHostPort(os.Getenv("BIND_ADDR"), port)
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %v", addr, err)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q in listen address %q", port, addr)
+	}
+	return addr, nil
+}
+
+// listen opens a TCP listener on addr, turning the common "address already
+// in use" failure into a clear message.
+func listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("cannot listen on %s: address already in use (is another instance running?)", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s: %w", addr, err)
+	}
+	return ln, nil
+}
+
+// serverConfig holds the HTTP server timeouts and size limits.
+type serverConfig struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	MaxBodyBytes      int64
+
+	// LegacySunset is the date the unversioned API paths will be removed.
+	LegacySunset time.Time
+	// IdempotencyTTL is how long Idempotency-Key responses are replayed;
+	// zero disables the header.
+	IdempotencyTTL time.Duration
+	// Compress enables response compression for bodies of at least
+	// CompressMinBytes.
+	Compress         bool
+	CompressMinBytes int
+	// PointsMaxAge is how long clients may cache receipt and points
+	// responses.
+	PointsMaxAge time.Duration
+	// ShutdownTimeout bounds how long a stopping process waits for
+	// in-flight requests; UpgradeTimeout how long a new process started by
+	// an upgrade has to become ready.
+	ShutdownTimeout time.Duration
+	UpgradeTimeout  time.Duration
+}
+
+// serverConfigFromEnv reads the HTTP server limits from the environment.
+func serverConfigFromEnv() (serverConfig, error) {
+	var (
+		cfg serverConfig
+		err error
+	)
+	if cfg.ReadTimeout, err = envDuration("HTTP_READ_TIMEOUT", 15*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadHeaderTimeout, err = envDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.WriteTimeout, err = envDuration("HTTP_WRITE_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.IdleTimeout, err = envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxHeaderBytes, err = envInt("HTTP_MAX_HEADER_BYTES", 64<<10); err != nil {
+		return cfg, err
+	}
+	maxBody, err := envInt("HTTP_MAX_BODY_BYTES", 10<<20)
+	if err != nil {
+		return cfg, err
+	}
+	if maxBody <= 0 || cfg.MaxHeaderBytes <= 0 {
+		return cfg, errors.New("HTTP_MAX_BODY_BYTES and HTTP_MAX_HEADER_BYTES must be positive")
+	}
+	cfg.MaxBodyBytes = int64(maxBody)
+	if cfg.IdempotencyTTL, err = envDuration("IDEMPOTENCY_TTL", 24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.Compress, err = envBool("HTTP_COMPRESSION", true); err != nil {
+		return cfg, err
+	}
+	if cfg.CompressMinBytes, err = envInt("HTTP_COMPRESSION_MIN_BYTES", 1024); err != nil {
+		return cfg, err
+	}
+	if cfg.PointsMaxAge, err = envDuration("POINTS_MAX_AGE", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.UpgradeTimeout, err = envDuration("UPGRADE_TIMEOUT", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownTimeout <= 0 || cfg.UpgradeTimeout <= 0 {
+		return cfg, errors.New("SHUTDOWN_TIMEOUT and UPGRADE_TIMEOUT must be positive")
+	}
+	if v := os.Getenv("LEGACY_API_SUNSET"); v != "" {
+		if cfg.LegacySunset, err = time.Parse("2006-01-02", v); err != nil {
+			return cfg, fmt.Errorf("LEGACY_API_SUNSET: invalid date %q, expected YYYY-MM-DD", v)
+		}
+	}
+	return cfg, nil
+}
+
+// envInt reads an integer environment variable, returning def when unset.
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid integer %q", key, v)
+	}
+	return n, nil
+}
+
+// envDuration reads a time.Duration environment variable, returning def when unset.
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid duration %q", key, v)
+	}
+	return d, nil
+}
+
+// envBool reads a boolean environment variable, returning def when unset.
+func envBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid boolean %q", key, v)
+	}
+	return b, nil
+}
+
+// envFloat reads a floating-point environment variable, returning def when unset.
+func envFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%s: invalid rate %q", key, v)
+	}
+	return f, nil
+}
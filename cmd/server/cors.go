@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsConfig configures cross-origin requests from browsers. CORS is off
+// when no origins are allowed.
+type corsConfig struct {
+	// Origins are the allowed origins, such as "https://upload.example.com".
+	// "*" allows any origin, and "https://*.example.com" any subdomain.
+	Origins []string
+	Methods []string
+	// Headers are the request headers browsers may send; "*" allows any.
+	Headers []string
+	// ExposeHeaders are the response headers scripts may read.
+	ExposeHeaders []string
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+	// Credentials lets browsers send cookies and client certificates.
+	Credentials bool
+}
+
+// corsConfigFromEnv reads the CORS settings from the environment.
+func corsConfigFromEnv() (corsConfig, error) {
+	cfg := corsConfig{
+		Origins:       splitList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		Methods:       splitList(os.Getenv("CORS_ALLOWED_METHODS")),
+		Headers:       splitList(os.Getenv("CORS_ALLOWED_HEADERS")),
+		ExposeHeaders: splitList(os.Getenv("CORS_EXPOSED_HEADERS")),
+	}
+	if len(cfg.Methods) == 0 {
+		cfg.Methods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	if len(cfg.Headers) == 0 {
+		cfg.Headers = []string{"Content-Type", "Authorization", "X-Api-Key", "Idempotency-Key", requestIDHeader}
+	}
+	if len(cfg.ExposeHeaders) == 0 {
+		cfg.ExposeHeaders = []string{"Location", "Retry-After", "Idempotent-Replayed", requestIDHeader}
+	}
+	for i, m := range cfg.Methods {
+		cfg.Methods[i] = strings.ToUpper(m)
+	}
+	for _, o := range cfg.Origins {
+		if o != "*" && !strings.Contains(o, "://") {
+			return cfg, fmt.Errorf("CORS_ALLOWED_ORIGINS: %q must be * or scheme://host[:port]", o)
+		}
+	}
+	var err error
+	if cfg.MaxAge, err = envDuration("CORS_MAX_AGE", 10*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.Credentials, err = envBool("CORS_ALLOW_CREDENTIALS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.Credentials && slices.Contains(cfg.Origins, "*") {
+		return cfg, fmt.Errorf("CORS_ALLOW_CREDENTIALS cannot be used with CORS_ALLOWED_ORIGINS=*")
+	}
+	return cfg, nil
+}
+
+// allowOrigin reports whether a request from origin is allowed.
+func (c corsConfig) allowOrigin(origin string) bool {
+	for _, o := range c.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(o, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) &&
+			strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS adds CORS headers to responses to allowed origins and answers
+// their preflight requests, which carry no credentials, before they are
+// authenticated.
+func withCORS(cfg corsConfig, next http.Handler) http.Handler {
+	if len(cfg.Origins) == 0 {
+		return next
+	}
+	methods := strings.Join(cfg.Methods, ", ")
+	headers := strings.Join(cfg.Headers, ", ")
+	expose := strings.Join(cfg.ExposeHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge / time.Second))
+	anyHeader := len(cfg.Headers) == 1 && cfg.Headers[0] == "*"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !cfg.allowOrigin(origin) {
+			if preflight {
+				writeProblem(w, r, http.StatusForbidden, "Origin is not allowed")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The allowed origin is echoed rather than sent as "*", which
+		// browsers reject for requests with credentials.
+		h.Set("Access-Control-Allow-Origin", origin)
+		if cfg.Credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", expose)
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", methods)
+		if anyHeader {
+			// "*" is taken literally on requests with credentials, so the
+			// requested headers are echoed instead.
+			if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+				h.Set("Access-Control-Allow-Headers", req)
+			}
+		} else {
+			h.Set("Access-Control-Allow-Headers", headers)
+		}
+		if cfg.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// decodeJSONBody requires an application/json request and decodes its body
+// into v, rejecting unknown fields and trailing data. On failure it returns
+// the HTTP status to respond with (415, 413 or 400) and a descriptive error.
+func decodeJSONBody(r *http.Request, v any) (int, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json")
+	}
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(v)
+	if err == nil {
+		err = expectEOF(dec)
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return http.StatusRequestEntityTooLarge, fmt.Errorf("Request body exceeds %d bytes", tooLarge.Limit)
+		}
+		return http.StatusBadRequest, fmt.Errorf("Invalid JSON: %w", jsonError(err))
+	}
+	return 0, nil
+}
+
+// errTrailingData reports input left over after the JSON value.
+var errTrailingData = errors.New("unexpected data after JSON value")
+
+// expectEOF reports errTrailingData unless dec has nothing left but
+// whitespace, or the error reading the rest. dec.More alone misses a stray
+// closing } or ].
+func expectEOF(dec *json.Decoder) error {
+	err := dec.Decode(&struct{}{})
+	if err == io.EOF {
+		return nil
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+	return errTrailingData
+}
+
+// bodyErrorStatus is the HTTP status for a failure reading a request body:
+// 413 if it exceeded the size limit, 400 otherwise.
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// decodeStrict unmarshals data into v, rejecting unknown fields and
+// trailing data.
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return jsonError(err)
+	}
+	return expectEOF(dec)
+}
+
+// jsonError rewrites encoding/json errors so they read well in responses,
+// e.g. `unknown field "purchseDate"` or `total: expected string, got number`.
+// Errors about one field are *jsonFieldError.
+func jsonError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field := jsonFieldPath(typeErr.Field)
+		if field == "" {
+			return fmt.Errorf("body: expected %s, got %s", jsonKind(typeErr.Type), typeErr.Value)
+		}
+		return &jsonFieldError{
+			msg:   fmt.Sprintf("%s: expected %s, got %s", field, jsonKind(typeErr.Type), typeErr.Value),
+			field: fieldError{Field: field, Code: codeInvalidType, Message: "must be a JSON " + jsonKind(typeErr.Type)},
+		}
+	}
+	msg := strings.TrimPrefix(err.Error(), "json: ")
+	if quoted, ok := strings.CutPrefix(msg, "unknown field "); ok {
+		if field, err := strconv.Unquote(quoted); err == nil {
+			return &jsonFieldError{msg: msg, field: fieldError{Field: field, Code: codeUnknownField, Message: "is not a known field"}}
+		}
+	}
+	return errors.New(msg)
+}
+
+// jsonFieldPath writes encoding/json's path to a field, "items.0.price", as
+// validation does, "items[0].price".
+func jsonFieldPath(path string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(path, ".") {
+		if _, err := strconv.Atoi(part); err == nil && i > 0 {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// jsonFieldError is a decoding error about one field of the JSON.
+type jsonFieldError struct {
+	msg   string
+	field fieldError
+}
+
+func (e *jsonFieldError) Error() string { return e.msg }
+
+// decodeFieldErrors returns the field a decoding error is about, for
+// responses listing invalid fields, or nil if it is not about one, such as
+// malformed JSON.
+func decodeFieldErrors(err error) []fieldError {
+	var fe *jsonFieldError
+	if errors.As(err, &fe) {
+		return []fieldError{fe.field}
+	}
+	return nil
+}
+
+// jsonKind names the JSON type that decodes into t.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	default:
+		return t.String()
+	}
+}
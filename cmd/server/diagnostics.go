@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/metrics"
+	"time"
+)
+
+// processStart is when the process started, for uptime.
+var processStart = time.Now()
+
+// receiptCounter is implemented by stores that can count their receipts
+// without listing them.
+type receiptCounter interface {
+	CountReceipts(ctx context.Context) (int, error)
+}
+
+// registerPprof mounts the net/http/pprof handlers under /debug/pprof/ for
+// administrators.
+func registerPprof(mux *http.ServeMux) {
+	mux.Handle("GET /debug/pprof/", requireAdmin(pprof.Index))
+	mux.Handle("GET /debug/pprof/cmdline", requireAdmin(pprof.Cmdline))
+	mux.Handle("GET /debug/pprof/profile", requireAdmin(longProfile(pprof.Profile)))
+	mux.Handle("GET /debug/pprof/symbol", requireAdmin(pprof.Symbol))
+	mux.Handle("POST /debug/pprof/symbol", requireAdmin(pprof.Symbol))
+	mux.Handle("GET /debug/pprof/trace", requireAdmin(longProfile(pprof.Trace)))
+}
+
+// longProfile lets CPU profiles and traces run past HTTP_WRITE_TIMEOUT.
+// pprof refuses durations longer than the server's WriteTimeout, which it
+// reads from the request context, so it is shown a server without one.
+func longProfile(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		ctx := context.WithValue(r.Context(), http.ServerContextKey, &http.Server{})
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// runtimeResponse is the body of GET /admin/runtime.
+type runtimeResponse struct {
+	GoVersion     string  `json:"goVersion"`
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+	NumCPU        int     `json:"numCPU"`
+	GOMAXPROCS    int     `json:"gomaxprocs"`
+	Goroutines    int     `json:"goroutines"`
+	Heap          struct {
+		AllocBytes    uint64 `json:"allocBytes"`
+		InuseBytes    uint64 `json:"inuseBytes"`
+		IdleBytes     uint64 `json:"idleBytes"`
+		ReleasedBytes uint64 `json:"releasedBytes"`
+		Objects       uint64 `json:"objects"`
+		SysBytes      uint64 `json:"sysBytes"`
+	} `json:"heap"`
+	GC struct {
+		Cycles      uint32     `json:"cycles"`
+		Forced      uint32     `json:"forced"`
+		LastAt      *time.Time `json:"lastAt"`
+		PauseTotalS float64    `json:"pauseTotalSeconds"`
+		// RecentPausesS are the latest stop-the-world pauses, newest first.
+		RecentPausesS []float64 `json:"recentPausesSeconds"`
+		NextHeapBytes uint64    `json:"nextHeapBytes"`
+		CPUFraction   float64   `json:"cpuFraction"`
+		// GOGC is the GC target percentage; -1 when GC is off.
+		GOGC int `json:"gogc"`
+	} `json:"gc"`
+	Store struct {
+		// Receipts is absent for stores that cannot count cheaply.
+		Receipts *int `json:"receipts,omitempty"`
+	} `json:"store"`
+}
+
+// runtimeHandler handles GET /admin/runtime
+func (s *server) runtimeHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var resp runtimeResponse
+	resp.GoVersion = runtime.Version()
+	resp.UptimeSeconds = time.Since(processStart).Seconds()
+	resp.NumCPU = runtime.NumCPU()
+	resp.GOMAXPROCS = runtime.GOMAXPROCS(0)
+	resp.Goroutines = runtime.NumGoroutine()
+
+	resp.Heap.AllocBytes = mem.HeapAlloc
+	resp.Heap.InuseBytes = mem.HeapInuse
+	resp.Heap.IdleBytes = mem.HeapIdle
+	resp.Heap.ReleasedBytes = mem.HeapReleased
+	resp.Heap.Objects = mem.HeapObjects
+	resp.Heap.SysBytes = mem.Sys
+
+	resp.GC.Cycles = mem.NumGC
+	resp.GC.Forced = mem.NumForcedGC
+	if mem.LastGC > 0 {
+		last := time.Unix(0, int64(mem.LastGC)).UTC()
+		resp.GC.LastAt = &last
+	}
+	resp.GC.PauseTotalS = time.Duration(mem.PauseTotalNs).Seconds()
+	resp.GC.RecentPausesS = []float64{}
+	for i := uint32(0); i < min(mem.NumGC, 10); i++ {
+		// PauseNs is a circular buffer whose latest entry is at
+		// (NumGC+255)%256.
+		ns := mem.PauseNs[(mem.NumGC-i+255)%256]
+		resp.GC.RecentPausesS = append(resp.GC.RecentPausesS, time.Duration(ns).Seconds())
+	}
+	resp.GC.NextHeapBytes = mem.NextGC
+	resp.GC.CPUFraction = mem.GCCPUFraction
+	gogc := []metrics.Sample{{Name: "/gc/gogc:percent"}}
+	metrics.Read(gogc)
+	if gogc[0].Value.Kind() == metrics.KindUint64 {
+		resp.GC.GOGC = int(int64(gogc[0].Value.Uint64()))
+	}
+
+	if c, ok := s.store.(receiptCounter); ok {
+		n, err := c.CountReceipts(r.Context())
+		if err != nil {
+			log.Printf("Error counting receipts: %v", err)
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to count receipts")
+			return
+		}
+		resp.Store.Receipts = &n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sealedPrefix marks a payload sealed by receiptCipher. Payloads without it
+// were written before encryption was turned on and are read as they are.
+const sealedPrefix = "enc1."
+
+const (
+	// dataKeyMaxUses bounds how many payloads share a data key, well
+	// within the limit for AES-GCM with random nonces.
+	dataKeyMaxUses = 1 << 20
+	// unwrappedCacheSize bounds the data keys kept unwrapped for reads.
+	unwrappedCacheSize = 1024
+)
+
+// receiptCipher encrypts receipt payloads with AES-256-GCM before the store
+// writes them (envelope encryption). Each payload is sealed with a data key
+// that is kept beside it, wrapped by a key-encryption key: one of the local
+// keys, or a Vault transit key when vault is set. The receipt ID is bound to
+// the ciphertext, so a payload cannot be moved to another receipt.
+//
+// A nil *receiptCipher leaves payloads in plaintext.
+type receiptCipher struct {
+	vault *vaultTransit
+	// dataKeyTTL is how long a data key is used for new payloads.
+	dataKeyTTL time.Duration
+
+	mu sync.Mutex
+	// local are the key-encryption keys by ID. current wraps new data keys
+	// unless vault is set; the others are kept to read older payloads.
+	local     map[string]cipher.AEAD
+	current   string
+	key       cipher.AEAD
+	wrapped   string
+	keyUses   int
+	keyExpiry time.Time
+	// fetching, while a data key is being fetched from Vault, is closed
+	// when the fetch is done.
+	fetching  chan struct{}
+	unwrapped map[string]cipher.AEAD
+}
+
+// receiptCipherFromEnv reads the keys from RECEIPT_ENCRYPTION_KEYS and, for
+// Vault, RECEIPT_ENCRYPTION_VAULT_KEY. It returns nil when neither is set.
+func receiptCipherFromEnv(vault *vaultClient) (*receiptCipher, error) {
+	c := &receiptCipher{unwrapped: make(map[string]cipher.AEAD)}
+	var err error
+	if c.local, c.current, err = parseEncryptionKeys(os.Getenv("RECEIPT_ENCRYPTION_KEYS")); err != nil {
+		return nil, err
+	}
+	if name := os.Getenv("RECEIPT_ENCRYPTION_VAULT_KEY"); name != "" {
+		if vault == nil {
+			return nil, fmt.Errorf("RECEIPT_ENCRYPTION_VAULT_KEY needs VAULT_ADDR")
+		}
+		c.vault = &vaultTransit{client: vault, mount: os.Getenv("VAULT_TRANSIT_MOUNT"), key: name}
+		if c.vault.mount == "" {
+			c.vault.mount = "transit"
+		}
+	}
+	if c.current == "" && c.vault == nil {
+		return nil, nil
+	}
+	if c.dataKeyTTL, err = envDuration("RECEIPT_DATA_KEY_TTL", time.Hour); err != nil {
+		return nil, err
+	}
+	if c.dataKeyTTL <= 0 {
+		return nil, fmt.Errorf("RECEIPT_DATA_KEY_TTL must be positive")
+	}
+	return c, nil
+}
+
+// parseEncryptionKeys parses RECEIPT_ENCRYPTION_KEYS, returning the keys
+// by ID and the ID of the first.
+func parseEncryptionKeys(v string) (map[string]cipher.AEAD, string, error) {
+	keys := make(map[string]cipher.AEAD)
+	var current string
+	for _, entry := range splitList(v) {
+		id, encoded, ok := strings.Cut(entry, "=")
+		if !ok || id == "" || strings.ContainsAny(id, ":.") {
+			return nil, "", fmt.Errorf("RECEIPT_ENCRYPTION_KEYS entries must look like id=base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, "", fmt.Errorf("RECEIPT_ENCRYPTION_KEYS: key %q must be 32 bytes, base64-encoded", id)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, "", fmt.Errorf("RECEIPT_ENCRYPTION_KEYS: key %q is listed twice", id)
+		}
+		if keys[id], err = newGCM(key); err != nil {
+			return nil, "", err
+		}
+		if current == "" {
+			current = id
+		}
+	}
+	return keys, current, nil
+}
+
+// setLocalKeys replaces the local keys with those in v, a new value of
+// RECEIPT_ENCRYPTION_KEYS. A new current key takes effect with the next
+// data key.
+func (c *receiptCipher) setLocalKeys(v string) error {
+	keys, current, err := parseEncryptionKeys(v)
+	if err != nil {
+		return err
+	}
+	if current == "" && c.vault == nil {
+		return fmt.Errorf("RECEIPT_ENCRYPTION_KEYS is empty")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if current != c.current && c.vault == nil {
+		c.key = nil
+	}
+	c.local, c.current = keys, current
+	return nil
+}
+
+// check makes sure a data key can be obtained, so that a misconfigured
+// key service is reported at startup rather than on the first write.
+func (c *receiptCipher) check(ctx context.Context) error {
+	_, err := c.seal(ctx, "check", []byte("{}"))
+	return err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts payload for the receipt id. The result is sealedPrefix, the
+// wrapped data key, '.', and the nonce and ciphertext in base64.
+func (c *receiptCipher) seal(ctx context.Context, id string, payload []byte) ([]byte, error) {
+	if c == nil {
+		return payload, nil
+	}
+	aead, wrapped, err := c.dataKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("data key: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, payload, []byte(id))
+	out := make([]byte, 0, len(sealedPrefix)+len(wrapped)+1+base64.RawStdEncoding.EncodedLen(len(sealed)))
+	out = append(out, sealedPrefix...)
+	out = append(out, wrapped...)
+	out = append(out, '.')
+	return base64.RawStdEncoding.AppendEncode(out, sealed), nil
+}
+
+// open reverses seal. Payloads that were never sealed are returned as they
+// are, so data written before encryption was turned on still reads.
+func (c *receiptCipher) open(ctx context.Context, id string, data []byte) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(data, []byte(sealedPrefix))
+	if !ok {
+		return data, nil
+	}
+	if c == nil {
+		return nil, errors.New("payload is encrypted but no encryption keys are configured")
+	}
+	i := bytes.LastIndexByte(rest, '.')
+	if i < 0 {
+		return nil, errors.New("malformed encrypted payload")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(string(rest[i+1:]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted payload: %w", err)
+	}
+	aead, err := c.unwrap(ctx, string(rest[:i]))
+	if err != nil {
+		return nil, fmt.Errorf("data key: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted payload")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	payload, err := aead.Open(nil, nonce, sealed, []byte(id))
+	if err != nil {
+		return nil, errors.New("encrypted payload failed authentication")
+	}
+	return payload, nil
+}
+
+// dataKey returns the data key for new payloads and its wrapped form,
+// replacing it once it is too old or has been used too often. A key from
+// Vault is fetched without holding c.mu, so that payloads can still be
+// opened meanwhile; concurrent callers wait for the one fetch.
+func (c *receiptCipher) dataKey(ctx context.Context) (cipher.AEAD, string, error) {
+	for {
+		c.mu.Lock()
+		if c.key != nil && c.keyUses < dataKeyMaxUses && time.Now().Before(c.keyExpiry) {
+			c.keyUses++
+			aead, wrapped := c.key, c.wrapped
+			c.mu.Unlock()
+			return aead, wrapped, nil
+		}
+		if c.vault == nil {
+			defer c.mu.Unlock()
+			key, wrapped, err := c.wrapLocal()
+			if err != nil {
+				return nil, "", err
+			}
+			aead, err := c.installKey(key, wrapped)
+			if err != nil {
+				return nil, "", err
+			}
+			return aead, wrapped, nil
+		}
+		if fetching := c.fetching; fetching != nil {
+			c.mu.Unlock()
+			select {
+			case <-fetching:
+				continue
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			}
+		}
+		done := make(chan struct{})
+		c.fetching = done
+		c.mu.Unlock()
+
+		key, wrapped, err := c.vault.dataKey(ctx)
+		c.mu.Lock()
+		c.fetching = nil
+		close(done)
+		var aead cipher.AEAD
+		if err == nil {
+			aead, err = c.installKey(key, wrapped)
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return nil, "", err
+		}
+		return aead, wrapped, nil
+	}
+}
+
+// installKey makes key, wrapped as wrapped, the data key for new payloads
+// and counts this use of it. c.mu must be held.
+func (c *receiptCipher) installKey(key []byte, wrapped string) (cipher.AEAD, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	c.key, c.wrapped, c.keyUses, c.keyExpiry = aead, wrapped, 1, time.Now().Add(c.dataKeyTTL)
+	return aead, nil
+}
+
+// wrapLocal makes a data key and wraps it with the current local key as
+// "<key id>:<base64 nonce and ciphertext>". c.mu must be held.
+func (c *receiptCipher) wrapLocal() ([]byte, string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", err
+	}
+	kek := c.local[c.current]
+	nonce := make([]byte, kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	sealed := kek.Seal(nonce, nonce, key, []byte(c.current))
+	return key, c.current + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// unwrap returns the data key for a wrapped key written by seal.
+func (c *receiptCipher) unwrap(ctx context.Context, wrapped string) (cipher.AEAD, error) {
+	c.mu.Lock()
+	aead, ok := c.unwrapped[wrapped]
+	c.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+
+	var key []byte
+	if strings.HasPrefix(wrapped, "vault:") {
+		if c.vault == nil {
+			return nil, errors.New("payload key is held in Vault but RECEIPT_ENCRYPTION_VAULT_KEY is not set")
+		}
+		var err error
+		if key, err = c.vault.decrypt(ctx, wrapped); err != nil {
+			return nil, err
+		}
+	} else {
+		id, encoded, _ := strings.Cut(wrapped, ":")
+		c.mu.Lock()
+		kek, ok := c.local[id]
+		c.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", id)
+		}
+		sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+		if err != nil || len(sealed) < kek.NonceSize() {
+			return nil, errors.New("malformed wrapped key")
+		}
+		if key, err = kek.Open(nil, sealed[:kek.NonceSize()], sealed[kek.NonceSize():], []byte(id)); err != nil {
+			return nil, fmt.Errorf("key %q does not unwrap the data key", id)
+		}
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.unwrapped) >= unwrappedCacheSize {
+		clear(c.unwrapped)
+	}
+	c.unwrapped[wrapped] = aead
+	return aead, nil
+}
+
+// vaultTransit makes and unwraps data keys with a key in HashiCorp Vault's
+// transit secrets engine, so the key-encryption key never leaves Vault.
+type vaultTransit struct {
+	client *vaultClient
+	mount  string
+	key    string
+}
+
+// dataKey asks Vault for a new data key, returning it in plaintext and
+// wrapped ("vault:v1:...").
+func (v *vaultTransit) dataKey(ctx context.Context) ([]byte, string, error) {
+	var resp struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := v.client.write(ctx, v.mount+"/datakey/plaintext/"+v.key, map[string]any{"bits": 256}, &resp); err != nil {
+		return nil, "", err
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, "", fmt.Errorf("vault datakey: %w", err)
+	}
+	return key, resp.Ciphertext, nil
+}
+
+// decrypt has Vault unwrap a data key made by dataKey.
+func (v *vaultTransit) decrypt(ctx context.Context, wrapped string) ([]byte, error) {
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := v.client.write(ctx, v.mount+"/decrypt/"+v.key, map[string]any{"ciphertext": wrapped}, &resp); err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("vault decrypt: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeJSONWithETag writes v as JSON with a strong ETag computed from the
+// encoded body, or answers 304 Not Modified when the request's
+// If-None-Match already names it.
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v any) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(v); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+	sum := sha256.Sum256(body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	h := w.Header()
+	if match, ok := matchETag(r.Header.Get("If-None-Match"), etag); ok {
+		// Repeat the tag the client holds, which may be that of a
+		// compressed copy.
+		h.Set("ETag", match)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("ETag", etag)
+	h.Set("Content-Type", "application/json")
+	w.Write(body.Bytes())
+}
+
+// setCacheControl lets clients keep a receipt or points response for
+// s.pointsMaxAge. Points only change when a receipt is rescored or
+// reviewed, so within that time they are treated as immutable; afterwards
+// the ETag makes checking cheap. Responses depend on the caller, so shared
+// caches must not keep them.
+func (s *server) setCacheControl(w http.ResponseWriter) {
+	if s.pointsMaxAge <= 0 {
+		w.Header().Set("Cache-Control", "private, no-cache")
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(s.pointsMaxAge/time.Second))+", immutable")
+}
+
+// matchETag reports whether an If-None-Match header names etag, by the
+// weak comparison RFC 9110 prescribes for it, and returns the tag that
+// matched. Tags of compressed copies (see compressWriter) match the
+// uncompressed tag.
+func matchETag(header, etag string) (string, bool) {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return etag, true
+		}
+		opaque := strings.TrimPrefix(tag, "W/")
+		for _, enc := range []string{"gzip", "deflate"} {
+			if base, ok := strings.CutSuffix(opaque, "-"+enc+`"`); ok {
+				opaque = base + `"`
+			}
+		}
+		if opaque == etag {
+			return tag, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types.
+const (
+	eventReceiptProcessed = "receipt.processed" // a new receipt was scored and saved
+	eventReceiptRescored  = "receipt.rescored"  // a stored receipt's points changed
+	eventPointsRedeemed   = "points.redeemed"   // a user spent points
+)
+
+// eventTypes lists every event type, for validating subscriptions.
+var eventTypes = []string{eventReceiptProcessed, eventReceiptRescored, eventPointsRedeemed}
+
+// receiptEvent tells consumers outside the server about a change to a
+// receipt or to a user's points.
+type receiptEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	// RequestID is the X-Request-Id of the API request that caused the
+	// event, if one did.
+	RequestID string           `json:"requestId,omitempty"`
+	Data      receiptEventData `json:"data"`
+	// APIKey is the API key, or client certificate tenant, of the caller
+	// that caused the event. Only its own webhooks receive the event.
+	APIKey string `json:"-"`
+}
+
+// receiptEventData describes the receipt, or for points events the
+// ledger entry, that an event is about.
+type receiptEventData struct {
+	ReceiptID    string `json:"receiptId,omitempty"`
+	UserID       string `json:"userId,omitempty"`
+	Retailer     string `json:"retailer,omitempty"`
+	Total        string `json:"total,omitempty"`
+	Points       int    `json:"points"`
+	RulesVersion string `json:"rulesVersion,omitempty"`
+	Status       string `json:"status,omitempty"`
+
+	// Set for points events only.
+	EntryID string `json:"entryId,omitempty"`
+	Balance *int   `json:"balance,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func newReceiptEvent(ctx context.Context, typ string, rec StoredReceipt) receiptEvent {
+	return receiptEvent{
+		ID:        uuid.New().String(),
+		Type:      typ,
+		CreatedAt: time.Now().UTC(),
+		RequestID: requestIDFrom(ctx),
+		APIKey:    callerAPIKey(ctx),
+		Data: receiptEventData{
+			ReceiptID:    rec.ID,
+			UserID:       rec.UserID,
+			Retailer:     rec.Receipt.Retailer,
+			Total:        rec.Receipt.Total,
+			Points:       rec.Points,
+			RulesVersion: rec.RulesVersion,
+			Status:       statusText(rec.Status),
+		},
+	}
+}
+
+// newPointsEvent builds an event of type typ for ledger entry e.
+func newPointsEvent(ctx context.Context, typ string, e LedgerEntry) receiptEvent {
+	return receiptEvent{
+		ID:        uuid.New().String(),
+		Type:      typ,
+		CreatedAt: time.Now().UTC(),
+		RequestID: requestIDFrom(ctx),
+		APIKey:    callerAPIKey(ctx),
+		Data: receiptEventData{
+			UserID:  e.UserID,
+			Points:  e.Points,
+			EntryID: e.ID,
+			Balance: &e.Balance,
+			Reason:  e.Reason,
+		},
+	}
+}
+
+// callerAPIKey returns the API key or tenant of the caller on ctx, or ""
+// for end users and unauthenticated callers.
+func callerAPIKey(ctx context.Context) string {
+	id, _ := identityFrom(ctx)
+	return id.APIKey
+}
+
+// emit tells every event consumer that rec changed.
+func (s *server) emit(ctx context.Context, typ string, rec StoredReceipt) {
+	s.publish(newReceiptEvent(ctx, typ, rec))
+}
+
+// publish hands ev to every event consumer without waiting for delivery.
+// Only receipt.processed events go to the event stream and the message
+// broker, and not to the broker from here if they are relayed from the
+// outbox.
+func (s *server) publish(ev receiptEvent) {
+	s.webhooks.publish(ev)
+	s.sockets.publish(ev)
+	if ev.Type != eventReceiptProcessed {
+		return
+	}
+	s.stream.publish(ev)
+	if s.events != nil && s.outbox == nil {
+		s.events.Publish(ev)
+	}
+}
+
+// eventPublisher sends receipt events to a message broker.
+type eventPublisher interface {
+	// Publish queues ev without blocking on the broker; delivery failures
+	// are logged and counted.
+	Publish(ev receiptEvent)
+	// Send publishes evs and waits for the broker to accept them.
+	Send(ctx context.Context, evs []receiptEvent) error
+	Close() error
+}
+
+// eventsConfig selects the message broker that receives
+// receipt.processed events.
+type eventsConfig struct {
+	Broker string // "" (none), "kafka" or "nats"
+
+	KafkaBrokers []string
+	KafkaTopic   string
+
+	NATSURL     string
+	NATSSubject string
+
+	// OutboxInterval is how often events saved in the outbox by the SQL
+	// stores are relayed to the broker.
+	OutboxInterval time.Duration
+}
+
+// eventsConfigFromEnv reads the event broker settings from the environment.
+func eventsConfigFromEnv() (eventsConfig, error) {
+	cfg := eventsConfig{
+		Broker:      os.Getenv("EVENTS_BROKER"),
+		KafkaTopic:  os.Getenv("KAFKA_TOPIC"),
+		NATSURL:     os.Getenv("NATS_URL"),
+		NATSSubject: os.Getenv("NATS_SUBJECT"),
+	}
+	for _, b := range strings.Split(os.Getenv("KAFKA_BROKERS"), ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			cfg.KafkaBrokers = append(cfg.KafkaBrokers, b)
+		}
+	}
+	if len(cfg.KafkaBrokers) == 0 {
+		cfg.KafkaBrokers = []string{"localhost:9092"}
+	}
+	if cfg.KafkaTopic == "" {
+		cfg.KafkaTopic = "receipts"
+	}
+	if cfg.NATSURL == "" {
+		cfg.NATSURL = "nats://localhost:4222"
+	}
+	if cfg.NATSSubject == "" {
+		cfg.NATSSubject = "receipts.processed"
+	}
+	var err error
+	if cfg.OutboxInterval, err = envDuration("OUTBOX_RELAY_INTERVAL", time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.OutboxInterval <= 0 {
+		return cfg, fmt.Errorf("OUTBOX_RELAY_INTERVAL: must be positive")
+	}
+	switch cfg.Broker {
+	case "", "kafka", "nats":
+		return cfg, nil
+	default:
+		return cfg, fmt.Errorf("EVENTS_BROKER: must be \"kafka\" or \"nats\", got %q", cfg.Broker)
+	}
+}
+
+// newEventPublisher connects to the configured broker, or returns nil if
+// there is none.
+func newEventPublisher(cfg eventsConfig) (eventPublisher, error) {
+	switch cfg.Broker {
+	case "kafka":
+		return newKafkaPublisher(cfg), nil
+	case "nats":
+		return newNATSPublisher(cfg)
+	default:
+		return nil, nil
+	}
+}
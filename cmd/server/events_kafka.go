@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// kafkaPublisherQueue is how many events may wait for the Kafka writer
+	// before new ones are dropped.
+	kafkaPublisherQueue = 1000
+	// kafkaBatchSize is the most queued events written in one request.
+	kafkaBatchSize = 100
+)
+
+// kafkaPublisher writes events to a Kafka topic, keyed by receipt ID so
+// that a receipt's events stay in order on one partition. Published events
+// are queued and written in batches by a background goroutine.
+type kafkaPublisher struct {
+	w       *kafka.Writer
+	pending chan kafka.Message
+	done    chan struct{}
+}
+
+func newKafkaPublisher(cfg eventsConfig) *kafkaPublisher {
+	p := &kafkaPublisher{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.KafkaBrokers...),
+			Topic:        cfg.KafkaTopic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchSize:    kafkaBatchSize,
+			BatchTimeout: 10 * time.Millisecond,
+		},
+		pending: make(chan kafka.Message, kafkaPublisherQueue),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func kafkaMessage(ev receiptEvent) (kafka.Message, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	headers := []kafka.Header{
+		{Key: "event-id", Value: []byte(ev.ID)},
+		{Key: "event-type", Value: []byte(ev.Type)},
+	}
+	if ev.RequestID != "" {
+		headers = append(headers, kafka.Header{Key: "request-id", Value: []byte(ev.RequestID)})
+	}
+	return kafka.Message{
+		Key:     []byte(ev.Data.ReceiptID),
+		Value:   body,
+		Headers: headers,
+	}, nil
+}
+
+func (p *kafkaPublisher) Publish(ev receiptEvent) {
+	msg, err := kafkaMessage(ev)
+	if err != nil {
+		slog.Error("Encoding event failed", "event_id", ev.ID, "error", err)
+		return
+	}
+	select {
+	case p.pending <- msg:
+	default:
+		p.failed(1, errQueueFull)
+	}
+}
+
+func (p *kafkaPublisher) Send(ctx context.Context, evs []receiptEvent) error {
+	msgs := make([]kafka.Message, len(evs))
+	for i, ev := range evs {
+		var err error
+		if msgs[i], err = kafkaMessage(ev); err != nil {
+			return err
+		}
+	}
+	if err := p.w.WriteMessages(ctx, msgs...); err != nil {
+		eventsFailed.Add(int64(len(msgs)))
+		return err
+	}
+	eventsPublished.Add(int64(len(msgs)))
+	return nil
+}
+
+// run writes queued messages, batching whatever has piled up during the
+// previous write.
+func (p *kafkaPublisher) run() {
+	defer close(p.done)
+	for msg := range p.pending {
+		batch := []kafka.Message{msg}
+	fill:
+		for len(batch) < kafkaBatchSize {
+			select {
+			case msg, ok := <-p.pending:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, msg)
+			default:
+				break fill
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := p.w.WriteMessages(ctx, batch...); err != nil {
+			p.failed(len(batch), err)
+		} else {
+			eventsPublished.Add(int64(len(batch)))
+		}
+		cancel()
+	}
+}
+
+func (p *kafkaPublisher) failed(n int, err error) {
+	eventsFailed.Add(int64(n))
+	slog.Warn("Publishing events to Kafka failed", "topic", p.w.Topic, "events", n, "error", err)
+}
+
+// Close flushes queued events.
+func (p *kafkaPublisher) Close() error {
+	close(p.pending)
+	<-p.done
+	return p.w.Close()
+}
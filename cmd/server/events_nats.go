@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsPublisher publishes events to a NATS subject. The client buffers
+// messages while it reconnects.
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSPublisher(cfg eventsConfig) (*natsPublisher, error) {
+	conn, err := nats.Connect(cfg.NATSURL,
+		nats.Name("receipt-processor"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("Disconnected from NATS", "error", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			slog.Info("Reconnected to NATS", "url", c.ConnectedUrl())
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("connect to nats %s: %w", cfg.NATSURL, err)
+	}
+	return &natsPublisher{conn: conn, subject: cfg.NATSSubject}, nil
+}
+
+func (p *natsPublisher) publish(ev receiptEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(p.subject)
+	msg.Data = body
+	// JetStream streams use Nats-Msg-Id to drop duplicate publishes.
+	msg.Header.Set(nats.MsgIdHdr, ev.ID)
+	msg.Header.Set("Event-Type", ev.Type)
+	if ev.RequestID != "" {
+		msg.Header.Set(requestIDHeader, ev.RequestID)
+	}
+	return p.conn.PublishMsg(msg)
+}
+
+func (p *natsPublisher) Publish(ev receiptEvent) {
+	if err := p.publish(ev); err != nil {
+		eventsFailed.Add(1)
+		slog.Warn("Publishing event to NATS failed", "subject", p.subject, "event_id", ev.ID, "error", err)
+		return
+	}
+	eventsPublished.Add(1)
+}
+
+// Send publishes evs and waits for the server to acknowledge them.
+func (p *natsPublisher) Send(ctx context.Context, evs []receiptEvent) error {
+	for _, ev := range evs {
+		if err := p.publish(ev); err != nil {
+			eventsFailed.Add(int64(len(evs)))
+			return err
+		}
+	}
+	if err := p.conn.FlushWithContext(ctx); err != nil {
+		eventsFailed.Add(int64(len(evs)))
+		return err
+	}
+	eventsPublished.Add(int64(len(evs)))
+	return nil
+}
+
+// Close flushes buffered events and disconnects.
+func (p *natsPublisher) Close() error {
+	return p.conn.Drain()
+}
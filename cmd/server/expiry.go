@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultExpiringWithin is how far ahead GET /users/{id}/balance/expiring
+// looks when no window is given.
+const defaultExpiringWithin = 30 * 24 * time.Hour
+
+// expiryConfig controls when earned points lapse.
+type expiryConfig struct {
+	// After is how long points last from when they were earned; zero means
+	// they never expire.
+	After    time.Duration
+	Interval time.Duration
+}
+
+// expiryConfigFromEnv reads the points expiry settings from the environment.
+func expiryConfigFromEnv() (expiryConfig, error) {
+	var cfg expiryConfig
+	var err error
+	if cfg.After, err = envDuration("POINTS_EXPIRE_AFTER", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.Interval, err = envDuration("POINTS_EXPIRY_INTERVAL", time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.After < 0 {
+		return cfg, fmt.Errorf("POINTS_EXPIRE_AFTER must not be negative")
+	}
+	if cfg.After > 0 && cfg.Interval <= 0 {
+		return cfg, fmt.Errorf("POINTS_EXPIRY_INTERVAL must be positive")
+	}
+	return cfg, nil
+}
+
+// pointsLot is a credit to a user's balance that has not yet been spent
+// or expired.
+type pointsLot struct {
+	Points    int       `json:"points"`
+	EarnedAt  time.Time `json:"earnedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// unspentLots replays a ledger, oldest first, and returns the credits still
+// outstanding when each lasts for after. Debits use up the oldest points
+// first; a debit larger than the balance is made good from later credits.
+func unspentLots(entries []LedgerEntry, after time.Duration) []pointsLot {
+	var lots []pointsLot
+	owed := 0
+	for _, e := range entries {
+		if e.Points > 0 {
+			p := e.Points
+			used := min(owed, p)
+			owed, p = owed-used, p-used
+			if p > 0 {
+				lots = append(lots, pointsLot{Points: p, EarnedAt: e.CreatedAt, ExpiresAt: e.CreatedAt.Add(after)})
+			}
+			continue
+		}
+		debit := -e.Points
+		for debit > 0 && len(lots) > 0 {
+			used := min(debit, lots[0].Points)
+			lots[0].Points -= used
+			debit -= used
+			if lots[0].Points == 0 {
+				lots = lots[1:]
+			}
+		}
+		owed += debit
+	}
+	return lots
+}
+
+// runPointsExpiry expires points earned more than after ago, checking
+// every interval until ctx is done.
+func runPointsExpiry(ctx context.Context, store ReceiptStore, audit auditLog, after, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		expirePoints(ctx, store, audit, after, time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expirePoints records an expire entry for every user holding points that
+// lapsed by now.
+func expirePoints(ctx context.Context, store ReceiptStore, audit auditLog, after time.Duration, now time.Time) {
+	users, err := store.UsersWithBalance(ctx)
+	if err != nil {
+		slog.Error("Error listing users for points expiry", "error", err)
+		return
+	}
+	for _, user := range users {
+		if err := expireUserPoints(ctx, store, audit, user, after, now); err != nil {
+			slog.Error("Error expiring points", "user_id", user, "error", err)
+		}
+	}
+}
+
+func expireUserPoints(ctx context.Context, store ReceiptStore, audit auditLog, user string, after time.Duration, now time.Time) error {
+	entries, err := store.Ledger(ctx, user)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	expired := 0
+	var earnedBy time.Time
+	for _, lot := range unspentLots(entries, after) {
+		if lot.ExpiresAt.After(now) {
+			break
+		}
+		expired += lot.Points
+		earnedBy = lot.EarnedAt
+	}
+	if expired == 0 {
+		return nil
+	}
+
+	// The entry ID follows from the last entry seen, so on SQL stores two
+	// replicas expiring the same points at once cannot both record it.
+	last := entries[len(entries)-1].ID
+	e, err := store.AddLedgerEntry(ctx, LedgerEntry{
+		ID:        uuid.NewSHA1(uuid.NameSpaceOID, []byte(user+"\x00"+last)).String(),
+		UserID:    user,
+		Type:      ledgerExpire,
+		Points:    -expired,
+		Reason:    "Points earned on or before " + earnedBy.Format(time.DateOnly) + " expired",
+		CreatedAt: now,
+	})
+	if errors.Is(err, ErrInsufficientPoints) {
+		// Spent in the meantime; the next run works from the new balance.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pointsExpired.Add(int64(expired))
+	slog.Info("Expired points", "user_id", user, "points", expired, "balance", e.Balance)
+	recordAudit(ctx, audit, auditEntry{
+		Actor:  auditActorSystem,
+		User:   user,
+		Action: "points expiry",
+		Target: e.ID,
+		Detail: e.Reason,
+	})
+	return nil
+}
+
+// expiringPointsHandler handles GET /users/{id}/balance/expiring
+func (s *server) expiringPointsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	within := defaultExpiringWithin
+	if v := r.URL.Query().Get("within"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeProblem(w, r, http.StatusBadRequest, "within must be a positive duration such as 720h")
+			return
+		}
+		within = d
+	}
+
+	lots := []pointsLot{}
+	total := 0
+	if s.pointsExpireAfter > 0 {
+		entries, err := s.store.Ledger(r.Context(), user)
+		if err != nil {
+			log.Printf("Error loading ledger: %v", err)
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to load ledger")
+			return
+		}
+		cutoff := time.Now().Add(within)
+		for _, lot := range unspentLots(entries, s.pointsExpireAfter) {
+			if lot.ExpiresAt.After(cutoff) {
+				break
+			}
+			lots = append(lots, lot)
+			total += lot.Points
+		}
+	}
+
+	response := struct {
+		UserID string      `json:"userId"`
+		Points int         `json:"points"`
+		Lots   []pointsLot `json:"lots"`
+	}{user, total, lots}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// exportFormats are the values GET /admin/export accepts for format, with
+// the content type and file extension of each.
+var exportFormats = map[string]struct{ contentType, ext string }{
+	"json":    {"application/x-ndjson", "ndjson"},
+	"csv":     {"text/csv; charset=utf-8", "csv"},
+	"parquet": {"application/vnd.apache.parquet", "parquet"},
+}
+
+// exportCSVHeader lists the CSV columns: the item columns of a CSV import,
+// grouped by receipt ID, followed by what the service added.
+var exportCSVHeader = []string{"receipt", "retailer", "purchaseDate", "purchaseTime", "total",
+	"shortDescription", "price", "category", "points", "rulesVersion", "status", "userId", "processedAt"}
+
+// exportItem and exportRow are the Parquet schema.
+type exportItem struct {
+	ShortDescription string `parquet:"short_description"`
+	Price            string `parquet:"price"`
+	Category         string `parquet:"category"`
+}
+
+type exportRow struct {
+	ID           string       `parquet:"id"`
+	Retailer     string       `parquet:"retailer"`
+	PurchaseDate string       `parquet:"purchase_date"`
+	PurchaseTime string       `parquet:"purchase_time"`
+	Total        string       `parquet:"total"`
+	Items        []exportItem `parquet:"items,list"`
+	Points       int64        `parquet:"points"`
+	RulesVersion string       `parquet:"rules_version"`
+	Status       string       `parquet:"status"`
+	UserID       string       `parquet:"user_id"`
+	ProcessedAt  time.Time    `parquet:"processed_at,timestamp(millisecond)"`
+}
+
+// parseSince reads an RFC 3339 timestamp or a YYYY-MM-DD date, which means
+// midnight UTC.
+func parseSince(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// exportHandler handles GET /admin/export
+func (s *server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("format")
+	if name == "" {
+		name = "json"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "format must be json, csv or parquet")
+		return
+	}
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := parseSince(v)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "since must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+			return
+		}
+		since = t
+	}
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing receipts: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to export receipts")
+		return
+	}
+	// List returns receipts oldest first, so the export can resume from the
+	// last processedAt it contained.
+	recs := all[:0]
+	for _, rec := range all {
+		if !rec.ProcessedAt.Before(since) {
+			recs = append(recs, rec)
+		}
+	}
+
+	// Exports of large stores outlast HTTP_WRITE_TIMEOUT.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="receipts-`+time.Now().UTC().Format("20060102T150405Z")+"."+format.ext+`"`)
+	switch name {
+	case "json":
+		err = exportJSON(w, recs)
+	case "csv":
+		err = exportCSV(w, recs)
+	case "parquet":
+		err = exportParquet(w, recs)
+	}
+	// The status is sent by now, so a failure can only cut the body short.
+	if err != nil {
+		log.Printf("Error writing %s export: %v", name, err)
+	}
+}
+
+// exportJSON writes recs as newline-delimited JSON, one stored receipt per
+// line.
+func exportJSON(w http.ResponseWriter, recs []StoredReceipt) error {
+	enc := json.NewEncoder(w)
+	for _, rec := range recs {
+		rec.Status = statusText(rec.Status)
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportCSV writes one row per item of each receipt in recs.
+func exportCSV(w http.ResponseWriter, recs []StoredReceipt) error {
+	cw := csv.NewWriter(w)
+	cw.Write(exportCSVHeader)
+	for _, rec := range recs {
+		for _, item := range rec.Receipt.Items {
+			cw.Write([]string{rec.ID, rec.Receipt.Retailer, rec.Receipt.PurchaseDate, rec.Receipt.PurchaseTime, rec.Receipt.Total,
+				item.ShortDescription, item.Price, item.Category,
+				strconv.Itoa(rec.Points), rec.RulesVersion, statusText(rec.Status), rec.UserID, rec.ProcessedAt.UTC().Format(time.RFC3339Nano)})
+		}
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportParquet writes one row per receipt in recs, with its items nested.
+func exportParquet(w http.ResponseWriter, recs []StoredReceipt) error {
+	pw := parquet.NewGenericWriter[exportRow](w, parquet.Compression(&parquet.Snappy))
+	for _, rec := range recs {
+		row := exportRow{
+			ID:           rec.ID,
+			Retailer:     rec.Receipt.Retailer,
+			PurchaseDate: rec.Receipt.PurchaseDate,
+			PurchaseTime: rec.Receipt.PurchaseTime,
+			Total:        rec.Receipt.Total,
+			Points:       int64(rec.Points),
+			RulesVersion: rec.RulesVersion,
+			Status:       statusText(rec.Status),
+			UserID:       rec.UserID,
+			ProcessedAt:  rec.ProcessedAt.UTC(),
+		}
+		for _, item := range rec.Receipt.Items {
+			row.Items = append(row.Items, exportItem(item))
+		}
+		if _, err := pw.Write([]exportRow{row}); err != nil {
+			return err
+		}
+	}
+	return pw.Close()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fetch_assessment/points"
+)
+
+// Fraud signals, stored in StoredReceipt.Flags.
+const (
+	// flagNearDuplicate: another receipt from the same retailer with the
+	// same total was purchased within the duplicate window.
+	flagNearDuplicate = "near_duplicate"
+	// flagFuturePurchase: the purchase date and time have not happened yet.
+	flagFuturePurchase = "future_purchase"
+	// flagJustOverThreshold: the total only just clears a totalGreaterThan
+	// rule's amount.
+	flagJustOverThreshold = "just_over_threshold"
+)
+
+// fraudWeights is what each flag adds to a receipt's fraud score.
+var fraudWeights = map[string]int{
+	flagNearDuplicate:     60,
+	flagFuturePurchase:    50,
+	flagTotalMismatch:     30,
+	flagJustOverThreshold: 20,
+}
+
+const (
+	// fraudHistory is how long submissions are remembered for
+	// near-duplicate detection.
+	fraudHistory = 24 * time.Hour
+	// futureSlack allows for receipts from time zones ahead of the
+	// server's; purchase times carry no zone.
+	futureSlack = 24 * time.Hour
+	// thresholdMargin is how far above a rule's amount a total counts as
+	// just over it.
+	thresholdMargin points.Cents = 100
+)
+
+// fraudScore adds up the weights of flags, capped at 100.
+func fraudScore(flags []string) int {
+	n := 0
+	for _, f := range flags {
+		n += fraudWeights[f]
+	}
+	return min(n, 100)
+}
+
+// fraudDetector looks for signs that a receipt was fabricated or altered.
+// It remembers recent submissions in memory, so near duplicates are only
+// recognised among receipts processed by the same instance.
+type fraudDetector struct {
+	// window is how close in purchase time two receipts must be to count
+	// as near duplicates; zero disables the check.
+	window time.Duration
+
+	mu        sync.Mutex
+	recent    map[string][]sighting // by fraudKey
+	lastSweep time.Time
+}
+
+type sighting struct {
+	id              string
+	purchased, seen time.Time
+}
+
+func newFraudDetector(window time.Duration) *fraudDetector {
+	return &fraudDetector{window: window, recent: make(map[string][]sighting)}
+}
+
+// fraudKey groups receipts that could be copies of each other: the same
+// canonical retailer and total.
+func fraudKey(rules *points.Engine, r points.Receipt) string {
+	return strings.ToLower(strings.TrimSpace(rules.CanonicalRetailer(r.Retailer))) + "\x00" + r.Total
+}
+
+// assess returns the fraud signals for a new, validated receipt and
+// remembers it under id for later near-duplicate checks.
+func (d *fraudDetector) assess(rules *points.Engine, id string, r points.Receipt, now time.Time) []string {
+	var flags []string
+	purchased, _ := time.Parse("2006-01-02 15:04", r.PurchaseDate+" "+r.PurchaseTime)
+	if d.nearDuplicate(fraudKey(rules, r), id, purchased, now) {
+		flags = append(flags, flagNearDuplicate)
+	}
+	if purchased.After(now.Add(futureSlack)) {
+		flags = append(flags, flagFuturePurchase)
+	}
+	if justOverThreshold(rules, r.Total) {
+		flags = append(flags, flagJustOverThreshold)
+	}
+	return flags
+}
+
+// nearDuplicate reports whether a remembered receipt under key was
+// purchased within the window of purchased, and records this one.
+func (d *fraudDetector) nearDuplicate(key, id string, purchased, now time.Time) bool {
+	if d.window <= 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.lastSweep) > time.Minute {
+		for k, list := range d.recent {
+			if list = pruneSightings(list, now); len(list) == 0 {
+				delete(d.recent, k)
+			} else {
+				d.recent[k] = list
+			}
+		}
+		d.lastSweep = now
+	}
+
+	list := pruneSightings(d.recent[key], now)
+	found := false
+	for _, s := range list {
+		if diff := purchased.Sub(s.purchased).Abs(); diff <= d.window {
+			found = true
+			break
+		}
+	}
+	d.recent[key] = append(list, sighting{id: id, purchased: purchased, seen: now})
+	return found
+}
+
+// forget drops the receipt recorded under id, e.g. because it could not be
+// saved.
+func (d *fraudDetector) forget(rules *points.Engine, id string, r points.Receipt) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := fraudKey(rules, r)
+	d.recent[key] = slices.DeleteFunc(d.recent[key], func(s sighting) bool { return s.id == id })
+}
+
+func pruneSightings(list []sighting, now time.Time) []sighting {
+	return slices.DeleteFunc(list, func(s sighting) bool { return now.Sub(s.seen) > fraudHistory })
+}
+
+// justOverThreshold reports whether total clears a totalGreaterThan rule's
+// amount by no more than thresholdMargin.
+func justOverThreshold(rules *points.Engine, total string) bool {
+	cents, err := points.ParseCents(total)
+	if err != nil {
+		return false
+	}
+	for _, c := range rules.RuleSet().Rules {
+		if c.Type != "totalGreaterThan" {
+			continue
+		}
+		amount, err := points.ParseCents(c.Amount)
+		if err == nil && cents > amount && cents-amount <= thresholdMargin {
+			return true
+		}
+	}
+	return false
+}
+
+// fraudReviewHandler handles GET /admin/fraud
+func (s *server) fraudReviewHandler(w http.ResponseWriter, r *http.Request) {
+	minScore := 1
+	if v := r.URL.Query().Get("minScore"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			writeProblem(w, r, http.StatusBadRequest, "minScore must be an integer from 0 to 100")
+			return
+		}
+		minScore = n
+	}
+
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing receipts: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to list receipts")
+		return
+	}
+	receipts := make([]StoredReceipt, 0)
+	for _, rec := range all {
+		if rec.FraudScore >= minScore {
+			receipts = append(receipts, rec)
+		}
+	}
+	// Most suspicious first, then newest first.
+	slices.SortStableFunc(receipts, func(a, b StoredReceipt) int {
+		if c := cmp.Compare(b.FraudScore, a.FraudScore); c != 0 {
+			return c
+		}
+		return b.ProcessedAt.Compare(a.ProcessedAt)
+	})
+
+	response := map[string][]StoredReceipt{"receipts": receipts}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+
+	"fetch_assessment/points"
+)
+
+// graphqlSchema exposes the receipt store over GraphQL.
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+type Query {
+	receipt(id: ID!): Receipt
+	receipts(filter: ReceiptFilter): [Receipt!]!
+}
+
+type Mutation {
+	processReceipt(input: ReceiptInput!): Receipt!
+}
+
+input ReceiptFilter {
+	retailer: String
+	from: String
+	to: String
+}
+
+input ReceiptInput {
+	retailer: String!
+	purchaseDate: String!
+	purchaseTime: String!
+	items: [ItemInput!]!
+	total: String!
+}
+
+input ItemInput {
+	shortDescription: String!
+	price: String!
+}
+
+type Receipt {
+	id: ID!
+	retailer: String!
+	purchaseDate: String!
+	purchaseTime: String!
+	items: [Item!]!
+	total: String!
+	# Points awarded; zero until the receipt is accepted.
+	points: Int!
+	# accepted, needs_review, rejected or pending.
+	status: String!
+	# Version of the rule set that computed points; null if not recorded.
+	rulesVersion: String
+	processedAt: String!
+	breakdown: [RuleResult!]!
+}
+
+type Item {
+	shortDescription: String!
+	price: String!
+}
+
+type RuleResult {
+	rule: String!
+	description: String!
+	points: Int!
+}
+`
+
+// graphqlHandler serves POST /graphql.
+func (s *server) graphqlHandler() http.Handler {
+	schema := graphql.MustParseSchema(graphqlSchema, &graphqlResolver{s: s}, graphql.UseFieldResolvers())
+	return &relay.Handler{Schema: schema}
+}
+
+// graphqlError is a resolver error carrying machine-readable extensions.
+type graphqlError struct {
+	msg        string
+	extensions map[string]any
+}
+
+func (e *graphqlError) Error() string              { return e.msg }
+func (e *graphqlError) Extensions() map[string]any { return e.extensions }
+
+// checkScope applies the same scope rules as the REST routes.
+func checkScope(ctx context.Context, scope string) error {
+	if id, _ := identityFrom(ctx); id.ScopesEnforced && !slices.Contains(id.Scopes, scope) {
+		return &graphqlError{msg: "token lacks the required scope " + scope, extensions: map[string]any{"code": "FORBIDDEN"}}
+	}
+	return nil
+}
+
+type graphqlResolver struct {
+	s *server
+}
+
+func (g *graphqlResolver) Receipt(ctx context.Context, args struct{ ID graphql.ID }) (*receiptResolver, error) {
+	if err := checkScope(ctx, scopeReceiptsRead); err != nil {
+		return nil, err
+	}
+	rec, err := g.s.store.GetReceipt(ctx, string(args.ID))
+	if errors.Is(err, ErrReceiptNotFound) || (err == nil && !canAccess(ctx, rec)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &receiptResolver{rec: rec, rules: g.s.withCanary(g.s.rulesFor(ctx), rec.ContentHash, rec.UserID)}, nil
+}
+
+type receiptFilterInput struct {
+	Retailer *string
+	From     *string
+	To       *string
+}
+
+func (g *graphqlResolver) Receipts(ctx context.Context, args struct{ Filter *receiptFilterInput }) ([]*receiptResolver, error) {
+	if err := checkScope(ctx, scopeReceiptsRead); err != nil {
+		return nil, err
+	}
+	q := map[string][]string{}
+	if f := args.Filter; f != nil {
+		for key, v := range map[string]*string{"retailer": f.Retailer, "from": f.From, "to": f.To} {
+			if v != nil {
+				q[key] = []string{*v}
+			}
+		}
+	}
+	filter, err := parseReceiptFilter(q, g.s.rulesFor(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := g.s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := []*receiptResolver{}
+	for _, rec := range all {
+		if filter.matches(rec) && canAccess(ctx, rec) {
+			out = append(out, &receiptResolver{rec: rec, rules: g.s.withCanary(g.s.rulesFor(ctx), rec.ContentHash, rec.UserID)})
+		}
+	}
+	return out, nil
+}
+
+func (g *graphqlResolver) ProcessReceipt(ctx context.Context, args struct{ Input points.Receipt }) (*receiptResolver, error) {
+	if err := checkScope(ctx, scopeReceiptsWrite); err != nil {
+		return nil, err
+	}
+	if errs := g.s.validate(args.Input); errs != nil {
+		return nil, &graphqlError{
+			msg:        "The receipt is invalid.",
+			extensions: map[string]any{"code": "INVALID_RECEIPT", "fields": errs},
+		}
+	}
+	rec, _, err := g.s.processReceipt(ctx, args.Input, true)
+	if err != nil {
+		return nil, err
+	}
+	setLogReceiptID(ctx, rec.ID)
+	recordAudit(ctx, g.s.audit, auditEntry{Action: "graphql processReceipt", Target: rec.ID})
+	return &receiptResolver{rec: rec, rules: g.s.withCanary(g.s.rulesFor(ctx), rec.ContentHash, rec.UserID)}, nil
+}
+
+// receiptResolver resolves the Receipt type. Item fields are read directly
+// from the struct through graphql.UseFieldResolvers.
+type receiptResolver struct {
+	rec   StoredReceipt
+	rules *points.Engine
+}
+
+func (r *receiptResolver) ID() graphql.ID       { return graphql.ID(r.rec.ID) }
+func (r *receiptResolver) Retailer() string     { return r.rec.Receipt.Retailer }
+func (r *receiptResolver) PurchaseDate() string { return r.rec.Receipt.PurchaseDate }
+func (r *receiptResolver) PurchaseTime() string { return r.rec.Receipt.PurchaseTime }
+func (r *receiptResolver) Items() []points.Item { return r.rec.Receipt.Items }
+func (r *receiptResolver) Total() string        { return r.rec.Receipt.Total }
+func (r *receiptResolver) Points() int32        { return int32(r.rec.Points) }
+func (r *receiptResolver) ProcessedAt() string  { return r.rec.ProcessedAt.Format(time.RFC3339Nano) }
+func (r *receiptResolver) Status() string       { return statusText(r.rec.Status) }
+
+func (r *receiptResolver) RulesVersion() *string {
+	if r.rec.RulesVersion == "" {
+		return nil
+	}
+	return &r.rec.RulesVersion
+}
+
+func (r *receiptResolver) Breakdown() ([]*ruleResultResolver, error) {
+	_, breakdown, err := r.rules.CalculateForTier(r.rec.Receipt, r.rec.Tier)
+	if err != nil {
+		return nil, err
+	}
+	var out []*ruleResultResolver
+	for _, res := range breakdown {
+		out = append(out, &ruleResultResolver{res})
+	}
+	return out, nil
+}
+
+type ruleResultResolver struct {
+	res points.RuleResult
+}
+
+func (r *ruleResultResolver) Rule() string        { return r.res.Rule }
+func (r *ruleResultResolver) Description() string { return r.res.Description }
+func (r *ruleResultResolver) Points() int32       { return int32(r.res.Points) }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// pinger is implemented by stores that depend on an external service and
+// can check that it is reachable.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// healthzHandler handles GET /healthz. It reports that the process is up
+// and serving requests.
+func (s *server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyzHandler handles GET /readyz. It reports whether the instance can
+// serve traffic, which requires its storage backend to be reachable.
+func (s *server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	response := map[string]string{"status": "ok", "storage": "ok"}
+	if p, ok := s.store.(pinger); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := p.Ping(ctx); err != nil {
+			status = http.StatusServiceUnavailable
+			response = map[string]string{"status": "unavailable", "storage": err.Error()}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKeyLen bounds the Idempotency-Key header value.
+const maxIdempotencyKeyLen = 255
+
+// idempotencyEntry is the outcome of the first request made with a key.
+// Until the handler returns, done is open and the response fields are unset.
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	done        chan struct{}
+
+	status      int
+	contentType string
+	body        []byte
+}
+
+// idempotencyCache remembers responses by Idempotency-Key so a retried
+// request gets the original response instead of being processed again.
+// Keys are scoped to the authenticated caller and kept for ttl. Entries live
+// in process memory, so replicas do not share them.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, entries: make(map[string]*idempotencyEntry), lastSweep: time.Now()}
+}
+
+// begin returns the entry for key, creating an in-flight one if there is
+// none. created reports whether the caller should run the request.
+func (c *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte, now time.Time) (e *idempotencyEntry, created bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) > time.Minute {
+		for k, e := range c.entries {
+			if now.After(e.expires) && isClosed(e.done) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if e, ok := c.entries[key]; ok && (now.Before(e.expires) || !isClosed(e.done)) {
+		return e, false
+	}
+	e = &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(c.ttl), done: make(chan struct{})}
+	c.entries[key] = e
+	return e, true
+}
+
+// forget drops key so that the request can be retried.
+func (c *idempotencyCache) forget(key string, e *idempotencyEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[key] == e {
+		delete(c.entries, key)
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// idempotent wraps a POST handler with Idempotency-Key support. The first
+// request with a key runs normally and its response is recorded; repeats
+// within the window get that response replayed with an Idempotent-Replayed
+// header. Reusing a key for a different request is rejected with 422, and
+// a repeat that arrives while the first is still running gets 409. Server
+// errors are not recorded, so the client can retry them with the same key.
+func (s *server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || s.idempotency == nil {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeProblem(w, r, http.StatusBadRequest, "Idempotency-Key must be at most "+strconv.Itoa(maxIdempotencyKeyLen)+" characters")
+			return
+		}
+
+		// Fingerprint the request so a reused key can be told apart from a
+		// retry. A body that fails to read (e.g. too large) is handed on with
+		// its error for the handler to report, and nothing is recorded.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+			next(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256(append([]byte(r.URL.RawQuery+"\n"), body...))
+
+		cacheKey := callerScope(r.Context()) + "\x00" + key
+
+		e, created := s.idempotency.begin(cacheKey, fingerprint, time.Now())
+		if !created {
+			switch {
+			case e.fingerprint != fingerprint:
+				writeProblem(w, r, http.StatusUnprocessableEntity, "Idempotency-Key has already been used for a different request")
+			case !isClosed(e.done):
+				writeProblem(w, r, http.StatusConflict, "A request with this Idempotency-Key is still being processed")
+			default:
+				w.Header().Set("Content-Type", e.contentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(e.status)
+				w.Write(e.body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		finished := false
+		defer func() {
+			if !finished || rec.status >= 500 {
+				s.idempotency.forget(cacheKey, e)
+			} else {
+				e.status, e.contentType, e.body = rec.status, w.Header().Get("Content-Type"), rec.body.Bytes()
+			}
+			close(e.done)
+		}()
+		next(rec, r)
+		finished = true
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of its
+// status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if !rr.wroteHeader {
+		rr.status, rr.wroteHeader = status, true
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.wroteHeader = true
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// errReader returns err from every Read.
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
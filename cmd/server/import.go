@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"fetch_assessment/points"
+)
+
+// importFields are the receipt fields a CSV import maps columns to. Each
+// row is one item; receipt fields repeat on every row of the receipt.
+// "receipt" is an optional identifier that groups rows into receipts.
+var importFields = []string{"receipt", "retailer", "purchaseDate", "purchaseTime", "total", "shortDescription", "price", "category"}
+
+// importOptionalFields may be left without a column.
+var importOptionalFields = []string{"receipt", "category"}
+
+// maxImportMappingBytes caps the mapping part of an import.
+const maxImportMappingBytes = 64 << 10
+
+// importResult is the outcome for the receipt on rows FirstRow to LastRow
+// of an import, counting the header as row 1.
+type importResult struct {
+	FirstRow int    `json:"firstRow"`
+	LastRow  int    `json:"lastRow"`
+	Receipt  string `json:"receipt,omitempty"`
+	batchResult
+}
+
+// importColumns maps import fields to column indexes, -1 for fields
+// without a column.
+type importColumns map[string]int
+
+// resolveImportColumns finds the column for each field in header, using
+// mapping to rename columns; unmapped fields use a column named after the
+// field. Names are matched ignoring case and surrounding space.
+func resolveImportColumns(header []string, mapping map[string]string) (importColumns, error) {
+	for field := range mapping {
+		if !slices.Contains(importFields, field) {
+			return nil, fmt.Errorf("The mapping names unknown field %q", field)
+		}
+	}
+	cols := make(importColumns, len(importFields))
+	for _, field := range importFields {
+		name := field
+		if m, ok := mapping[field]; ok {
+			name = m
+		}
+		cols[field] = -1
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), strings.TrimSpace(name)) {
+				cols[field] = i
+				break
+			}
+		}
+		if cols[field] < 0 && !slices.Contains(importOptionalFields, field) {
+			return nil, fmt.Errorf("No column for %s (expected %q)", field, name)
+		}
+	}
+	return cols, nil
+}
+
+// get returns the trimmed value of field in row, or "" if it has no column.
+func (c importColumns) get(row []string, field string) string {
+	i := c[field]
+	if i < 0 || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// groupKey identifies the receipt row belongs to: its receipt column, or
+// failing that its receipt-level fields.
+func (c importColumns) groupKey(row []string) string {
+	if c["receipt"] >= 0 {
+		return c.get(row, "receipt")
+	}
+	return strings.Join([]string{c.get(row, "retailer"), c.get(row, "purchaseDate"), c.get(row, "purchaseTime"), c.get(row, "total")}, "\x00")
+}
+
+// importReceiptsHandler handles POST /receipts/import
+func (s *server) importReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	dedupe, err := boolParam(r, "dedupe", true)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "Content-Type must be multipart/form-data")
+		return
+	}
+
+	// The mapping, if any, must come before the file, which is read as it
+	// arrives rather than buffered.
+	var mapping map[string]string
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			writeProblem(w, r, http.StatusBadRequest, "The upload has no file part")
+			return
+		}
+		if err != nil {
+			writeProblem(w, r, bodyErrorStatus(err), "Invalid multipart body: "+err.Error())
+			return
+		}
+		switch part.FormName() {
+		case "mapping":
+			body, err := io.ReadAll(io.LimitReader(part, maxImportMappingBytes+1))
+			if err != nil {
+				writeProblem(w, r, bodyErrorStatus(err), "Invalid multipart body: "+err.Error())
+				return
+			}
+			if len(body) > maxImportMappingBytes {
+				writeProblem(w, r, http.StatusBadRequest, "The mapping is too large")
+				return
+			}
+			if err := decodeStrict(body, &mapping); err != nil {
+				writeProblem(w, r, http.StatusBadRequest, "The mapping must be a JSON object of field names to column names: "+err.Error())
+				return
+			}
+		case "file":
+			s.importCSV(w, r, part, mapping, dedupe)
+			return
+		}
+	}
+}
+
+// importCSV scores and saves the receipts in a CSV file and writes the
+// result for each.
+func (s *server) importCSV(w http.ResponseWriter, r *http.Request, file io.Reader, mapping map[string]string, dedupe bool) {
+	cr := csv.NewReader(file)
+	cr.FieldsPerRecord = -1 // short rows are reported per receipt
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		writeProblem(w, r, http.StatusBadRequest, "The file is empty")
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, bodyErrorStatus(err), "Invalid CSV: "+err.Error())
+		return
+	}
+	cols, err := resolveImportColumns(header, mapping)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var (
+		results []importResult
+		current *importResult
+		receipt points.Receipt
+		key     string
+		invalid string // why the current receipt cannot be imported
+	)
+	flush := func() {
+		if current == nil {
+			return
+		}
+		res := *current
+		current = nil
+		if invalid != "" {
+			res.Error = invalid
+			results = append(results, res)
+			return
+		}
+		if errs := s.validate(receipt); errs != nil {
+			res.Error = "The receipt is invalid."
+			res.Fields = errs
+			results = append(results, res)
+			return
+		}
+		rec, created, err := s.processReceipt(r.Context(), receipt, dedupe)
+		switch {
+		case errors.Is(err, ErrStoreFull):
+			res.Error = "The receipt store is full"
+		case err != nil:
+			log.Printf("Error saving receipt from import rows %d-%d: %v", res.FirstRow, res.LastRow, err)
+			res.Error = "Failed to save receipt"
+		default:
+			res.ID = rec.ID
+			res.Points = &rec.Points
+			res.Status = statusText(rec.Status)
+			res.Duplicate = !created
+		}
+		results = append(results, res)
+	}
+
+	var readErr string
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// Malformed rows are reported on their own; the receipt
+			// around them is cut short.
+			flush()
+			results = append(results, importResult{
+				FirstRow:    parseErr.StartLine,
+				LastRow:     parseErr.Line,
+				batchResult: batchResult{Error: "Invalid CSV: " + parseErr.Err.Error()},
+			})
+			continue
+		}
+		if err != nil {
+			// The rest of the upload is unreadable, but the receipts
+			// before it have been saved, so report them.
+			readErr = "Reading the file failed: " + err.Error()
+			break
+		}
+		line, _ := cr.FieldPos(0)
+		if k := cols.groupKey(row); current == nil || k != key {
+			flush()
+			key, invalid = k, ""
+			current = &importResult{FirstRow: line, Receipt: cols.get(row, "receipt")}
+			receipt = points.Receipt{
+				Retailer:     cols.get(row, "retailer"),
+				PurchaseDate: cols.get(row, "purchaseDate"),
+				PurchaseTime: cols.get(row, "purchaseTime"),
+				Total:        cols.get(row, "total"),
+			}
+		} else if cols.get(row, "retailer") != receipt.Retailer || cols.get(row, "purchaseDate") != receipt.PurchaseDate ||
+			cols.get(row, "purchaseTime") != receipt.PurchaseTime || cols.get(row, "total") != receipt.Total {
+			invalid = fmt.Sprintf("Row %d does not match the receipt's retailer, purchase date, time or total", line)
+		}
+		current.LastRow = line
+		if len(row) != len(header) && invalid == "" {
+			invalid = fmt.Sprintf("Row %d has %d columns, expected %d", line, len(row), len(header))
+		}
+		receipt.Items = append(receipt.Items, points.Item{
+			ShortDescription: cols.get(row, "shortDescription"),
+			Price:            cols.get(row, "price"),
+			Category:         cols.get(row, "category"),
+		})
+	}
+	flush()
+
+	response := struct {
+		Imported   int            `json:"imported"`
+		Duplicates int            `json:"duplicates"`
+		Failed     int            `json:"failed"`
+		Error      string         `json:"error,omitempty"`
+		Results    []importResult `json:"results"`
+	}{Error: readErr, Results: results}
+	if response.Results == nil {
+		response.Results = []importResult{}
+	}
+	for _, res := range results {
+		switch {
+		case res.Error != "":
+			response.Failed++
+		case res.Duplicate:
+			response.Duplicates++
+		default:
+			response.Imported++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ipAccessFile is the JSON file named by IP_ACCESS_FILE. Addresses are
+// CIDR prefixes or single IPs.
+type ipAccessFile struct {
+	// Allow, if not empty, admits only these addresses. Deny refuses these
+	// addresses, whatever the other lists say.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// Paths adds lists for requests under a path prefix, such as
+	// "/admin/". The prefix is matched with and without the /v1 version
+	// prefix; only the longest matching prefix applies.
+	Paths map[string]ipAccessLists `json:"paths"`
+}
+
+type ipAccessLists struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// ipRules are the parsed lists, swapped whole when the file changes.
+type ipRules struct {
+	allow, deny []netip.Prefix
+	// paths are sorted longest prefix first.
+	paths []ipPathRules
+}
+
+type ipPathRules struct {
+	prefix      string
+	allow, deny []netip.Prefix
+}
+
+// parseIPRules parses the contents of an IP access file.
+func parseIPRules(data []byte) (*ipRules, error) {
+	var f ipAccessFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	rules := &ipRules{}
+	var err error
+	if rules.allow, err = parsePrefixes(f.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if rules.deny, err = parsePrefixes(f.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	for prefix, lists := range f.Paths {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("paths: %q must start with /", prefix)
+		}
+		p := ipPathRules{prefix: prefix}
+		if p.allow, err = parsePrefixes(lists.Allow); err != nil {
+			return nil, fmt.Errorf("paths %s allow: %w", prefix, err)
+		}
+		if p.deny, err = parsePrefixes(lists.Deny); err != nil {
+			return nil, fmt.Errorf("paths %s deny: %w", prefix, err)
+		}
+		rules.paths = append(rules.paths, p)
+	}
+	sort.Slice(rules.paths, func(i, j int) bool { return len(rules.paths[i].prefix) > len(rules.paths[j].prefix) })
+	return rules, nil
+}
+
+// parsePrefixes parses CIDR prefixes, taking a single IP as a prefix of
+// its full length.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+func containsAddr(list []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range list {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether addr may request path.
+func (rules *ipRules) allowed(addr netip.Addr, path string) bool {
+	if containsAddr(rules.deny, addr) {
+		return false
+	}
+	if len(rules.allow) > 0 && !containsAddr(rules.allow, addr) {
+		return false
+	}
+	unversioned := path
+	if rest, ok := strings.CutPrefix(path, "/v1/"); ok {
+		unversioned = "/" + rest
+	}
+	for _, p := range rules.paths {
+		if strings.HasPrefix(path, p.prefix) || strings.HasPrefix(unversioned, p.prefix) {
+			if containsAddr(p.deny, addr) {
+				return false
+			}
+			return len(p.allow) == 0 || containsAddr(p.allow, addr)
+		}
+	}
+	return true
+}
+
+// ipFilter applies the lists in an IP access file, reloading it when it
+// changes.
+type ipFilter struct {
+	path  string
+	rules atomic.Pointer[ipRules]
+	// modTime and size identify the version of the file loaded.
+	modTime time.Time
+	size    int64
+}
+
+// newIPFilter loads the file named by IP_ACCESS_FILE. It returns nil when
+// the variable is not set.
+func newIPFilter() (*ipFilter, error) {
+	path := os.Getenv("IP_ACCESS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	f := &ipFilter{path: path}
+	if _, err := f.reload(); err != nil {
+		return nil, fmt.Errorf("IP_ACCESS_FILE: %w", err)
+	}
+	return f, nil
+}
+
+// reload reads the file again if it has changed since it was last loaded,
+// reporting whether it did. On error the lists in use are kept.
+func (f *ipFilter) reload() (bool, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	if f.rules.Load() != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return false, nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	// A file that does not parse is not read again until it changes.
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	rules, err := parseIPRules(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.rules.Store(rules)
+	return true, nil
+}
+
+// watch reloads the file every interval until ctx is done.
+func (f *ipFilter) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := f.reload()
+		if err != nil {
+			slog.Error("Error reloading the IP access lists; keeping the previous ones", "file", f.path, "error", err)
+			continue
+		}
+		if changed {
+			slog.Info("IP access lists reloaded", "file", f.path)
+		}
+	}
+}
+
+// middleware refuses requests from addresses the lists do not allow with
+// 403, before they are authenticated or routed. Health probes are always
+// allowed, and so are requests over a Unix socket, whose file permissions
+// decide who may connect.
+func (f *ipFilter) middleware(next http.Handler) http.Handler {
+	if f == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isProbe(r) || unixSocketFrom(r.Context()) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// A client whose address a trusted proxy did not know is refused.
+		addr, ok := clientAddrFrom(r.Context())
+		if !ok || !f.rules.Load().allowed(addr, r.URL.Path) {
+			ipDenied.Add(1)
+			writeProblem(w, r, http.StatusForbidden, "Requests from your address are not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
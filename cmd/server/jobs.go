@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"fetch_assessment/points"
+)
+
+// Job states.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// errQueueFull is returned by jobQueue.submit when no more jobs fit.
+var errQueueFull = errors.New("job queue is full")
+
+// job is a receipt submitted with ?async=true. The exported fields are the
+// body of GET /jobs/{id}; they are guarded by the queue's mutex.
+type job struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Set once the job is done.
+	ReceiptID     string `json:"receiptId,omitempty"`
+	Points        *int   `json:"points,omitempty"`
+	ReceiptStatus string `json:"receiptStatus,omitempty"`
+	Duplicate     bool   `json:"duplicate,omitempty"`
+	// Set if the job failed.
+	Error string `json:"error,omitempty"`
+
+	caller  string          // callerScope of the submitter
+	ctx     context.Context // the submitting request's values, without its deadline
+	receipt points.Receipt
+	dedupe  bool
+}
+
+// jobQueue runs receipt jobs on a pool of workers. Jobs live in process
+// memory: they are lost on restart and each replica only knows its own.
+// Finished jobs are kept for ttl.
+type jobQueue struct {
+	ttl     time.Duration
+	pending chan *job
+
+	mu        sync.Mutex
+	jobs      map[string]*job
+	lastSweep time.Time
+	stopped   bool
+
+	workers sync.WaitGroup
+}
+
+func newJobQueue(size int, ttl time.Duration) *jobQueue {
+	return &jobQueue{
+		ttl:       ttl,
+		pending:   make(chan *job, size),
+		jobs:      make(map[string]*job),
+		lastSweep: time.Now(),
+	}
+}
+
+// submit queues receipt for processing on behalf of the request's caller.
+func (q *jobQueue) submit(ctx context.Context, receipt points.Receipt, dedupe bool) (*job, error) {
+	now := time.Now().UTC()
+	j := &job{
+		ID:        uuid.New().String(),
+		Status:    jobQueued,
+		CreatedAt: now,
+		caller:    callerScope(ctx),
+		ctx:       context.WithoutCancel(ctx),
+		receipt:   receipt,
+		dedupe:    dedupe,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now.Sub(q.lastSweep) > time.Minute {
+		for id, old := range q.jobs {
+			if old.FinishedAt != nil && now.Sub(*old.FinishedAt) > q.ttl {
+				delete(q.jobs, id)
+			}
+		}
+		q.lastSweep = now
+	}
+	if q.stopped {
+		// The process is draining; the client retries against the one
+		// taking over.
+		return nil, errQueueFull
+	}
+	select {
+	case q.pending <- j:
+	default:
+		return nil, errQueueFull
+	}
+	q.jobs[j.ID] = j
+	return j, nil
+}
+
+// get returns a copy of job id if caller submitted it.
+func (q *jobQueue) get(id, caller string) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok || j.caller != caller {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// startWorkers starts n workers that process queued jobs with s.
+func (q *jobQueue) startWorkers(s *server, n int) {
+	for range n {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for j := range q.pending {
+				q.run(s, j)
+			}
+		}()
+	}
+}
+
+// stop takes no more jobs and waits until the queued ones are processed,
+// or ctx is done.
+func (q *jobQueue) stop(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.pending)
+	}
+	q.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *jobQueue) run(s *server, j *job) {
+	q.mu.Lock()
+	j.Status = jobRunning
+	q.mu.Unlock()
+
+	rec, created, err := s.processReceipt(j.ctx, j.receipt, j.dedupe)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now().UTC()
+	j.FinishedAt = &now
+	switch {
+	case errors.Is(err, ErrStoreFull):
+		j.Status, j.Error = jobFailed, "The receipt store is full"
+	case err != nil:
+		log.Printf("Error processing job %s: %v", j.ID, err)
+		j.Status, j.Error = jobFailed, "Failed to save receipt"
+	default:
+		j.Status = jobDone
+		j.ReceiptID, j.Points = rec.ID, &rec.Points
+		j.ReceiptStatus, j.Duplicate = statusText(rec.Status), !created
+	}
+}
+
+// processAsync queues a validated receipt and answers 202 Accepted with
+// the job, or 503 if the queue is full.
+func (s *server) processAsync(w http.ResponseWriter, r *http.Request, receipt points.Receipt, dedupe bool) {
+	j, err := s.jobs.submit(r.Context(), receipt, dedupe)
+	if errors.Is(err, errQueueFull) {
+		w.Header().Set("Retry-After", "5")
+		writeProblem(w, r, http.StatusServiceUnavailable, "The job queue is full; try again later")
+		return
+	}
+	snapshot, _ := s.jobs.get(j.ID, j.caller)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// getJobHandler handles GET /jobs/{id}
+func (s *server) getJobHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := s.jobs.get(r.PathValue("id"), callerScope(r.Context()))
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, "Job ID not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Ledger entry types.
+const (
+	ledgerEarn   = "earn"   // points awarded for an accepted receipt
+	ledgerAdjust = "adjust" // a correction: a re-scored receipt or an admin adjustment
+	ledgerRedeem = "redeem" // points spent
+	ledgerExpire = "expire" // earned points that lapsed
+	ledgerBonus  = "bonus"  // points awarded for an achievement
+)
+
+// spends reports whether e may only be recorded if the balance covers it.
+// Adjustments can take a balance below zero; redemptions and expiries
+// cannot.
+func (e LedgerEntry) spends() bool {
+	return e.Type == ledgerRedeem || e.Type == ledgerExpire
+}
+
+// earnedFromReceipt reports whether e is points a receipt earned: when it
+// was accepted, or when it was re-scored.
+func (e LedgerEntry) earnedFromReceipt() bool {
+	return e.Type == ledgerEarn || (e.Type == ledgerAdjust && e.ReceiptID != "")
+}
+
+// maxReasonLen caps the reason given for an admin adjustment.
+const maxReasonLen = 500
+
+// record adds an entry to user's ledger.
+func (s *server) record(ctx context.Context, user, typ string, points int, receiptID, reason string) (LedgerEntry, error) {
+	return s.store.AddLedgerEntry(ctx, LedgerEntry{
+		ID:        uuid.New().String(),
+		UserID:    user,
+		Type:      typ,
+		Points:    points,
+		ReceiptID: receiptID,
+		Reason:    reason,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// credit records the points rec earned in its user's ledger. Receipts
+// submitted for nobody in particular, or not accepted, earn nothing.
+func (s *server) credit(ctx context.Context, rec StoredReceipt, reason string) {
+	if rec.UserID == "" || rec.Points == 0 || !rec.accepted() {
+		return
+	}
+	if _, err := s.record(ctx, rec.UserID, ledgerEarn, rec.Points, rec.ID, reason); err != nil {
+		log.Printf("Error crediting points for receipt %s: %v", rec.ID, err)
+		return
+	}
+	s.awardAchievements(ctx, rec.UserID)
+	s.rewardReferral(ctx, rec.UserID)
+}
+
+// rescored records the difference when an accepted receipt's points
+// change from old to rec.Points.
+func (s *server) rescored(ctx context.Context, rec StoredReceipt, old int) {
+	if rec.UserID == "" || rec.Points == old {
+		return
+	}
+	reason := "Receipt re-scored with rules " + rec.RulesVersion
+	if _, err := s.record(ctx, rec.UserID, ledgerAdjust, rec.Points-old, rec.ID, reason); err != nil {
+		log.Printf("Error adjusting points for receipt %s: %v", rec.ID, err)
+		return
+	}
+	s.awardAchievements(ctx, rec.UserID)
+}
+
+// balanceHandler handles GET /users/{id}/balance
+func (s *server) balanceHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	balance, err := s.store.Balance(r.Context(), user)
+	if err != nil {
+		log.Printf("Error loading balance: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load balance")
+		return
+	}
+
+	response := struct {
+		UserID string `json:"userId"`
+		Points int    `json:"points"`
+	}{user, balance}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseLedgerRange reads the from and to query parameters: RFC 3339
+// timestamps, or dates, which cover the whole day. Zero times are unbounded.
+func parseLedgerRange(q url.Values) (from, to time.Time, err error) {
+	parse := func(name string, endOfDay bool) (time.Time, error) {
+		v := q.Get(name)
+		if v == "" {
+			return time.Time{}, nil
+		}
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, nil
+		}
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s %q, expected YYYY-MM-DD or an RFC 3339 timestamp", name, v)
+		}
+		if endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+	if from, err = parse("from", false); err != nil {
+		return
+	}
+	if to, err = parse("to", true); err != nil {
+		return
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		err = fmt.Errorf("to is before from")
+	}
+	return
+}
+
+// ledgerHandler handles GET /users/{id}/ledger
+func (s *server) ledgerHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	from, to, err := parseLedgerRange(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	all, err := s.store.Ledger(r.Context(), user)
+	if err != nil {
+		log.Printf("Error loading ledger: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load ledger")
+		return
+	}
+	entries := make([]LedgerEntry, 0, len(all))
+	for _, e := range all {
+		if (from.IsZero() || !e.CreatedAt.Before(from)) && (to.IsZero() || !e.CreatedAt.After(to)) {
+			entries = append(entries, e)
+		}
+	}
+
+	response := map[string][]LedgerEntry{"entries": entries}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// redeemHandler handles POST /users/{id}/redeem
+func (s *server) redeemHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	var req struct {
+		Points int    `json:"points"`
+		Reason string `json:"reason"`
+	}
+	if status, err := decodeJSONBody(r, &req); err != nil {
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	defer r.Body.Close()
+	req.Reason = strings.TrimSpace(req.Reason)
+	switch {
+	case req.Points <= 0:
+		writeProblem(w, r, http.StatusBadRequest, "points must be a positive integer")
+		return
+	case len(req.Reason) > maxReasonLen:
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("reason must be at most %d characters", maxReasonLen))
+		return
+	case req.Reason == "":
+		req.Reason = "Points redeemed"
+	}
+
+	e, err := s.record(r.Context(), user, ledgerRedeem, -req.Points, "", req.Reason)
+	switch {
+	case errors.Is(err, ErrInsufficientPoints):
+		writeProblem(w, r, http.StatusConflict, "Insufficient points balance")
+		return
+	case err != nil:
+		log.Printf("Error redeeming points for %s: %v", user, err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to redeem points")
+		return
+	}
+	s.publish(newPointsEvent(r.Context(), eventPointsRedeemed, e))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(e)
+}
+
+// adjustPointsHandler handles POST /admin/users/{id}/adjustments
+func (s *server) adjustPointsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	var req struct {
+		Points int    `json:"points"`
+		Reason string `json:"reason"`
+	}
+	if status, err := decodeJSONBody(r, &req); err != nil {
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	defer r.Body.Close()
+	req.Reason = strings.TrimSpace(req.Reason)
+	switch {
+	case req.Points == 0:
+		writeProblem(w, r, http.StatusBadRequest, "points must be a non-zero integer")
+		return
+	case req.Reason == "" || len(req.Reason) > maxReasonLen:
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("reason is required and must be at most %d characters", maxReasonLen))
+		return
+	}
+
+	e, err := s.record(r.Context(), user, ledgerAdjust, req.Points, "", req.Reason)
+	if err != nil {
+		log.Printf("Error adjusting points for %s: %v", user, err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to adjust points")
+		return
+	}
+
+	caller, _ := identityFrom(r.Context())
+	slog.Info("Points adjusted",
+		"audit", true,
+		"api_key", caller.APIKey,
+		"subject", caller.Subject,
+		"user_id", user,
+		"points", req.Points,
+		"reason", req.Reason)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(e)
+}
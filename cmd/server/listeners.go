@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// listenerSpec describes a listener: the main one given with -addr, or an
+// additional one given with -listen for clients such as sidecars that
+// reach the service without going through TLS.
+type listenerSpec struct {
+	// Network is "tcp", or "unix" for a Unix domain socket at Addr.
+	Network string
+	Addr    string
+	// HTTP2 accepts cleartext HTTP/2 (h2c) besides HTTP/1.1.
+	HTTP2 bool
+	// Mode and Group, if set, are given to a Unix socket once it is
+	// created.
+	Mode  os.FileMode
+	Group string
+}
+
+// listenFlag collects the -listen flags.
+type listenFlag []listenerSpec
+
+func (l *listenFlag) String() string {
+	var addrs []string
+	for _, spec := range *l {
+		addrs = append(addrs, spec.Addr)
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (l *listenFlag) Set(v string) error {
+	spec, err := parseListenerSpec(v, true)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, spec)
+	return nil
+}
+
+// parseListenerSpec parses "[tcp://]host:port[?http2=on|off]" or
+// "unix:///path/to.sock[?mode=0660&group=name][&http2=on|off]". The http2
+// option is only allowed when withHTTP2 is set; the main listener takes
+// -http2 instead.
+func parseListenerSpec(v string, withHTTP2 bool) (listenerSpec, error) {
+	addr, query, _ := strings.Cut(v, "?")
+	spec := listenerSpec{Network: "tcp", Addr: strings.TrimPrefix(addr, "tcp://")}
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if path == "" {
+			return spec, fmt.Errorf("invalid listen address %q: no socket path", v)
+		}
+		spec.Network, spec.Addr = "unix", path
+	} else if _, _, err := net.SplitHostPort(spec.Addr); err != nil {
+		return spec, fmt.Errorf("invalid listen address %q: %v", v, err)
+	}
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		return spec, fmt.Errorf("invalid listen options in %q: %v", v, err)
+	}
+	for name, values := range opts {
+		value := values[len(values)-1]
+		switch {
+		case name == "http2" && withHTTP2:
+			if spec.HTTP2, err = parseHTTP2Mode(value); err != nil {
+				return spec, fmt.Errorf("%s: %v", v, err)
+			}
+		case name == "mode" && spec.Network == "unix":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 0o777 {
+				return spec, fmt.Errorf("%s: mode must be octal permissions such as 0660, got %q", v, value)
+			}
+			spec.Mode = os.FileMode(mode)
+		case name == "group" && spec.Network == "unix":
+			spec.Group = value
+		default:
+			return spec, fmt.Errorf("%s: unknown listen option %q", v, name)
+		}
+	}
+	return spec, nil
+}
+
+// listenOn opens the listener spec describes.
+func listenOn(spec listenerSpec) (net.Listener, error) {
+	if spec.Network != "unix" {
+		return listen(spec.Addr)
+	}
+	if err := removeStaleSocket(spec.Addr); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", spec.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s: %w", spec.Addr, err)
+	}
+	if spec.Group != "" {
+		gid, err := lookupGroup(spec.Group)
+		if err == nil {
+			err = os.Chown(spec.Addr, -1, gid)
+		}
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("socket %s group: %w", spec.Addr, err)
+		}
+	}
+	if spec.Mode != 0 {
+		if err := os.Chmod(spec.Addr, spec.Mode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("socket %s mode: %w", spec.Addr, err)
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes a socket left at path by a process that has
+// exited, so that it can be listened on again. A socket something still
+// listens on, or a file that is not a socket, is an error.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("cannot listen on %s: file exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("cannot listen on %s: socket in use (is another instance running?)", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("cannot listen on %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
+
+// lookupGroup returns the ID of a group given by name or number.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// markUnixSocket records in the context of connections accepted on a Unix
+// socket the socket's path; see unixSocketFrom.
+func markUnixSocket(ctx context.Context, c net.Conn) context.Context {
+	if addr := c.LocalAddr(); addr.Network() == "unix" {
+		ctx = context.WithValue(ctx, unixSocketKey, addr.String())
+	}
+	return ctx
+}
+
+// unixSocketFrom returns the path of the Unix socket a request arrived on,
+// or "" if it came over TCP.
+func unixSocketFrom(ctx context.Context) string {
+	path, _ := ctx.Value(unixSocketKey).(string)
+	return path
+}
+
+func parseHTTP2Mode(v string) (bool, error) {
+	switch v {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf(`http2 must be "on" or "off", got %q`, v)
+}
+
+// configureHTTP2 enables or disables HTTP/2 on srv before it serves. Over
+// TLS, HTTP/2 is negotiated with ALPN, which net/http does by default; in
+// cleartext it is h2c, taken both with prior knowledge and as an upgrade
+// from HTTP/1.1.
+func configureHTTP2(srv *http.Server, enabled, overTLS bool) {
+	if !enabled {
+		// A non-nil, empty map stops net/http from adding HTTP/2.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		if srv.TLSConfig != nil {
+			srv.TLSConfig.NextProtos = slices.DeleteFunc(srv.TLSConfig.NextProtos, func(p string) bool { return p == "h2" })
+		}
+		return
+	}
+	if !overTLS {
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{IdleTimeout: srv.IdleTimeout})
+	}
+}
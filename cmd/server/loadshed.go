@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// shedPaths are the endpoints protected by load shedding.
+var shedPaths = map[string]bool{
+	"/receipts/process": true, "/v1/receipts/process": true,
+}
+
+// loadShedConfig configures the adaptive concurrency limit on shedPaths.
+type loadShedConfig struct {
+	Enabled bool
+	// The limit moves between MinConcurrency and MaxConcurrency, growing
+	// while requests finish within TargetLatency and shrinking when they
+	// take longer.
+	MinConcurrency int
+	MaxConcurrency int
+	TargetLatency  time.Duration
+	// QueueSize requests may wait up to QueueTimeout for a slot; others
+	// are refused at once.
+	QueueSize    int
+	QueueTimeout time.Duration
+}
+
+// loadShedConfigFromEnv reads LOAD_SHEDDING and the LOAD_SHED_* settings.
+func loadShedConfigFromEnv() (loadShedConfig, error) {
+	var (
+		cfg loadShedConfig
+		err error
+	)
+	if cfg.Enabled, err = envBool("LOAD_SHEDDING", false); err != nil {
+		return cfg, err
+	}
+	if cfg.MinConcurrency, err = envInt("LOAD_SHED_MIN_CONCURRENCY", 4); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxConcurrency, err = envInt("LOAD_SHED_MAX_CONCURRENCY", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.TargetLatency, err = envDuration("LOAD_SHED_TARGET_LATENCY", 250*time.Millisecond); err != nil {
+		return cfg, err
+	}
+	if cfg.QueueSize, err = envInt("LOAD_SHED_QUEUE_SIZE", 50); err != nil {
+		return cfg, err
+	}
+	if cfg.QueueTimeout, err = envDuration("LOAD_SHED_QUEUE_TIMEOUT", time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.MinConcurrency <= 0 || cfg.MaxConcurrency < cfg.MinConcurrency {
+		return cfg, errors.New("LOAD_SHED_MIN_CONCURRENCY must be positive and at most LOAD_SHED_MAX_CONCURRENCY")
+	}
+	if cfg.TargetLatency <= 0 || cfg.QueueSize < 0 || cfg.QueueTimeout < 0 {
+		return cfg, errors.New("LOAD_SHED_TARGET_LATENCY must be positive, and LOAD_SHED_QUEUE_SIZE and LOAD_SHED_QUEUE_TIMEOUT not negative")
+	}
+	return cfg, nil
+}
+
+// loadShedder caps how many requests run at once. The cap adapts to the
+// latency the requests see (additive increase, multiplicative decrease),
+// so that under overload excess requests are refused quickly instead of
+// all slowing down together and piling up in memory.
+type loadShedder struct {
+	cfg loadShedConfig
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	// waiting are the queued requests, oldest first; a slot is handed over
+	// by closing the channel.
+	waiting      []chan struct{}
+	lastDecrease time.Time
+}
+
+// newLoadShedder returns nil when load shedding is disabled.
+func newLoadShedder(cfg loadShedConfig) *loadShedder {
+	if !cfg.Enabled {
+		return nil
+	}
+	ls := &loadShedder{cfg: cfg, limit: float64(cfg.MaxConcurrency)}
+	loadShedLimit.Set(int64(cfg.MaxConcurrency))
+	return ls
+}
+
+// acquire takes a slot, waiting in the queue if there is room in it. It
+// reports false if the request should be refused.
+func (ls *loadShedder) acquire(r *http.Request) bool {
+	ls.mu.Lock()
+	if ls.inFlight < int(ls.limit) && len(ls.waiting) == 0 {
+		ls.inFlight++
+		ls.mu.Unlock()
+		return true
+	}
+	if len(ls.waiting) >= ls.cfg.QueueSize || ls.cfg.QueueTimeout == 0 {
+		ls.mu.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	ls.waiting = append(ls.waiting, ready)
+	ls.mu.Unlock()
+
+	timer := time.NewTimer(ls.cfg.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for i, ch := range ls.waiting {
+		if ch == ready {
+			ls.waiting = append(ls.waiting[:i], ls.waiting[i+1:]...)
+			return false
+		}
+	}
+	// The slot was handed over as the wait ended; give it back.
+	ls.releaseLocked()
+	return false
+}
+
+// release frees a slot taken by acquire and adjusts the limit by how long
+// the request took.
+func (ls *loadShedder) release(latency time.Duration) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	now := time.Now()
+	if latency <= ls.cfg.TargetLatency {
+		ls.limit = math.Min(ls.limit+1/ls.limit, float64(ls.cfg.MaxConcurrency))
+	} else if now.Sub(ls.lastDecrease) >= ls.cfg.TargetLatency {
+		// Requests that were slow together count once, so that the limit
+		// does not collapse after a single stall.
+		ls.limit = math.Max(ls.limit*0.9, float64(ls.cfg.MinConcurrency))
+		ls.lastDecrease = now
+	}
+	loadShedLimit.Set(int64(ls.limit))
+	ls.releaseLocked()
+}
+
+// releaseLocked frees a slot, handing it to queued requests while the
+// limit allows. ls.mu must be held.
+func (ls *loadShedder) releaseLocked() {
+	ls.inFlight--
+	for len(ls.waiting) > 0 && ls.inFlight < int(ls.limit) {
+		close(ls.waiting[0])
+		ls.waiting = ls.waiting[1:]
+		ls.inFlight++
+	}
+}
+
+// middleware refuses requests to shedPaths with 503 and a Retry-After
+// header when the process is at its concurrency limit and the queue is
+// full, or a queued request waits too long.
+func (ls *loadShedder) middleware(next http.Handler) http.Handler {
+	if ls == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !shedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !ls.acquire(r) {
+			requestsShed.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(ls.retryAfter()))
+			writeProblem(w, r, http.StatusServiceUnavailable, "The server is overloaded; retry later")
+			return
+		}
+		start := time.Now()
+		defer func() { ls.release(time.Since(start)) }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// retryAfter estimates in seconds how long the queue takes to clear.
+func (ls *loadShedder) retryAfter() int {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	wait := time.Duration(float64(len(ls.waiting)+1) / ls.limit * float64(ls.cfg.TargetLatency))
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,970 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"fetch_assessment/points"
+)
+
+// server holds the dependencies shared by the HTTP handlers.
+type server struct {
+	store ReceiptStore
+	// rules scores incoming receipts. It can be replaced at runtime through
+	// the admin API, so load it once per operation.
+	rules atomic.Pointer[points.Engine]
+	// rulesMu serialises admin changes to rules.
+	rulesMu sync.Mutex
+	// keyRules maps API key names to rule sets of their own, used instead
+	// of rules for callers with those keys (see rulesFor).
+	// Both are replaced when the configuration is reloaded.
+	keyRules atomic.Pointer[map[string]*points.Engine]
+	// shadowRules, if set, also scores every new receipt; its results are
+	// only logged and counted (see shadowScore).
+	shadowRules atomic.Pointer[points.Engine]
+	// canary, if set, scores a share of the receipts that would use rules
+	// with a candidate rule set (see withCanary).
+	canary atomic.Pointer[canaryRules]
+	// legacySunset, if set, is advertised in the Sunset header on the
+	// unversioned API paths.
+	legacySunset time.Time
+	// idempotency replays responses for repeated Idempotency-Keys; nil
+	// disables the header.
+	idempotency *idempotencyCache
+	// reconcile checks receipt totals against their items.
+	reconcile reconcileConfig
+	// fraud scores new receipts for signs of fraud.
+	fraud *fraudDetector
+	// reviewMinScore is the fraud score from which new receipts need
+	// review; zero disables reviews.
+	reviewMinScore int
+	// jobs processes receipts submitted with ?async=true.
+	jobs *jobQueue
+	// webhooks delivers receipt events to registered URLs.
+	webhooks *webhookDispatcher
+	// stream pushes receipt.processed events to GET /events/stream.
+	stream *eventStream
+	// sockets tracks WebSocket clients for pushing re-scored receipts.
+	sockets *wsHub
+	// maxBodyBytes caps request bodies and WebSocket messages.
+	maxBodyBytes int64
+	// events, if set, publishes receipt.processed events to a message
+	// broker.
+	events eventPublisher
+	// outbox, if set, is the store itself: events bound for the broker
+	// are saved with their receipt and relayed by runOutboxRelay.
+	outbox outboxStore
+	// pointsExpireAfter is how long earned points last; zero means forever.
+	pointsExpireAfter time.Duration
+	// achievementBonuses maps achievement IDs to the points they award.
+	achievementBonuses map[string]int
+	// referrals sets the referral bonuses and limits.
+	referrals referralConfig
+	// analytics aggregates points for GET /analytics/points.
+	analytics *analytics
+	// backups, if set, is the bucket POST /admin/backup uploads to and
+	// POST /admin/restore downloads from.
+	backups *backupBucket
+	// audit records every change made through the API.
+	audit auditLog
+	// pointsMaxAge is how long clients may reuse receipt and points
+	// responses without asking again; zero makes them revalidate.
+	pointsMaxAge time.Duration
+	// reloader applies configuration changes on POST /admin/reload.
+	reloader *reloader
+}
+
+// receiptHash returns the hex SHA-256 of the receipt's canonical JSON
+// encoding, so the same receipt hashes identically however the client
+// formatted or ordered its fields.
+func receiptHash(r points.Receipt) string {
+	body, _ := json.Marshal(r)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// processReceipt computes the points for receipt, assigns it a new ID and
+// saves it to the store. If dedupe is set and the caller already submitted
+// an identical receipt, that receipt is returned instead and created is
+// false.
+func (s *server) processReceipt(ctx context.Context, receipt points.Receipt, dedupe bool) (rec StoredReceipt, created bool, err error) {
+	var owner string
+	if id, ok := identityFrom(ctx); ok {
+		owner = id.Subject
+		// Service callers otherwise share the empty owner; a key with its
+		// own rules gets its own, so it is never handed a receipt that was
+		// scored under someone else's rules.
+		if _, ok := s.keyRulesFor(id.APIKey); ok {
+			owner = "apikey:" + id.APIKey
+		}
+	}
+	user := userFrom(ctx)
+	hash := receiptHash(receipt)
+	if user != "" && user != owner {
+		hash = userReceiptHash(user, hash)
+	}
+	if dedupe {
+		existing, err := s.store.FindByHash(ctx, owner, hash)
+		if err == nil {
+			return existing, false, nil
+		}
+		if !errors.Is(err, ErrReceiptNotFound) {
+			return StoredReceipt{}, false, err
+		}
+	}
+
+	rules := s.withCanary(s.rulesFor(ctx), hash, user)
+	var tier string
+	if user != "" {
+		standing, err := s.tierStanding(ctx, rules, user)
+		if err != nil {
+			return StoredReceipt{}, false, err
+		}
+		tier = standing.Tier.Name
+	}
+	total, _, err := rules.CalculateForTier(receipt, tier)
+	if err != nil {
+		return StoredReceipt{}, false, err
+	}
+	id, now := uuid.New().String(), time.Now().UTC()
+	flags := append(s.receiptFlags(receipt), s.fraud.assess(rules, id, receipt, now)...)
+	rec = StoredReceipt{
+		ID:           id,
+		Receipt:      receipt,
+		Points:       total,
+		ProcessedAt:  now,
+		Owner:        owner,
+		UserID:       user,
+		Tier:         tier,
+		ContentHash:  hash,
+		RulesVersion: rules.Version(),
+		Flags:        flags,
+		FraudScore:   fraudScore(flags),
+		Dedupe:       dedupe,
+	}
+	// Receipts held for review earn nothing until they are approved.
+	if rec.Status = s.initialStatus(rec.FraudScore); rec.Status != statusAccepted {
+		rec.Points, rec.RulesVersion = 0, ""
+	}
+	ev := newReceiptEvent(ctx, eventReceiptProcessed, rec)
+	if err := s.save(ctx, rec, ev); err != nil {
+		s.fraud.forget(rules, id, receipt)
+		// An identical receipt was saved since FindByHash above.
+		if errors.Is(err, ErrDuplicateReceipt) {
+			if existing, err := s.store.FindByHash(ctx, owner, hash); err == nil {
+				return existing, false, nil
+			}
+		}
+		return StoredReceipt{}, false, err
+	}
+	if rec.FraudScore > 0 {
+		receiptsSuspicious.Add(1)
+	}
+	if c := s.canary.Load(); c != nil && rules == c.engine {
+		canaryScored.Add(1)
+	}
+	s.analytics.add(rec, 1, rec.Points)
+	s.credit(ctx, rec, "Receipt accepted")
+	s.publish(ev)
+	// Shadow rules are a candidate for the default rules, so receipts
+	// scored with an API key's own rules or the canary rules, or not
+	// scored yet, are not compared.
+	if rules == s.rules.Load() && rec.Status == statusAccepted {
+		s.shadowScore(rec)
+	}
+	return rec, true, nil
+}
+
+// boolParam reads a boolean query parameter, returning def when it is absent.
+func boolParam(r *http.Request, name string, def bool) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value %q, expected true or false", name, v)
+	}
+	return b, nil
+}
+
+// processReceiptHandler handles POST /receipts/process
+func (s *server) processReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	dedupe, err := boolParam(r, "dedupe", true)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	async, err := boolParam(r, "async", false)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Decode the JSON request into a Receipt struct.
+	var receipt points.Receipt
+	if status, err := decodeJSONBody(r, &receipt); err != nil {
+		if errs := decodeFieldErrors(err); errs != nil {
+			writeInvalidReceipt(w, r, errs)
+			return
+		}
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	// Reject receipts that do not match the schema, listing every bad field.
+	if errs := s.validate(receipt); errs != nil {
+		writeInvalidReceipt(w, r, errs)
+		return
+	}
+
+	// Slow scoring can be left to the job workers.
+	if async {
+		s.processAsync(w, r, receipt, dedupe)
+		return
+	}
+
+	// Score and save the receipt, or find the copy submitted earlier.
+	rec, created, err := s.processReceipt(r.Context(), receipt, dedupe)
+	if errors.Is(err, ErrStoreFull) {
+		writeProblem(w, r, http.StatusInsufficientStorage, "The receipt store is full; try again later")
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving receipt: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to save receipt")
+		return
+	}
+
+	// Return the ID and status as JSON: 201 for a new receipt, 200 for a
+	// duplicate.
+	setLogReceiptID(r.Context(), rec.ID)
+	response := map[string]string{"id": rec.ID, "status": statusText(rec.Status)}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// scoreReceiptHandler handles POST /receipts/score
+func (s *server) scoreReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	var receipt points.Receipt
+	if status, err := decodeJSONBody(r, &receipt); err != nil {
+		if errs := decodeFieldErrors(err); errs != nil {
+			writeInvalidReceipt(w, r, errs)
+			return
+		}
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if errs := s.validate(receipt); errs != nil {
+		writeInvalidReceipt(w, r, errs)
+		return
+	}
+
+	// Score without saving: nothing is stored and no ID is issued.
+	response, err := score(s.rulesFor(r.Context()), receipt)
+	if err != nil {
+		log.Printf("Error scoring receipt: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to score receipt")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// batchResult is the outcome for one receipt in a batch request: either an
+// ID and points, or an error describing why the receipt was not processed.
+// Duplicate is set when the ID belongs to an earlier identical receipt.
+type batchResult struct {
+	ID        string       `json:"id,omitempty"`
+	Points    *int         `json:"points,omitempty"`
+	Status    string       `json:"status,omitempty"`
+	Duplicate bool         `json:"duplicate,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	Fields    []fieldError `json:"fields,omitempty"`
+}
+
+// processBatchHandler handles POST /receipts/process/batch
+func (s *server) processBatchHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	dedupe, err := boolParam(r, "dedupe", true)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Decode each element separately so one malformed receipt does not
+	// reject the whole batch.
+	var raw []json.RawMessage
+	if status, err := decodeJSONBody(r, &raw); err != nil {
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+
+	results := make([]batchResult, len(raw))
+	for i, msg := range raw {
+		var receipt points.Receipt
+		if err := decodeStrict(msg, &receipt); err != nil {
+			results[i].Error = "Invalid receipt JSON: " + err.Error()
+			results[i].Fields = decodeFieldErrors(err)
+			continue
+		}
+		if errs := s.validate(receipt); errs != nil {
+			results[i].Error = "The receipt is invalid."
+			results[i].Fields = errs
+			continue
+		}
+		rec, created, err := s.processReceipt(r.Context(), receipt, dedupe)
+		if errors.Is(err, ErrStoreFull) {
+			results[i].Error = "The receipt store is full"
+			continue
+		}
+		if err != nil {
+			log.Printf("Error saving receipt %d of batch: %v", i, err)
+			results[i].Error = "Failed to save receipt"
+			continue
+		}
+		results[i].ID = rec.ID
+		results[i].Points = &rec.Points
+		results[i].Status = statusText(rec.Status)
+		results[i].Duplicate = !created
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// loadReceipt fetches receipt id for the caller, writing a 404 (also used
+// when the caller may not see it) or 500 response and returning false on
+// failure.
+func (s *server) loadReceipt(w http.ResponseWriter, r *http.Request, id string) (StoredReceipt, bool) {
+	rec, err := s.store.GetReceipt(r.Context(), id)
+	if errors.Is(err, ErrReceiptNotFound) || (err == nil && !canAccess(r.Context(), rec)) {
+		writeProblem(w, r, http.StatusNotFound, "Receipt ID not found")
+		return StoredReceipt{}, false
+	}
+	if err != nil {
+		log.Printf("Error loading receipt: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load receipt")
+		return StoredReceipt{}, false
+	}
+	return rec, true
+}
+
+// pointsResponse is the body of GET /receipts/{id}/points.
+type pointsResponse struct {
+	Points int `json:"points"`
+	// RulesVersion is empty for receipts scored before versions were recorded.
+	RulesVersion string `json:"rulesVersion,omitempty"`
+}
+
+// getPointsHandler handles GET /receipts/{id}/points
+func (s *server) getPointsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	setLogReceiptID(r.Context(), id)
+
+	// Users may only read their own receipts, which needs the full record;
+	// other callers take the cheaper points lookup.
+	if userFrom(r.Context()) != "" {
+		rec, ok := s.loadReceipt(w, r, id)
+		if !ok {
+			return
+		}
+		s.setCacheControl(w)
+		writeJSONWithETag(w, r, pointsResponse{rec.Points, rec.RulesVersion})
+		return
+	}
+
+	// Look up the receipt in the store, on a replica that has caught up
+	// with the caller's session token if there are replicas.
+	ctx, err := readAfter(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid "+sessionTokenHeader+" header")
+		return
+	}
+	points, version, err := s.store.GetPoints(ctx, id)
+	if errors.Is(err, ErrReceiptNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "Receipt ID not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading points: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load points")
+		return
+	}
+
+	// Return points as JSON, tagged so that polling clients can ask only
+	// for changes.
+	s.setCacheControl(w)
+	writeJSONWithETag(w, r, pointsResponse{points, version})
+}
+
+// getBreakdownHandler handles GET /receipts/{id}/points/breakdown
+func (s *server) getBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	setLogReceiptID(r.Context(), id)
+
+	rec, ok := s.loadReceipt(w, r, id)
+	if !ok {
+		return
+	}
+
+	// Re-run the rules against the stored receipt to explain its score. If
+	// the rules have changed since it was scored, the breakdown reflects the
+	// current rules and says so.
+	rules := s.withCanary(s.rulesFor(r.Context()), rec.ContentHash, rec.UserID)
+	_, breakdown, err := rules.CalculateForTier(rec.Receipt, rec.Tier)
+	if err != nil {
+		log.Printf("Error scoring stored receipt %s: %v", id, err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to compute breakdown")
+		return
+	}
+	response := struct {
+		ID                    string           `json:"id"`
+		Points                int              `json:"points"`
+		RulesVersion          string           `json:"rulesVersion,omitempty"`
+		Breakdown             points.Breakdown `json:"breakdown"`
+		BreakdownRulesVersion string           `json:"breakdownRulesVersion"`
+	}{rec.ID, rec.Points, rec.RulesVersion, breakdown, rules.Version()}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getReceiptHandler handles GET /receipts/{id}
+func (s *server) getReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	setLogReceiptID(r.Context(), id)
+
+	rec, ok := s.loadReceipt(w, r, id)
+	if !ok {
+		return
+	}
+
+	// Return the receipt as submitted together with its points and timestamp.
+	s.setCacheControl(w)
+	writeJSONWithETag(w, r, rec)
+}
+
+// deleteReceiptHandler handles DELETE /receipts/{id}
+func (s *server) deleteReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	setLogReceiptID(r.Context(), id)
+
+	if userFrom(r.Context()) != "" {
+		if _, ok := s.loadReceipt(w, r, id); !ok {
+			return
+		}
+	}
+
+	err := s.store.Delete(r.Context(), id)
+	if errors.Is(err, ErrReceiptNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "Receipt ID not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting receipt: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to delete receipt")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// receiptFilter narrows a receipt listing. Zero values match everything.
+type receiptFilter struct {
+	Retailer string    // case-insensitive exact match on the canonical retailer name
+	From, To time.Time // inclusive bounds on the purchase date
+
+	// rules resolves retailer aliases.
+	rules *points.Engine
+}
+
+// parseReceiptFilter reads ?retailer=, ?from= and ?to= (dates as YYYY-MM-DD).
+// Retailers are compared by their canonical names under rules.
+func parseReceiptFilter(q url.Values, rules *points.Engine) (receiptFilter, error) {
+	f := receiptFilter{Retailer: strings.TrimSpace(rules.CanonicalRetailer(q.Get("retailer"))), rules: rules}
+	var err error
+	if v := q.Get("from"); v != "" {
+		if f.From, err = time.Parse("2006-01-02", v); err != nil {
+			return f, fmt.Errorf("invalid from date %q, expected YYYY-MM-DD", v)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if f.To, err = time.Parse("2006-01-02", v); err != nil {
+			return f, fmt.Errorf("invalid to date %q, expected YYYY-MM-DD", v)
+		}
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && f.To.Before(f.From) {
+		return f, fmt.Errorf("to date is before from date")
+	}
+	return f, nil
+}
+
+// matches reports whether rec satisfies every filter that is set.
+func (f receiptFilter) matches(rec StoredReceipt) bool {
+	if f.Retailer != "" && !strings.EqualFold(strings.TrimSpace(f.rules.CanonicalRetailer(rec.Receipt.Retailer)), f.Retailer) {
+		return false
+	}
+	if f.From.IsZero() && f.To.IsZero() {
+		return true
+	}
+	purchased, err := time.Parse("2006-01-02", rec.Receipt.PurchaseDate)
+	if err != nil {
+		return false
+	}
+	if !f.From.IsZero() && purchased.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && purchased.After(f.To) {
+		return false
+	}
+	return true
+}
+
+// listReceiptsHandler handles GET /receipts
+func (s *server) listReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseReceiptFilter(r.URL.Query(), s.rulesFor(r.Context()))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing receipts: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to list receipts")
+		return
+	}
+	receipts := make([]StoredReceipt, 0, len(all))
+	for _, rec := range all {
+		if filter.matches(rec) && canAccess(r.Context(), rec) {
+			receipts = append(receipts, rec)
+		}
+	}
+
+	response := map[string][]StoredReceipt{"receipts": receipts}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func main() {
+	// Log as JSON; this also routes the standard log package through slog.
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	slog.SetDefault(logger)
+
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML file of settings; the environment and -set override it")
+	settingFlags := setFlag{}
+	flag.Var(settingFlags, "set", "NAME=value: a setting that overrides the environment and the config file; may be repeated")
+	addrFlag := flag.String("addr", "", "listen address, e.g. :8000, 127.0.0.1:9000 or unix:///var/run/receipts.sock (overrides PORT and BIND_ADDR)")
+	var tlsCfg tlsConfig
+	var autocertDomains string
+	flag.StringVar(&tlsCfg.CertFile, "tls-cert", "", "TLS certificate file (PEM); enables HTTPS together with -tls-key")
+	flag.StringVar(&tlsCfg.KeyFile, "tls-key", "", "TLS private key file (PEM)")
+	flag.StringVar(&autocertDomains, "autocert-domains", "", "comma-separated domains to obtain Let's Encrypt certificates for")
+	flag.StringVar(&tlsCfg.AutocertCacheDir, "autocert-cache", "autocert-cache", "directory for caching automatic certificates")
+	flag.StringVar(&tlsCfg.AutocertEmail, "autocert-email", "", "contact email for the ACME account")
+	flag.StringVar(&tlsCfg.AutocertHTTPAddr, "autocert-http-addr", ":80", "address for ACME HTTP-01 challenges; empty to disable")
+	flag.StringVar(&tlsCfg.ClientCAFile, "tls-client-ca", "", "CA certificates (PEM) to verify client certificates against; enables mTLS")
+	flag.StringVar(&tlsCfg.ClientAuth, "tls-client-auth", "require", "with -tls-client-ca: require a client certificate, or make it optional so other credentials are accepted too")
+	flag.StringVar(&tlsCfg.HTTP2, "http2", "", "HTTP/2 on the main listener, on or off; by default on with TLS and off (no h2c) without")
+	pidFile := flag.String("pid-file", "", "file to write the process ID to once ready, and again after each upgrade")
+	var extraListeners listenFlag
+	flag.Var(&extraListeners, "listen", "additional plain HTTP listener for local clients such as sidecars, e.g. 127.0.0.1:9000?http2=on for h2c or unix:///var/run/receipts.sock?mode=0660; may be repeated")
+	flag.Parse()
+	sources, err := applySettings(*configFile, settingFlags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if logger, err = newLogger(); err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	flags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "set" {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+	logSettings(logger, sources, flags)
+	tlsCfg.AutocertDomains = splitList(autocertDomains)
+	if err := tlsCfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Replace references to Vault in the environment with the secrets
+	// they name, before any configuration is read.
+	vault, err := vaultClientFromEnv(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	secrets, err := loadVaultSecrets(context.Background(), vault)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	addr, err := resolveListenAddr(*addrFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mainListener, err := parseListenerSpec(addr, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serverCfg, err := serverConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	upg, err := newUpgrader(serverCfg.UpgradeTimeout, *pidFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rateCfg, err := rateLimitConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	shedCfg, err := loadShedConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	reconcileCfg, err := reconcileConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fraudWindow, err := envDuration("FRAUD_DUPLICATE_WINDOW", 10*time.Minute)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobWorkers, err := envInt("JOB_WORKERS", 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobQueueSize, err := envInt("JOB_QUEUE_SIZE", 1000)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jobWorkers <= 0 || jobQueueSize <= 0 {
+		log.Fatal("JOB_WORKERS and JOB_QUEUE_SIZE must be positive")
+	}
+	jobTTL, err := envDuration("JOB_TTL", time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhookTimeout, err := envDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhookAllowPrivate, err := envBool("WEBHOOK_ALLOW_PRIVATE_NETWORKS", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhookAttempts, err := envInt("WEBHOOK_MAX_ATTEMPTS", 8)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if webhookAttempts <= 0 {
+		log.Fatal("WEBHOOK_MAX_ATTEMPTS must be positive")
+	}
+	reviewMinScore, err := envInt("REVIEW_MIN_FRAUD_SCORE", 1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if reviewMinScore < 0 || reviewMinScore > 100 {
+		log.Fatal("REVIEW_MIN_FRAUD_SCORE must be from 0 to 100")
+	}
+	auth, err := newAuthenticator(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsCfg.ClientCAFile != "" {
+		if auth.certs, err = loadCertTenants(); err != nil {
+			log.Fatal(err)
+		}
+		auth.certAdmins = loadCertAdmins()
+		for tenant := range auth.certAdmins {
+			if len(auth.certs) > 0 && !auth.certs.has(tenant) {
+				logger.Warn("ADMIN_CLIENT_CERT_TENANTS names an unknown tenant", "tenant", tenant)
+			}
+		}
+	}
+	if !auth.enabled() {
+		logger.Warn("No API keys, JWT validation or OIDC provider configured; requests are not authenticated")
+	}
+	for name := range auth.admins() {
+		if !auth.keys().has(name) {
+			logger.Warn("ADMIN_API_KEYS names an unknown API key", "api_key", name)
+		}
+	}
+
+	// Select the storage backend from the environment (defaults to in-memory).
+	storeCfg, err := storeConfigFromEnv(vault)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if storeCfg.Cipher != nil {
+		if err := storeCfg.Cipher.check(context.Background()); err != nil {
+			log.Fatalf("Receipt encryption: %v", err)
+		}
+		logger.Info("Encrypting receipt payloads at rest")
+	}
+	if vault != nil {
+		go runVaultRenewal(context.Background(), vault, secrets, func(name string) {
+			applySecret(name, auth, storeCfg.Cipher)
+		})
+	}
+	store, err := newStore(storeCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if d := storeCfg.Driver; d == "" || d == "memory" || d == "raft" {
+		upg.unsupported = "upgrades need a store the new process can share: the sqlite, postgres or redis driver"
+	}
+	if c, ok := store.(io.Closer); ok {
+		defer c.Close()
+	}
+	audit, persistent, err := newAuditLog(store, storeCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if f, ok := audit.(*fileAuditLog); ok {
+		defer f.Close()
+	}
+	if !persistent {
+		logger.Warn("The audit log is only kept in memory; set AUDIT_LOG_FILE to keep it")
+	}
+	if storeCfg.Retention > 0 {
+		go runRetentionSweeper(context.Background(), store, audit, storeCfg.Retention, storeCfg.RetentionSweepEvery)
+	}
+	expiryCfg, err := expiryConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if expiryCfg.After > 0 {
+		go runPointsExpiry(context.Background(), store, audit, expiryCfg.After, expiryCfg.Interval)
+	}
+	rules, err := loadRules(os.Getenv("RULES_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &server{
+		store:             store,
+		legacySunset:      serverCfg.LegacySunset,
+		reconcile:         reconcileCfg,
+		fraud:             newFraudDetector(fraudWindow),
+		reviewMinScore:    reviewMinScore,
+		jobs:              newJobQueue(jobQueueSize, jobTTL),
+		webhooks:          newWebhookDispatcher(webhookTimeout, webhookAttempts, webhookAllowPrivate),
+		stream:            newEventStream(),
+		sockets:           newWSHub(),
+		maxBodyBytes:      serverCfg.MaxBodyBytes,
+		pointsExpireAfter: expiryCfg.After,
+		audit:             audit,
+		pointsMaxAge:      serverCfg.PointsMaxAge,
+	}
+	s.jobs.startWorkers(s, jobWorkers)
+	eventsCfg, err := eventsConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.events, err = newEventPublisher(eventsCfg); err != nil {
+		log.Fatal(err)
+	}
+	if s.events != nil {
+		defer s.events.Close()
+		logger.Info("Publishing receipt events", "broker", eventsCfg.Broker)
+		if ob, ok := store.(outboxStore); ok {
+			s.outbox = ob
+			go runOutboxRelay(context.Background(), ob, s.events, eventsCfg.OutboxInterval)
+		}
+	}
+	s.rules.Store(rules)
+	if s.referrals, err = referralConfigFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if s.achievementBonuses, err = parseAchievementBonuses(os.Getenv("ACHIEVEMENT_BONUSES")); err != nil {
+		log.Fatal(err)
+	}
+	keyRules, err := loadKeyRules(os.Getenv("API_KEY_RULES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.keyRules.Store(&keyRules)
+	for name, engine := range keyRules {
+		if !auth.keys().has(name) && !auth.certs.has(name) {
+			logger.Warn("API_KEY_RULES names an unknown API key or tenant", "api_key", name)
+		}
+		logger.Info("API key rules loaded", "api_key", name, "rules_version", engine.Version())
+	}
+	if path := os.Getenv("SHADOW_RULES_FILE"); path != "" {
+		shadow, err := loadRules(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.shadowRules.Store(shadow)
+		logger.Info("Shadow scoring enabled", "rules_version", shadow.Version())
+	}
+	canary, err := canaryRulesFromEnv(rules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if canary != nil {
+		s.canary.Store(canary)
+		logger.Info("Canary rules enabled", "rules_version", canary.engine.Version(), "percent", canary.percent, "sticky_by", canary.stickyBy)
+	}
+	if serverCfg.IdempotencyTTL > 0 {
+		s.idempotency = newIdempotencyCache(serverCfg.IdempotencyTTL)
+	}
+	analyticsRefresh, err := envDuration("ANALYTICS_REFRESH_INTERVAL", 5*time.Minute)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if analyticsRefresh <= 0 {
+		log.Fatal("ANALYTICS_REFRESH_INTERVAL must be positive")
+	}
+	s.analytics = newAnalytics(s.rules.Load)
+	if err := s.analytics.refresh(context.Background(), store); err != nil {
+		logger.Error("Error building analytics", "error", err)
+	}
+	go runAnalyticsRefresh(context.Background(), s.analytics, store, analyticsRefresh)
+	reportCfg, err := reportConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if reportCfg.Schedule != nil {
+		go runReportScheduler(context.Background(), store, audit, s.rules.Load, reportCfg)
+	}
+	backupBucketCfg, err := backupBucketConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.backups, err = newBackupBucket(backupBucketCfg); err != nil {
+		log.Fatal(err)
+	}
+	backupScheduleCfg, err := backupScheduleConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if backupScheduleCfg.Schedule != nil {
+		bs, ok := store.(backupStore)
+		if !ok {
+			log.Fatal("BACKUP_SCHEDULE: the storage driver does not support backups")
+		}
+		if s.backups == nil {
+			log.Fatal("BACKUP_SCHEDULE needs BACKUP_S3_BUCKET to be set")
+		}
+		go runBackupScheduler(context.Background(), bs, s.backups, backupScheduleCfg)
+	}
+
+	// Start the server on the configured address.
+	ln, err := upg.listen(mainListener)
+	if err != nil {
+		log.Fatal(err)
+	}
+	extraLns := make([]net.Listener, len(extraListeners))
+	for i, spec := range extraListeners {
+		if extraLns[i], err = upg.listen(spec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(tlsCfg.AutocertDomains) > 0 && tlsCfg.AutocertHTTPAddr != "" {
+		if tlsCfg.acmeListener, err = upg.listen(listenerSpec{Network: "tcp", Addr: tlsCfg.AutocertHTTPAddr}); err != nil {
+			log.Fatal(err)
+		}
+	}
+	proxies, err := trustedProxiesFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	corsCfg, err := corsConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ipf, err := newIPFilter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ipf != nil {
+		interval, err := envDuration("IP_ACCESS_RELOAD_INTERVAL", 10*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if interval <= 0 {
+			log.Fatal("IP_ACCESS_RELOAD_INTERVAL must be positive")
+		}
+		go ipf.watch(context.Background(), interval)
+	}
+
+	// Middleware, outermost first: request ID, client IP, access log,
+	// compression, IP access lists, CORS, authentication, user, rate limit,
+	// load shedding, body limit and, with read replicas, session tokens.
+	limiter := newRateLimiter(rateCfg)
+	shedder := newLoadShedder(shedCfg)
+	if s.reloader, err = newReloader(s, auth, limiter, *configFile, sources); err != nil {
+		log.Fatal(err)
+	}
+	go s.reloader.watchSignals(context.Background())
+	routes := s.routes()
+	if st, ok := store.(sessionTokener); ok && len(storeCfg.PostgresReadDSNs) > 0 {
+		routes = withSessionTokens(st, routes)
+	}
+	handler := withRequestID(withClientIP(proxies, logRequests(logger,
+		withCompression(serverCfg.Compress, serverCfg.CompressMinBytes, ipf.middleware(withCORS(corsCfg,
+			auth.middleware(withUser(limiter.middleware(shedder.middleware(limitBody(serverCfg.MaxBodyBytes, routes)))))))))))
+	var servers []*http.Server
+	newHTTPServer := func() *http.Server {
+		srv := &http.Server{
+			Handler:           handler,
+			ReadTimeout:       serverCfg.ReadTimeout,
+			ReadHeaderTimeout: serverCfg.ReadHeaderTimeout,
+			WriteTimeout:      serverCfg.WriteTimeout,
+			IdleTimeout:       serverCfg.IdleTimeout,
+			MaxHeaderBytes:    serverCfg.MaxHeaderBytes,
+			ConnContext:       markUnixSocket,
+		}
+		srv.RegisterOnShutdown(s.stream.disconnect)
+		servers = append(servers, srv)
+		return srv
+	}
+	serveErr := make(chan error, len(extraListeners)+1)
+	for i, spec := range extraListeners {
+		srv, ln := newHTTPServer(), extraLns[i]
+		configureHTTP2(srv, spec.HTTP2, false)
+		logger.Info("Listening for local clients", "addr", ln.Addr().String(), "http2", spec.HTTP2)
+		go func() { serveErr <- srv.Serve(ln) }()
+	}
+	httpServer := newHTTPServer()
+	logger.Info("Server is running", "addr", ln.Addr().String())
+	go func() { serveErr <- tlsCfg.serve(httpServer, ln) }()
+	if err := upg.ready(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Serve until stopped or replaced, then let in-flight requests finish.
+	if err := upg.waitForStop(serveErr); err != nil {
+		log.Fatal(err)
+	}
+	drain(servers, s.jobs, serverCfg.ShutdownTimeout)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+// Counters published through expvar at GET /debug/vars.
+var (
+	// receiptsExpired counts receipts removed by the retention sweeper.
+	receiptsExpired = expvar.NewInt("receipts_expired_total")
+	// pointsExpired counts points lapsed by the expiry job.
+	pointsExpired = expvar.NewInt("points_expired_total")
+	// reportsGenerated counts daily reports saved by the scheduler, and
+	// reportDeliveryFailures the sinks that did not take one.
+	reportsGenerated       = expvar.NewInt("reports_generated_total")
+	reportDeliveryFailures = expvar.NewInt("report_delivery_failures_total")
+	// receiptsEvicted counts receipts dropped to make room in a capped
+	// memory store.
+	receiptsEvicted = expvar.NewInt("receipts_evicted_total")
+	// receiptsTotalMismatch counts receipts whose total did not match
+	// their items (see TOTAL_RECONCILIATION).
+	receiptsTotalMismatch = expvar.NewInt("receipts_total_mismatch_total")
+	// receiptsSuspicious counts receipts saved with a non-zero fraud score.
+	receiptsSuspicious = expvar.NewInt("receipts_suspicious_total")
+
+	// Shadow scoring: receipts scored by the shadow rule set, how many of
+	// them scored differently, and the summed difference (shadow minus
+	// live points).
+	shadowScored      = expvar.NewInt("shadow_scored_total")
+	shadowMismatches  = expvar.NewInt("shadow_mismatch_total")
+	shadowPointsDelta = expvar.NewInt("shadow_points_delta_total")
+	// canaryScored counts new receipts scored with the canary rules.
+	canaryScored = expvar.NewInt("canary_scored_total")
+
+	// Webhooks: events delivered, given up on after the last attempt or a
+	// permanent error, and dropped because the delivery queue was full.
+	webhookDeliveries = expvar.NewInt("webhook_deliveries_total")
+	webhookFailures   = expvar.NewInt("webhook_failures_total")
+	webhookDropped    = expvar.NewInt("webhook_dropped_total")
+
+	// Events handed to the message broker, and those it did not accept.
+	eventsPublished = expvar.NewInt("events_published_total")
+	eventsFailed    = expvar.NewInt("events_failed_total")
+
+	// Backups uploaded to the backup bucket, uploads that failed, and old
+	// backups deleted by rotation.
+	backupsUploaded = expvar.NewInt("backups_total")
+	backupFailures  = expvar.NewInt("backup_failures_total")
+	backupsPruned   = expvar.NewInt("backups_pruned_total")
+	// lastBackupAt is when the newest backup in the bucket was taken, in
+	// Unix seconds, or zero if none is known.
+	lastBackupAt = expvar.NewInt("last_successful_backup_timestamp_seconds")
+
+	// auditFailures counts changes that could not be written to the audit
+	// log.
+	auditFailures = expvar.NewInt("audit_failures_total")
+
+	// vaultFailures counts failed token renewals, secret reads and
+	// secrets that could not be applied.
+	vaultFailures = expvar.NewInt("vault_failures_total")
+
+	// Points lookups answered from the in-process points cache, and those
+	// that went to the store.
+	pointsCacheHits   = expvar.NewInt("points_cache_hits_total")
+	pointsCacheMisses = expvar.NewInt("points_cache_misses_total")
+
+	// ipDenied counts requests refused by the IP access lists.
+	ipDenied = expvar.NewInt("requests_ip_denied_total")
+
+	// Requests refused by load shedding, and its current concurrency
+	// limit.
+	requestsShed  = expvar.NewInt("requests_shed_total")
+	loadShedLimit = expvar.NewInt("load_shed_concurrency_limit")
+)
+
+func init() {
+	// Alerts on stale backups need the age, which expvar cannot derive.
+	expvar.Publish("last_successful_backup_age_seconds", expvar.Func(func() any {
+		if lastBackupAt.Value() == 0 {
+			return nil
+		}
+		return int64(time.Since(time.Unix(lastBackupAt.Value(), 0)).Seconds())
+	}))
+}
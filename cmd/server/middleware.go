@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	requestLogKey
+	identityKey
+	userKey
+	clientIPKey
+	unixSocketKey
+)
+
+// requestIDHeader carries a request's ID in both directions.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen bounds the incoming request IDs that are kept.
+const maxRequestIDLen = 128
+
+// withRequestID tags each request with an ID that is returned in the
+// X-Request-Id response header and error bodies, and recorded in the access
+// log and the events the request causes. An X-Request-Id sent by the client
+// or a proxy is kept if it is well formed, so one ID can follow a request
+// across services; otherwise a new one is generated.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID reports whether id is 1 to maxRequestIDLen printable
+// ASCII characters without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFrom returns the request's ID, or "" outside withRequestID.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// streamedBodyPaths read their bodies a record at a time and limit each
+// record instead of the whole body, or, for restores, take whole backups.
+var streamedBodyPaths = map[string]bool{
+	"/receipts/stream": true, "/v1/receipts/stream": true,
+	"/admin/restore": true, "/v1/admin/restore": true,
+}
+
+// limitBody caps every request body at max bytes, except on
+// streamedBodyPaths. Reads beyond the limit fail with *http.MaxBytesError,
+// which decodeJSONBody reports as 413.
+func limitBody(max int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !streamedBodyPaths[r.URL.Path] {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestLog collects details about a request for the access log. Handlers
+// add to it through the setLog* functions.
+type requestLog struct {
+	receiptID string
+	apiKey    string
+	subject   string
+}
+
+// setLogReceiptID records the receipt a request operated on so it appears
+// in the access log entry.
+func setLogReceiptID(ctx context.Context, id string) {
+	if rl, ok := ctx.Value(requestLogKey).(*requestLog); ok {
+		rl.receiptID = id
+	}
+}
+
+// setLogAPIKey records the name of the API key that authenticated a request.
+func setLogAPIKey(ctx context.Context, name string) {
+	if rl, ok := ctx.Value(requestLogKey).(*requestLog); ok {
+		rl.apiKey = name
+	}
+}
+
+// setLogSubject records the token subject that authenticated a request.
+func setLogSubject(ctx context.Context, sub string) {
+	if rl, ok := ctx.Value(requestLogKey).(*requestLog); ok {
+		rl.subject = sub
+	}
+}
+
+// statusRecorder captures the status code and response size.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// logRequests writes one structured log entry per request with its method,
+// path, status, latency, body sizes and, when known, the receipt ID.
+func logRequests(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rl := &requestLog{}
+		rec := &statusRecorder{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestLogKey, rl)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int64("request_bytes", body.n),
+			slog.Int("response_bytes", rec.bytes),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("client_ip", clientIP(r)),
+			slog.String("request_id", requestIDFrom(r.Context())),
+		}
+		if rl.receiptID != "" {
+			attrs = append(attrs, slog.String("receipt_id", rl.receiptID))
+		}
+		if rl.apiKey != "" {
+			attrs = append(attrs, slog.String("api_key", rl.apiKey))
+		}
+		if rl.subject != "" {
+			attrs = append(attrs, slog.String("subject", rl.subject))
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
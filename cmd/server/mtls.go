@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// certTenants maps the identities in client certificates to tenants. A
+// caller authenticated by certificate acts as its tenant wherever a caller
+// would otherwise be named by its API key: per-key rules, rate limits,
+// webhooks and the audit log. It is only an administrator if listed in
+// ADMIN_CLIENT_CERT_TENANTS; ADMIN_API_KEYS does not apply to tenants.
+type certTenants map[string]string
+
+// loadCertTenants reads the mapping from CLIENT_CERT_TENANTS
+// ("identity=tenant" entries separated by commas) and from the file named
+// by CLIENT_CERT_TENANTS_FILE (one "identity=tenant" per line, "#" comments
+// allowed). The tenant follows the last "=", so identities may contain one.
+func loadCertTenants() (certTenants, error) {
+	tenants := make(certTenants)
+	add := func(entry, source string) error {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			return nil
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return fmt.Errorf("%s: %q must look like identity=tenant", source, entry)
+		}
+		identity, tenant := strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		if identity == "" || tenant == "" {
+			return fmt.Errorf("%s: %q must look like identity=tenant", source, entry)
+		}
+		tenants[identity] = tenant
+		return nil
+	}
+
+	for _, entry := range strings.Split(os.Getenv("CLIENT_CERT_TENANTS"), ",") {
+		if err := add(entry, "CLIENT_CERT_TENANTS"); err != nil {
+			return nil, err
+		}
+	}
+	if path := os.Getenv("CLIENT_CERT_TENANTS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("CLIENT_CERT_TENANTS_FILE: %w", err)
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if err := add(sc.Text(), path); err != nil {
+				return nil, err
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("CLIENT_CERT_TENANTS_FILE: %w", err)
+		}
+	}
+	return tenants, nil
+}
+
+// loadCertAdmins reads ADMIN_CLIENT_CERT_TENANTS, the comma-separated
+// tenants whose certificates may use the administration endpoints.
+func loadCertAdmins() map[string]bool {
+	admins := make(map[string]bool)
+	for _, tenant := range splitList(os.Getenv("ADMIN_CLIENT_CERT_TENANTS")) {
+		admins[tenant] = true
+	}
+	return admins
+}
+
+// certIdentities lists the identities of cert in the order they are
+// matched: its URI names (such as SPIFFE IDs), DNS names and email
+// addresses, then its subject's common name.
+func certIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
+
+// tenant returns the tenant of cert and the identity it was found by.
+// Without a mapping the first identity is the tenant; with one, a
+// certificate none of whose identities is mapped has no tenant.
+func (t certTenants) tenant(cert *x509.Certificate) (tenant, identity string, ok bool) {
+	ids := certIdentities(cert)
+	if len(t) == 0 {
+		if len(ids) == 0 {
+			return "", "", false
+		}
+		return ids[0], ids[0], true
+	}
+	for _, id := range ids {
+		if tenant, ok := t[id]; ok {
+			return tenant, id, true
+		}
+	}
+	return "", "", false
+}
+
+// has reports whether a certificate identity maps to tenant.
+func (t certTenants) has(tenant string) bool {
+	for _, name := range t {
+		if name == tenant {
+			return true
+		}
+	}
+	return false
+}
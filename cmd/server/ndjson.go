@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"fetch_assessment/points"
+)
+
+// errLineTooLong is returned by readLine for lines over the size limit.
+var errLineTooLong = errors.New("line too long")
+
+// streamResult is the outcome for the receipt on line Line of an NDJSON
+// upload, counting from 1.
+type streamResult struct {
+	Line int `json:"line"`
+	batchResult
+}
+
+// readLine returns the next line from br, including its newline, or
+// errLineTooLong after skipping a line longer than max bytes.
+func readLine(br *bufio.Reader, max int64) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if int64(len(line)+len(chunk)) > max {
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = br.ReadSlice('\n')
+			}
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			return nil, errLineTooLong
+		}
+		line = append(line, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+// streamReceiptsHandler handles POST /receipts/stream
+func (s *server) streamReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	dedupe, err := boolParam(r, "dedupe", true)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/x-ndjson" {
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "Content-Type must be application/x-ndjson")
+		return
+	}
+	rc := http.NewResponseController(w)
+	// Uploads may run far beyond HTTP_READ_TIMEOUT and HTTP_WRITE_TIMEOUT.
+	if rc.SetReadDeadline(time.Time{}) != nil || rc.SetWriteDeadline(time.Time{}) != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	// Results are written while the body is still being read. HTTP/2 always
+	// allows this, and reports that it cannot be enabled.
+	rc.EnableFullDuplex()
+	// Start reading before responding: a client waiting for 100 Continue
+	// would otherwise never send the body.
+	br := bufio.NewReaderSize(r.Body, 64<<10)
+	br.Peek(1)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for n := 1; r.Context().Err() == nil; n++ {
+		line, err := readLine(br, s.maxBodyBytes)
+		if errors.Is(err, errLineTooLong) {
+			enc.Encode(streamResult{Line: n, batchResult: batchResult{Error: "Line exceeds the request size limit"}})
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			enc.Encode(streamResult{Line: n, batchResult: batchResult{Error: "Reading the request failed: " + err.Error()}})
+			return
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if enc.Encode(s.processStreamLine(r, n, line, dedupe)) != nil {
+				return
+			}
+		}
+		if err != nil {
+			rc.Flush()
+			return
+		}
+		// Flush whenever the client has to send more, so results keep up
+		// with a slow upload without a write per line of a fast one.
+		if br.Buffered() == 0 && rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// processStreamLine scores and saves the receipt on line n.
+func (s *server) processStreamLine(r *http.Request, n int, line []byte, dedupe bool) streamResult {
+	res := streamResult{Line: n}
+	var receipt points.Receipt
+	if err := decodeStrict(line, &receipt); err != nil {
+		res.Error = "Invalid receipt JSON: " + err.Error()
+		res.Fields = decodeFieldErrors(err)
+		return res
+	}
+	if errs := s.validate(receipt); errs != nil {
+		res.Error = "The receipt is invalid."
+		res.Fields = errs
+		return res
+	}
+	rec, created, err := s.processReceipt(r.Context(), receipt, dedupe)
+	if errors.Is(err, ErrStoreFull) {
+		res.Error = "The receipt store is full"
+		return res
+	}
+	if err != nil {
+		log.Printf("Error saving receipt from stream line %d: %v", n, err)
+		res.Error = "Failed to save receipt"
+		return res
+	}
+	res.ID = rec.ID
+	res.Points = &rec.Points
+	res.Status = statusText(rec.Status)
+	res.Duplicate = !created
+	return res
+}
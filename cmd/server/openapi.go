@@ -0,0 +1,29 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the hand-maintained OpenAPI 3 description of the REST API.
+// Keep it in step with routes.go and the request/response types.
+//
+//go:embed api/openapi.json
+var openAPISpec []byte
+
+// docsPage renders openAPISpec with Swagger UI.
+//
+//go:embed api/docs.html
+var docsPage []byte
+
+// openAPIHandler handles GET /openapi.json
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// docsHandler handles GET /docs
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// outboxBatchSize is the most events relayed to the broker at once.
+const outboxBatchSize = 100
+
+// outboxStore is implemented by stores that can record events in the same
+// transaction as the receipt they describe. The relay then publishes them,
+// so an event is sent if and only if its receipt was saved, even across
+// crashes. Events may be published more than once.
+type outboxStore interface {
+	SaveWithEvents(ctx context.Context, rec StoredReceipt, evs []receiptEvent) error
+	RelayEvents(ctx context.Context, limit int, send func([]receiptEvent) error) (int, error)
+}
+
+// save stores a new receipt, adding ev to the outbox in the same
+// transaction if broker events are relayed from one.
+func (s *server) save(ctx context.Context, rec StoredReceipt, ev receiptEvent) error {
+	if s.outbox != nil {
+		return s.outbox.SaveWithEvents(ctx, rec, []receiptEvent{ev})
+	}
+	return s.store.Save(ctx, rec)
+}
+
+// runOutboxRelay publishes outbox events to pub, checking every interval
+// until ctx is done. Events that cannot be published stay in the outbox and
+// are retried.
+func runOutboxRelay(ctx context.Context, store outboxStore, pub eventPublisher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	send := func(evs []receiptEvent) error {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		return pub.Send(ctx, evs)
+	}
+	for {
+		// Drain the backlog before waiting again.
+		for {
+			n, err := store.RelayEvents(ctx, outboxBatchSize, send)
+			if err != nil {
+				slog.Warn("Relaying outbox events failed", "error", err)
+			}
+			if err != nil || n < outboxBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// pointsCache keeps recently read points in process, in front of the sqlite,
+// postgres and redis drivers, so that repeated lookups of the same receipt
+// do not go to the database. Writes made through this process update it.
+// With postgres and redis, instances tell each other about their writes
+// (see peerCacheMessage), and drop what the others changed; a message
+// lost while an instance reconnects shows after at most ttl. A nil
+// *pointsCache caches nothing.
+type pointsCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru orders entries from most to least recently used.
+	lru *list.List
+	// gen counts removals, so that a value read before one is not cached
+	// after it.
+	gen uint64
+}
+
+type pointsCacheEntry struct {
+	id           string
+	points       int
+	rulesVersion string
+	expires      time.Time
+}
+
+// newPointsCache returns a cache of up to size receipts kept for ttl, or
+// nil when size is not positive.
+func newPointsCache(size int, ttl time.Duration) *pointsCache {
+	if size <= 0 {
+		return nil
+	}
+	return &pointsCache{size: size, ttl: ttl, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// pointsCacheChannel is the Postgres notification channel and the Redis
+// channel that carry peerCacheMessage.
+const pointsCacheChannel = "receipts_points_cache"
+
+// cacheInstance tells this process's messages on pointsCacheChannel from
+// those of other instances, which it has already applied.
+var cacheInstance = uuid.NewString()
+
+// peerCacheMessage tells the other instances to drop receipt id from their
+// points caches, or everything when id is "*".
+func peerCacheMessage(id string) string {
+	return cacheInstance + " " + id
+}
+
+// applyPeer applies a peerCacheMessage from another instance.
+func (c *pointsCache) applyPeer(msg string) {
+	from, id, ok := strings.Cut(msg, " ")
+	if !ok || from == cacheInstance {
+		return
+	}
+	if id == "*" {
+		c.purge()
+		return
+	}
+	c.remove(id)
+}
+
+// get returns the cached points of receipt id and the cache generation,
+// which put needs when the points are read from the store instead.
+func (c *pointsCache) get(id string) (points int, rulesVersion string, gen uint64, ok bool) {
+	if c == nil {
+		return 0, "", 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		pointsCacheMisses.Add(1)
+		return 0, "", c.gen, false
+	}
+	e := el.Value.(*pointsCacheEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+		pointsCacheMisses.Add(1)
+		return 0, "", c.gen, false
+	}
+	c.lru.MoveToFront(el)
+	pointsCacheHits.Add(1)
+	return e.points, e.rulesVersion, c.gen, true
+}
+
+// fill caches points read from the store. The read may predate a change
+// made meanwhile, so it is dropped if an entry was removed since get
+// returned gen, and does not replace an entry written since.
+func (c *pointsCache) fill(gen uint64, id string, points int, rulesVersion string) {
+	c.fillUntil(gen, id, points, rulesVersion, time.Time{})
+}
+
+// fillUntil is fill for a receipt that the store forgets at until, if that
+// is sooner than ttl.
+func (c *pointsCache) fillUntil(gen uint64, id string, points int, rulesVersion string, until time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.entries[id]; ok && time.Now().Before(el.Value.(*pointsCacheEntry).expires) {
+		return
+	}
+	c.set(id, points, rulesVersion, until)
+}
+
+// put caches points just written to the store.
+func (c *pointsCache) put(id string, points int, rulesVersion string) {
+	c.putUntil(id, points, rulesVersion, time.Time{})
+}
+
+// putUntil is put for a receipt that the store forgets at until, if that
+// is sooner than ttl.
+func (c *pointsCache) putUntil(id string, points int, rulesVersion string, until time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(id, points, rulesVersion, until)
+}
+
+// set adds or replaces an entry, kept for ttl or until until if it is set
+// and sooner, evicting the least recently used one when the cache is
+// full. c.mu must be held.
+func (c *pointsCache) set(id string, points int, rulesVersion string, until time.Time) {
+	expires := time.Now().Add(c.ttl)
+	if !until.IsZero() && until.Before(expires) {
+		expires = until
+	}
+	e := &pointsCacheEntry{id: id, points: points, rulesVersion: rulesVersion, expires: expires}
+	if el, ok := c.entries[id]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*pointsCacheEntry).id)
+	}
+	c.entries[id] = c.lru.PushFront(e)
+}
+
+// remove drops receipt id, after it is deleted or when its new points are
+// not known.
+func (c *pointsCache) remove(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if el, ok := c.entries[id]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+	}
+}
+
+// purge drops every entry, after changes to many receipts at once.
+func (c *pointsCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	clear(c.entries)
+	c.lru.Init()
+}
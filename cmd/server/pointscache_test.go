@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPointsCachePeerMessages checks that messages from other instances
+// drop what they changed, and that an instance ignores its own.
+func TestPointsCachePeerMessages(t *testing.T) {
+	c := newPointsCache(10, time.Hour)
+	c.put("a", 10, "v1")
+	c.put("b", 20, "v1")
+
+	c.applyPeer(peerCacheMessage("a"))
+	if _, _, _, ok := c.get("a"); !ok {
+		t.Error("an instance's own message dropped its entry")
+	}
+	c.applyPeer("other-instance a")
+	if _, _, _, ok := c.get("a"); ok {
+		t.Error("receipt a is still cached after another instance changed it")
+	}
+	if _, _, _, ok := c.get("b"); !ok {
+		t.Error("receipt b was dropped by a message about a")
+	}
+	c.applyPeer("other-instance *")
+	if _, _, _, ok := c.get("b"); ok {
+		t.Error("receipt b is still cached after another instance changed everything")
+	}
+}
+
+// TestPointsCacheUntil checks that entries for receipts that expire
+// sooner than the cache's ttl are dropped when the receipt expires.
+func TestPointsCacheUntil(t *testing.T) {
+	c := newPointsCache(10, time.Hour)
+	c.putUntil("a", 10, "v1", time.Now().Add(-time.Second))
+	if _, _, _, ok := c.get("a"); ok {
+		t.Error("an expired receipt is still cached")
+	}
+	c.putUntil("b", 20, "v1", time.Now().Add(time.Minute))
+	if _, _, _, ok := c.get("b"); !ok {
+		t.Error("a live receipt is not cached")
+	}
+}
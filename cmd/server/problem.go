@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// problemTypeInvalidReceipt identifies responses for receipts that fail
+// schema validation; they carry the offending fields in "fields".
+const problemTypeInvalidReceipt = "/problems/invalid-receipt"
+
+// problem is an RFC 7807 problem details body.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// RequestID is the request's X-Request-Id. TraceID repeats it for
+	// clients written before request IDs.
+	RequestID string `json:"requestId"`
+	TraceID   string `json:"traceId"`
+
+	// Fields lists validation failures for problemTypeInvalidReceipt.
+	Fields []fieldError `json:"fields,omitempty"`
+}
+
+// newProblem builds a generic ("about:blank") problem for status.
+func newProblem(r *http.Request, status int, detail string) problem {
+	id := requestIDFrom(r.Context())
+	return problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: id,
+		TraceID:   id,
+	}
+}
+
+func (p problem) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeProblem responds with a generic problem for status.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	newProblem(r, status, detail).write(w)
+}
+
+// writeInvalidReceipt responds with 400 and the receipt's invalid fields.
+func writeInvalidReceipt(w http.ResponseWriter, r *http.Request, fields []fieldError) {
+	p := newProblem(r, http.StatusBadRequest, "The receipt is invalid.")
+	p.Type = problemTypeInvalidReceipt
+	p.Fields = fields
+	p.write(w)
+}
+
+// problemWriter converts the plain-text 404 and 405 responses generated by
+// http.ServeMux into problem details, keeping headers such as Allow.
+type problemWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	replaced bool
+}
+
+func (p *problemWriter) WriteHeader(status int) {
+	if status == http.StatusNotFound || status == http.StatusMethodNotAllowed {
+		p.replaced = true
+		writeProblem(p.ResponseWriter, p.r, status, "")
+		return
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *problemWriter) Write(b []byte) (int, error) {
+	if p.replaced {
+		return len(b), nil
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (p *problemWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Connections to a node's Raft address start with one of these bytes: the
+// Raft protocol itself, or a write forwarded to the leader.
+const (
+	raftConnRaft    byte = 'R'
+	raftConnForward byte = 'F'
+)
+
+// raftMux shares one listener between Raft and write forwarding.
+type raftMux struct {
+	ln        net.Listener
+	advertise net.Addr
+	forward   func(net.Conn)
+
+	raftConns chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newRaftMux listens on bind, advertising advertise to its peers, and
+// passes forwarded writes to forward.
+func newRaftMux(bind, advertise string, forward func(net.Conn)) (*raftMux, error) {
+	addr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return nil, fmt.Errorf("raft address %s: %w", advertise, err)
+	}
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, fmt.Errorf("raft listen: %w", err)
+	}
+	m := &raftMux{ln: ln, advertise: addr, forward: forward, raftConns: make(chan net.Conn), closed: make(chan struct{})}
+	go m.serve()
+	return m, nil
+}
+
+// serve sorts accepted connections by their first byte.
+func (m *raftMux) serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			var kind [1]byte
+			if _, err := conn.Read(kind[:]); err != nil {
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			switch kind[0] {
+			case raftConnRaft:
+				select {
+				case m.raftConns <- conn:
+				case <-m.closed:
+					conn.Close()
+				}
+			case raftConnForward:
+				m.forward(conn)
+			default:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// Accept, Close, Addr and Dial make raftMux a raft.StreamLayer.
+
+func (m *raftMux) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.raftConns:
+		return conn, nil
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *raftMux) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		err = m.ln.Close()
+	})
+	return err
+}
+
+func (m *raftMux) Addr() net.Addr {
+	return m.advertise
+}
+
+func (m *raftMux) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return dialRaft(string(addr), raftConnRaft, timeout)
+}
+
+func dialRaft(addr string, kind byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{kind}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// raftForwardResponse answers a write forwarded to the leader: the result,
+// the log index it was applied at, and any error. ErrIs names the
+// ReceiptStore error the error wraps, so callers can still test for it.
+type raftForwardResponse struct {
+	Result memoryResult `json:"result"`
+	Index  uint64       `json:"index"`
+	Err    string       `json:"err,omitempty"`
+	ErrIs  string       `json:"errIs,omitempty"`
+}
+
+// raftStoreErrors are the errors that keep their identity when a write is
+// forwarded.
+var raftStoreErrors = []error{
+	ErrReceiptNotFound, ErrStoreFull, ErrStatusChanged, ErrInsufficientPoints, ErrReferralNotFound,
+	ErrAlreadyReferred, ErrReferralLimit, ErrReportNotFound, ErrStoreNotEmpty, ErrDuplicateReceipt, errRaftNotLeader,
+}
+
+// remoteError is an error returned by the leader.
+type remoteError struct {
+	msg string
+	is  error
+}
+
+func (e *remoteError) Error() string { return e.msg }
+func (e *remoteError) Unwrap() error { return e.is }
+
+func (r *raftForwardResponse) setErr(err error) {
+	if err == nil {
+		return
+	}
+	r.Err = err.Error()
+	for _, known := range raftStoreErrors {
+		if errors.Is(err, known) {
+			r.ErrIs = known.Error()
+			return
+		}
+	}
+}
+
+func (r *raftForwardResponse) err() error {
+	if r.Err == "" {
+		return nil
+	}
+	for _, known := range raftStoreErrors {
+		if r.ErrIs == known.Error() {
+			if r.Err == r.ErrIs {
+				return known
+			}
+			return &remoteError{msg: r.Err, is: known}
+		}
+	}
+	return errors.New(r.Err)
+}
+
+// forwardWrite sends r to the leader at addr and returns its response.
+func forwardWrite(addr string, r memoryLogRecord, timeout time.Duration) (raftForwardResponse, error) {
+	var resp raftForwardResponse
+	conn, err := dialRaft(addr, raftConnForward, timeout)
+	if err != nil {
+		return resp, fmt.Errorf("forward to leader: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := json.NewEncoder(conn).Encode(r); err != nil {
+		return resp, fmt.Errorf("forward to leader: %w", err)
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("forward to leader: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitConfig configures the token-bucket limits. A zero RPS disables
+// the corresponding limit.
+type rateLimitConfig struct {
+	RPS         float64 // sustained requests per second per client
+	Burst       int
+	GlobalRPS   float64 // sustained requests per second across all clients
+	GlobalBurst int
+	// KeyBy selects how clients are identified: "ip" or "api-key" (the
+	// authenticated API key or token subject, falling back to the IP).
+	KeyBy string
+}
+
+// rateLimitConfigFromEnv reads the rate limits from the environment.
+func rateLimitConfigFromEnv() (rateLimitConfig, error) {
+	cfg := rateLimitConfig{KeyBy: os.Getenv("RATE_LIMIT_KEY")}
+	if cfg.KeyBy == "" {
+		cfg.KeyBy = "ip"
+	}
+	if cfg.KeyBy != "ip" && cfg.KeyBy != "api-key" {
+		return cfg, fmt.Errorf("RATE_LIMIT_KEY: must be \"ip\" or \"api-key\", got %q", cfg.KeyBy)
+	}
+	var err error
+	if cfg.RPS, err = envFloat("RATE_LIMIT_RPS", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.Burst, err = envInt("RATE_LIMIT_BURST", 40); err != nil {
+		return cfg, err
+	}
+	if cfg.GlobalRPS, err = envFloat("RATE_LIMIT_GLOBAL_RPS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.GlobalBurst, err = envInt("RATE_LIMIT_GLOBAL_BURST", 200); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// clientLimiterIdle is how long a client's bucket is kept after its last request.
+const clientLimiterIdle = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter enforces a per-client and an optional global token bucket.
+type rateLimiter struct {
+	mu sync.Mutex
+	// cfg and global are replaced by update.
+	cfg       rateLimitConfig
+	global    *rate.Limiter
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg rateLimitConfig) *rateLimiter {
+	rl := &rateLimiter{clients: make(map[string]*clientLimiter), lastSweep: time.Now()}
+	rl.update(cfg)
+	return rl
+}
+
+// update puts new limits into effect. Clients start again with full
+// buckets.
+func (rl *rateLimiter) update(cfg rateLimitConfig) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.cfg = cfg
+	rl.global = nil
+	if cfg.GlobalRPS > 0 {
+		rl.global = rate.NewLimiter(rate.Limit(cfg.GlobalRPS), cfg.GlobalBurst)
+	}
+	clear(rl.clients)
+}
+
+// clientLimiter returns the bucket for key, creating it on first use and
+// dropping buckets that have been idle for clientLimiterIdle. rl.mu must
+// be held.
+func (rl *rateLimiter) clientLimiter(key string, now time.Time) *rate.Limiter {
+	if now.Sub(rl.lastSweep) > time.Minute {
+		for k, c := range rl.clients {
+			if now.Sub(c.lastSeen) > clientLimiterIdle {
+				delete(rl.clients, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(rl.cfg.RPS), rl.cfg.Burst)}
+		rl.clients[key] = c
+	}
+	c.lastSeen = now
+	return c.limiter
+}
+
+// clientKey identifies the caller according to keyBy.
+func clientKey(r *http.Request, keyBy string) string {
+	if keyBy == "api-key" {
+		if id, ok := identityFrom(r.Context()); ok && id.APIKey != "" {
+			return "key:" + id.APIKey
+		} else if ok && id.Subject != "" {
+			return "sub:" + id.Subject
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// allow takes a token from the caller's bucket and the global bucket. When
+// either is empty it returns false and how long the caller should wait.
+func (rl *rateLimiter) allow(r *http.Request) (bool, time.Duration) {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	var client *rate.Reservation
+	if rl.cfg.RPS > 0 {
+		client = rl.clientLimiter(clientKey(r, rl.cfg.KeyBy), now).ReserveN(now, 1)
+		if delay := client.DelayFrom(now); !client.OK() || delay > 0 {
+			client.CancelAt(now)
+			return false, delay
+		}
+	}
+	if rl.global != nil {
+		global := rl.global.ReserveN(now, 1)
+		if delay := global.DelayFrom(now); !global.OK() || delay > 0 {
+			global.CancelAt(now)
+			if client != nil {
+				client.CancelAt(now)
+			}
+			return false, delay
+		}
+	}
+	return true, 0
+}
+
+// middleware rejects requests over the limits with 429 and a Retry-After
+// header. Health probes are never limited.
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isProbe(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, delay := rl.allow(r); !ok {
+			retry := int(math.Ceil(delay.Seconds()))
+			if retry < 1 {
+				retry = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			writeProblem(w, r, http.StatusTooManyRequests, "Rate limit exceeded, retry later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// recalcResult reports a receipt's score before and after re-running the
+// current rules.
+type recalcResult struct {
+	ID              string `json:"id"`
+	OldPoints       int    `json:"oldPoints"`
+	NewPoints       int    `json:"newPoints"`
+	OldRulesVersion string `json:"oldRulesVersion,omitempty"`
+	RulesVersion    string `json:"rulesVersion"`
+	Changed         bool   `json:"changed"`
+	Error           string `json:"error,omitempty"`
+	// Status is set for receipts left alone because they have not been
+	// accepted.
+	Status string `json:"status,omitempty"`
+}
+
+// recalculate re-scores rec with the current rules and saves the result if
+// the points or rules version differ from what is stored. Receipts that
+// have not been accepted are left alone: they earn no points yet.
+func (s *server) recalculate(ctx context.Context, rec StoredReceipt) (recalcResult, error) {
+	if !rec.accepted() {
+		return recalcResult{
+			ID:              rec.ID,
+			OldPoints:       rec.Points,
+			NewPoints:       rec.Points,
+			OldRulesVersion: rec.RulesVersion,
+			RulesVersion:    rec.RulesVersion,
+			Status:          rec.Status,
+		}, nil
+	}
+	rules := s.withCanary(s.rulesFor(ctx), rec.ContentHash, rec.UserID)
+	res := recalcResult{
+		ID:              rec.ID,
+		OldPoints:       rec.Points,
+		OldRulesVersion: rec.RulesVersion,
+		RulesVersion:    rules.Version(),
+	}
+	total, _, err := rules.CalculateForTier(rec.Receipt, rec.Tier)
+	if err != nil {
+		return res, err
+	}
+	res.NewPoints = total
+	res.Changed = total != rec.Points
+	if res.Changed || rec.RulesVersion != res.RulesVersion {
+		if err := s.store.UpdatePoints(ctx, rec.ID, total, res.RulesVersion); err != nil {
+			return res, err
+		}
+		if res.Changed {
+			rec.Points, rec.RulesVersion = total, res.RulesVersion
+			s.analytics.add(rec, 0, total-res.OldPoints)
+			s.rescored(ctx, rec, res.OldPoints)
+			s.emit(ctx, eventReceiptRescored, rec)
+		}
+	}
+	return res, nil
+}
+
+// recalculateHandler handles POST /receipts/{id}/recalculate
+func (s *server) recalculateHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	setLogReceiptID(r.Context(), id)
+
+	rec, ok := s.loadReceipt(w, r, id)
+	if !ok {
+		return
+	}
+	res, err := s.recalculate(r.Context(), rec)
+	if err != nil {
+		log.Printf("Error recalculating receipt %s: %v", id, err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to recalculate receipt")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// recalculateAllHandler handles POST /receipts/recalculate
+func (s *server) recalculateAllHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseReceiptFilter(r.URL.Query(), s.rulesFor(r.Context()))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing receipts: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to list receipts")
+		return
+	}
+
+	// Re-score every matching receipt the caller can see. A failure on one
+	// receipt is reported in its result and does not stop the others.
+	response := struct {
+		Total   int            `json:"total"`
+		Changed int            `json:"changed"`
+		Failed  int            `json:"failed"`
+		Results []recalcResult `json:"results"`
+	}{Results: []recalcResult{}}
+	for _, rec := range all {
+		if !filter.matches(rec) || !canAccess(r.Context(), rec) {
+			continue
+		}
+		res, err := s.recalculate(r.Context(), rec)
+		if err != nil {
+			log.Printf("Error recalculating receipt %s: %v", rec.ID, err)
+			res.Error = "Failed to recalculate receipt"
+			response.Failed++
+		} else if res.Changed {
+			response.Changed++
+		}
+		response.Total++
+		response.Results = append(response.Results, res)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"fetch_assessment/points"
+)
+
+// Total reconciliation modes.
+const (
+	reconcileOff    = "off"
+	reconcileFlag   = "flag"   // accept, but flag the receipt
+	reconcileReject = "reject" // refuse the receipt
+)
+
+// flagTotalMismatch marks receipts whose total is not the sum of their
+// item prices.
+const flagTotalMismatch = "total_mismatch"
+
+// reconcileConfig configures the check that a receipt's total equals the
+// sum of its item prices.
+type reconcileConfig struct {
+	Mode string
+	// Tolerance is the largest difference still accepted, e.g. for tax
+	// or rounding.
+	Tolerance points.Cents
+}
+
+// reconcileConfigFromEnv reads TOTAL_RECONCILIATION and TOTAL_TOLERANCE.
+func reconcileConfigFromEnv() (reconcileConfig, error) {
+	cfg := reconcileConfig{Mode: os.Getenv("TOTAL_RECONCILIATION")}
+	if cfg.Mode == "" {
+		cfg.Mode = reconcileOff
+	}
+	if cfg.Mode != reconcileOff && cfg.Mode != reconcileFlag && cfg.Mode != reconcileReject {
+		return cfg, fmt.Errorf("TOTAL_RECONCILIATION: must be \"off\", \"flag\" or \"reject\", got %q", cfg.Mode)
+	}
+	if v := os.Getenv("TOTAL_TOLERANCE"); v != "" {
+		tol, err := points.ParseCents(v)
+		if err != nil {
+			return cfg, fmt.Errorf("TOTAL_TOLERANCE: invalid dollar amount %q", v)
+		}
+		cfg.Tolerance = tol
+	}
+	return cfg, nil
+}
+
+// totalMismatch reports whether r's total differs from the sum of its item
+// prices by more than the tolerance, and returns that sum. Receipts with
+// malformed amounts are left to validateReceipt.
+func (c reconcileConfig) totalMismatch(r points.Receipt) (points.Cents, bool) {
+	total, err := points.ParseCents(r.Total)
+	if err != nil {
+		return 0, false
+	}
+	var sum points.Cents
+	for _, item := range r.Items {
+		price, err := points.ParseCents(item.Price)
+		if err != nil {
+			return 0, false
+		}
+		sum += price
+	}
+	diff := total - sum
+	if diff < 0 {
+		diff = -diff
+	}
+	return sum, diff > c.Tolerance
+}
+
+// validate checks r against the receipt schema and, in reject mode, that
+// its total reconciles with its items.
+func (s *server) validate(r points.Receipt) []fieldError {
+	errs := validateReceipt(r)
+	if errs != nil || s.reconcile.Mode != reconcileReject {
+		return errs
+	}
+	if sum, bad := s.reconcile.totalMismatch(r); bad {
+		receiptsTotalMismatch.Add(1)
+		msg := fmt.Sprintf("must equal the sum of item prices (%s)", sum)
+		if s.reconcile.Tolerance > 0 {
+			msg += fmt.Sprintf(" within %s", s.reconcile.Tolerance)
+		}
+		return []fieldError{{Field: "total", Code: codeTotalMismatch, Message: msg}}
+	}
+	return nil
+}
+
+// receiptFlags returns the flags to store with a receipt that passed
+// validation.
+func (s *server) receiptFlags(r points.Receipt) []string {
+	if s.reconcile.Mode != reconcileFlag {
+		return nil
+	}
+	if _, bad := s.reconcile.totalMismatch(r); bad {
+		receiptsTotalMismatch.Add(1)
+		return []string{flagTotalMismatch}
+	}
+	return nil
+}
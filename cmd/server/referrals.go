@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// referralConfig sets the referral bonuses and limits.
+type referralConfig struct {
+	ReferrerBonus int // points for the user whose code was used
+	RefereeBonus  int // points for the user who used it
+	// MaxPerReferrer caps how many users one code can refer.
+	MaxPerReferrer int
+}
+
+// referralConfigFromEnv reads the referral settings from the environment.
+func referralConfigFromEnv() (referralConfig, error) {
+	var cfg referralConfig
+	var err error
+	if cfg.ReferrerBonus, err = envInt("REFERRAL_REFERRER_BONUS", 500); err != nil {
+		return cfg, err
+	}
+	if cfg.RefereeBonus, err = envInt("REFERRAL_REFEREE_BONUS", 250); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxPerReferrer, err = envInt("REFERRAL_MAX_PER_USER", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.ReferrerBonus < 0 || cfg.RefereeBonus < 0 {
+		return cfg, fmt.Errorf("REFERRAL_REFERRER_BONUS and REFERRAL_REFEREE_BONUS must not be negative")
+	}
+	if cfg.MaxPerReferrer < 0 {
+		return cfg, fmt.Errorf("REFERRAL_MAX_PER_USER must not be negative")
+	}
+	return cfg, nil
+}
+
+// newReferralCode returns a random code that is easy to type.
+func newReferralCode() string {
+	b := make([]byte, 5)
+	rand.Read(b)
+	return base32.StdEncoding.EncodeToString(b)
+}
+
+// referralEntryID is the ledger entry ID for user's bonus for referee's
+// referral, fixed so the bonus is only paid once.
+func referralEntryID(user, referee string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(user+"\x00referral\x00"+referee)).String()
+}
+
+// rewardReferral pays the referral bonuses once referee, who has just
+// earned points, was referred. Each bonus is only paid once.
+func (s *server) rewardReferral(ctx context.Context, referee string) {
+	r, err := s.store.ReferralOf(ctx, referee)
+	if errors.Is(err, ErrReferralNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading referral of %s: %v", referee, err)
+		return
+	}
+	pay := func(user string, bonus int, reason string) {
+		if bonus == 0 {
+			return
+		}
+		id := referralEntryID(user, referee)
+		entries, err := s.store.Ledger(ctx, user)
+		if err != nil {
+			log.Printf("Error loading ledger for referral bonus: %v", err)
+			return
+		}
+		if slices.ContainsFunc(entries, func(e LedgerEntry) bool { return e.ID == id }) {
+			return
+		}
+		_, err = s.store.AddLedgerEntry(ctx, LedgerEntry{
+			ID:        id,
+			UserID:    user,
+			Type:      ledgerBonus,
+			Points:    bonus,
+			Reason:    reason,
+			CreatedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			log.Printf("Error paying referral bonus to %s: %v", user, err)
+		}
+	}
+	pay(referee, s.referrals.RefereeBonus, "Referral bonus for joining with code "+r.Code)
+	pay(r.Referrer, s.referrals.ReferrerBonus, "Referral bonus for referring "+referee)
+}
+
+// referralCodeHandler handles POST /users/{id}/referral-code
+func (s *server) referralCodeHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	code, err := s.store.ReferralCode(r.Context(), user, newReferralCode())
+	if err != nil {
+		log.Printf("Error creating referral code: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to create referral code")
+		return
+	}
+
+	response := map[string]string{"userId": user, "code": code}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// claimReferralHandler handles POST /users/{id}/referrer
+func (s *server) claimReferralHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if status, err := decodeJSONBody(r, &req); err != nil {
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	defer r.Body.Close()
+	req.Code = strings.ToUpper(strings.TrimSpace(req.Code))
+	if req.Code == "" {
+		writeProblem(w, r, http.StatusBadRequest, "code is required")
+		return
+	}
+
+	ctx := r.Context()
+	referrer, err := s.store.ReferralCodeOwner(ctx, req.Code)
+	if errors.Is(err, ErrReferralNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "Referral code not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up referral code: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to claim referral")
+		return
+	}
+	if referrer == user {
+		writeProblem(w, r, http.StatusBadRequest, "Users cannot refer themselves")
+		return
+	}
+	// Only new users can be referred, so existing users cannot trade codes
+	// for bonuses.
+	entries, err := s.store.Ledger(ctx, user)
+	if err != nil {
+		log.Printf("Error loading ledger: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to claim referral")
+		return
+	}
+	if slices.ContainsFunc(entries, func(e LedgerEntry) bool { return e.Type == ledgerEarn }) {
+		writeProblem(w, r, http.StatusConflict, "Referral codes must be claimed before the first receipt")
+		return
+	}
+
+	ref := Referral{Referrer: referrer, Referee: user, Code: req.Code, CreatedAt: time.Now().UTC()}
+	err = s.store.AddReferral(ctx, ref, s.referrals.MaxPerReferrer)
+	switch {
+	case errors.Is(err, ErrAlreadyReferred):
+		writeProblem(w, r, http.StatusConflict, "User was already referred")
+		return
+	case errors.Is(err, ErrReferralLimit):
+		writeProblem(w, r, http.StatusConflict, "This referral code has been used too many times")
+		return
+	case err != nil:
+		log.Printf("Error recording referral: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to claim referral")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ref)
+}
+
+// referralsHandler handles GET /users/{id}/referrals
+func (s *server) referralsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	refs, err := s.store.Referrals(r.Context(), user)
+	if err != nil {
+		log.Printf("Error loading referrals: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load referrals")
+		return
+	}
+	entries, err := s.store.Ledger(r.Context(), user)
+	if err != nil {
+		log.Printf("Error loading ledger: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load referrals")
+		return
+	}
+
+	type referral struct {
+		Referral
+		// Rewarded is set once the referee's first receipt paid the
+		// referrer's bonus.
+		Rewarded bool `json:"rewarded"`
+	}
+	out := make([]referral, len(refs))
+	for i, ref := range refs {
+		id := referralEntryID(user, ref.Referee)
+		out[i] = referral{ref, slices.ContainsFunc(entries, func(e LedgerEntry) bool { return e.ID == id })}
+	}
+
+	response := struct {
+		UserID    string     `json:"userId"`
+		Limit     int        `json:"limit"`
+		Referrals []referral `json:"referrals"`
+	}{user, s.referrals.MaxPerReferrer, out}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"fetch_assessment/points"
+)
+
+// reloader puts configuration changes into effect without a restart, on
+// SIGHUP or POST /admin/reload: the rules files, canary, API keys, rate
+// limits and log level. Everything is read and checked before anything is replaced,
+// so a mistake leaves the running configuration as it was.
+type reloader struct {
+	s       *server
+	auth    *authenticator
+	limiter *rateLimiter
+	// authEnabled is whether the server started with authentication, which
+	// a reload cannot turn on or off.
+	authEnabled bool
+
+	mu         sync.Mutex
+	configFile string
+	// sources says where each setting came from; see applySettings.
+	sources map[string]string
+	// fileValues are the settings last read from configFile.
+	fileValues map[string]string
+	// fileRules is the rule set last read from RULES_FILE. The active
+	// rules are only replaced when the file changes, so that rules set
+	// through the admin API survive a reload.
+	fileRules *points.Engine
+}
+
+// reloadResult is the body of the POST /admin/reload response.
+type reloadResult struct {
+	// Changed lists what was replaced: "rules", "apiKeyRules",
+	// "shadowRules", "canaryRules", "apiKeys", "rateLimits" and "logLevel".
+	Changed      []string `json:"changed"`
+	RulesVersion string   `json:"rulesVersion"`
+}
+
+func newReloader(s *server, auth *authenticator, limiter *rateLimiter, configFile string, sources map[string]string) (*reloader, error) {
+	rl := &reloader{s: s, auth: auth, limiter: limiter, authEnabled: auth.enabled(), configFile: configFile, sources: sources, fileRules: s.rules.Load()}
+	if configFile != "" {
+		var err error
+		if rl.fileValues, err = readSettingsFile(configFile); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", configFile, err)
+		}
+	}
+	return rl, nil
+}
+
+// reload reads the configuration again and applies what changed.
+func (rl *reloader) reload() (reloadResult, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	restore, err := rl.rereadFile()
+	if err != nil {
+		return reloadResult{}, err
+	}
+	res, err := rl.apply()
+	if err != nil {
+		restore()
+		return reloadResult{}, err
+	}
+	return res, nil
+}
+
+// rereadFile puts settings that changed in the configuration file into the
+// environment, unless the environment or -set gives them. It returns a
+// function that undoes this.
+func (rl *reloader) rereadFile() (func(), error) {
+	if rl.configFile == "" {
+		return func() {}, nil
+	}
+	values, err := readSettingsFile(rl.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", rl.configFile, err)
+	}
+	old := make(map[string]*string)
+	set := func(name string, value *string) {
+		if _, saved := old[name]; !saved {
+			if v, ok := os.LookupEnv(name); ok {
+				old[name] = &v
+			} else {
+				old[name] = nil
+			}
+		}
+		if value == nil {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, *value)
+		}
+	}
+	undo := func() {
+		for name, value := range old {
+			set(name, value)
+		}
+	}
+	for _, name := range knownSettings {
+		if source, ok := rl.sources[name]; ok && source != sourceFile {
+			continue
+		}
+		value, inFile := values[name]
+		prev, wasInFile := rl.fileValues[name]
+		switch {
+		case inFile && (!wasInFile || value != prev):
+			if strings.HasPrefix(value, "vault:") || vaultRefPattern.MatchString(value) {
+				undo()
+				return nil, fmt.Errorf("%s refers to Vault; restart the server to change it", name)
+			}
+			set(name, &value)
+		case !inFile && wasInFile:
+			set(name, nil)
+		}
+	}
+	committed := rl.fileValues
+	rl.fileValues = values
+	return func() {
+		undo()
+		rl.fileValues = committed
+	}, nil
+}
+
+// apply reads the reloadable settings from the environment and, if they
+// are all valid, puts those that changed into effect.
+func (rl *reloader) apply() (reloadResult, error) {
+	s := rl.s
+	fileRules, err := loadRules(os.Getenv("RULES_FILE"))
+	if err != nil {
+		return reloadResult{}, fmt.Errorf("RULES_FILE: %w", err)
+	}
+	keyRules, err := loadKeyRules(os.Getenv("API_KEY_RULES"))
+	if err != nil {
+		return reloadResult{}, err
+	}
+	var shadow *points.Engine
+	if path := os.Getenv("SHADOW_RULES_FILE"); path != "" {
+		if shadow, err = loadRules(path); err != nil {
+			return reloadResult{}, fmt.Errorf("SHADOW_RULES_FILE: %w", err)
+		}
+	}
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return reloadResult{}, err
+	}
+	admins := loadAdminKeys()
+	if !rl.authEnabled && len(keys) > 0 {
+		return reloadResult{}, errors.New("API keys cannot turn authentication on; restart the server")
+	}
+	rateCfg, err := rateLimitConfigFromEnv()
+	if err != nil {
+		return reloadResult{}, err
+	}
+	var level slog.Level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return reloadResult{}, fmt.Errorf("LOG_LEVEL: %w", err)
+		}
+	}
+
+	// Rules changed through the admin API in the meantime win unless the
+	// file changed too; a changed file must not reuse the active version
+	// for different rules.
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	rulesChanged := !reflect.DeepEqual(fileRules.RuleSet(), rl.fileRules.RuleSet())
+	if active := s.rules.Load(); rulesChanged && fileRules.Version() == active.Version() && !reflect.DeepEqual(fileRules.RuleSet(), active.RuleSet()) {
+		return reloadResult{}, fmt.Errorf("RULES_FILE: rule set version %q is already active with different rules", fileRules.Version())
+	}
+	active := s.rules.Load()
+	if rulesChanged {
+		active = fileRules
+	}
+	canary, err := canaryRulesFromEnv(active)
+	if err != nil {
+		return reloadResult{}, err
+	}
+
+	var res reloadResult
+	if rulesChanged {
+		s.rules.Store(fileRules)
+		rl.fileRules = fileRules
+		res.Changed = append(res.Changed, "rules")
+	}
+	if old := s.keyRules.Load(); old == nil || !sameEngines(*old, keyRules) {
+		s.keyRules.Store(&keyRules)
+		res.Changed = append(res.Changed, "apiKeyRules")
+	}
+	if old := s.shadowRules.Load(); (old == nil) != (shadow == nil) || (old != nil && !reflect.DeepEqual(old.RuleSet(), shadow.RuleSet())) {
+		s.shadowRules.Store(shadow)
+		res.Changed = append(res.Changed, "shadowRules")
+	}
+	if !canary.equal(s.canary.Load()) {
+		s.canary.Store(canary)
+		res.Changed = append(res.Changed, "canaryRules")
+	}
+	if !reflect.DeepEqual(keys, rl.auth.keys()) || !maps.Equal(admins, rl.auth.admins()) {
+		rl.auth.apiKeys.Store(&keys)
+		rl.auth.adminKeys.Store(&admins)
+		res.Changed = append(res.Changed, "apiKeys")
+	}
+	rl.limiter.mu.Lock()
+	rateChanged := rateCfg != rl.limiter.cfg
+	rl.limiter.mu.Unlock()
+	if rateChanged {
+		rl.limiter.update(rateCfg)
+		res.Changed = append(res.Changed, "rateLimits")
+	}
+	if level != logLevel.Level() {
+		logLevel.Set(level)
+		res.Changed = append(res.Changed, "logLevel")
+	}
+	res.RulesVersion = s.rules.Load().Version()
+	if res.Changed == nil {
+		res.Changed = []string{}
+	}
+	return res, nil
+}
+
+// sameEngines reports whether two sets of per-key rules are the same.
+func sameEngines(a, b map[string]*points.Engine) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, engine := range a {
+		other, ok := b[name]
+		if !ok || !reflect.DeepEqual(engine.RuleSet(), other.RuleSet()) {
+			return false
+		}
+	}
+	return true
+}
+
+// watchSignals reloads the configuration on each SIGHUP until ctx is done,
+// recording each attempt in the audit log.
+func (rl *reloader) watchSignals(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+		}
+		res, err := rl.reload()
+		entry := auditEntry{Actor: auditActorSystem, Action: "SIGHUP reload"}
+		if err != nil {
+			slog.Error("Configuration reload failed; keeping the current configuration", "error", err)
+			entry.Detail = "Reload failed: " + err.Error()
+		} else {
+			slog.Info("Configuration reloaded", "audit", true, "trigger", "SIGHUP", "changed", res.Changed, "rules_version", res.RulesVersion)
+			entry.Detail = "Changed: " + strings.Join(res.Changed, ", ")
+		}
+		recordAudit(ctx, rl.s.audit, entry)
+	}
+}
+
+// reloadHandler handles POST /admin/reload
+func (s *server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := s.reloader.reload()
+	if err != nil {
+		slog.Error("Configuration reload failed; keeping the current configuration", "error", err)
+		setAuditDetail(r.Context(), "Reload failed: "+err.Error())
+		writeProblem(w, r, http.StatusUnprocessableEntity, "Reload failed: "+err.Error())
+		return
+	}
+	id, _ := identityFrom(r.Context())
+	slog.Info("Configuration reloaded", "audit", true, "trigger", "api", "api_key", id.APIKey, "subject", id.Subject,
+		"changed", res.Changed, "rules_version", res.RulesVersion)
+	setAuditDetail(r.Context(), "Changed: "+strings.Join(res.Changed, ", "))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"fetch_assessment/points"
+)
+
+const (
+	// defaultReportSchedule produces the previous day's report shortly
+	// after midnight UTC.
+	defaultReportSchedule = "5 0 * * *"
+	// reportDeliveryAttempts bounds how often each sink is tried.
+	reportDeliveryAttempts = 5
+	reportDateLayout       = "2006-01-02"
+)
+
+// reportConfig controls when daily reports are generated and where they
+// are sent.
+type reportConfig struct {
+	// Schedule is a cron expression, in UTC, for generating the previous
+	// day's report; nil disables reports.
+	Schedule     cron.Schedule
+	TopRetailers int
+
+	// WebhookURL receives each report as JSON, signed with WebhookSecret
+	// when set.
+	WebhookURL    string
+	WebhookSecret string
+
+	// EmailTo receives each report as a plain-text email sent through
+	// SMTPAddr.
+	EmailTo      []string
+	EmailFrom    string
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// reportConfigFromEnv reads the daily report settings from the environment.
+func reportConfigFromEnv() (reportConfig, error) {
+	var cfg reportConfig
+	var err error
+	spec := os.Getenv("REPORT_SCHEDULE")
+	if spec == "" {
+		spec = defaultReportSchedule
+	}
+	if spec != "off" {
+		if cfg.Schedule, err = cron.ParseStandard(spec); err != nil {
+			return cfg, fmt.Errorf("REPORT_SCHEDULE: %w", err)
+		}
+	}
+	if cfg.TopRetailers, err = envInt("REPORT_TOP_RETAILERS", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.TopRetailers < 1 || cfg.TopRetailers > maxStatsTop {
+		return cfg, fmt.Errorf("REPORT_TOP_RETAILERS must be from 1 to %d", maxStatsTop)
+	}
+	cfg.WebhookURL = os.Getenv("REPORT_WEBHOOK_URL")
+	cfg.WebhookSecret = os.Getenv("REPORT_WEBHOOK_SECRET")
+	if cfg.WebhookURL != "" {
+		u, err := url.Parse(cfg.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("REPORT_WEBHOOK_URL must be an absolute http or https URL")
+		}
+	}
+	cfg.EmailTo = splitList(os.Getenv("REPORT_EMAIL_TO"))
+	cfg.EmailFrom = os.Getenv("REPORT_EMAIL_FROM")
+	cfg.SMTPAddr = os.Getenv("REPORT_SMTP_ADDR")
+	cfg.SMTPUsername = os.Getenv("REPORT_SMTP_USERNAME")
+	cfg.SMTPPassword = os.Getenv("REPORT_SMTP_PASSWORD")
+	if len(cfg.EmailTo) > 0 && (cfg.EmailFrom == "" || cfg.SMTPAddr == "") {
+		return cfg, fmt.Errorf("REPORT_EMAIL_TO requires REPORT_EMAIL_FROM and REPORT_SMTP_ADDR")
+	}
+	return cfg, nil
+}
+
+// buildDailyReport summarises the receipts processed on day, a UTC date.
+func buildDailyReport(ctx context.Context, store ReceiptStore, rules *points.Engine, day time.Time, top int) (DailyReport, error) {
+	all, err := store.List(ctx)
+	if err != nil {
+		return DailyReport{}, err
+	}
+	start := day.UTC().Truncate(24 * time.Hour)
+	end := start.Add(24 * time.Hour)
+	report := DailyReport{
+		Date:        start.Format(reportDateLayout),
+		ByStatus:    make(map[string]int),
+		GeneratedAt: time.Now().UTC(),
+	}
+	var processed []StoredReceipt
+	for _, rec := range all {
+		if rec.ProcessedAt.Before(start) || !rec.ProcessedAt.Before(end) {
+			continue
+		}
+		processed = append(processed, rec)
+		report.ByStatus[statusText(rec.Status)]++
+		report.PointsAwarded += rec.Points
+	}
+	report.ReceiptsProcessed = len(processed)
+	report.TopRetailers = topRetailers(processed, rules, top)
+	return report, nil
+}
+
+// runReportScheduler generates the previous day's report at each time
+// cfg.Schedule names until ctx is done. Only the replica that saves a
+// report first delivers it.
+func runReportScheduler(ctx context.Context, store ReceiptStore, audit auditLog, rules func() *points.Engine, cfg reportConfig) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for {
+		next := cfg.Schedule.Next(time.Now().UTC())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		report, err := buildDailyReport(ctx, store, rules(), next.AddDate(0, 0, -1), cfg.TopRetailers)
+		if err != nil {
+			slog.Error("Error building daily report", "error", err)
+			continue
+		}
+		added, err := store.AddReport(ctx, report)
+		if err != nil {
+			slog.Error("Error saving daily report", "date", report.Date, "error", err)
+			continue
+		}
+		if !added {
+			continue
+		}
+		reportsGenerated.Add(1)
+		slog.Info("Daily report generated", "date", report.Date, "receipts", report.ReceiptsProcessed)
+		recordAudit(ctx, audit, auditEntry{Actor: auditActorSystem, Action: "daily report", Target: report.Date})
+		go deliverReport(client, cfg, report)
+	}
+}
+
+// deliverReport sends report to each configured sink, retrying failures.
+func deliverReport(client *http.Client, cfg reportConfig, report DailyReport) {
+	var sinks []func() error
+	if cfg.WebhookURL != "" {
+		sinks = append(sinks, func() error { return sendReportWebhook(client, cfg, report) })
+	}
+	if len(cfg.EmailTo) > 0 {
+		sinks = append(sinks, func() error { return sendReportEmail(cfg, report) })
+	}
+	for _, send := range sinks {
+		for attempt := 1; ; attempt++ {
+			err := send()
+			if err == nil {
+				break
+			}
+			if attempt >= reportDeliveryAttempts {
+				reportDeliveryFailures.Add(1)
+				slog.Warn("Daily report delivery failed", "date", report.Date, "attempts", attempt, "error", err)
+				break
+			}
+			time.Sleep(webhookBackoff(attempt))
+		}
+	}
+}
+
+// sendReportWebhook POSTs report to cfg.WebhookURL.
+func sendReportWebhook(client *http.Client, cfg reportConfig, report DailyReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "receipt-processor-webhooks")
+	req.Header.Set("X-Event-Type", "report.daily")
+	if cfg.WebhookSecret != "" {
+		req.Header.Set("X-Signature", "sha256="+signPayload(cfg.WebhookSecret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// sendReportEmail mails a plain-text rendering of report to cfg.EmailTo.
+func sendReportEmail(cfg reportConfig, report DailyReport) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.EmailFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.EmailTo, ", "))
+	fmt.Fprintf(&msg, "Subject: Receipt report for %s\r\n", report.Date)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Receipts processed: %d\r\n", report.ReceiptsProcessed)
+	for _, status := range []string{statusAccepted, statusNeedsReview, statusRejected, statusPending} {
+		if n := report.ByStatus[status]; n > 0 {
+			fmt.Fprintf(&msg, "  %s: %d\r\n", status, n)
+		}
+	}
+	fmt.Fprintf(&msg, "Points awarded: %d\r\n", report.PointsAwarded)
+	if len(report.TopRetailers) > 0 {
+		msg.WriteString("\r\nTop retailers:\r\n")
+		for i, rt := range report.TopRetailers {
+			fmt.Fprintf(&msg, "%2d. %s: %d receipts, %d points\r\n", i+1, rt.Retailer, rt.Receipts, rt.Points)
+		}
+	}
+
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return smtp.SendMail(cfg.SMTPAddr, auth, cfg.EmailFrom, cfg.EmailTo, []byte(msg.String()))
+}
+
+// reportHandler handles GET /reports/{date}
+func (s *server) reportHandler(w http.ResponseWriter, r *http.Request) {
+	date := r.PathValue("date")
+	if _, err := time.Parse(reportDateLayout, date); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "date must be formatted YYYY-MM-DD")
+		return
+	}
+	report, err := s.store.Report(r.Context(), date)
+	if errors.Is(err, ErrReportNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "No report for that date")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading report %s: %v", date, err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load report")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// runRetentionSweeper deletes receipts processed more than retention ago,
+// checking every interval until ctx is done.
+func runRetentionSweeper(ctx context.Context, store ReceiptStore, audit auditLog, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sweepExpired(ctx, store, audit, time.Now().Add(-retention))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepExpired deletes receipts processed before cutoff and records how many
+// were removed.
+func sweepExpired(ctx context.Context, store ReceiptStore, audit auditLog, cutoff time.Time) {
+	n, err := store.DeleteBefore(ctx, cutoff)
+	if err != nil {
+		slog.Error("Error purging expired receipts", "error", err)
+	}
+	if n > 0 {
+		receiptsExpired.Add(int64(n))
+		slog.Info("Purged expired receipts", "count", n, "cutoff", cutoff.UTC())
+		recordAudit(ctx, audit, auditEntry{
+			Actor:  auditActorSystem,
+			Action: "retention sweep",
+			Detail: fmt.Sprintf("Deleted %d receipts processed before %s", n, cutoff.UTC().Format(time.RFC3339)),
+		})
+	}
+}
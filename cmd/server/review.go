@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"fetch_assessment/points"
+)
+
+// Receipt statuses. Receipts are accepted and awarded their points as they
+// are processed unless their fraud score sends them for review first.
+const (
+	statusPending     = "pending"      // received, not scored yet
+	statusAccepted    = "accepted"     // points awarded
+	statusNeedsReview = "needs_review" // waiting in the review queue
+	statusRejected    = "rejected"     // refused by a reviewer; no points
+)
+
+// accepted reports whether rec has been awarded its points.
+func (rec StoredReceipt) accepted() bool {
+	return rec.Status == statusAccepted || rec.Status == ""
+}
+
+// initialStatus is the status of a newly scored receipt: receipts with a
+// fraud score of at least s.reviewMinScore need review.
+func (s *server) initialStatus(fraudScore int) string {
+	if s.reviewMinScore > 0 && fraudScore >= s.reviewMinScore {
+		return statusNeedsReview
+	}
+	return statusAccepted
+}
+
+// ownerRules returns the rules receipts submitted by owner are scored
+// with: its API key's own rules, or the default rules.
+func (s *server) ownerRules(owner string) *points.Engine {
+	if name, ok := strings.CutPrefix(owner, "apikey:"); ok {
+		if engine, ok := s.keyRulesFor(name); ok {
+			return engine
+		}
+	}
+	return s.rules.Load()
+}
+
+// reviewsHandler handles GET /admin/reviews
+func (s *server) reviewsHandler(w http.ResponseWriter, r *http.Request) {
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing receipts: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to list receipts")
+		return
+	}
+	// Oldest first: the queue is worked in submission order.
+	receipts := make([]StoredReceipt, 0)
+	for _, rec := range all {
+		if rec.Status == statusNeedsReview {
+			receipts = append(receipts, rec)
+		}
+	}
+
+	response := map[string][]StoredReceipt{"receipts": receipts}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// approveReviewHandler handles POST /admin/reviews/{id}/approve
+func (s *server) approveReviewHandler(w http.ResponseWriter, r *http.Request) {
+	s.review(w, r, statusAccepted)
+}
+
+// rejectReviewHandler handles POST /admin/reviews/{id}/reject
+func (s *server) rejectReviewHandler(w http.ResponseWriter, r *http.Request) {
+	s.review(w, r, statusRejected)
+}
+
+// review moves a receipt out of the review queue into status. Approved
+// receipts are scored with their owner's current rules.
+func (s *server) review(w http.ResponseWriter, r *http.Request, status string) {
+	id := r.PathValue("id")
+	setLogReceiptID(r.Context(), id)
+
+	rec, err := s.store.GetReceipt(r.Context(), id)
+	if errors.Is(err, ErrReceiptNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "Receipt ID not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading receipt: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load receipt")
+		return
+	}
+	if rec.Status != statusNeedsReview {
+		writeProblem(w, r, http.StatusConflict, fmt.Sprintf("Receipt is %s, not waiting for review", statusText(rec.Status)))
+		return
+	}
+
+	total, version := 0, ""
+	if status == statusAccepted {
+		rules := s.withCanary(s.ownerRules(rec.Owner), rec.ContentHash, rec.UserID)
+		if total, _, err = rules.CalculateForTier(rec.Receipt, rec.Tier); err != nil {
+			log.Printf("Error scoring receipt %s: %v", id, err)
+			writeProblem(w, r, http.StatusInternalServerError, "Failed to score receipt")
+			return
+		}
+		version = rules.Version()
+	}
+	err = s.store.SetStatus(r.Context(), id, statusNeedsReview, status, total, version)
+	switch {
+	case errors.Is(err, ErrReceiptNotFound):
+		writeProblem(w, r, http.StatusNotFound, "Receipt ID not found")
+		return
+	case errors.Is(err, ErrStatusChanged):
+		writeProblem(w, r, http.StatusConflict, "Receipt was reviewed by someone else")
+		return
+	case err != nil:
+		log.Printf("Error updating receipt %s: %v", id, err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to update receipt")
+		return
+	}
+	rec.Status, rec.Points, rec.RulesVersion = status, total, version
+	s.analytics.add(rec, 0, total)
+	if status == statusAccepted {
+		s.credit(r.Context(), rec, "Receipt approved on review")
+		s.emit(r.Context(), eventReceiptRescored, rec)
+	}
+
+	caller, _ := identityFrom(r.Context())
+	slog.Info("Receipt reviewed",
+		"audit", true,
+		"api_key", caller.APIKey,
+		"subject", caller.Subject,
+		"receipt_id", id,
+		"status", status,
+		"points", total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// statusText returns status for display, reporting receipts stored before
+// statuses existed as accepted.
+func statusText(status string) string {
+	if status == "" {
+		return statusAccepted
+	}
+	return status
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// legacyDeprecatedAt is when the unversioned paths were superseded by /v1.
+var legacyDeprecatedAt = time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC)
+
+// routes registers the API handlers under /v1 and, for existing clients,
+// at their original unversioned paths. The method-qualified patterns make
+// the mux answer 405 with an Allow header for wrong methods and 404 for
+// anything else; both are returned as problem details.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range []struct {
+		method, path string
+		scope        string
+		handler      http.HandlerFunc
+	}{
+		{"POST", "/receipts/process", scopeReceiptsWrite, s.idempotent(s.processReceiptHandler)},
+		{"POST", "/receipts/process/batch", scopeReceiptsWrite, s.processBatchHandler},
+		{"POST", "/receipts/import", scopeReceiptsWrite, s.importReceiptsHandler},
+		{"POST", "/receipts/stream", scopeReceiptsWrite, s.streamReceiptsHandler},
+		{"POST", "/receipts/score", scopeReceiptsRead, s.scoreReceiptHandler},
+		{"GET", "/receipts", scopeReceiptsRead, s.listReceiptsHandler},
+		{"GET", "/receipts/{id}", scopeReceiptsRead, s.getReceiptHandler},
+		{"DELETE", "/receipts/{id}", scopeReceiptsWrite, s.deleteReceiptHandler},
+		{"POST", "/receipts/{id}/recalculate", scopeReceiptsWrite, s.recalculateHandler},
+		{"POST", "/receipts/recalculate", scopeReceiptsWrite, s.recalculateAllHandler},
+		{"GET", "/receipts/{id}/points", scopeReceiptsRead, s.getPointsHandler},
+		{"GET", "/receipts/{id}/points/breakdown", scopeReceiptsRead, s.getBreakdownHandler},
+		{"GET", "/jobs/{id}", scopeReceiptsRead, s.getJobHandler},
+		{"GET", "/users/{id}/receipts", scopeReceiptsRead, s.userReceiptsHandler},
+		{"GET", "/users/{id}/balance", scopeReceiptsRead, s.balanceHandler},
+		{"GET", "/users/{id}/balance/expiring", scopeReceiptsRead, s.expiringPointsHandler},
+		{"GET", "/users/{id}/ledger", scopeReceiptsRead, s.ledgerHandler},
+		{"GET", "/users/{id}/achievements", scopeReceiptsRead, s.achievementsHandler},
+		{"GET", "/users/{id}/tier", scopeReceiptsRead, s.tierHandler},
+		{"POST", "/users/{id}/referral-code", scopeReceiptsWrite, s.referralCodeHandler},
+		{"POST", "/users/{id}/referrer", scopeReceiptsWrite, s.claimReferralHandler},
+		{"GET", "/users/{id}/referrals", scopeReceiptsRead, s.referralsHandler},
+		{"POST", "/users/{id}/redeem", scopeReceiptsWrite, s.idempotent(s.redeemHandler)},
+		{"GET", "/users/{id}/export", scopeReceiptsRead, s.exportUserHandler},
+		{"DELETE", "/users/{id}/data", scopeReceiptsWrite, s.deleteUserDataHandler},
+		{"GET", "/ws", scopeReceiptsRead, s.webSocketHandler},
+		{"POST", "/rules/simulate", scopeReceiptsRead, s.simulateRulesHandler},
+		{"POST", "/webhooks", scopeReceiptsWrite, requireAPIKey(s.createWebhookHandler)},
+		{"GET", "/webhooks", scopeReceiptsRead, requireAPIKey(s.listWebhooksHandler)},
+		{"DELETE", "/webhooks/{id}", scopeReceiptsWrite, requireAPIKey(s.deleteWebhookHandler)},
+		{"POST", "/webhooks/{id}/rotate-secret", scopeReceiptsWrite, requireAPIKey(s.rotateWebhookSecretHandler)},
+		{"GET", "/admin/rules", scopeRulesAdmin, requireAdmin(s.getRulesHandler)},
+		{"PUT", "/admin/rules", scopeRulesAdmin, requireAdmin(s.putRulesHandler)},
+		{"GET", "/admin/promotions", scopeRulesAdmin, requireAdmin(s.getPromotionsHandler)},
+		{"PUT", "/admin/promotions/{name}", scopeRulesAdmin, requireAdmin(s.putPromotionHandler)},
+		{"DELETE", "/admin/promotions/{name}", scopeRulesAdmin, requireAdmin(s.deletePromotionHandler)},
+		{"GET", "/admin/categories", scopeRulesAdmin, requireAdmin(s.getCategoriesHandler)},
+		{"PUT", "/admin/categories", scopeRulesAdmin, requireAdmin(s.putCategoriesHandler)},
+		{"GET", "/admin/fraud", scopeRulesAdmin, requireAdmin(s.fraudReviewHandler)},
+		{"GET", "/admin/reviews", scopeRulesAdmin, requireAdmin(s.reviewsHandler)},
+		{"POST", "/admin/reviews/{id}/approve", scopeRulesAdmin, requireAdmin(s.approveReviewHandler)},
+		{"POST", "/admin/reviews/{id}/reject", scopeRulesAdmin, requireAdmin(s.rejectReviewHandler)},
+		{"POST", "/admin/users/{id}/adjustments", scopeRulesAdmin, requireAdmin(s.adjustPointsHandler)},
+		{"GET", "/admin/stats", scopeRulesAdmin, requireAdmin(s.statsHandler)},
+		{"GET", "/admin/runtime", scopeRulesAdmin, requireAdmin(s.runtimeHandler)},
+		{"POST", "/admin/reload", scopeRulesAdmin, requireAdmin(s.reloadHandler)},
+		{"GET", "/admin/audit", scopeRulesAdmin, requireAdmin(s.auditHandler)},
+		{"GET", "/analytics/points", scopeRulesAdmin, requireAdmin(s.analyticsPointsHandler)},
+		{"GET", "/reports/{date}", scopeRulesAdmin, requireAdmin(s.reportHandler)},
+		{"GET", "/admin/export", scopeRulesAdmin, requireAdmin(s.exportHandler)},
+		{"POST", "/admin/backup", scopeRulesAdmin, requireAdmin(s.backupHandler)},
+		{"POST", "/admin/restore", scopeRulesAdmin, requireAdmin(s.restoreHandler)},
+		{"GET", "/events/stream", scopeRulesAdmin, requireAdmin(s.eventStreamHandler)},
+	} {
+		h := requireScope(rt.scope, rt.handler)
+		if audited(rt.method, rt.path) {
+			h = s.withAudit(rt.method+" "+rt.path, h)
+		}
+		mux.Handle(rt.method+" /v1"+rt.path, h)
+		mux.Handle(rt.method+" "+rt.path, s.deprecated(h))
+	}
+
+	// GraphQL view of the same store; scopes are checked per field.
+	mux.Handle("POST /graphql", s.graphqlHandler())
+
+	// API contract and interactive documentation.
+	mux.HandleFunc("GET /openapi.json", openAPIHandler)
+	mux.HandleFunc("GET /docs", docsHandler)
+
+	// Runtime counters such as receipts_expired_total, for administrators
+	// only: they include the command line, which may carry -set secrets.
+	mux.Handle("GET /debug/vars", requireScope(scopeRulesAdmin, requireAdmin(expvar.Handler().ServeHTTP)))
+
+	// Profiles for live instances, for administrators only.
+	registerPprof(mux)
+
+	// Probes for orchestrators and load balancers; not part of the versioned API.
+	mux.HandleFunc("GET /healthz", s.healthzHandler)
+	mux.HandleFunc("GET /readyz", s.readyzHandler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests that match no route get the mux's built-in 404/405
+		// response, rewritten as problem details.
+		if _, pattern := mux.Handler(r); pattern == "" {
+			w = &problemWriter{ResponseWriter: w, r: r}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// deprecated marks responses from a legacy unversioned path with
+// Deprecation (RFC 9745), Sunset (RFC 8594, when configured) and a Link to
+// the /v1 equivalent.
+func (s *server) deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecatedAt.Unix(), 10))
+		if !s.legacySunset.IsZero() {
+			h.Set("Sunset", s.legacySunset.Format(http.TimeFormat))
+		}
+		h.Set("Link", `</v1`+r.URL.EscapedPath()+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
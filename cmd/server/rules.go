@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"fetch_assessment/points"
+)
+
+// loadRules compiles the rule set in path, or the built-in rules when path
+// is empty.
+func loadRules(path string) (*points.Engine, error) {
+	if path == "" {
+		return points.DefaultEngine(), nil
+	}
+	rs, err := points.LoadRuleSet(path)
+	if err != nil {
+		return nil, err
+	}
+	engine, err := points.Compile(rs)
+	if err != nil {
+		return nil, fmt.Errorf("rule set %s: %w", path, err)
+	}
+	return engine, nil
+}
+
+// loadKeyRules compiles the per-API-key rule sets in spec, a comma-separated
+// list of "name=path" entries naming an API key and its rules file.
+func loadKeyRules(spec string) (map[string]*points.Engine, error) {
+	out := make(map[string]*points.Engine)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, path, ok := strings.Cut(entry, "=")
+		name, path = strings.TrimSpace(name), strings.TrimSpace(path)
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("API_KEY_RULES: invalid entry %q, expected name=path", entry)
+		}
+		if _, dup := out[name]; dup {
+			return nil, fmt.Errorf("API_KEY_RULES: duplicate entry for %q", name)
+		}
+		engine, err := loadRules(path)
+		if err != nil {
+			return nil, fmt.Errorf("API_KEY_RULES: %w", err)
+		}
+		out[name] = engine
+	}
+	return out, nil
+}
+
+// rulesFor returns the rules that score receipts for the caller on ctx:
+// their API key's own rules if it has some, otherwise the active rules.
+func (s *server) rulesFor(ctx context.Context) *points.Engine {
+	if id, ok := identityFrom(ctx); ok && id.APIKey != "" {
+		if engine, ok := s.keyRulesFor(id.APIKey); ok {
+			return engine
+		}
+	}
+	return s.rules.Load()
+}
+
+// keyRulesFor returns the API key name's own rules, if it has some.
+func (s *server) keyRulesFor(name string) (*points.Engine, bool) {
+	keyRules := s.keyRules.Load()
+	if keyRules == nil {
+		return nil, false
+	}
+	engine, ok := (*keyRules)[name]
+	return engine, ok
+}
+
+// shadowScore scores rec with the shadow rule set, if one is configured,
+// and records how the result compares with the live score. Receipts that
+// score differently are logged.
+func (s *server) shadowScore(rec StoredReceipt) {
+	shadow := s.shadowRules.Load()
+	if shadow == nil {
+		return
+	}
+	total, _, err := shadow.CalculateForTier(rec.Receipt, rec.Tier)
+	if err != nil {
+		slog.Warn("Shadow scoring failed", "receipt_id", rec.ID, "error", err)
+		return
+	}
+	shadowScored.Add(1)
+	if total == rec.Points {
+		return
+	}
+	shadowMismatches.Add(1)
+	shadowPointsDelta.Add(int64(total - rec.Points))
+	slog.Info("Shadow score differs",
+		"receipt_id", rec.ID,
+		"points", rec.Points,
+		"rules_version", rec.RulesVersion,
+		"shadow_points", total,
+		"shadow_rules_version", shadow.Version())
+}
+
+// scoreResult is a receipt's score under one rule set.
+type scoreResult struct {
+	Points       int              `json:"points"`
+	RulesVersion string           `json:"rulesVersion"`
+	Breakdown    points.Breakdown `json:"breakdown"`
+}
+
+// simulateRulesHandler handles POST /rules/simulate
+func (s *server) simulateRulesHandler(w http.ResponseWriter, r *http.Request) {
+	// Rules replaces the active rule set entirely; Overrides replaces or
+	// adds individual rules by name. With neither, the simulation uses the
+	// active rules unchanged.
+	var req struct {
+		Receipt   points.Receipt      `json:"receipt"`
+		Rules     *points.RuleSet     `json:"rules"`
+		Overrides []points.RuleConfig `json:"overrides"`
+	}
+	if status, err := decodeJSONBody(r, &req); err != nil {
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if errs := s.validate(req.Receipt); errs != nil {
+		for i := range errs {
+			errs[i].Field = "receipt." + errs[i].Field
+		}
+		writeInvalidReceipt(w, r, errs)
+		return
+	}
+
+	active := s.rulesFor(r.Context())
+	simulated := active.RuleSet()
+	if req.Rules != nil {
+		simulated = *req.Rules
+	}
+	if len(req.Overrides) > 0 {
+		simulated = simulated.WithOverrides(req.Overrides)
+	}
+	// Plugins and calendars are read from the server's disk or network, so
+	// a simulation may only use those the active rules already load.
+	if ref := newExternalRef(simulated, active.RuleSet()); ref != "" {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid rule set: %s is not used by the active rules", ref))
+		return
+	}
+	engine, err := points.Compile(simulated)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid rule set: "+err.Error())
+		return
+	}
+
+	// Score under the active and the hypothetical rules; nothing is stored.
+	current, err := score(active, req.Receipt)
+	if err != nil {
+		log.Printf("Error scoring receipt: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to score receipt")
+		return
+	}
+	sim, err := score(engine, req.Receipt)
+	if err != nil {
+		log.Printf("Error scoring receipt: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to score receipt")
+		return
+	}
+	response := struct {
+		Current    scoreResult `json:"current"`
+		Simulated  scoreResult `json:"simulated"`
+		Difference int         `json:"difference"`
+	}{current, sim, sim.Points - current.Points}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// newExternalRef describes the first plugin module or calendar in rs that
+// active does not use, or returns "" if there is none.
+func newExternalRef(rs, active points.RuleSet) string {
+	loaded := make(map[string]bool)
+	for _, c := range active.Rules {
+		loaded["module "+c.Module] = true
+		loaded["calendar "+c.Calendar] = true
+	}
+	for _, c := range rs.Rules {
+		if c.Type == "wasm" && !loaded["module "+c.Module] {
+			return fmt.Sprintf("plugin module %q", c.Module)
+		}
+		if c.Type == "holiday" && !loaded["calendar "+c.Calendar] {
+			return fmt.Sprintf("calendar %q", c.Calendar)
+		}
+	}
+	return ""
+}
+
+// score runs engine against receipt.
+func score(engine *points.Engine, receipt points.Receipt) (scoreResult, error) {
+	total, breakdown, err := engine.Calculate(receipt)
+	if err != nil {
+		return scoreResult{}, err
+	}
+	return scoreResult{total, engine.Version(), breakdown}, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// vaultRefPattern matches a reference to a field of a secret in Vault
+// inside an environment variable: ${vault:<path>#<field>}.
+var vaultRefPattern = regexp.MustCompile(`\$\{vault:([^}#]+)#([^}]+)\}`)
+
+// vaultSecrets resolves environment variables that refer to secrets in
+// Vault, either as the whole value ("vault:<path>#<field>") or embedded in
+// it ("postgres://${vault:database/creds/receipts#username}:..."), and
+// reads them again so that rotated secrets take effect.
+type vaultSecrets struct {
+	client   *vaultClient
+	interval time.Duration
+	// templates are the variables' values as configured, by name.
+	templates map[string]string
+	// nextRead is when the secrets are read again: after interval, or
+	// sooner when a lease is running out.
+	nextRead time.Time
+}
+
+// loadVaultSecrets finds the environment variables that refer to Vault and
+// replaces each with the secret it refers to, so the rest of the
+// configuration reads them like any other value. It returns nil when no
+// variable refers to Vault.
+func loadVaultSecrets(ctx context.Context, client *vaultClient) (*vaultSecrets, error) {
+	s := &vaultSecrets{client: client, templates: make(map[string]string)}
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "VAULT_") {
+			continue
+		}
+		if strings.HasPrefix(value, "vault:") || vaultRefPattern.MatchString(value) {
+			s.templates[name] = value
+		}
+	}
+	if len(s.templates) == 0 {
+		return nil, nil
+	}
+	if client == nil {
+		return nil, fmt.Errorf("environment variables refer to Vault but VAULT_ADDR is not set")
+	}
+	var err error
+	if s.interval, err = envDuration("VAULT_SECRETS_REFRESH", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if s.interval <= 0 {
+		return nil, fmt.Errorf("VAULT_SECRETS_REFRESH must be positive")
+	}
+	if _, err := s.resolve(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// resolve reads each secret referred to once and sets the variables to
+// their values, returning the names of those that changed. If any read
+// fails no variable is changed.
+func (s *vaultSecrets) resolve(ctx context.Context) ([]string, error) {
+	secrets := make(map[string]map[string]any)
+	var lease time.Duration
+	lookup := func(path, field string) (string, error) {
+		data, ok := secrets[path]
+		if !ok {
+			// Read each path once, so that fields of a dynamic secret,
+			// such as a database username and password, belong together.
+			var l time.Duration
+			var err error
+			if data, l, err = s.client.read(ctx, path); err != nil {
+				return "", err
+			}
+			secrets[path] = data
+			if l > 0 && (lease == 0 || l < lease) {
+				lease = l
+			}
+		}
+		v, ok := data[field]
+		if !ok || v == nil {
+			return "", fmt.Errorf("vault %s has no field %q", path, field)
+		}
+		return fmt.Sprint(v), nil
+	}
+
+	values := make(map[string]string, len(s.templates))
+	for name, tmpl := range s.templates {
+		if ref, ok := strings.CutPrefix(tmpl, "vault:"); ok {
+			path, field, ok := strings.Cut(ref, "#")
+			if !ok {
+				return nil, fmt.Errorf("%s must look like vault:<path>#<field>", name)
+			}
+			v, err := lookup(path, field)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			values[name] = v
+			continue
+		}
+		var err error
+		values[name] = vaultRefPattern.ReplaceAllStringFunc(tmpl, func(m string) string {
+			sub := vaultRefPattern.FindStringSubmatch(m)
+			v, lerr := lookup(sub[1], sub[2])
+			if lerr != nil && err == nil {
+				err = fmt.Errorf("%s: %w", name, lerr)
+			}
+			return v
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var changed []string
+	for name, v := range values {
+		if os.Getenv(name) != v {
+			os.Setenv(name, v)
+			changed = append(changed, name)
+		}
+	}
+	next := s.interval
+	if lease > 0 && lease*2/3 < next {
+		next = lease * 2 / 3
+	}
+	s.nextRead = time.Now().Add(next)
+	return changed, nil
+}
+
+// runVaultRenewal keeps the Vault token alive and reads secrets again when
+// they are due, until ctx is done. apply is called with the name of each
+// variable whose value changed.
+func runVaultRenewal(ctx context.Context, client *vaultClient, secrets *vaultSecrets, apply func(name string)) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := client.renew(ctx); err != nil {
+			vaultFailures.Add(1)
+			slog.Error("Error renewing the Vault token", "error", err)
+		}
+		if secrets == nil || time.Now().Before(secrets.nextRead) {
+			continue
+		}
+		// A failed read is retried on the next tick.
+		changed, err := secrets.resolve(ctx)
+		if err != nil {
+			vaultFailures.Add(1)
+			slog.Error("Error reading secrets from Vault", "error", err)
+			continue
+		}
+		for _, name := range changed {
+			apply(name)
+		}
+	}
+}
+
+// applySecret puts the new value of the variable name into effect. API
+// keys and receipt encryption keys are replaced, and database credentials
+// are read for each new connection; other secrets are only read at
+// startup.
+func applySecret(name string, auth *authenticator, cipher *receiptCipher) {
+	var err error
+	switch name {
+	case "API_KEYS":
+		err = auth.reloadAPIKeys()
+	case "RECEIPT_ENCRYPTION_KEYS":
+		if cipher != nil {
+			err = cipher.setLocalKeys(os.Getenv(name))
+		}
+	case "POSTGRES_DSN", "POSTGRES_READ_DSNS", "REDIS_PASSWORD":
+	default:
+		slog.Warn("A secret changed in Vault; restart the server to use it", "name", name)
+		return
+	}
+	if err != nil {
+		vaultFailures.Add(1)
+		slog.Error("Error applying a secret from Vault", "name", name, "error", err)
+		return
+	}
+	slog.Info("Applied a secret changed in Vault", "name", name)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// knownSettings are the environment variables the service reads. A
+// configuration file or -set may only give these.
+var knownSettings = []string{
+	"ACHIEVEMENT_BONUSES", "ANALYTICS_REFRESH_INTERVAL",
+	"ADMIN_API_KEYS", "API_KEYS", "API_KEYS_FILE", "API_KEY_RULES",
+	"AUDIT_LOG_FILE",
+	"BACKUP_KEEP", "BACKUP_MAX_AGE", "BACKUP_SCHEDULE",
+	"BACKUP_S3_ACCESS_KEY_ID", "BACKUP_S3_BUCKET", "BACKUP_S3_ENDPOINT", "BACKUP_S3_PREFIX", "BACKUP_S3_REGION", "BACKUP_S3_SECRET_ACCESS_KEY",
+	"BIND_ADDR", "PORT",
+	"ADMIN_CLIENT_CERT_TENANTS", "CLIENT_CERT_TENANTS", "CLIENT_CERT_TENANTS_FILE",
+	"CORS_ALLOWED_HEADERS", "CORS_ALLOWED_METHODS", "CORS_ALLOWED_ORIGINS", "CORS_ALLOW_CREDENTIALS", "CORS_EXPOSED_HEADERS", "CORS_MAX_AGE",
+	"DB_CONN_MAX_LIFETIME", "DB_MAX_IDLE_CONNS", "DB_MAX_OPEN_CONNS",
+	"EVENTS_BROKER", "KAFKA_BROKERS", "KAFKA_TOPIC", "NATS_SUBJECT", "NATS_URL", "OUTBOX_RELAY_INTERVAL",
+	"FRAUD_DUPLICATE_WINDOW", "REVIEW_MIN_FRAUD_SCORE",
+	"HTTP_COMPRESSION", "HTTP_COMPRESSION_MIN_BYTES",
+	"HTTP_IDLE_TIMEOUT", "HTTP_MAX_BODY_BYTES", "HTTP_MAX_HEADER_BYTES", "HTTP_READ_HEADER_TIMEOUT", "HTTP_READ_TIMEOUT", "HTTP_WRITE_TIMEOUT",
+	"IDEMPOTENCY_TTL", "LEGACY_API_SUNSET", "POINTS_MAX_AGE", "SHUTDOWN_TIMEOUT", "UPGRADE_TIMEOUT",
+	"IP_ACCESS_FILE", "IP_ACCESS_RELOAD_INTERVAL", "TRUSTED_PROXIES",
+	"JOB_QUEUE_SIZE", "JOB_TTL", "JOB_WORKERS",
+	"JWT_AUDIENCE", "JWT_HS256_SECRET", "JWT_ISSUER", "JWT_JWKS_URL", "JWT_RS256_PUBLIC_KEY_FILE",
+	"LOAD_SHEDDING", "LOAD_SHED_MAX_CONCURRENCY", "LOAD_SHED_MIN_CONCURRENCY", "LOAD_SHED_QUEUE_SIZE", "LOAD_SHED_QUEUE_TIMEOUT", "LOAD_SHED_TARGET_LATENCY",
+	"LOG_FORMAT", "LOG_LEVEL",
+	"MEMORY_FULL_POLICY", "MEMORY_MAX_RECEIPTS", "MEMORY_SNAPSHOT_DIR", "MEMORY_SNAPSHOT_INTERVAL", "MEMORY_WAL_FSYNC", "MEMORY_WAL_MAX_BYTES",
+	"OIDC_CLIENT_ID", "OIDC_CLIENT_SECRET", "OIDC_ISSUER_URL",
+	"POINTS_CACHE_SIZE", "POINTS_CACHE_TTL", "POINTS_EXPIRE_AFTER", "POINTS_EXPIRY_INTERVAL",
+	"POSTGRES_DSN", "POSTGRES_READ_DSNS", "SQLITE_PATH", "STORAGE_DRIVER",
+	"RAFT_APPLY_TIMEOUT", "RAFT_BIND_ADDR", "RAFT_DIR", "RAFT_NODE_ID", "RAFT_PEERS",
+	"RATE_LIMIT_BURST", "RATE_LIMIT_GLOBAL_BURST", "RATE_LIMIT_GLOBAL_RPS", "RATE_LIMIT_KEY", "RATE_LIMIT_RPS",
+	"RECEIPT_DATA_KEY_TTL", "RECEIPT_ENCRYPTION_KEYS", "RECEIPT_ENCRYPTION_VAULT_KEY", "RECEIPT_RETENTION", "RETENTION_SWEEP_INTERVAL",
+	"REDIS_ADDR", "REDIS_DB", "REDIS_PASSWORD", "REDIS_TTL",
+	"REFERRAL_MAX_PER_USER", "REFERRAL_REFEREE_BONUS", "REFERRAL_REFERRER_BONUS",
+	"REPORT_EMAIL_FROM", "REPORT_EMAIL_TO", "REPORT_SCHEDULE", "REPORT_SMTP_ADDR", "REPORT_SMTP_PASSWORD", "REPORT_SMTP_USERNAME",
+	"REPORT_TOP_RETAILERS", "REPORT_WEBHOOK_SECRET", "REPORT_WEBHOOK_URL",
+	"CANARY_PERCENT", "CANARY_RULES_FILE", "CANARY_STICKY_BY", "RULES_FILE", "SHADOW_RULES_FILE",
+	"TOTAL_RECONCILIATION", "TOTAL_TOLERANCE",
+	"VAULT_ADDR", "VAULT_APPROLE_MOUNT", "VAULT_NAMESPACE", "VAULT_ROLE_ID", "VAULT_SECRETS_REFRESH", "VAULT_SECRET_ID", "VAULT_TOKEN", "VAULT_TRANSIT_MOUNT",
+	"WEBHOOK_ALLOW_PRIVATE_NETWORKS", "WEBHOOK_MAX_ATTEMPTS", "WEBHOOK_TIMEOUT",
+}
+
+// secretSettings hold credentials, which the configuration summary does
+// not show.
+var secretSettings = map[string]bool{
+	"API_KEYS": true, "BACKUP_S3_SECRET_ACCESS_KEY": true, "JWT_HS256_SECRET": true, "OIDC_CLIENT_SECRET": true,
+	"POSTGRES_DSN": true, "POSTGRES_READ_DSNS": true, "RECEIPT_ENCRYPTION_KEYS": true, "REDIS_PASSWORD": true,
+	"REPORT_SMTP_PASSWORD": true, "REPORT_WEBHOOK_SECRET": true, "VAULT_SECRET_ID": true, "VAULT_TOKEN": true,
+}
+
+// Where a setting's value came from.
+const (
+	sourceFlag = "flag"
+	sourceEnv  = "env"
+	sourceFile = "file"
+)
+
+// setFlag collects -set NAME=value flags.
+type setFlag map[string]string
+
+func (f setFlag) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ",")
+}
+
+func (f setFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("want NAME=value, got %q", v)
+	}
+	if !slices.Contains(knownSettings, name) {
+		return fmt.Errorf("unknown setting %s", name)
+	}
+	f[name] = value
+	return nil
+}
+
+// applySettings puts the settings from -set and the configuration file at
+// path, if any, into the environment, where the rest of the configuration
+// is read from. -set overrides the environment, which overrides the file.
+// It returns where each setting that is set came from.
+func applySettings(path string, set setFlag) (map[string]string, error) {
+	sources := make(map[string]string)
+	for _, name := range knownSettings {
+		if _, ok := os.LookupEnv(name); ok {
+			sources[name] = sourceEnv
+		}
+	}
+	if path != "" {
+		file, err := readSettingsFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		for name, value := range file {
+			if _, ok := sources[name]; !ok {
+				os.Setenv(name, value)
+				sources[name] = sourceFile
+			}
+		}
+	}
+	for name, value := range set {
+		os.Setenv(name, value)
+		sources[name] = sourceFlag
+	}
+	return sources, nil
+}
+
+// readSettingsFile reads a YAML file of settings. Keys are the names of
+// environment variables, in any case, and may be nested: "storage:
+// {driver: sqlite}" sets STORAGE_DRIVER. Lists are joined with commas.
+func readSettingsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var doc map[string]any
+	if err := yaml.NewDecoder(f).Decode(&doc); err != nil && err != io.EOF {
+		return nil, err
+	}
+	settings := make(map[string]string)
+	if err := flattenSettings("", doc, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func flattenSettings(prefix string, doc map[string]any, into map[string]string) error {
+	for key, v := range doc {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		var value string
+		switch v := v.(type) {
+		case map[string]any:
+			if err := flattenSettings(name, v, into); err != nil {
+				return err
+			}
+			continue
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		case nil:
+		default:
+			value = fmt.Sprint(v)
+		}
+		if !slices.Contains(knownSettings, name) {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		if _, ok := into[name]; ok {
+			return fmt.Errorf("%s is set twice", name)
+		}
+		into[name] = value
+	}
+	return nil
+}
+
+// logSettings logs the settings in effect and where they came from, with
+// secrets hidden, along with the command-line flags given.
+func logSettings(logger *slog.Logger, sources map[string]string, flags map[string]string) {
+	type setting struct {
+		Value  string `json:"value"`
+		Source string `json:"source"`
+	}
+	settings := make(map[string]setting, len(sources))
+	for name, source := range sources {
+		value := os.Getenv(name)
+		if secretSettings[name] && value != "" && !strings.HasPrefix(value, "vault:") {
+			value = "[redacted]"
+		}
+		settings[name] = setting{value, source}
+	}
+	logger.Info("Effective configuration", "settings", settings, "flags", flags)
+}
+
+// logLevel is the level of the service's log, set from LOG_LEVEL.
+var logLevel slog.LevelVar
+
+// newLogger returns the logger LOG_FORMAT and LOG_LEVEL select: JSON or
+// text, at debug, info, warn or error level.
+func newLogger() (*slog.Logger, error) {
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf("LOG_FORMAT: must be \"json\" or \"text\", got %q", format)
+	}
+}
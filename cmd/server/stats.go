@@ -0,0 +1,156 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fetch_assessment/points"
+)
+
+// statsBuckets are the lower bounds of the points histogram's buckets.
+var statsBuckets = []int{0, 10, 25, 50, 100, 250, 500, 1000}
+
+// maxStatsTop caps the ?top parameter of GET /admin/stats.
+const maxStatsTop = 100
+
+// retailerStats is the receipts and points of one retailer.
+type retailerStats struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+// versionStats is the receipts scored with one rule set version, and the
+// points they earned.
+type versionStats struct {
+	Receipts      int     `json:"receipts"`
+	Points        int     `json:"points"`
+	AveragePoints float64 `json:"averagePoints"`
+}
+
+// topRetailers returns the n retailers with the most receipts in recs,
+// grouped by canonical name ignoring case.
+func topRetailers(recs []StoredReceipt, rules *points.Engine, n int) []retailerStats {
+	byRetailer := make(map[string]*retailerStats)
+	for _, rec := range recs {
+		name := strings.TrimSpace(rules.CanonicalRetailer(rec.Receipt.Retailer))
+		key := strings.ToLower(name)
+		rt, ok := byRetailer[key]
+		if !ok {
+			rt = &retailerStats{Retailer: name}
+			byRetailer[key] = rt
+		}
+		rt.Receipts++
+		rt.Points += rec.Points
+	}
+	retailers := make([]retailerStats, 0, len(byRetailer))
+	for _, rt := range byRetailer {
+		retailers = append(retailers, *rt)
+	}
+	slices.SortFunc(retailers, func(a, b retailerStats) int {
+		return cmp.Or(b.Receipts-a.Receipts, b.Points-a.Points, strings.Compare(a.Retailer, b.Retailer))
+	})
+	return retailers[:min(n, len(retailers))]
+}
+
+// statsHandler handles GET /admin/stats
+func (s *server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	top := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStatsTop {
+			writeProblem(w, r, http.StatusBadRequest, "top must be an integer from 1 to "+strconv.Itoa(maxStatsTop))
+			return
+		}
+		top = n
+	}
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing receipts: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to compute stats")
+		return
+	}
+
+	type bucket struct {
+		Min   int  `json:"min"`
+		Max   *int `json:"max,omitempty"` // exclusive; absent for the last bucket
+		Count int  `json:"count"`
+	}
+	histogram := make([]bucket, len(statsBuckets))
+	for i, min := range statsBuckets {
+		histogram[i].Min = min
+		if i+1 < len(statsBuckets) {
+			histogram[i].Max = &statsBuckets[i+1]
+		}
+	}
+	byStatus := make(map[string]int)
+	byVersion := make(map[string]versionStats)
+	users := make(map[string]bool)
+	total := 0
+	for _, rec := range all {
+		byStatus[statusText(rec.Status)]++
+		// Receipts scored before versions were recorded, or not scored
+		// yet, have none.
+		if rec.RulesVersion != "" {
+			v := byVersion[rec.RulesVersion]
+			v.Receipts++
+			v.Points += rec.Points
+			byVersion[rec.RulesVersion] = v
+		}
+		if rec.UserID != "" {
+			users[rec.UserID] = true
+		}
+		total += rec.Points
+		i, _ := slices.BinarySearch(statsBuckets, rec.Points+1)
+		histogram[max(i-1, 0)].Count++
+	}
+
+	var average float64
+	if len(all) > 0 {
+		average = float64(total) / float64(len(all))
+	}
+	for version, v := range byVersion {
+		v.AveragePoints = float64(v.Points) / float64(v.Receipts)
+		byVersion[version] = v
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	response := struct {
+		Receipts       int                     `json:"receipts"`
+		ByStatus       map[string]int          `json:"byStatus"`
+		ByRulesVersion map[string]versionStats `json:"byRulesVersion"`
+		Users          int                     `json:"users"`
+		TotalPoints    int                     `json:"totalPoints"`
+		AveragePoints  float64                 `json:"averagePoints"`
+		Histogram      []bucket                `json:"histogram"`
+		TopRetailers   []retailerStats         `json:"topRetailers"`
+		Memory         struct {
+			HeapAllocBytes uint64 `json:"heapAllocBytes"`
+			HeapInuseBytes uint64 `json:"heapInuseBytes"`
+			SysBytes       uint64 `json:"sysBytes"`
+			Goroutines     int    `json:"goroutines"`
+		} `json:"memory"`
+	}{
+		Receipts:       len(all),
+		ByStatus:       byStatus,
+		ByRulesVersion: byVersion,
+		Users:          len(users),
+		TotalPoints:    total,
+		AveragePoints:  average,
+		Histogram:      histogram,
+		TopRetailers:   topRetailers(all, s.rules.Load(), top),
+	}
+	response.Memory.HeapAllocBytes = mem.HeapAlloc
+	response.Memory.HeapInuseBytes = mem.HeapInuse
+	response.Memory.SysBytes = mem.Sys
+	response.Memory.Goroutines = runtime.NumGoroutine()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"fetch_assessment/points"
+)
+
+// ErrReceiptNotFound is returned by a ReceiptStore when no receipt exists for an ID.
+var ErrReceiptNotFound = errors.New("receipt not found")
+
+// ErrStoreFull is returned by Save when a capped store has no room left.
+var ErrStoreFull = errors.New("receipt store is full")
+
+// ErrStatusChanged is returned by SetStatus when the receipt is no longer
+// in the expected status.
+var ErrStatusChanged = errors.New("receipt status has changed")
+
+// ErrInsufficientPoints is returned by AddLedgerEntry when a redemption
+// or expiry is larger than the user's balance.
+var ErrInsufficientPoints = errors.New("insufficient points")
+
+// ErrReferralNotFound is returned for unknown referral codes and for users
+// nobody referred.
+var ErrReferralNotFound = errors.New("referral not found")
+
+// ErrAlreadyReferred is returned by AddReferral when the referee already
+// has a referrer.
+var ErrAlreadyReferred = errors.New("user was already referred")
+
+// ErrReferralLimit is returned by AddReferral when the referrer has
+// referred as many users as they may.
+var ErrReferralLimit = errors.New("referral limit reached")
+
+// ErrReportNotFound is returned by Report when no report exists for a date.
+var ErrReportNotFound = errors.New("report not found")
+
+// ErrDuplicateReceipt is returned by Save for a receipt with Dedupe set
+// when its owner already has a receipt with the same content hash.
+var ErrDuplicateReceipt = errors.New("duplicate receipt")
+
+// ErrStoreNotEmpty is returned by Restore when asked not to replace
+// existing data.
+var ErrStoreNotEmpty = errors.New("store is not empty")
+
+// StoredReceipt is a processed receipt together with its computed points.
+type StoredReceipt struct {
+	ID          string         `json:"id"`
+	Receipt     points.Receipt `json:"receipt"`
+	Points      int            `json:"points"`
+	ProcessedAt time.Time      `json:"processedAt"`
+	// Status is where the receipt is in its review lifecycle (see
+	// review.go). Points stay zero until it is accepted. Receipts stored
+	// before reviews existed have no status and count as accepted.
+	Status string `json:"status,omitempty"`
+	// Owner is the authenticated subject that submitted the receipt,
+	// "apikey:" and the key name for API keys with their own rules (see
+	// API_KEY_RULES), or empty otherwise.
+	Owner string `json:"owner,omitempty"`
+	// UserID is the end user the receipt was submitted for (see
+	// userFrom), or empty.
+	UserID string `json:"userId,omitempty"`
+	// Tier is the user's loyalty tier when the receipt was submitted; its
+	// multiplier applies whenever the receipt is scored.
+	Tier string `json:"tier,omitempty"`
+	// ContentHash is the receipt's canonical hash (see receiptHash), used
+	// to recognise resubmissions of the same receipt. Receipts a service
+	// submits for a user hash the user in too (see userReceiptHash).
+	ContentHash string `json:"contentHash,omitempty"`
+	// Dedupe makes Save fail with ErrDuplicateReceipt rather than store a
+	// second receipt with the same Owner and ContentHash, checking and
+	// saving in one step so concurrent submissions cannot both be saved.
+	// It is not read back.
+	Dedupe bool `json:"-"`
+	// RulesVersion is the version of the rule set that computed Points.
+	RulesVersion string `json:"rulesVersion,omitempty"`
+	// Flags lists the checks the receipt failed when it was submitted:
+	// "total_mismatch" (see TOTAL_RECONCILIATION) and the fraud signals in
+	// fraud.go.
+	Flags []string `json:"flags,omitempty"`
+	// FraudScore rates how suspicious the submission looked, from 0 to
+	// 100, by the weights of its Flags.
+	FraudScore int `json:"fraudScore,omitempty"`
+}
+
+// LedgerEntry is one change to a user's points balance. Entries are never
+// changed or removed once recorded.
+type LedgerEntry struct {
+	ID     string `json:"id"`
+	UserID string `json:"userId"`
+	Type   string `json:"type"` // see ledger.go
+	// Points is positive for credits and negative for debits.
+	Points int `json:"points"`
+	// Balance is the user's balance after the entry.
+	Balance   int    `json:"balance"`
+	ReceiptID string `json:"receiptId,omitempty"`
+	// Reason explains the change to the user or an auditor.
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Referral records that Referee signed up with Referrer's referral code.
+type Referral struct {
+	Referrer  string    `json:"referrer"`
+	Referee   string    `json:"referee"`
+	Code      string    `json:"code"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// DailyReport summarises the receipts processed on one UTC day.
+type DailyReport struct {
+	Date              string          `json:"date"` // YYYY-MM-DD
+	ReceiptsProcessed int             `json:"receiptsProcessed"`
+	ByStatus          map[string]int  `json:"byStatus"`
+	PointsAwarded     int             `json:"pointsAwarded"` // by accepted receipts
+	TopRetailers      []retailerStats `json:"topRetailers"`
+	GeneratedAt       time.Time       `json:"generatedAt"`
+}
+
+// UserDeletion counts what DeleteUser removed.
+type UserDeletion struct {
+	Receipts      int  `json:"receipts"`
+	LedgerEntries int  `json:"ledgerEntries"`
+	ReferralCode  bool `json:"referralCode"`
+	Referrals     int  `json:"referrals"` // made and received
+	// Events counts queued events about the user that were dropped before
+	// being sent.
+	Events int `json:"events"`
+}
+
+// ReceiptStore persists processed receipts. Implementations must return
+// ErrReceiptNotFound for unknown IDs.
+type ReceiptStore interface {
+	Save(ctx context.Context, rec StoredReceipt) error
+	// FindByHash returns a receipt submitted by owner with the given
+	// content hash, or ErrReceiptNotFound if there is none.
+	FindByHash(ctx context.Context, owner, hash string) (StoredReceipt, error)
+	// GetPoints returns a receipt's points and the version of the rule set
+	// that computed them.
+	GetPoints(ctx context.Context, id string) (points int, rulesVersion string, err error)
+	GetReceipt(ctx context.Context, id string) (StoredReceipt, error)
+	// UpdatePoints replaces a receipt's points and rules version after it
+	// has been re-scored.
+	UpdatePoints(ctx context.Context, id string, points int, rulesVersion string) error
+	// SetStatus moves a receipt from status from to status to, awarding it
+	// points under rulesVersion. It returns ErrStatusChanged if the
+	// receipt is not in status from.
+	SetStatus(ctx context.Context, id, from, to string, points int, rulesVersion string) error
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context) ([]StoredReceipt, error)
+	// DeleteBefore removes every receipt processed before cutoff and
+	// returns how many were removed.
+	DeleteBefore(ctx context.Context, cutoff time.Time) (int, error)
+
+	// AddLedgerEntry applies e to its user's balance and appends it to
+	// their ledger, returning it with Balance set. A redeem or expire
+	// entry that would take the balance below zero is rejected with
+	// ErrInsufficientPoints.
+	AddLedgerEntry(ctx context.Context, e LedgerEntry) (LedgerEntry, error)
+	// Balance returns a user's points balance; zero if they have none.
+	Balance(ctx context.Context, user string) (int, error)
+	// Ledger returns a user's ledger entries, oldest first.
+	Ledger(ctx context.Context, user string) ([]LedgerEntry, error)
+	// UsersWithBalance returns every user whose balance is above zero.
+	UsersWithBalance(ctx context.Context) ([]string, error)
+
+	// ReferralCode returns user's referral code, giving them code if they
+	// have none yet.
+	ReferralCode(ctx context.Context, user, code string) (string, error)
+	// ReferralCodeOwner returns the user a referral code belongs to, or
+	// ErrReferralNotFound.
+	ReferralCodeOwner(ctx context.Context, code string) (string, error)
+	// AddReferral records r unless its referee already has a referrer
+	// (ErrAlreadyReferred) or its referrer has max referrals already
+	// (ErrReferralLimit).
+	AddReferral(ctx context.Context, r Referral, max int) error
+	// ReferralOf returns the referral of referee, or ErrReferralNotFound.
+	ReferralOf(ctx context.Context, referee string) (Referral, error)
+	// Referrals returns the users referrer referred, oldest first.
+	Referrals(ctx context.Context, referrer string) ([]Referral, error)
+	// ReferralCodeOf returns user's referral code, or ErrReferralNotFound
+	// if they have none.
+	ReferralCodeOf(ctx context.Context, user string) (string, error)
+	// AddReport saves r unless there is already a report for its date, and
+	// reports whether it did.
+	AddReport(ctx context.Context, r DailyReport) (bool, error)
+	// Report returns the report for date, or ErrReportNotFound.
+	Report(ctx context.Context, date string) (DailyReport, error)
+
+	// DeleteUser removes everything held about user: the receipts that
+	// belong to them, their ledger and balance, their referral code and
+	// the referrals they made or received. Other users' ledger entries
+	// are kept.
+	DeleteUser(ctx context.Context, user string) (UserDeletion, error)
+}
+
+// storeConfig selects and configures the storage backend.
+type storeConfig struct {
+	Driver     string // "memory" (default), "sqlite", "postgres", "redis" or "raft"
+	SQLitePath string
+
+	// MemoryMaxReceipts caps the memory driver; zero means unlimited. When
+	// the cap is reached MemoryFullPolicy decides between evicting the
+	// least recently used receipt ("evict") and rejecting the save ("reject").
+	MemoryMaxReceipts int
+	MemoryFullPolicy  string
+	// MemorySnapshotDir, when set, keeps the memory driver's contents on
+	// disk across restarts, snapshotting every MemorySnapshotInterval or
+	// once the log reaches MemoryWALMaxBytes. MemoryWALFsync flushes each
+	// log record to disk before the change it records is applied.
+	MemorySnapshotDir      string
+	MemorySnapshotInterval time.Duration
+	MemoryWALMaxBytes      int
+	MemoryWALFsync         bool
+
+	// The raft driver replicates a memory store across RaftPeers, of which
+	// this node is RaftNodeID. RaftBindAddr defaults to the node's address
+	// in RaftPeers.
+	RaftNodeID       string
+	RaftPeers        []raftPeer
+	RaftBindAddr     string
+	RaftDir          string
+	RaftApplyTimeout time.Duration
+
+	PostgresDSN string
+	// PostgresReadDSNs are read replicas of PostgresDSN; see
+	// store_replica.go.
+	PostgresReadDSNs []string
+	MaxOpenConns     int
+	MaxIdleConns     int
+	ConnMaxLifetime  time.Duration
+
+	// The Redis password is read from REDIS_PASSWORD for each connection.
+	RedisAddr string
+	RedisDB   int
+	RedisTTL  time.Duration // zero keeps receipts forever
+
+	// Retention is how long receipts are kept before the sweeper purges
+	// them; zero keeps them forever.
+	Retention           time.Duration
+	RetentionSweepEvery time.Duration
+
+	// Cipher, if set, encrypts receipt payloads in the sqlite, postgres
+	// and redis drivers.
+	Cipher *receiptCipher
+	// PointsCache, if set, caches points in process for the same drivers.
+	PointsCache *pointsCache
+}
+
+// storeConfigFromEnv reads the storage settings from the environment.
+// vault, if set, can hold the receipt encryption key.
+func storeConfigFromEnv(vault *vaultClient) (storeConfig, error) {
+	cfg := storeConfig{
+		Driver:            os.Getenv("STORAGE_DRIVER"),
+		SQLitePath:        os.Getenv("SQLITE_PATH"),
+		MemoryFullPolicy:  os.Getenv("MEMORY_FULL_POLICY"),
+		MemorySnapshotDir: os.Getenv("MEMORY_SNAPSHOT_DIR"),
+		PostgresDSN:       os.Getenv("POSTGRES_DSN"),
+		RaftNodeID:        os.Getenv("RAFT_NODE_ID"),
+		RaftBindAddr:      os.Getenv("RAFT_BIND_ADDR"),
+		RaftDir:           os.Getenv("RAFT_DIR"),
+
+		RedisAddr: os.Getenv("REDIS_ADDR"),
+	}
+	if cfg.SQLitePath == "" {
+		cfg.SQLitePath = "receipts.db"
+	}
+	if cfg.RedisAddr == "" {
+		cfg.RedisAddr = "localhost:6379"
+	}
+	if cfg.MemoryFullPolicy == "" {
+		cfg.MemoryFullPolicy = "evict"
+	}
+	if cfg.MemoryFullPolicy != "evict" && cfg.MemoryFullPolicy != "reject" {
+		return cfg, fmt.Errorf("MEMORY_FULL_POLICY: must be \"evict\" or \"reject\", got %q", cfg.MemoryFullPolicy)
+	}
+	var err error
+	if cfg.MemoryMaxReceipts, err = envInt("MEMORY_MAX_RECEIPTS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MemorySnapshotInterval, err = envDuration("MEMORY_SNAPSHOT_INTERVAL", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.MemorySnapshotDir != "" && cfg.MemorySnapshotInterval <= 0 {
+		return cfg, fmt.Errorf("MEMORY_SNAPSHOT_INTERVAL must be positive")
+	}
+	if cfg.MemoryWALMaxBytes, err = envInt("MEMORY_WAL_MAX_BYTES", 64<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.MemoryWALFsync, err = envBool("MEMORY_WAL_FSYNC", true); err != nil {
+		return cfg, err
+	}
+	if dsns := os.Getenv("POSTGRES_READ_DSNS"); dsns != "" {
+		if cfg.Driver != "postgres" {
+			return cfg, fmt.Errorf("POSTGRES_READ_DSNS needs STORAGE_DRIVER=postgres")
+		}
+		for _, dsn := range strings.Split(dsns, ",") {
+			if dsn = strings.TrimSpace(dsn); dsn != "" {
+				cfg.PostgresReadDSNs = append(cfg.PostgresReadDSNs, dsn)
+			}
+		}
+	}
+	if cfg.Driver == "raft" {
+		if cfg.RaftNodeID == "" || os.Getenv("RAFT_PEERS") == "" {
+			return cfg, fmt.Errorf("the raft driver needs RAFT_NODE_ID and RAFT_PEERS")
+		}
+		if cfg.RaftPeers, err = parseRaftPeers(os.Getenv("RAFT_PEERS")); err != nil {
+			return cfg, err
+		}
+		if cfg.RaftDir == "" {
+			cfg.RaftDir = "raft"
+		}
+		if cfg.RaftApplyTimeout, err = envDuration("RAFT_APPLY_TIMEOUT", 5*time.Second); err != nil {
+			return cfg, err
+		}
+		if cfg.RaftApplyTimeout <= 0 {
+			return cfg, fmt.Errorf("RAFT_APPLY_TIMEOUT must be positive")
+		}
+		// Reads reorder the eviction list, so nodes would evict different
+		// receipts.
+		if cfg.MemoryMaxReceipts > 0 && cfg.MemoryFullPolicy == "evict" {
+			return cfg, fmt.Errorf("the raft driver needs MEMORY_FULL_POLICY=reject when MEMORY_MAX_RECEIPTS is set")
+		}
+		if cfg.MemorySnapshotDir != "" {
+			return cfg, fmt.Errorf("the raft driver keeps its own snapshots in RAFT_DIR; unset MEMORY_SNAPSHOT_DIR")
+		}
+	}
+	if cfg.MaxOpenConns, err = envInt("DB_MAX_OPEN_CONNS", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxIdleConns, err = envInt("DB_MAX_IDLE_CONNS", 5); err != nil {
+		return cfg, err
+	}
+	if cfg.ConnMaxLifetime, err = envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.RedisDB, err = envInt("REDIS_DB", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.RedisTTL, err = envDuration("REDIS_TTL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.Retention, err = envDuration("RECEIPT_RETENTION", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.RetentionSweepEvery, err = envDuration("RETENTION_SWEEP_INTERVAL", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.Retention > 0 && cfg.RetentionSweepEvery <= 0 {
+		return cfg, fmt.Errorf("RETENTION_SWEEP_INTERVAL must be positive")
+	}
+	if cfg.Cipher, err = receiptCipherFromEnv(vault); err != nil {
+		return cfg, err
+	}
+	// The memory driver's snapshots and the Raft log hold whole records,
+	// which are not encrypted.
+	if cfg.Cipher != nil && cfg.Driver != "sqlite" && cfg.Driver != "postgres" && cfg.Driver != "redis" {
+		return cfg, fmt.Errorf("receipt encryption needs the sqlite, postgres or redis driver")
+	}
+	size, err := envInt("POINTS_CACHE_SIZE", 10000)
+	if err != nil {
+		return cfg, err
+	}
+	ttl, err := envDuration("POINTS_CACHE_TTL", time.Minute)
+	if err != nil {
+		return cfg, err
+	}
+	if size > 0 && ttl <= 0 {
+		return cfg, fmt.Errorf("POINTS_CACHE_TTL must be positive")
+	}
+	cfg.PointsCache = newPointsCache(size, ttl)
+	return cfg, nil
+}
+
+// newStore builds the ReceiptStore selected by cfg.Driver.
+func newStore(cfg storeConfig) (ReceiptStore, error) {
+	switch cfg.Driver {
+	case "", "memory":
+		mem := newMemoryStore(cfg.MemoryMaxReceipts, cfg.MemoryFullPolicy == "reject")
+		if cfg.MemorySnapshotDir == "" {
+			return mem, nil
+		}
+		return newSnapshotStore(mem, cfg)
+	case "sqlite":
+		s, err := newSQLiteStore(cfg.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		s.cipher, s.cache = cfg.Cipher, cfg.PointsCache
+		return s, nil
+	case "postgres":
+		s, err := newPostgresStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.cipher, s.cache = cfg.Cipher, cfg.PointsCache
+		if s.cache != nil {
+			s.peers = true
+			s.stopPeers = listenPostgresPeers(s.cache, func() string { return os.Getenv("POSTGRES_DSN") })
+		}
+		return s, nil
+	case "redis":
+		return newRedisStore(cfg)
+	case "raft":
+		return newRaftStore(newMemoryStore(cfg.MemoryMaxReceipts, cfg.MemoryFullPolicy == "reject"), cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.Driver)
+	}
+}
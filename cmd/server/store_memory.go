@@ -0,0 +1,362 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps receipts in a map for the lifetime of the process. It is
+// safe for concurrent use by multiple handler goroutines.
+//
+// With a positive maxEntries the store is capped: once full, saving a new
+// receipt either evicts the least recently used one or, if rejectWhenFull
+// is set, fails with ErrStoreFull.
+type memoryStore struct {
+	maxEntries     int
+	rejectWhenFull bool
+
+	mu       sync.Mutex
+	receipts map[string]*list.Element // values are StoredReceipt
+	// lru orders receipts from most to least recently used.
+	lru *list.List
+	// byHash maps owner and content hash (see memoryHashKey) to a receipt ID.
+	byHash map[string]string
+	// ledgers and balances are kept per user and never evicted.
+	ledgers  map[string][]LedgerEntry
+	balances map[string]int
+	// Referral codes by user and users by code, and referrals by referee.
+	referralCodes map[string]string
+	codeOwners    map[string]string
+	referrals     map[string]Referral
+	// reports are kept by date.
+	reports map[string]DailyReport
+}
+
+func newMemoryStore(maxEntries int, rejectWhenFull bool) *memoryStore {
+	return &memoryStore{
+		maxEntries:     maxEntries,
+		rejectWhenFull: rejectWhenFull,
+		receipts:       make(map[string]*list.Element),
+		lru:            list.New(),
+		byHash:         make(map[string]string),
+		ledgers:        make(map[string][]LedgerEntry),
+		balances:       make(map[string]int),
+		referralCodes:  make(map[string]string),
+		codeOwners:     make(map[string]string),
+		referrals:      make(map[string]Referral),
+		reports:        make(map[string]DailyReport),
+	}
+}
+
+func memoryHashKey(owner, hash string) string {
+	return owner + "\x00" + hash
+}
+
+// get returns receipt id and marks it as recently used. Callers hold m.mu.
+func (m *memoryStore) get(id string) (StoredReceipt, bool) {
+	el, ok := m.receipts[id]
+	if !ok {
+		return StoredReceipt{}, false
+	}
+	m.lru.MoveToFront(el)
+	return el.Value.(StoredReceipt), true
+}
+
+// remove deletes the receipt held in el. Callers hold m.mu.
+func (m *memoryStore) remove(el *list.Element) {
+	rec := m.lru.Remove(el).(StoredReceipt)
+	delete(m.receipts, rec.ID)
+	if key := memoryHashKey(rec.Owner, rec.ContentHash); m.byHash[key] == rec.ID {
+		delete(m.byHash, key)
+	}
+}
+
+func (m *memoryStore) Save(ctx context.Context, rec StoredReceipt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rec.Dedupe {
+		if _, ok := m.receipts[m.byHash[memoryHashKey(rec.Owner, rec.ContentHash)]]; ok {
+			return ErrDuplicateReceipt
+		}
+	}
+	if el, ok := m.receipts[rec.ID]; ok {
+		m.remove(el)
+	}
+	if m.maxEntries > 0 && len(m.receipts) >= m.maxEntries {
+		if m.rejectWhenFull {
+			return ErrStoreFull
+		}
+		for len(m.receipts) >= m.maxEntries {
+			m.remove(m.lru.Back())
+			receiptsEvicted.Add(1)
+		}
+	}
+	m.receipts[rec.ID] = m.lru.PushFront(rec)
+	if rec.ContentHash != "" {
+		m.byHash[memoryHashKey(rec.Owner, rec.ContentHash)] = rec.ID
+	}
+	return nil
+}
+
+func (m *memoryStore) FindByHash(ctx context.Context, owner, hash string) (StoredReceipt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.get(m.byHash[memoryHashKey(owner, hash)])
+	if !ok {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	return rec, nil
+}
+
+func (m *memoryStore) CountReceipts(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.receipts), nil
+}
+
+func (m *memoryStore) GetPoints(ctx context.Context, id string) (int, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.get(id)
+	if !ok {
+		return 0, "", ErrReceiptNotFound
+	}
+	return rec.Points, rec.RulesVersion, nil
+}
+
+func (m *memoryStore) GetReceipt(ctx context.Context, id string) (StoredReceipt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.get(id)
+	if !ok {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	return rec, nil
+}
+
+func (m *memoryStore) UpdatePoints(ctx context.Context, id string, points int, rulesVersion string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.receipts[id]
+	if !ok {
+		return ErrReceiptNotFound
+	}
+	rec := el.Value.(StoredReceipt)
+	rec.Points, rec.RulesVersion = points, rulesVersion
+	el.Value = rec
+	return nil
+}
+
+func (m *memoryStore) SetStatus(ctx context.Context, id, from, to string, points int, rulesVersion string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.receipts[id]
+	if !ok {
+		return ErrReceiptNotFound
+	}
+	rec := el.Value.(StoredReceipt)
+	if rec.Status != from {
+		return ErrStatusChanged
+	}
+	rec.Status, rec.Points, rec.RulesVersion = to, points, rulesVersion
+	el.Value = rec
+	return nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.receipts[id]
+	if !ok {
+		return ErrReceiptNotFound
+	}
+	m.remove(el)
+	return nil
+}
+
+func (m *memoryStore) DeleteBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, el := range m.receipts {
+		if el.Value.(StoredReceipt).ProcessedAt.Before(cutoff) {
+			m.remove(el)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// List returns all receipts ordered by processing time. Listing does not
+// count as use for eviction purposes.
+func (m *memoryStore) List(ctx context.Context) ([]StoredReceipt, error) {
+	m.mu.Lock()
+	out := make([]StoredReceipt, 0, len(m.receipts))
+	for _, el := range m.receipts {
+		out = append(out, el.Value.(StoredReceipt))
+	}
+	m.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ProcessedAt.Before(out[j].ProcessedAt) })
+	return out, nil
+}
+
+func (m *memoryStore) AddLedgerEntry(ctx context.Context, e LedgerEntry) (LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.Balance = m.balances[e.UserID] + e.Points
+	if e.spends() && e.Balance < 0 {
+		return e, ErrInsufficientPoints
+	}
+	m.balances[e.UserID] = e.Balance
+	m.ledgers[e.UserID] = append(m.ledgers[e.UserID], e)
+	return e, nil
+}
+
+func (m *memoryStore) Balance(ctx context.Context, user string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.balances[user], nil
+}
+
+func (m *memoryStore) Ledger(ctx context.Context, user string) ([]LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.ledgers[user]), nil
+}
+
+func (m *memoryStore) UsersWithBalance(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var users []string
+	for user, balance := range m.balances {
+		if balance > 0 {
+			users = append(users, user)
+		}
+	}
+	slices.Sort(users)
+	return users, nil
+}
+
+func (m *memoryStore) ReferralCode(ctx context.Context, user, code string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.referralCodes[user]; ok {
+		return existing, nil
+	}
+	m.referralCodes[user] = code
+	m.codeOwners[code] = user
+	return code, nil
+}
+
+func (m *memoryStore) ReferralCodeOwner(ctx context.Context, code string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.codeOwners[code]
+	if !ok {
+		return "", ErrReferralNotFound
+	}
+	return user, nil
+}
+
+func (m *memoryStore) AddReferral(ctx context.Context, r Referral, max int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.referrals[r.Referee]; ok {
+		return ErrAlreadyReferred
+	}
+	n := 0
+	for _, other := range m.referrals {
+		if other.Referrer == r.Referrer {
+			n++
+		}
+	}
+	if n >= max {
+		return ErrReferralLimit
+	}
+	m.referrals[r.Referee] = r
+	return nil
+}
+
+func (m *memoryStore) ReferralOf(ctx context.Context, referee string) (Referral, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.referrals[referee]
+	if !ok {
+		return Referral{}, ErrReferralNotFound
+	}
+	return r, nil
+}
+
+func (m *memoryStore) Referrals(ctx context.Context, referrer string) ([]Referral, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []Referral
+	for _, r := range m.referrals {
+		if r.Referrer == referrer {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryStore) ReferralCodeOf(ctx context.Context, user string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code, ok := m.referralCodes[user]
+	if !ok {
+		return "", ErrReferralNotFound
+	}
+	return code, nil
+}
+
+func (m *memoryStore) AddReport(ctx context.Context, r DailyReport) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.reports[r.Date]; ok {
+		return false, nil
+	}
+	m.reports[r.Date] = r
+	return true, nil
+}
+
+func (m *memoryStore) Report(ctx context.Context, date string) (DailyReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.reports[date]
+	if !ok {
+		return DailyReport{}, ErrReportNotFound
+	}
+	return r, nil
+}
+
+func (m *memoryStore) DeleteUser(ctx context.Context, user string) (UserDeletion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var d UserDeletion
+	for _, el := range m.receipts {
+		if el.Value.(StoredReceipt).belongsTo(user) {
+			m.remove(el)
+			d.Receipts++
+		}
+	}
+	d.LedgerEntries = len(m.ledgers[user])
+	delete(m.ledgers, user)
+	delete(m.balances, user)
+	if code, ok := m.referralCodes[user]; ok {
+		delete(m.referralCodes, user)
+		delete(m.codeOwners, code)
+		d.ReferralCode = true
+	}
+	for referee, r := range m.referrals {
+		if r.Referee == user || r.Referrer == user {
+			delete(m.referrals, referee)
+			d.Referrals++
+		}
+	}
+	return d, nil
+}
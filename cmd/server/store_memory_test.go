@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMemoryStoreConcurrentAccess runs Save, Get, Delete and List from
+// many goroutines at once. Run it with -race to check the store's locking.
+func TestMemoryStoreConcurrentAccess(t *testing.T) {
+	const (
+		workers = 16
+		perWork = 200
+	)
+	ctx := context.Background()
+	m := newMemoryStore(0, false)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWork {
+				id := fmt.Sprintf("w%d-r%d", w, i)
+				rec := StoredReceipt{ID: id, Points: i, ProcessedAt: time.Now(), ContentHash: id}
+				if err := m.Save(ctx, rec); err != nil {
+					errs <- fmt.Errorf("save %s: %w", id, err)
+					return
+				}
+				got, err := m.GetReceipt(ctx, id)
+				if err != nil || got.Points != i {
+					errs <- fmt.Errorf("get %s: got %d points, %v", id, got.Points, err)
+					return
+				}
+				if _, _, err := m.GetPoints(ctx, id); err != nil {
+					errs <- fmt.Errorf("get points %s: %w", id, err)
+					return
+				}
+				if _, err := m.List(ctx); err != nil {
+					errs <- fmt.Errorf("list: %w", err)
+					return
+				}
+				// Delete every other receipt, so that reads race with
+				// removals.
+				if i%2 == 0 {
+					if err := m.Delete(ctx, id); err != nil {
+						errs <- fmt.Errorf("delete %s: %w", id, err)
+						return
+					}
+					if _, err := m.GetReceipt(ctx, id); !errors.Is(err, ErrReceiptNotFound) {
+						errs <- fmt.Errorf("get deleted %s: got %v, want ErrReceiptNotFound", id, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	all, err := m.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := workers * perWork / 2; len(all) != want {
+		t.Errorf("List returned %d receipts, want %d", len(all), want)
+	}
+	n, err := m.CountReceipts(ctx)
+	if err != nil || n != len(all) {
+		t.Errorf("CountReceipts = %d, %v; want %d", n, err, len(all))
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresMigrations are applied in order; each entry's index+1 is its
+// schema version. Append new migrations, never edit existing ones.
+var postgresMigrations = []string{
+	`CREATE TABLE receipts (
+		id           TEXT PRIMARY KEY,
+		receipt      JSONB NOT NULL,
+		points       INTEGER NOT NULL,
+		processed_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX receipts_processed_at_idx ON receipts (processed_at)`,
+	`ALTER TABLE receipts ADD COLUMN owner TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE receipts ADD COLUMN content_hash TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX receipts_owner_hash_idx ON receipts (owner, content_hash)`,
+	`ALTER TABLE receipts ADD COLUMN rules_version TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE receipts ADD COLUMN flags TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE receipts ADD COLUMN fraud_score INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE receipts ADD COLUMN status TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE outbox (
+		seq        BIGSERIAL PRIMARY KEY,
+		event      JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE receipts ADD COLUMN user_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE balances (
+		user_id TEXT PRIMARY KEY,
+		points  INTEGER NOT NULL
+	)`,
+	`CREATE TABLE ledger (
+		seq        BIGSERIAL PRIMARY KEY,
+		id         TEXT NOT NULL UNIQUE,
+		user_id    TEXT NOT NULL,
+		type       TEXT NOT NULL,
+		points     INTEGER NOT NULL,
+		balance    INTEGER NOT NULL,
+		receipt_id TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX ledger_user_id_idx ON ledger (user_id, seq)`,
+	`ALTER TABLE ledger ADD COLUMN reason TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE receipts ADD COLUMN tier TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE referral_codes (
+		user_id TEXT PRIMARY KEY,
+		code    TEXT NOT NULL UNIQUE
+	)`,
+	`CREATE TABLE referrals (
+		referee    TEXT PRIMARY KEY,
+		referrer   TEXT NOT NULL,
+		code       TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX referrals_referrer_idx ON referrals (referrer, created_at)`,
+	`CREATE TABLE reports (
+		date       TEXT PRIMARY KEY,
+		report     TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE audit_log (
+		seq    BIGSERIAL PRIMARY KEY,
+		id     TEXT NOT NULL UNIQUE,
+		at     TIMESTAMPTZ NOT NULL,
+		actor  TEXT NOT NULL,
+		action TEXT NOT NULL,
+		entry  TEXT NOT NULL
+	)`,
+	`CREATE INDEX audit_log_at_idx ON audit_log (at, seq)`,
+	// Encrypted receipts (see encryption.go) are not JSON.
+	`ALTER TABLE receipts ALTER COLUMN receipt TYPE TEXT`,
+	// Receipts saved with deduplication are unique per owner and content
+	// hash; see StoredReceipt.Dedupe.
+	`ALTER TABLE receipts ADD COLUMN dedupe BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE UNIQUE INDEX receipts_owner_hash_dedupe_idx ON receipts (owner, content_hash) WHERE dedupe`,
+}
+
+// postgresMigrationLock is the advisory lock key that serialises migrations
+// when several replicas start at once.
+const postgresMigrationLock = 7246590113
+
+// newPostgresStore connects to Postgres using cfg, configures the pool and
+// brings the schema up to date.
+func newPostgresStore(cfg storeConfig) (*sqlStore, error) {
+	if cfg.PostgresDSN == "" {
+		return nil, fmt.Errorf("postgres driver requires POSTGRES_DSN")
+	}
+	db, err := openPostgres(cfg, func() string { return os.Getenv("POSTGRES_DSN") })
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := migratePostgres(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &sqlStore{db: db, dollarParams: true, skipLocked: true}
+	for i, dsn := range cfg.PostgresReadDSNs {
+		rdb, err := openPostgres(cfg, func() string {
+			if dsns := splitList(os.Getenv("POSTGRES_READ_DSNS")); i < len(dsns) {
+				return dsns[i]
+			}
+			return dsn
+		})
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.replicas = append(s.replicas, &sqlReplica{db: rdb})
+	}
+	return s, nil
+}
+
+// listenPostgresPeers applies the messages other instances send on
+// pointsCacheChannel to cache until the returned function is called. It
+// connects with the DSN returned by dsn, and reconnects when the connection
+// is lost.
+func listenPostgresPeers(cache *pointsCache, dsn func() string) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			err := listenPostgres(ctx, cache, dsn())
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("Lost points cache notifications; reconnecting", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// listenPostgres listens on one connection until it fails or ctx is done.
+func listenPostgres(ctx context.Context, cache *pointsCache, dsn string) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+pointsCacheChannel); err != nil {
+		return err
+	}
+	// Whatever changed while nobody was listening is forgotten.
+	cache.purge()
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		cache.applyPeer(n.Payload)
+	}
+}
+
+// openPostgres opens a pool of connections configured by cfg. dsn is
+// called for each new connection, whose credentials are taken from it, so
+// that credentials rotated in Vault are used without a restart.
+func openPostgres(cfg storeConfig, dsn func() string) (*sql.DB, error) {
+	connCfg, err := pgx.ParseConfig(dsn())
+	if err != nil {
+		return nil, fmt.Errorf("open postgres: %w", err)
+	}
+	db := stdlib.OpenDB(*connCfg, stdlib.OptionBeforeConnect(func(ctx context.Context, cc *pgx.ConnConfig) error {
+		fresh, err := pgx.ParseConfig(dsn())
+		if err != nil {
+			return err
+		}
+		cc.User, cc.Password = fresh.User, fresh.Password
+		return nil
+	}))
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	return db, nil
+}
+
+// migratePostgres applies any pending postgresMigrations inside a single
+// transaction, recording progress in schema_migrations.
+func migratePostgres(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	for i := current; i < len(postgresMigrations); i++ {
+		if _, err := tx.ExecContext(ctx, postgresMigrations[i]); err != nil {
+			return fmt.Errorf("apply migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			return fmt.Errorf("record migration %d: %w", i+1, err)
+		}
+	}
+	return tx.Commit()
+}
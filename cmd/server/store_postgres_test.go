@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"fetch_assessment/points"
+)
+
+// newTestPostgresStore connects to the database named by POSTGRES_TEST_DSN,
+// skipping the test when it is not set, with the rest of cfg as given. The
+// schema is migrated, and the receipts the test saves must be deleted by it.
+func newTestPostgresStore(t *testing.T, cfg storeConfig) *sqlStore {
+	t.Helper()
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+	t.Setenv("POSTGRES_DSN", dsn)
+	cfg.Driver, cfg.PostgresDSN = "postgres", dsn
+	s, err := newStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg := s.(*sqlStore)
+	t.Cleanup(func() { pg.Close() })
+	return pg
+}
+
+// TestPostgresStoreEncryptedReceipts saves a receipt with encryption on
+// and checks that it is stored sealed and reads back as it was.
+func TestPostgresStoreEncryptedReceipts(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	t.Setenv("RECEIPT_ENCRYPTION_KEYS", "test="+base64.StdEncoding.EncodeToString(key))
+	cipher, err := receiptCipherFromEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestPostgresStore(t, storeConfig{Cipher: cipher})
+	ctx := context.Background()
+
+	rec := StoredReceipt{
+		ID: uuid.New().String(),
+		Receipt: points.Receipt{
+			Retailer:     "Target",
+			PurchaseDate: "2022-01-01",
+			PurchaseTime: "13:01",
+			Items:        []points.Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+			Total:        "6.49",
+		},
+		Points:       28,
+		ProcessedAt:  time.Now().UTC().Truncate(time.Microsecond),
+		Status:       statusAccepted,
+		ContentHash:  uuid.New().String(),
+		RulesVersion: "builtin-1",
+	}
+	if err := s.Save(ctx, rec); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	t.Cleanup(func() { s.Delete(context.Background(), rec.ID) })
+
+	var stored string
+	if err := s.db.QueryRowContext(ctx, `SELECT receipt FROM receipts WHERE id = $1`, rec.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, sealedPrefix) || strings.Contains(stored, "Target") {
+		t.Errorf("receipt column holds %q, want a sealed payload", stored)
+	}
+
+	got, err := s.GetReceipt(ctx, rec.ID)
+	if err != nil {
+		t.Fatalf("GetReceipt: %v", err)
+	}
+	if !reflect.DeepEqual(got, rec) {
+		t.Errorf("GetReceipt = %+v, want %+v", got, rec)
+	}
+}
+
+// TestPostgresStorePointsCacheAcrossInstances checks that a receipt deleted
+// or rescored through one instance stops being served from another
+// instance's points cache.
+func TestPostgresStorePointsCacheAcrossInstances(t *testing.T) {
+	a := newTestPostgresStore(t, storeConfig{PointsCache: newPointsCache(100, time.Hour)})
+	b := newTestPostgresStore(t, storeConfig{PointsCache: newPointsCache(100, time.Hour)})
+	ctx := context.Background()
+
+	rec := StoredReceipt{ID: uuid.New().String(), Points: 28, ProcessedAt: time.Now().UTC(), Status: statusAccepted, ContentHash: uuid.New().String(), RulesVersion: "builtin-1"}
+	if err := a.Save(ctx, rec); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	t.Cleanup(func() { a.Delete(context.Background(), rec.ID) })
+	if points, _, err := a.GetPoints(ctx, rec.ID); err != nil || points != 28 {
+		t.Fatalf("GetPoints = %d, %v; want 28", points, err)
+	}
+
+	eventually := func(what string, ok func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !ok(); time.Sleep(20 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("the other instance still serves cached points after %s", what)
+			}
+		}
+	}
+	if err := b.UpdatePoints(ctx, rec.ID, 35, "builtin-2"); err != nil {
+		t.Fatalf("UpdatePoints: %v", err)
+	}
+	eventually("a rescore", func() bool {
+		points, _, err := a.GetPoints(ctx, rec.ID)
+		return err == nil && points == 35
+	})
+	if err := b.Delete(ctx, rec.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	eventually("a delete", func() bool {
+		_, _, err := a.GetPoints(ctx, rec.ID)
+		return errors.Is(err, ErrReceiptNotFound)
+	})
+}
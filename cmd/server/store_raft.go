@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// raftRetryDelay is how long a write waits before trying again while the
+// cluster has no leader.
+const raftRetryDelay = 50 * time.Millisecond
+
+// errRaftNotLeader is returned for writes made while the cluster has no
+// leader, or to a node that has stopped being it. They were not applied.
+var errRaftNotLeader = errors.New("no raft leader")
+
+// raftPeer is a member of the Raft cluster.
+type raftPeer struct {
+	ID   string
+	Addr string
+}
+
+// parseRaftPeers parses RAFT_PEERS: comma-separated id=host:port pairs.
+func parseRaftPeers(s string) ([]raftPeer, error) {
+	var peers []raftPeer
+	for _, p := range strings.Split(s, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("RAFT_PEERS: want id=host:port, got %q", p)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("RAFT_PEERS: %s: %w", id, err)
+		}
+		if slices.ContainsFunc(peers, func(q raftPeer) bool { return q.ID == id }) {
+			return nil, fmt.Errorf("RAFT_PEERS: %s is listed twice", id)
+		}
+		peers = append(peers, raftPeer{ID: id, Addr: addr})
+	}
+	return peers, nil
+}
+
+// raftApplyReply is what raftFSM.Apply returns for a record.
+type raftApplyReply struct {
+	res memoryResult
+	err error
+}
+
+// raftFSM applies committed memory log records to a memory store. Raft
+// calls Apply, Snapshot and Restore one at a time.
+type raftFSM struct {
+	m *memoryStore
+}
+
+func (f *raftFSM) Apply(l *raft.Log) interface{} {
+	var r memoryLogRecord
+	if err := json.Unmarshal(l.Data, &r); err != nil {
+		return raftApplyReply{err: fmt.Errorf("decode raft log %d: %w", l.Index, err)}
+	}
+	// Every node runs the background jobs, so a ledger entry can be
+	// proposed twice; like the SQL stores, keep only the first.
+	if r.Op == "addLedgerEntry" && r.Entry != nil {
+		entries, _ := f.m.Ledger(context.Background(), r.Entry.UserID)
+		if slices.ContainsFunc(entries, func(e LedgerEntry) bool { return e.ID == r.Entry.ID }) {
+			return raftApplyReply{err: fmt.Errorf("ledger entry %s already exists", r.Entry.ID)}
+		}
+	}
+	res, err := f.m.apply(context.Background(), r)
+	if errors.Is(err, errUnknownLogOp) {
+		slog.Warn("Skipping unknown raft log record", "index", l.Index, "op", r.Op)
+	}
+	return raftApplyReply{res: res, err: err}
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return raftSnapshot(f.m.dump()), nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snap storeSnapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return fmt.Errorf("decode raft snapshot: %w", err)
+	}
+	return f.m.Restore(context.Background(), snap, true)
+}
+
+// raftSnapshot is a copy of the store taken for Raft to persist.
+type raftSnapshot storeSnapshot
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(storeSnapshot(s)); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
+
+// raftStore replicates a memory store across a Raft cluster. Writes are
+// made on the leader, which followers forward them to, and return once
+// committed by a majority and applied on the node they were made on. Reads
+// are served from the local copy, so on followers they may briefly miss
+// writes made through other nodes.
+type raftStore struct {
+	*memoryStore
+	raft    *raft.Raft
+	trans   *raft.NetworkTransport
+	bolt    *raftboltdb.BoltStore
+	timeout time.Duration
+}
+
+// newRaftStore joins mem to the cluster in cfg, keeping its Raft log and
+// snapshots in cfg.RaftDir. The first start of each node bootstraps the
+// cluster from cfg.RaftPeers.
+func newRaftStore(mem *memoryStore, cfg storeConfig) (*raftStore, error) {
+	var self raftPeer
+	for _, p := range cfg.RaftPeers {
+		if p.ID == cfg.RaftNodeID {
+			self = p
+		}
+	}
+	if self.ID == "" {
+		return nil, fmt.Errorf("RAFT_NODE_ID %q is not in RAFT_PEERS", cfg.RaftNodeID)
+	}
+	bind := cfg.RaftBindAddr
+	if bind == "" {
+		bind = self.Addr
+	}
+	if err := os.MkdirAll(cfg.RaftDir, 0o700); err != nil {
+		return nil, fmt.Errorf("raft dir: %w", err)
+	}
+	logger := hclog.New(&hclog.LoggerOptions{Name: "raft", Output: os.Stdout, JSONFormat: true, Level: hclog.Info})
+
+	s := &raftStore{memoryStore: mem, timeout: cfg.RaftApplyTimeout}
+	bolt, err := raftboltdb.NewBoltStore(filepath.Join(cfg.RaftDir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("raft log: %w", err)
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(cfg.RaftDir, 2, logger)
+	if err != nil {
+		bolt.Close()
+		return nil, fmt.Errorf("raft snapshots: %w", err)
+	}
+	mux, err := newRaftMux(bind, self.Addr, s.serveForward)
+	if err != nil {
+		bolt.Close()
+		return nil, err
+	}
+	trans := raft.NewNetworkTransportWithLogger(mux, 3, 10*time.Second, logger)
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(self.ID)
+	conf.Logger = logger
+	existing, err := raft.HasExistingState(bolt, bolt, snaps)
+	if err != nil {
+		trans.Close()
+		bolt.Close()
+		return nil, fmt.Errorf("raft state: %w", err)
+	}
+	r, err := raft.NewRaft(conf, &raftFSM{m: mem}, bolt, bolt, snaps, trans)
+	if err != nil {
+		trans.Close()
+		bolt.Close()
+		return nil, fmt.Errorf("raft: %w", err)
+	}
+	if !existing {
+		var servers []raft.Server
+		for _, p := range cfg.RaftPeers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.Addr)})
+		}
+		// Every node bootstraps with the same configuration, so it does not
+		// matter which starts first.
+		if err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			r.Shutdown()
+			trans.Close()
+			bolt.Close()
+			return nil, fmt.Errorf("raft bootstrap: %w", err)
+		}
+	}
+	s.raft, s.trans, s.bolt = r, trans, bolt
+	return s, nil
+}
+
+// write makes the mutation r on the leader, retrying while there is none
+// for up to the apply timeout.
+func (s *raftStore) write(ctx context.Context, r memoryLogRecord) (memoryResult, error) {
+	deadline := time.Now().Add(s.timeout)
+	for {
+		res, err := s.tryWrite(r, deadline)
+		if !errors.Is(err, errRaftNotLeader) || time.Now().Add(raftRetryDelay).After(deadline) {
+			return res, err
+		}
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-time.After(raftRetryDelay):
+		}
+	}
+}
+
+// tryWrite applies r if this node is the leader and forwards it to the
+// leader otherwise. A forwarded write returns once this node has applied
+// it too, so the caller can read it back.
+func (s *raftStore) tryWrite(r memoryLogRecord, deadline time.Time) (memoryResult, error) {
+	if s.raft.State() == raft.Leader {
+		res, _, err := s.apply(r, time.Until(deadline))
+		return res, err
+	}
+	addr, _ := s.raft.LeaderWithID()
+	if addr == "" {
+		return memoryResult{}, errRaftNotLeader
+	}
+	resp, err := forwardWrite(string(addr), r, time.Until(deadline))
+	if err != nil {
+		return memoryResult{}, err
+	}
+	for resp.Index > 0 && s.raft.AppliedIndex() < resp.Index && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return resp.Result, resp.err()
+}
+
+// apply proposes r and waits for it to be applied here, on the leader.
+func (s *raftStore) apply(r memoryLogRecord, timeout time.Duration) (memoryResult, uint64, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return memoryResult{}, 0, err
+	}
+	f := s.raft.Apply(data, timeout)
+	if err := f.Error(); err != nil {
+		// Only these errors mean the record was never proposed; after the
+		// others it may still be committed.
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipTransferInProgress) {
+			return memoryResult{}, 0, errRaftNotLeader
+		}
+		return memoryResult{}, 0, fmt.Errorf("raft apply: %w", err)
+	}
+	reply := f.Response().(raftApplyReply)
+	return reply.res, f.Index(), reply.err
+}
+
+// serveForward applies a write forwarded by a follower.
+func (s *raftStore) serveForward(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout + 5*time.Second))
+	var r memoryLogRecord
+	if err := json.NewDecoder(conn).Decode(&r); err != nil {
+		slog.Warn("Bad forwarded raft write", "remote", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	var resp raftForwardResponse
+	if s.raft.State() != raft.Leader {
+		resp.setErr(errRaftNotLeader)
+	} else {
+		var err error
+		resp.Result, resp.Index, err = s.apply(r, s.timeout)
+		resp.setErr(err)
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		slog.Warn("Error answering forwarded raft write", "remote", conn.RemoteAddr().String(), "error", err)
+	}
+}
+
+// Ping fails while the node knows of no leader, as writes would.
+func (s *raftStore) Ping(ctx context.Context) error {
+	if addr, _ := s.raft.LeaderWithID(); addr == "" {
+		return errRaftNotLeader
+	}
+	return nil
+}
+
+// Close leaves the cluster running without this node.
+func (s *raftStore) Close() error {
+	err := s.raft.Shutdown().Error()
+	return errors.Join(err, s.trans.Close(), s.bolt.Close())
+}
+
+func (s *raftStore) Save(ctx context.Context, rec StoredReceipt) error {
+	_, err := s.write(ctx, memoryLogRecord{Op: "save", Receipt: &rec, Dedupe: rec.Dedupe})
+	return err
+}
+
+func (s *raftStore) UpdatePoints(ctx context.Context, id string, points int, rulesVersion string) error {
+	_, err := s.write(ctx, memoryLogRecord{Op: "updatePoints", ID: id, Points: points, RulesVersion: rulesVersion})
+	return err
+}
+
+func (s *raftStore) SetStatus(ctx context.Context, id, from, to string, points int, rulesVersion string) error {
+	_, err := s.write(ctx, memoryLogRecord{Op: "setStatus", ID: id, From: from, To: to, Points: points, RulesVersion: rulesVersion})
+	return err
+}
+
+func (s *raftStore) Delete(ctx context.Context, id string) error {
+	_, err := s.write(ctx, memoryLogRecord{Op: "delete", ID: id})
+	return err
+}
+
+func (s *raftStore) DeleteBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	res, err := s.write(ctx, memoryLogRecord{Op: "deleteBefore", Cutoff: &cutoff})
+	return res.N, err
+}
+
+func (s *raftStore) AddLedgerEntry(ctx context.Context, e LedgerEntry) (LedgerEntry, error) {
+	res, err := s.write(ctx, memoryLogRecord{Op: "addLedgerEntry", Entry: &e})
+	if res.Entry != nil {
+		e = *res.Entry
+	}
+	return e, err
+}
+
+func (s *raftStore) ReferralCode(ctx context.Context, user, code string) (string, error) {
+	res, err := s.write(ctx, memoryLogRecord{Op: "referralCode", User: user, Code: code})
+	return res.Code, err
+}
+
+func (s *raftStore) AddReferral(ctx context.Context, r Referral, max int) error {
+	_, err := s.write(ctx, memoryLogRecord{Op: "addReferral", Referral: &r, Max: max})
+	return err
+}
+
+func (s *raftStore) AddReport(ctx context.Context, r DailyReport) (bool, error) {
+	res, err := s.write(ctx, memoryLogRecord{Op: "addReport", Report: &r})
+	return res.Added, err
+}
+
+func (s *raftStore) DeleteUser(ctx context.Context, user string) (UserDeletion, error) {
+	res, err := s.write(ctx, memoryLogRecord{Op: "deleteUser", User: user})
+	if res.Deletion != nil {
+		return *res.Deletion, err
+	}
+	return UserDeletion{}, err
+}
+
+func (s *raftStore) Restore(ctx context.Context, snap storeSnapshot, replace bool) error {
+	_, err := s.write(ctx, memoryLogRecord{Op: "restore", Snapshot: &snap, Replace: replace})
+	return err
+}
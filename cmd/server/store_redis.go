@@ -0,0 +1,775 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisIndexKey is a sorted set of receipt IDs scored by processing time,
+// used to answer List without scanning the keyspace.
+const redisIndexKey = "receipts:index"
+
+// redisStore keeps each receipt in a hash at "receipt:{id}" with fields
+// "points", "rules_version" and "receipt" (the JSON body). When ttl is non-zero every
+// receipt key expires that long after it is saved. When cipher is set the
+// body is stored encrypted, and when cache is set it serves GetPoints and
+// the instances sharing the server tell each other about changed points
+// on pointsCacheChannel.
+type redisStore struct {
+	client    *redis.Client
+	ttl       time.Duration
+	cipher    *receiptCipher
+	cache     *pointsCache
+	stopPeers func()
+}
+
+// newRedisStore connects to the Redis server described by cfg.
+func newRedisStore(cfg storeConfig) (*redisStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: cfg.RedisAddr,
+		// Read for each new connection, so that a password rotated in
+		// Vault is used without a restart.
+		CredentialsProvider: func() (string, string) {
+			return "", os.Getenv("REDIS_PASSWORD")
+		},
+		DB: cfg.RedisDB,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connect to redis %s: %w", cfg.RedisAddr, err)
+	}
+	s := &redisStore{client: client, ttl: cfg.RedisTTL, cipher: cfg.Cipher, cache: cfg.PointsCache}
+	if s.cache != nil {
+		s.stopPeers = s.listenPeers()
+	}
+	return s, nil
+}
+
+// listenPeers applies the messages other instances publish on
+// pointsCacheChannel until the returned function is called.
+func (s *redisStore) listenPeers() (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := s.client.Subscribe(ctx, pointsCacheChannel)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			msg, err := sub.Receive(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				// Sent on every (re)subscription: whatever changed while
+				// nobody was listening is forgotten.
+				s.cache.purge()
+			case *redis.Message:
+				s.cache.applyPeer(msg.Payload)
+			}
+			if err != nil {
+				// The next Receive reconnects.
+				slog.Warn("Lost points cache messages; reconnecting", "error", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		sub.Close()
+		<-done
+	}
+}
+
+// notifyPeers tells the other instances to drop receipt id from their
+// points caches. A failure is only logged; their entries expire after
+// POINTS_CACHE_TTL.
+func (s *redisStore) notifyPeers(ctx context.Context, id string) {
+	if s.cache == nil {
+		return
+	}
+	if err := s.client.Publish(context.WithoutCancel(ctx), pointsCacheChannel, peerCacheMessage(id)).Err(); err != nil {
+		slog.Warn("Error notifying other instances of changed points", "error", err)
+	}
+}
+
+// expiry is when a receipt saved now expires, or zero if it does not.
+func (s *redisStore) expiry() time.Time {
+	if s.ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.ttl)
+}
+
+// cacheWritten caches points just written to receipt id without touching
+// its expiry. When receipts expire the entry is dropped instead, so that
+// the next read learns when.
+func (s *redisStore) cacheWritten(id string, points int, rulesVersion string) {
+	if s.ttl > 0 {
+		s.cache.remove(id)
+		return
+	}
+	s.cache.put(id, points, rulesVersion)
+}
+
+func redisReceiptKey(id string) string {
+	return "receipt:" + id
+}
+
+// redisHashKey maps an owner's content hash to the ID of their receipt.
+func redisHashKey(owner, hash string) string {
+	return "receipts:hash:" + owner + ":" + hash
+}
+
+// Save writes rec in one transaction. With rec.Dedupe set it first checks
+// the content-hash key under WATCH, so a concurrent save of the same
+// receipt fails the transaction and is checked again.
+func (s *redisStore) Save(ctx context.Context, rec StoredReceipt) error {
+	body, err := s.encode(ctx, rec)
+	if err != nil {
+		return err
+	}
+	if !rec.Dedupe {
+		_, err = s.client.TxPipelined(ctx, s.saveCmds(ctx, rec, body))
+	} else {
+		hashKey := redisHashKey(rec.Owner, rec.ContentHash)
+		for range 3 {
+			err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+				id, err := tx.Get(ctx, hashKey).Result()
+				if err != nil && !errors.Is(err, redis.Nil) {
+					return err
+				}
+				if err == nil {
+					// A key left behind by a deleted receipt does not count.
+					if n, err := tx.Exists(ctx, redisReceiptKey(id)).Result(); err != nil {
+						return err
+					} else if n > 0 {
+						return ErrDuplicateReceipt
+					}
+				}
+				_, err = tx.TxPipelined(ctx, s.saveCmds(ctx, rec, body))
+				return err
+			}, hashKey)
+			if !errors.Is(err, redis.TxFailedErr) {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.cache.putUntil(rec.ID, rec.Points, rec.RulesVersion, s.expiry())
+	return nil
+}
+
+// saveCmds queues the writes that save rec with the encoded body.
+func (s *redisStore) saveCmds(ctx context.Context, rec StoredReceipt, body []byte) func(redis.Pipeliner) error {
+	key := redisReceiptKey(rec.ID)
+	return func(p redis.Pipeliner) error {
+		p.HSet(ctx, key, "points", rec.Points, "rules_version", rec.RulesVersion, "receipt", body)
+		if s.ttl > 0 {
+			p.Expire(ctx, key, s.ttl)
+		}
+		p.ZAdd(ctx, redisIndexKey, redis.Z{Score: float64(rec.ProcessedAt.UnixNano()), Member: rec.ID})
+		if rec.ContentHash != "" {
+			p.Set(ctx, redisHashKey(rec.Owner, rec.ContentHash), rec.ID, s.ttl)
+		}
+		return nil
+	}
+}
+
+// FindByHash follows the hash key to its receipt. A hash key left behind by
+// a deleted receipt resolves to ErrReceiptNotFound.
+func (s *redisStore) FindByHash(ctx context.Context, owner, hash string) (StoredReceipt, error) {
+	id, err := s.client.Get(ctx, redisHashKey(owner, hash)).Result()
+	if errors.Is(err, redis.Nil) {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	return s.GetReceipt(ctx, id)
+}
+
+// GetPoints answers from the points cache if it can. Otherwise it reads
+// the points together with the time left before the receipt expires, which
+// bounds how long they are cached.
+func (s *redisStore) GetPoints(ctx context.Context, id string) (int, string, error) {
+	points, version, gen, ok := s.cache.get(id)
+	if ok {
+		return points, version, nil
+	}
+	var (
+		fields *redis.SliceCmd
+		left   *redis.DurationCmd
+	)
+	_, err := s.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		fields = p.HMGet(ctx, redisReceiptKey(id), "points", "rules_version")
+		if s.ttl > 0 {
+			left = p.PTTL(ctx, redisReceiptKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	vals := fields.Val()
+	pointsVal, ok := vals[0].(string)
+	if !ok {
+		return 0, "", ErrReceiptNotFound
+	}
+	if points, err = strconv.Atoi(pointsVal); err != nil {
+		return 0, "", fmt.Errorf("decode points for %s: %w", id, err)
+	}
+	version, _ = vals[1].(string)
+	var until time.Time
+	if left != nil && left.Val() > 0 {
+		until = time.Now().Add(left.Val())
+	}
+	s.cache.fillUntil(gen, id, points, version, until)
+	return points, version, nil
+}
+
+func (s *redisStore) GetReceipt(ctx context.Context, id string) (StoredReceipt, error) {
+	body, err := s.client.HGet(ctx, redisReceiptKey(id), "receipt").Bytes()
+	if errors.Is(err, redis.Nil) {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	return s.decode(ctx, id, body)
+}
+
+// encode marshals rec for the "receipt" field, encrypting it if configured.
+func (s *redisStore) encode(ctx context.Context, rec StoredReceipt) ([]byte, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("encode receipt: %w", err)
+	}
+	if body, err = s.cipher.seal(ctx, rec.ID, body); err != nil {
+		return nil, fmt.Errorf("encrypt receipt: %w", err)
+	}
+	return body, nil
+}
+
+// decode reverses encode for the receipt id.
+func (s *redisStore) decode(ctx context.Context, id string, body []byte) (StoredReceipt, error) {
+	body, err := s.cipher.open(ctx, id, body)
+	if err != nil {
+		return StoredReceipt{}, fmt.Errorf("decrypt receipt %s: %w", id, err)
+	}
+	var rec StoredReceipt
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return StoredReceipt{}, fmt.Errorf("decode receipt %s: %w", id, err)
+	}
+	return rec, nil
+}
+
+// UpdatePoints rewrites the points fields and the stored JSON body, leaving
+// the key's expiry untouched.
+func (s *redisStore) UpdatePoints(ctx context.Context, id string, points int, rulesVersion string) error {
+	rec, err := s.GetReceipt(ctx, id)
+	if err != nil {
+		return err
+	}
+	rec.Points, rec.RulesVersion = points, rulesVersion
+	body, err := s.encode(ctx, rec)
+	if err != nil {
+		return err
+	}
+	if err := s.client.HSet(ctx, redisReceiptKey(id), "points", points, "rules_version", rulesVersion, "receipt", body).Err(); err != nil {
+		return err
+	}
+	s.cacheWritten(id, points, rulesVersion)
+	s.notifyPeers(ctx, id)
+	return nil
+}
+
+// SetStatus rewrites the receipt inside a WATCH transaction, so a
+// concurrent change to it fails the update instead of being overwritten.
+func (s *redisStore) SetStatus(ctx context.Context, id, from, to string, points int, rulesVersion string) error {
+	key := redisReceiptKey(id)
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		body, err := tx.HGet(ctx, key, "receipt").Bytes()
+		if errors.Is(err, redis.Nil) {
+			return ErrReceiptNotFound
+		}
+		if err != nil {
+			return err
+		}
+		rec, err := s.decode(ctx, id, body)
+		if err != nil {
+			return err
+		}
+		if rec.Status != from {
+			return ErrStatusChanged
+		}
+		rec.Status, rec.Points, rec.RulesVersion = to, points, rulesVersion
+		if body, err = s.encode(ctx, rec); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, key, "points", points, "rules_version", rulesVersion, "receipt", body)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrStatusChanged
+	}
+	if err != nil {
+		return err
+	}
+	s.cacheWritten(id, points, rulesVersion)
+	s.notifyPeers(ctx, id)
+	return nil
+}
+
+func (s *redisStore) Delete(ctx context.Context, id string) error {
+	var del *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		del = p.Del(ctx, redisReceiptKey(id))
+		p.ZRem(ctx, redisIndexKey, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.cache.remove(id)
+	s.notifyPeers(ctx, id)
+	if del.Val() == 0 {
+		return ErrReceiptNotFound
+	}
+	return nil
+}
+
+// DeleteBefore removes receipts whose index score (processing time) is
+// before cutoff, together with their content-hash keys.
+func (s *redisStore) DeleteBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	ids, err := s.client.ZRangeByScore(ctx, redisIndexKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(cutoff.UnixNano(), 10),
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		rec, err := s.GetReceipt(ctx, id)
+		if err != nil && !errors.Is(err, ErrReceiptNotFound) {
+			return n, err
+		}
+		var del *redis.IntCmd
+		_, err = s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			del = p.Del(ctx, redisReceiptKey(id))
+			p.ZRem(ctx, redisIndexKey, id)
+			if rec.ContentHash != "" {
+				p.Del(ctx, redisHashKey(rec.Owner, rec.ContentHash))
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		s.cache.remove(id)
+		s.notifyPeers(ctx, id)
+		n += int(del.Val())
+	}
+	return n, nil
+}
+
+// List returns all live receipts ordered by processing time. Index entries
+// whose receipt has expired are pruned as they are encountered.
+func (s *redisStore) List(ctx context.Context) ([]StoredReceipt, error) {
+	ids, err := s.client.ZRange(ctx, redisIndexKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]StoredReceipt, 0, len(ids))
+	var expired []any
+	for _, id := range ids {
+		rec, err := s.GetReceipt(ctx, id)
+		if errors.Is(err, ErrReceiptNotFound) {
+			expired = append(expired, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	if len(expired) > 0 {
+		if err := s.client.ZRem(ctx, redisIndexKey, expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (s *redisStore) Close() error {
+	if s.stopPeers != nil {
+		s.stopPeers()
+	}
+	return s.client.Close()
+}
+
+func (s *redisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// CountReceipts counts the receipt index, which may still list receipts
+// that have just expired.
+func (s *redisStore) CountReceipts(ctx context.Context) (int, error) {
+	n, err := s.client.ZCard(ctx, redisIndexKey).Result()
+	return int(n), err
+}
+
+// redisLedgerKey is a list of a user's ledger entries as JSON, oldest
+// first, and redisBalanceKey holds their balance. Neither expires.
+func redisLedgerKey(user string) string {
+	return "ledger:" + user
+}
+
+func redisBalanceKey(user string) string {
+	return "balance:" + user
+}
+
+// AddLedgerEntry increments the balance and appends the entry in one
+// transaction, retrying if the balance changes underneath it.
+func (s *redisStore) AddLedgerEntry(ctx context.Context, e LedgerEntry) (LedgerEntry, error) {
+	key := redisBalanceKey(e.UserID)
+	for {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			balance, err := tx.Get(ctx, key).Int()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+			e.Balance = balance + e.Points
+			if e.spends() && e.Balance < 0 {
+				return ErrInsufficientPoints
+			}
+			body, err := json.Marshal(e)
+			if err != nil {
+				return fmt.Errorf("encode ledger entry: %w", err)
+			}
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.Set(ctx, key, e.Balance, 0)
+				p.RPush(ctx, redisLedgerKey(e.UserID), body)
+				return nil
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return e, err
+		}
+	}
+}
+
+func (s *redisStore) Balance(ctx context.Context, user string) (int, error) {
+	balance, err := s.client.Get(ctx, redisBalanceKey(user)).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return balance, err
+}
+
+func (s *redisStore) Ledger(ctx context.Context, user string) ([]LedgerEntry, error) {
+	bodies, err := s.client.LRange(ctx, redisLedgerKey(user), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]LedgerEntry, len(bodies))
+	for i, body := range bodies {
+		if err := json.Unmarshal([]byte(body), &out[i]); err != nil {
+			return nil, fmt.Errorf("decode ledger entry for %s: %w", user, err)
+		}
+	}
+	return out, nil
+}
+
+// UsersWithBalance scans the balance keys, so it visits the whole keyspace.
+func (s *redisStore) UsersWithBalance(ctx context.Context) ([]string, error) {
+	var users []string
+	iter := s.client.Scan(ctx, 0, redisBalanceKey("*"), 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		balance, err := s.client.Get(ctx, key).Int()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if balance > 0 {
+			users = append(users, strings.TrimPrefix(key, redisBalanceKey("")))
+		}
+	}
+	return users, iter.Err()
+}
+
+// Referral keys: a user's referral code, the user a code belongs to, the
+// referral of a referee as JSON, and the list of a referrer's referrals
+// as JSON, oldest first. None of them expire.
+func redisReferralCodeKey(user string) string  { return "referral-code:" + user }
+func redisReferralOwnerKey(code string) string { return "referral-owner:" + code }
+func redisReferralKey(referee string) string   { return "referral:" + referee }
+func redisReferralsKey(referrer string) string { return "referrals:" + referrer }
+
+func (s *redisStore) ReferralCode(ctx context.Context, user, code string) (string, error) {
+	key := redisReferralCodeKey(user)
+	for {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			existing, err := tx.Get(ctx, key).Result()
+			if err == nil {
+				code = existing
+				return nil
+			}
+			if !errors.Is(err, redis.Nil) {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.Set(ctx, key, code, 0)
+				p.Set(ctx, redisReferralOwnerKey(code), user, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return code, err
+		}
+	}
+}
+
+func (s *redisStore) ReferralCodeOwner(ctx context.Context, code string) (string, error) {
+	user, err := s.client.Get(ctx, redisReferralOwnerKey(code)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrReferralNotFound
+	}
+	return user, err
+}
+
+// AddReferral checks the referee and the limit and records the referral in
+// one transaction, retrying if either changes underneath it.
+func (s *redisStore) AddReferral(ctx context.Context, r Referral, max int) error {
+	key, listKey := redisReferralKey(r.Referee), redisReferralsKey(r.Referrer)
+	body, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("encode referral: %w", err)
+	}
+	for {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			exists, err := tx.Exists(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			if exists > 0 {
+				return ErrAlreadyReferred
+			}
+			n, err := tx.LLen(ctx, listKey).Result()
+			if err != nil {
+				return err
+			}
+			if n >= int64(max) {
+				return ErrReferralLimit
+			}
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.Set(ctx, key, body, 0)
+				p.RPush(ctx, listKey, body)
+				return nil
+			})
+			return err
+		}, key, listKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+}
+
+func (s *redisStore) ReferralOf(ctx context.Context, referee string) (Referral, error) {
+	var r Referral
+	body, err := s.client.Get(ctx, redisReferralKey(referee)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return r, ErrReferralNotFound
+	}
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return r, fmt.Errorf("decode referral of %s: %w", referee, err)
+	}
+	return r, nil
+}
+
+func (s *redisStore) Referrals(ctx context.Context, referrer string) ([]Referral, error) {
+	bodies, err := s.client.LRange(ctx, redisReferralsKey(referrer), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Referral, len(bodies))
+	for i, body := range bodies {
+		if err := json.Unmarshal([]byte(body), &out[i]); err != nil {
+			return nil, fmt.Errorf("decode referral for %s: %w", referrer, err)
+		}
+	}
+	return out, nil
+}
+
+func (s *redisStore) ReferralCodeOf(ctx context.Context, user string) (string, error) {
+	code, err := s.client.Get(ctx, redisReferralCodeKey(user)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrReferralNotFound
+	}
+	return code, err
+}
+
+// DeleteUser finds the user's receipts through the index, so like List it
+// reads every receipt. Each receipt is removed in its own transaction, and
+// the user's ledger and referrals in one more.
+func (s *redisStore) DeleteUser(ctx context.Context, user string) (UserDeletion, error) {
+	var d UserDeletion
+	all, err := s.List(ctx)
+	if err != nil {
+		return d, err
+	}
+	for _, rec := range all {
+		if !rec.belongsTo(user) {
+			continue
+		}
+		var del *redis.IntCmd
+		_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			del = p.Del(ctx, redisReceiptKey(rec.ID))
+			p.ZRem(ctx, redisIndexKey, rec.ID)
+			if rec.ContentHash != "" {
+				p.Del(ctx, redisHashKey(rec.Owner, rec.ContentHash))
+			}
+			return nil
+		})
+		if err != nil {
+			return d, err
+		}
+		s.cache.remove(rec.ID)
+		s.notifyPeers(ctx, rec.ID)
+		d.Receipts += int(del.Val())
+	}
+
+	code, err := s.client.Get(ctx, redisReferralCodeKey(user)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return d, err
+	}
+	d.ReferralCode = err == nil
+	received, err := s.client.Get(ctx, redisReferralKey(user)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return d, err
+	}
+	referred := err == nil
+	var referral Referral
+	if referred {
+		if err := json.Unmarshal([]byte(received), &referral); err != nil {
+			return d, fmt.Errorf("decode referral of %s: %w", user, err)
+		}
+	}
+	made, err := s.client.LRange(ctx, redisReferralsKey(user), 0, -1).Result()
+	if err != nil {
+		return d, err
+	}
+
+	var ledgerLen *redis.IntCmd
+	_, err = s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		ledgerLen = p.LLen(ctx, redisLedgerKey(user))
+		p.Del(ctx, redisLedgerKey(user), redisBalanceKey(user))
+		if d.ReferralCode {
+			p.Del(ctx, redisReferralCodeKey(user), redisReferralOwnerKey(code))
+		}
+		if referred {
+			p.Del(ctx, redisReferralKey(user))
+			p.LRem(ctx, redisReferralsKey(referral.Referrer), 0, received)
+		}
+		for _, body := range made {
+			var r Referral
+			if json.Unmarshal([]byte(body), &r) == nil {
+				p.Del(ctx, redisReferralKey(r.Referee))
+			}
+		}
+		p.Del(ctx, redisReferralsKey(user))
+		return nil
+	})
+	if err != nil {
+		return d, err
+	}
+	d.LedgerEntries = int(ledgerLen.Val())
+	d.Referrals = len(made)
+	if referred {
+		d.Referrals++
+	}
+	return d, nil
+}
+
+func redisReportKey(date string) string { return "report:" + date }
+
+func (s *redisStore) AddReport(ctx context.Context, r DailyReport) (bool, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	return s.client.SetNX(ctx, redisReportKey(r.Date), body, 0).Result()
+}
+
+func (s *redisStore) Report(ctx context.Context, date string) (DailyReport, error) {
+	body, err := s.client.Get(ctx, redisReportKey(date)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return DailyReport{}, ErrReportNotFound
+	}
+	if err != nil {
+		return DailyReport{}, err
+	}
+	var r DailyReport
+	err = json.Unmarshal(body, &r)
+	return r, err
+}
+
+// redisAuditKey is a sorted set of audit entries as JSON, scored by their
+// time in microseconds. Entries never expire.
+const redisAuditKey = "audit"
+
+func (s *redisStore) AppendAudit(ctx context.Context, e auditEntry) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.client.ZAdd(ctx, redisAuditKey, redis.Z{Score: float64(e.At.UnixMicro()), Member: body}).Err()
+}
+
+func (s *redisStore) Audit(ctx context.Context, since time.Time, limit int) ([]auditEntry, error) {
+	bodies, err := s.client.ZRangeByScore(ctx, redisAuditKey, &redis.ZRangeBy{
+		Min:   strconv.FormatInt(since.UnixMicro(), 10),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]auditEntry, 0, len(bodies))
+	for _, body := range bodies {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(body), &e); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
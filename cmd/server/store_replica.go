@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// sessionTokenHeader carries the position in the primary's write-ahead log
+// a client's reads must reflect.
+const sessionTokenHeader = "X-Session-Token"
+
+// sqlReplica is a read-only copy of the Postgres primary.
+type sqlReplica struct {
+	db *sql.DB
+	// replayed is the furthest WAL position the replica has been seen to
+	// replay; it only grows, so a replica past a token stays past it.
+	replayed atomic.Uint64
+}
+
+// advance records that the replica has replayed up to lsn.
+func (rep *sqlReplica) advance(lsn uint64) {
+	for {
+		cur := rep.replayed.Load()
+		if lsn <= cur || rep.replayed.CompareAndSwap(cur, lsn) {
+			return
+		}
+	}
+}
+
+// parseLSN parses a Postgres WAL position ("16/B374D848").
+func parseLSN(s string) (uint64, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid WAL position %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL position %q", s)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL position %q", s)
+	}
+	return h<<32 | l, nil
+}
+
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, lsn&0xFFFFFFFF)
+}
+
+type readAfterKey struct{}
+
+// withReadAfter asks the store to serve replica reads only from replicas
+// that have replayed the primary's WAL up to lsn.
+func withReadAfter(ctx context.Context, lsn uint64) context.Context {
+	return context.WithValue(ctx, readAfterKey{}, lsn)
+}
+
+// replica returns a replica that has replayed up to the position in ctx,
+// taking them in turn, or nil if none has.
+func (s *sqlStore) replica(ctx context.Context) *sqlReplica {
+	min, _ := ctx.Value(readAfterKey{}).(uint64)
+	start := s.nextReplica.Add(1)
+	for i := range len(s.replicas) {
+		rep := s.replicas[(int(start)+i)%len(s.replicas)]
+		if rep.replayed.Load() >= min {
+			return rep
+		}
+		var pos sql.NullString
+		if err := rep.db.QueryRowContext(ctx, `SELECT pg_last_wal_replay_lsn()::text`).Scan(&pos); err != nil {
+			slog.Warn("Error checking replica", "error", err)
+			continue
+		}
+		if !pos.Valid {
+			return rep // a primary, so up to date
+		}
+		lsn, err := parseLSN(pos.String)
+		if err != nil {
+			slog.Warn("Error checking replica", "error", err)
+			continue
+		}
+		rep.advance(lsn)
+		if lsn >= min {
+			return rep
+		}
+	}
+	return nil
+}
+
+// SessionToken returns the primary's current WAL position, or "" without
+// replicas. Reads given it see every write committed before the call.
+func (s *sqlStore) SessionToken(ctx context.Context) (string, error) {
+	if len(s.replicas) == 0 {
+		return "", nil
+	}
+	var pos string
+	if err := s.db.QueryRowContext(ctx, `SELECT pg_current_wal_lsn()::text`).Scan(&pos); err != nil {
+		return "", err
+	}
+	lsn, err := parseLSN(pos)
+	if err != nil {
+		return "", err
+	}
+	return formatLSN(lsn), nil
+}
+
+// sessionTokener is implemented by stores that serve reads from replicas.
+type sessionTokener interface {
+	SessionToken(ctx context.Context) (string, error)
+}
+
+// withSessionTokens sets the session token on successful responses to
+// requests that may have written, so that clients can send it back to read
+// their own writes. Responses streamed as records are processed carry none,
+// as their writes are not done when the headers are sent.
+func withSessionTokens(st sessionTokener, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(&sessionTokenWriter{ResponseWriter: w, r: r, st: st}, r)
+		}
+	})
+}
+
+// sessionTokenWriter adds the session token as the headers are written.
+type sessionTokenWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	st          sessionTokener
+	wroteHeader bool
+}
+
+func (t *sessionTokenWriter) WriteHeader(status int) {
+	if !t.wroteHeader {
+		t.wroteHeader = true
+		if status < 400 && t.Header().Get("Content-Type") != "application/x-ndjson" {
+			if token, err := t.st.SessionToken(t.r.Context()); err != nil {
+				slog.Error("Error reading session token", "error", err)
+			} else if token != "" {
+				t.Header().Set(sessionTokenHeader, token)
+			}
+		}
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *sessionTokenWriter) Write(b []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	return t.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (t *sessionTokenWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// readAfter applies the request's session token, if any, to ctx.
+func readAfter(r *http.Request) (context.Context, error) {
+	token := r.Header.Get(sessionTokenHeader)
+	if token == "" {
+		return r.Context(), nil
+	}
+	lsn, err := parseLSN(token)
+	if err != nil {
+		return nil, err
+	}
+	return withReadAfter(r.Context(), lsn), nil
+}
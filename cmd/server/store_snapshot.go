@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotFile   = "snapshot.json"
+	memoryLogGlob  = "log-*.jsonl"
+	memoryLogStart = "log-"
+)
+
+// memoryLogRecord is one mutation in the memory store's log. Op names the
+// ReceiptStore method and the other fields are its arguments.
+type memoryLogRecord struct {
+	Seq uint64 `json:"seq"`
+	Op  string `json:"op"`
+
+	Receipt      *StoredReceipt `json:"receipt,omitempty"`
+	Dedupe       bool           `json:"dedupe,omitempty"` // Receipt.Dedupe
+	ID           string         `json:"id,omitempty"`
+	From         string         `json:"from,omitempty"`
+	To           string         `json:"to,omitempty"`
+	Points       int            `json:"points,omitempty"`
+	RulesVersion string         `json:"rulesVersion,omitempty"`
+	Cutoff       *time.Time     `json:"cutoff,omitempty"`
+	Entry        *LedgerEntry   `json:"entry,omitempty"`
+	User         string         `json:"user,omitempty"`
+	Code         string         `json:"code,omitempty"`
+	Referral     *Referral      `json:"referral,omitempty"`
+	Max          int            `json:"max,omitempty"`
+	Report       *DailyReport   `json:"report,omitempty"`
+	Snapshot     *storeSnapshot `json:"snapshot,omitempty"`
+	Replace      bool           `json:"replace,omitempty"`
+}
+
+// storeSnapshot is the whole contents of a store: the memory store's as of
+// log record Seq, or any store's in a backup.
+type storeSnapshot struct {
+	Seq           uint64                   `json:"seq,omitempty"`
+	Receipts      []StoredReceipt          `json:"receipts"` // least recently used first
+	Ledgers       map[string][]LedgerEntry `json:"ledgers"`
+	ReferralCodes map[string]string        `json:"referralCodes"`
+	Referrals     []Referral               `json:"referrals"`
+	Reports       []DailyReport            `json:"reports"`
+}
+
+// dump copies the store's contents into a snapshot.
+func (m *memoryStore) dump() storeSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := storeSnapshot{
+		Receipts:      make([]StoredReceipt, 0, len(m.receipts)),
+		Ledgers:       make(map[string][]LedgerEntry, len(m.ledgers)),
+		ReferralCodes: make(map[string]string, len(m.referralCodes)),
+	}
+	for el := m.lru.Back(); el != nil; el = el.Prev() {
+		snap.Receipts = append(snap.Receipts, el.Value.(StoredReceipt))
+	}
+	for user, entries := range m.ledgers {
+		snap.Ledgers[user] = slices.Clone(entries)
+	}
+	for user, code := range m.referralCodes {
+		snap.ReferralCodes[user] = code
+	}
+	for _, r := range m.referrals {
+		snap.Referrals = append(snap.Referrals, r)
+	}
+	sort.Slice(snap.Referrals, func(i, j int) bool { return snap.Referrals[i].CreatedAt.Before(snap.Referrals[j].CreatedAt) })
+	for _, r := range m.reports {
+		snap.Reports = append(snap.Reports, r)
+	}
+	sort.Slice(snap.Reports, func(i, j int) bool { return snap.Reports[i].Date < snap.Reports[j].Date })
+	return snap
+}
+
+// Backup returns a copy of the store's contents.
+func (m *memoryStore) Backup(ctx context.Context) (storeSnapshot, error) {
+	return m.dump(), nil
+}
+
+// Restore replaces the store's contents with snap, which is loaded through
+// the store's own methods so that its indexes and balances are rebuilt.
+func (m *memoryStore) Restore(ctx context.Context, snap storeSnapshot, replace bool) error {
+	if m.maxEntries > 0 && len(snap.Receipts) > m.maxEntries {
+		return fmt.Errorf("%w: %d receipts do not fit", ErrStoreFull, len(snap.Receipts))
+	}
+	fresh := newMemoryStore(m.maxEntries, m.rejectWhenFull)
+	for _, rec := range snap.Receipts {
+		if err := fresh.Save(ctx, rec); err != nil {
+			return err
+		}
+	}
+	for _, entries := range snap.Ledgers {
+		for _, e := range entries {
+			if _, err := fresh.AddLedgerEntry(ctx, e); err != nil {
+				return fmt.Errorf("ledger entry %s: %w", e.ID, err)
+			}
+		}
+	}
+	for user, code := range snap.ReferralCodes {
+		fresh.ReferralCode(ctx, user, code)
+	}
+	for _, r := range snap.Referrals {
+		if err := fresh.AddReferral(ctx, r, math.MaxInt); err != nil {
+			return fmt.Errorf("referral of %s: %w", r.Referee, err)
+		}
+	}
+	for _, r := range snap.Reports {
+		fresh.AddReport(ctx, r)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !replace && (len(m.receipts) > 0 || len(m.ledgers) > 0 || len(m.referralCodes) > 0 || len(m.referrals) > 0 || len(m.reports) > 0) {
+		return ErrStoreNotEmpty
+	}
+	m.receipts, m.lru, m.byHash = fresh.receipts, fresh.lru, fresh.byHash
+	m.ledgers, m.balances = fresh.ledgers, fresh.balances
+	m.referralCodes, m.codeOwners, m.referrals = fresh.referralCodes, fresh.codeOwners, fresh.referrals
+	m.reports = fresh.reports
+	return nil
+}
+
+// snapshotStore keeps a memory store on disk in dir: every mutation is
+// appended to a write-ahead log, and flushed to disk if fsync is set, before
+// it is applied. The whole store is written to snapshot.json every interval
+// or once the log grows past maxBytes, after which the logs it covers are
+// removed. On startup the snapshot is loaded and the logs replayed.
+//
+// Logs are named after the sequence number of their first record, and a
+// new one is started at each snapshot and on startup, so a snapshot that
+// fails to write loses nothing.
+type snapshotStore struct {
+	*memoryStore
+	dir      string
+	fsync    bool
+	maxBytes int64
+	compact  chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex // orders log records and serialises their application
+	seq     uint64     // last record written
+	snapSeq uint64     // last record in snapshot.json
+	log     *os.File
+	size    int64 // bytes in log
+	failed  error // why the log can no longer be appended to
+}
+
+// newSnapshotStore restores mem from cfg.MemorySnapshotDir, creating it if
+// needed, and snapshots it until closed.
+func newSnapshotStore(mem *memoryStore, cfg storeConfig) (*snapshotStore, error) {
+	dir := cfg.MemorySnapshotDir
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("memory snapshot dir: %w", err)
+	}
+	p := &snapshotStore{
+		memoryStore: mem,
+		dir:         dir,
+		fsync:       cfg.MemoryWALFsync,
+		maxBytes:    int64(cfg.MemoryWALMaxBytes),
+		compact:     make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	replayed, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	if p.log, err = p.openLog(); err != nil {
+		return nil, err
+	}
+	// Compact what was replayed now rather than replaying it again after
+	// another crash.
+	if replayed > 0 {
+		if err := p.snapshot(); err != nil {
+			slog.Error("Error writing memory snapshot", "error", err)
+		}
+	}
+	go p.run(cfg.MemorySnapshotInterval)
+	return p, nil
+}
+
+// load restores the snapshot, if there is one, and replays the logs after
+// it, returning how many records it replayed. A record cut short by a crash
+// is removed; any other damage, or a missing record, is an error.
+func (p *snapshotStore) load() (int, error) {
+	ctx := context.Background()
+	body, err := os.ReadFile(filepath.Join(p.dir, snapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("read memory snapshot: %w", err)
+	}
+	if err == nil {
+		var snap storeSnapshot
+		if err := json.Unmarshal(body, &snap); err != nil {
+			return 0, fmt.Errorf("decode memory snapshot: %w", err)
+		}
+		if err := p.memoryStore.Restore(ctx, snap, true); err != nil {
+			return 0, fmt.Errorf("restore memory snapshot: %w", err)
+		}
+		p.seq, p.snapSeq = snap.Seq, snap.Seq
+	}
+
+	logs, err := p.logFiles()
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, name := range logs {
+		recs, valid, err := readWAL(name)
+		if err != nil {
+			return 0, fmt.Errorf("read memory log: %w", err)
+		}
+		if fi, err := os.Stat(name); err == nil && fi.Size() > valid {
+			// A write cut short by a crash; nothing after it was applied.
+			slog.Warn("Truncating a damaged record from the memory log", "file", name, "offset", valid, "bytes", fi.Size()-valid)
+			if err := os.Truncate(name, valid); err != nil {
+				return 0, fmt.Errorf("truncate memory log: %w", err)
+			}
+		}
+		for _, rec := range recs {
+			if rec.Seq <= p.seq {
+				continue // already in the snapshot
+			}
+			if rec.Seq != p.seq+1 {
+				return 0, fmt.Errorf("%w: %s skips from record %d to %d", errWALCorrupt, name, p.seq, rec.Seq)
+			}
+			p.replay(ctx, rec)
+			p.seq = rec.Seq
+			replayed++
+		}
+	}
+	slog.Info("Memory store restored", "dir", p.dir, "receipts", len(p.receipts), "log_records", replayed)
+	return replayed, nil
+}
+
+// errUnknownLogOp is returned by apply for records it cannot apply.
+var errUnknownLogOp = errors.New("unknown memory log op")
+
+// memoryResult holds what a logged mutation returned besides its error.
+type memoryResult struct {
+	N     int          `json:"n,omitempty"`     // deleteBefore
+	Entry *LedgerEntry `json:"entry,omitempty"` // addLedgerEntry
+	Code  string       `json:"code,omitempty"`  // referralCode
+	Added bool         `json:"added,omitempty"` // addReport
+	// Deletion is what deleteUser removed.
+	Deletion *UserDeletion `json:"deletion,omitempty"`
+}
+
+// apply makes the mutation r records.
+func (m *memoryStore) apply(ctx context.Context, r memoryLogRecord) (memoryResult, error) {
+	var (
+		res memoryResult
+		err error
+	)
+	switch r.Op {
+	case "save":
+		rec := *r.Receipt
+		rec.Dedupe = r.Dedupe
+		err = m.Save(ctx, rec)
+	case "updatePoints":
+		err = m.UpdatePoints(ctx, r.ID, r.Points, r.RulesVersion)
+	case "setStatus":
+		err = m.SetStatus(ctx, r.ID, r.From, r.To, r.Points, r.RulesVersion)
+	case "delete":
+		err = m.Delete(ctx, r.ID)
+	case "deleteBefore":
+		res.N, err = m.DeleteBefore(ctx, *r.Cutoff)
+	case "addLedgerEntry":
+		var e LedgerEntry
+		e, err = m.AddLedgerEntry(ctx, *r.Entry)
+		res.Entry = &e
+	case "referralCode":
+		res.Code, err = m.ReferralCode(ctx, r.User, r.Code)
+	case "addReferral":
+		err = m.AddReferral(ctx, *r.Referral, r.Max)
+	case "addReport":
+		res.Added, err = m.AddReport(ctx, *r.Report)
+	case "deleteUser":
+		var d UserDeletion
+		d, err = m.DeleteUser(ctx, r.User)
+		res.Deletion = &d
+	case "restore":
+		err = m.Restore(ctx, *r.Snapshot, r.Replace)
+	default:
+		err = fmt.Errorf("%w %q", errUnknownLogOp, r.Op)
+	}
+	return res, err
+}
+
+// replay applies a logged mutation. Mutations that failed when they were
+// made fail the same way again, so only unknown records are reported.
+func (p *snapshotStore) replay(ctx context.Context, r memoryLogRecord) {
+	if _, err := p.memoryStore.apply(ctx, r); errors.Is(err, errUnknownLogOp) {
+		slog.Warn("Skipping unknown memory log record", "seq", r.Seq, "op", r.Op)
+	}
+}
+
+// logFiles returns the paths of the logs in dir, oldest first.
+func (p *snapshotStore) logFiles() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(p.dir, memoryLogGlob))
+	if err != nil {
+		return nil, err
+	}
+	start := func(name string) uint64 {
+		n, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), memoryLogStart), ".jsonl"), 10, 64)
+		return n
+	}
+	sort.Slice(names, func(i, j int) bool { return start(names[i]) < start(names[j]) })
+	return names, nil
+}
+
+// logName is the path of the log whose first record is seq.
+func (p *snapshotStore) logName(seq uint64) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%s%020d.jsonl", memoryLogStart, seq))
+}
+
+// openLog starts a new log for the records after p.seq. A log already
+// under that name can only hold a damaged record, so it is replaced.
+// Callers hold p.mu or have not yet shared p, and reset p.size.
+func (p *snapshotStore) openLog() (*os.File, error) {
+	f, err := os.OpenFile(p.logName(p.seq+1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open memory log: %w", err)
+	}
+	if err := syncDir(p.dir); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("sync memory snapshot dir: %w", err)
+	}
+	return f, nil
+}
+
+// write logs r and then applies it with apply. If the record cannot be
+// removed again after a failed write, or may not have reached the disk,
+// further writes fail until the next snapshot replaces the log.
+func (p *snapshotStore) write(r memoryLogRecord, apply func() error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failed != nil {
+		return p.failed
+	}
+	r.Seq = p.seq + 1
+	line, err := encodeWALRecord(r)
+	if err != nil {
+		return err
+	}
+	if n, err := p.log.Write(line); err != nil {
+		err = fmt.Errorf("write memory log: %w", err)
+		if n > 0 {
+			if terr := p.log.Truncate(p.size); terr != nil {
+				p.fail(err)
+			} else if _, serr := p.log.Seek(p.size, io.SeekStart); serr != nil {
+				p.fail(err)
+			}
+		}
+		return err
+	}
+	if p.fsync {
+		if err := p.log.Sync(); err != nil {
+			// The record may or may not survive, and a failed fsync cannot
+			// be retried.
+			err = fmt.Errorf("sync memory log: %w", err)
+			p.fail(err)
+			return err
+		}
+	}
+	p.seq = r.Seq
+	p.size += int64(len(line))
+	if p.maxBytes > 0 && p.size >= p.maxBytes {
+		p.requestSnapshot()
+	}
+	return apply()
+}
+
+// fail stops writes to the log and asks for a snapshot to replace it.
+func (p *snapshotStore) fail(err error) {
+	slog.Error("Memory log failed; rejecting writes until the next snapshot", "error", err)
+	p.failed = err
+	p.requestSnapshot()
+}
+
+// requestSnapshot has run take a snapshot without waiting for the interval.
+func (p *snapshotStore) requestSnapshot() {
+	select {
+	case p.compact <- struct{}{}:
+	default: // one is already pending
+	}
+}
+
+// run snapshots the store every interval, and when write asks for one,
+// until Close.
+func (p *snapshotStore) run(interval time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		case <-p.compact:
+		}
+		if err := p.snapshot(); err != nil {
+			slog.Error("Error writing memory snapshot", "error", err)
+		}
+	}
+}
+
+// snapshot writes the store to snapshot.json and removes the logs it
+// covers. Only copying the store holds up writes.
+func (p *snapshotStore) snapshot() error {
+	p.mu.Lock()
+	if p.seq == p.snapSeq && p.failed == nil {
+		p.mu.Unlock()
+		return nil // nothing new
+	}
+	snap := p.dump()
+	snap.Seq = p.seq
+	// The current log is empty if it already starts after the snapshot,
+	// unless a failed write left part of a record in it.
+	if p.logName(p.seq+1) != p.log.Name() || p.failed != nil {
+		f, err := p.openLog()
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		p.log.Close()
+		p.log, p.size = f, 0
+	}
+	current := p.log.Name()
+	p.mu.Unlock()
+	old, err := p.logFiles()
+	if err != nil {
+		return err
+	}
+	old = slices.DeleteFunc(old, func(name string) bool { return name == current })
+
+	tmp, err := os.CreateTemp(p.dir, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := json.NewEncoder(tmp).Encode(snap); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(p.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err := syncDir(p.dir); err != nil {
+		return err
+	}
+	for _, name := range old {
+		os.Remove(name)
+	}
+	p.mu.Lock()
+	p.snapSeq = snap.Seq
+	if p.failed != nil {
+		slog.Info("Memory log replaced; accepting writes again")
+		p.failed = nil
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// Close takes a final snapshot and closes the log.
+func (p *snapshotStore) Close() error {
+	close(p.stop)
+	<-p.done
+	err := p.snapshot()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return errors.Join(err, p.log.Close())
+}
+
+func (p *snapshotStore) Save(ctx context.Context, rec StoredReceipt) error {
+	return p.write(memoryLogRecord{Op: "save", Receipt: &rec, Dedupe: rec.Dedupe}, func() error {
+		return p.memoryStore.Save(ctx, rec)
+	})
+}
+
+func (p *snapshotStore) UpdatePoints(ctx context.Context, id string, points int, rulesVersion string) error {
+	return p.write(memoryLogRecord{Op: "updatePoints", ID: id, Points: points, RulesVersion: rulesVersion}, func() error {
+		return p.memoryStore.UpdatePoints(ctx, id, points, rulesVersion)
+	})
+}
+
+func (p *snapshotStore) SetStatus(ctx context.Context, id, from, to string, points int, rulesVersion string) error {
+	return p.write(memoryLogRecord{Op: "setStatus", ID: id, From: from, To: to, Points: points, RulesVersion: rulesVersion}, func() error {
+		return p.memoryStore.SetStatus(ctx, id, from, to, points, rulesVersion)
+	})
+}
+
+func (p *snapshotStore) Delete(ctx context.Context, id string) error {
+	return p.write(memoryLogRecord{Op: "delete", ID: id}, func() error {
+		return p.memoryStore.Delete(ctx, id)
+	})
+}
+
+func (p *snapshotStore) DeleteBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	var n int
+	err := p.write(memoryLogRecord{Op: "deleteBefore", Cutoff: &cutoff}, func() error {
+		var err error
+		n, err = p.memoryStore.DeleteBefore(ctx, cutoff)
+		return err
+	})
+	return n, err
+}
+
+func (p *snapshotStore) AddLedgerEntry(ctx context.Context, e LedgerEntry) (LedgerEntry, error) {
+	var out LedgerEntry
+	err := p.write(memoryLogRecord{Op: "addLedgerEntry", Entry: &e}, func() error {
+		var err error
+		out, err = p.memoryStore.AddLedgerEntry(ctx, e)
+		return err
+	})
+	return out, err
+}
+
+func (p *snapshotStore) ReferralCode(ctx context.Context, user, code string) (string, error) {
+	var out string
+	err := p.write(memoryLogRecord{Op: "referralCode", User: user, Code: code}, func() error {
+		var err error
+		out, err = p.memoryStore.ReferralCode(ctx, user, code)
+		return err
+	})
+	return out, err
+}
+
+func (p *snapshotStore) AddReferral(ctx context.Context, r Referral, max int) error {
+	return p.write(memoryLogRecord{Op: "addReferral", Referral: &r, Max: max}, func() error {
+		return p.memoryStore.AddReferral(ctx, r, max)
+	})
+}
+
+func (p *snapshotStore) AddReport(ctx context.Context, r DailyReport) (bool, error) {
+	var added bool
+	err := p.write(memoryLogRecord{Op: "addReport", Report: &r}, func() error {
+		var err error
+		added, err = p.memoryStore.AddReport(ctx, r)
+		return err
+	})
+	return added, err
+}
+
+// DeleteUser takes a snapshot straight after, so the user's data is gone
+// from disk once the logs holding it are removed.
+func (p *snapshotStore) DeleteUser(ctx context.Context, user string) (UserDeletion, error) {
+	var d UserDeletion
+	err := p.write(memoryLogRecord{Op: "deleteUser", User: user}, func() error {
+		var err error
+		d, err = p.memoryStore.DeleteUser(ctx, user)
+		return err
+	})
+	if err == nil {
+		p.requestSnapshot()
+	}
+	return d, err
+}
+
+// Restore logs the whole of snap, so a snapshot is taken straight after
+// to keep the log from replaying it again.
+func (p *snapshotStore) Restore(ctx context.Context, snap storeSnapshot, replace bool) error {
+	err := p.write(memoryLogRecord{Op: "restore", Snapshot: &snap, Replace: replace}, func() error {
+		return p.memoryStore.Restore(ctx, snap, replace)
+	})
+	if err == nil {
+		p.requestSnapshot()
+	}
+	return err
+}
@@ -0,0 +1,898 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sqlStore is a ReceiptStore backed by a database/sql connection. The
+// receipt body is kept as JSON next to its points so it can be returned as
+// submitted.
+type sqlStore struct {
+	db *sql.DB
+	// dollarParams rewrites "?" placeholders to "$1", "$2", ... for drivers
+	// such as Postgres that require numbered parameters.
+	dollarParams bool
+	// skipLocked claims outbox events with SELECT ... FOR UPDATE SKIP
+	// LOCKED so that several replicas can relay them at once.
+	skipLocked bool
+	// replicas serve GetPoints; see store_replica.go.
+	replicas    []*sqlReplica
+	nextReplica atomic.Uint32
+	// cipher, if set, encrypts the receipt column; see encryption.go.
+	cipher *receiptCipher
+	// cache, if set, serves GetPoints; see pointscache.go.
+	cache *pointsCache
+	// peers, if set, tells other instances about changes to points
+	// through Postgres notifications; stopPeers stops hearing theirs. See
+	// listenPostgresPeers.
+	peers     bool
+	stopPeers func()
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// rebind converts a query written with "?" placeholders to the driver's syntax.
+func (s *sqlStore) rebind(query string) string {
+	if !s.dollarParams {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, ch := range query {
+		if ch == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
+
+// receiptColumns are the receipts columns in the order scanReceipt reads
+// them.
+const receiptColumns = "id, receipt, points, processed_at, owner, content_hash, rules_version, flags, fraud_score, status, user_id, tier"
+
+func (s *sqlStore) Save(ctx context.Context, rec StoredReceipt) error {
+	if err := s.insert(ctx, s.db, rec); err != nil {
+		return err
+	}
+	s.cache.put(rec.ID, rec.Points, rec.RulesVersion)
+	return nil
+}
+
+// insert adds rec, or returns ErrDuplicateReceipt if rec.Dedupe is set and
+// the unique index on deduplicated receipts already has its owner and hash.
+func (s *sqlStore) insert(ctx context.Context, db sqlExecer, rec StoredReceipt) error {
+	body, err := json.Marshal(rec.Receipt)
+	if err != nil {
+		return fmt.Errorf("encode receipt: %w", err)
+	}
+	if body, err = s.cipher.seal(ctx, rec.ID, body); err != nil {
+		return fmt.Errorf("encrypt receipt: %w", err)
+	}
+	res, err := db.ExecContext(ctx,
+		s.rebind(`INSERT INTO receipts (`+receiptColumns+`, dedupe) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (owner, content_hash) WHERE dedupe DO NOTHING`),
+		rec.ID, string(body), rec.Points, rec.ProcessedAt.UTC(), rec.Owner, rec.ContentHash, rec.RulesVersion,
+		strings.Join(rec.Flags, ","), rec.FraudScore, rec.Status, rec.UserID, rec.Tier, rec.Dedupe)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDuplicateReceipt
+	}
+	return nil
+}
+
+// SaveWithEvents saves rec and adds evs to the outbox in one transaction.
+func (s *sqlStore) SaveWithEvents(ctx context.Context, rec StoredReceipt, evs []receiptEvent) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.insert(ctx, tx, rec); err != nil {
+		return err
+	}
+	for _, ev := range evs {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			return fmt.Errorf("encode event: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO outbox (event) VALUES (?)`), string(body)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.cache.put(rec.ID, rec.Points, rec.RulesVersion)
+	return nil
+}
+
+// RelayEvents passes up to limit of the oldest outbox events to send and
+// deletes them once send succeeds. It returns how many were relayed.
+func (s *sqlStore) RelayEvents(ctx context.Context, limit int, send func([]receiptEvent) error) (int, error) {
+	var db sqlExecer = s.db
+	query := `SELECT seq, event FROM outbox ORDER BY seq LIMIT ?`
+	if s.skipLocked {
+		// Hold the rows until they are deleted so that other replicas
+		// skip them.
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+		db, query = tx, query+` FOR UPDATE SKIP LOCKED`
+	}
+
+	rows, err := db.QueryContext(ctx, s.rebind(query), limit)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		seqs []any
+		evs  []receiptEvent
+	)
+	for rows.Next() {
+		var (
+			seq  int64
+			body []byte
+			ev   receiptEvent
+		)
+		if err := rows.Scan(&seq, &body); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal(body, &ev); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("decode outbox event %d: %w", seq, err)
+		}
+		seqs, evs = append(seqs, seq), append(evs, ev)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(evs) == 0 {
+		return 0, err
+	}
+
+	if err := send(evs); err != nil {
+		return 0, err
+	}
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(seqs)), ", ")
+	if _, err := db.ExecContext(ctx, s.rebind(`DELETE FROM outbox WHERE seq IN (`+marks+`)`), seqs...); err != nil {
+		return 0, err
+	}
+	if tx, ok := db.(*sql.Tx); ok {
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	return len(evs), nil
+}
+
+func (s *sqlStore) FindByHash(ctx context.Context, owner, hash string) (StoredReceipt, error) {
+	row := s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT `+receiptColumns+` FROM receipts
+			WHERE owner = ? AND content_hash = ? ORDER BY processed_at DESC LIMIT 1`), owner, hash)
+	rec, err := s.scanReceipt(ctx, row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	return rec, err
+}
+
+// GetPoints answers from the points cache if it can. Otherwise it reads
+// from a replica when there is one that is up to date (see withReadAfter),
+// and from the primary if the replica fails or lacks the receipt.
+func (s *sqlStore) GetPoints(ctx context.Context, id string) (int, string, error) {
+	points, version, gen, ok := s.cache.get(id)
+	if ok {
+		return points, version, nil
+	}
+	var err error
+	if rep := s.replica(ctx); rep != nil {
+		points, version, err = s.getPoints(ctx, rep.db, id)
+		if err == nil {
+			s.cache.fill(gen, id, points, version)
+			return points, version, nil
+		}
+		if !errors.Is(err, ErrReceiptNotFound) {
+			slog.Warn("Error reading points from replica", "error", err)
+		}
+	}
+	if points, version, err = s.getPoints(ctx, s.db, id); err != nil {
+		return 0, "", err
+	}
+	s.cache.fill(gen, id, points, version)
+	return points, version, nil
+}
+
+func (s *sqlStore) getPoints(ctx context.Context, db *sql.DB, id string) (int, string, error) {
+	var (
+		points  int
+		version string
+	)
+	err := db.QueryRowContext(ctx, s.rebind(`SELECT points, rules_version FROM receipts WHERE id = ?`), id).Scan(&points, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", ErrReceiptNotFound
+	}
+	return points, version, err
+}
+
+func (s *sqlStore) GetReceipt(ctx context.Context, id string) (StoredReceipt, error) {
+	row := s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT `+receiptColumns+` FROM receipts WHERE id = ?`), id)
+	rec, err := s.scanReceipt(ctx, row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	return rec, err
+}
+
+func (s *sqlStore) UpdatePoints(ctx context.Context, id string, points int, rulesVersion string) error {
+	res, err := s.db.ExecContext(ctx,
+		s.rebind(`UPDATE receipts SET points = ?, rules_version = ? WHERE id = ?`), points, rulesVersion, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrReceiptNotFound
+	}
+	s.cache.put(id, points, rulesVersion)
+	s.notifyPeers(ctx, id)
+	return nil
+}
+
+func (s *sqlStore) SetStatus(ctx context.Context, id, from, to string, points int, rulesVersion string) error {
+	res, err := s.db.ExecContext(ctx,
+		s.rebind(`UPDATE receipts SET status = ?, points = ?, rules_version = ? WHERE id = ? AND status = ?`),
+		to, points, rulesVersion, id, from)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		s.cache.put(id, points, rulesVersion)
+		s.notifyPeers(ctx, id)
+		return nil
+	}
+	// Nothing matched: tell a missing receipt from one in another status.
+	if _, err := s.GetReceipt(ctx, id); err != nil {
+		return err
+	}
+	return ErrStatusChanged
+}
+
+func (s *sqlStore) Delete(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM receipts WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	s.cache.remove(id)
+	s.notifyPeers(ctx, id)
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrReceiptNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM receipts WHERE processed_at < ?`), cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	s.cache.purge()
+	s.notifyPeers(ctx, "*")
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// List returns all receipts ordered by processing time.
+func (s *sqlStore) List(ctx context.Context) ([]StoredReceipt, error) {
+	rows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT `+receiptColumns+` FROM receipts ORDER BY processed_at`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []StoredReceipt
+	for rows.Next() {
+		rec, err := s.scanReceipt(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+// AddLedgerEntry updates the balance and records the entry in one
+// transaction.
+func (s *sqlStore) AddLedgerEntry(ctx context.Context, e LedgerEntry) (LedgerEntry, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return e, err
+	}
+	defer tx.Rollback()
+
+	if e.spends() {
+		// The balance check and the debit are one statement, so concurrent
+		// debits cannot both spend the same points.
+		err = tx.QueryRowContext(ctx, s.rebind(`UPDATE balances SET points = points + ?
+			WHERE user_id = ? AND points + ? >= 0
+			RETURNING points`), e.Points, e.UserID, e.Points).Scan(&e.Balance)
+		if errors.Is(err, sql.ErrNoRows) {
+			return e, ErrInsufficientPoints
+		}
+	} else {
+		err = tx.QueryRowContext(ctx, s.rebind(`INSERT INTO balances (user_id, points) VALUES (?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET points = balances.points + excluded.points
+			RETURNING points`), e.UserID, e.Points).Scan(&e.Balance)
+	}
+	if err != nil {
+		return e, err
+	}
+	_, err = tx.ExecContext(ctx,
+		s.rebind(`INSERT INTO ledger (`+ledgerColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		e.ID, e.UserID, e.Type, e.Points, e.Balance, e.ReceiptID, e.Reason, e.CreatedAt.UTC())
+	if err != nil {
+		return e, err
+	}
+	return e, tx.Commit()
+}
+
+func (s *sqlStore) Balance(ctx context.Context, user string) (int, error) {
+	var points int
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT points FROM balances WHERE user_id = ?`), user).Scan(&points)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return points, err
+}
+
+// ledgerColumns are the ledger columns in the order Ledger reads them.
+const ledgerColumns = "id, user_id, type, points, balance, receipt_id, reason, created_at"
+
+func (s *sqlStore) Ledger(ctx context.Context, user string) ([]LedgerEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT `+ledgerColumns+` FROM ledger WHERE user_id = ? ORDER BY seq`), user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Type, &e.Points, &e.Balance, &e.ReceiptID, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = e.CreatedAt.UTC()
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) UsersWithBalance(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user_id FROM balances WHERE points > 0 ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlStore) ReferralCode(ctx context.Context, user, code string) (string, error) {
+	_, err := s.db.ExecContext(ctx,
+		s.rebind(`INSERT INTO referral_codes (user_id, code) VALUES (?, ?) ON CONFLICT (user_id) DO NOTHING`), user, code)
+	if err != nil {
+		return "", err
+	}
+	err = s.db.QueryRowContext(ctx, s.rebind(`SELECT code FROM referral_codes WHERE user_id = ?`), user).Scan(&code)
+	return code, err
+}
+
+func (s *sqlStore) ReferralCodeOwner(ctx context.Context, code string) (string, error) {
+	var user string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT user_id FROM referral_codes WHERE code = ?`), code).Scan(&user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrReferralNotFound
+	}
+	return user, err
+}
+
+// AddReferral checks the limit and records the referral in one
+// transaction, holding the referrer's referral code row so that concurrent
+// referrals by the same referrer are counted one after another.
+func (s *sqlStore) AddReferral(ctx context.Context, r Referral, max int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.rebind(`UPDATE referral_codes SET code = code WHERE user_id = ?`), r.Referrer); err != nil {
+		return err
+	}
+	var n int
+	if err := tx.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM referrals WHERE referee = ?`), r.Referee).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrAlreadyReferred
+	}
+	if err := tx.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM referrals WHERE referrer = ?`), r.Referrer).Scan(&n); err != nil {
+		return err
+	}
+	if n >= max {
+		return ErrReferralLimit
+	}
+	res, err := tx.ExecContext(ctx,
+		s.rebind(`INSERT INTO referrals (referee, referrer, code, created_at) VALUES (?, ?, ?, ?) ON CONFLICT (referee) DO NOTHING`),
+		r.Referee, r.Referrer, r.Code, r.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	if added, err := res.RowsAffected(); err != nil {
+		return err
+	} else if added == 0 {
+		return ErrAlreadyReferred
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ReferralOf(ctx context.Context, referee string) (Referral, error) {
+	var r Referral
+	err := s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT referrer, referee, code, created_at FROM referrals WHERE referee = ?`), referee).
+		Scan(&r.Referrer, &r.Referee, &r.Code, &r.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, ErrReferralNotFound
+	}
+	r.CreatedAt = r.CreatedAt.UTC()
+	return r, err
+}
+
+func (s *sqlStore) Referrals(ctx context.Context, referrer string) ([]Referral, error) {
+	rows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT referrer, referee, code, created_at FROM referrals WHERE referrer = ? ORDER BY created_at`), referrer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Referral
+	for rows.Next() {
+		var r Referral
+		if err := rows.Scan(&r.Referrer, &r.Referee, &r.Code, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = r.CreatedAt.UTC()
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) ReferralCodeOf(ctx context.Context, user string) (string, error) {
+	var code string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT code FROM referral_codes WHERE user_id = ?`), user).Scan(&code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrReferralNotFound
+	}
+	return code, err
+}
+
+// DeleteUser removes the user's data in one transaction, together with
+// any outbox events about them that have not been relayed yet.
+func (s *sqlStore) DeleteUser(ctx context.Context, user string) (UserDeletion, error) {
+	var d UserDeletion
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return d, err
+	}
+	defer tx.Rollback()
+	// Purged once the transaction is over, so nothing read before it ends
+	// stays cached.
+	defer s.cache.purge()
+	defer s.notifyPeers(ctx, "*")
+
+	// Receipts stored before user IDs were recorded belong to their owner;
+	// see belongsTo.
+	ids := make(map[string]bool)
+	rows, err := tx.QueryContext(ctx, s.rebind(`SELECT id FROM receipts WHERE user_id = ? OR (user_id = '' AND owner = ?)`), user, user)
+	if err != nil {
+		return d, err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return d, err
+		}
+		ids[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return d, err
+	}
+
+	var seqs []any
+	rows, err = tx.QueryContext(ctx, `SELECT seq, event FROM outbox`)
+	if err != nil {
+		return d, err
+	}
+	for rows.Next() {
+		var (
+			seq  int64
+			body string
+			ev   receiptEvent
+		)
+		if err := rows.Scan(&seq, &body); err != nil {
+			rows.Close()
+			return d, err
+		}
+		if json.Unmarshal([]byte(body), &ev) == nil && (ev.Data.UserID == user || ids[ev.Data.ReceiptID]) {
+			seqs = append(seqs, seq)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return d, err
+	}
+	if len(seqs) > 0 {
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(seqs)), ", ")
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM outbox WHERE seq IN (`+marks+`)`), seqs...); err != nil {
+			return d, err
+		}
+		d.Events = len(seqs)
+	}
+
+	exec := func(query string, args ...any) (int, error) {
+		res, err := tx.ExecContext(ctx, s.rebind(query), args...)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		return int(n), err
+	}
+	if d.Receipts, err = exec(`DELETE FROM receipts WHERE user_id = ? OR (user_id = '' AND owner = ?)`, user, user); err != nil {
+		return d, err
+	}
+	if d.LedgerEntries, err = exec(`DELETE FROM ledger WHERE user_id = ?`, user); err != nil {
+		return d, err
+	}
+	if _, err = exec(`DELETE FROM balances WHERE user_id = ?`, user); err != nil {
+		return d, err
+	}
+	codes, err := exec(`DELETE FROM referral_codes WHERE user_id = ?`, user)
+	if err != nil {
+		return d, err
+	}
+	d.ReferralCode = codes > 0
+	if d.Referrals, err = exec(`DELETE FROM referrals WHERE referee = ? OR referrer = ?`, user, user); err != nil {
+		return d, err
+	}
+	return d, tx.Commit()
+}
+
+// notifyPeers tells the other instances to drop receipt id, or everything
+// for "*", from their points caches. A failure is only logged; their
+// entries expire after POINTS_CACHE_TTL.
+func (s *sqlStore) notifyPeers(ctx context.Context, id string) {
+	if !s.peers {
+		return
+	}
+	if _, err := s.db.ExecContext(context.WithoutCancel(ctx), `SELECT pg_notify($1, $2)`, pointsCacheChannel, peerCacheMessage(id)); err != nil {
+		slog.Warn("Error notifying other instances of changed points", "error", err)
+	}
+}
+
+func (s *sqlStore) Close() error {
+	if s.stopPeers != nil {
+		s.stopPeers()
+	}
+	err := s.db.Close()
+	for _, rep := range s.replicas {
+		err = errors.Join(err, rep.db.Close())
+	}
+	return err
+}
+
+// scanReceipt reads one receipts row from either *sql.Row or *sql.Rows,
+// decrypting the receipt if it was stored encrypted.
+func (s *sqlStore) scanReceipt(ctx context.Context, row interface{ Scan(...any) error }) (StoredReceipt, error) {
+	var (
+		rec         StoredReceipt
+		body        []byte
+		processedAt time.Time
+		flags       string
+	)
+	if err := row.Scan(&rec.ID, &body, &rec.Points, &processedAt, &rec.Owner, &rec.ContentHash, &rec.RulesVersion, &flags, &rec.FraudScore, &rec.Status, &rec.UserID, &rec.Tier); err != nil {
+		return StoredReceipt{}, err
+	}
+	if flags != "" {
+		rec.Flags = strings.Split(flags, ",")
+	}
+	body, err := s.cipher.open(ctx, rec.ID, body)
+	if err != nil {
+		return StoredReceipt{}, fmt.Errorf("decrypt receipt %s: %w", rec.ID, err)
+	}
+	if err := json.Unmarshal(body, &rec.Receipt); err != nil {
+		return StoredReceipt{}, fmt.Errorf("decode receipt %s: %w", rec.ID, err)
+	}
+	rec.ProcessedAt = processedAt.UTC()
+	return rec, nil
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) CountReceipts(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM receipts`).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) AddReport(ctx context.Context, r DailyReport) (bool, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.db.ExecContext(ctx,
+		s.rebind(`INSERT INTO reports (date, report, created_at) VALUES (?, ?, ?) ON CONFLICT (date) DO NOTHING`),
+		r.Date, string(body), r.GeneratedAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) Report(ctx context.Context, date string) (DailyReport, error) {
+	var body string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT report FROM reports WHERE date = ?`), date).Scan(&body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DailyReport{}, ErrReportNotFound
+	}
+	if err != nil {
+		return DailyReport{}, err
+	}
+	var r DailyReport
+	err = json.Unmarshal([]byte(body), &r)
+	return r, err
+}
+
+// AppendAudit records e in the audit_log table, which the service only ever
+// inserts into.
+func (s *sqlStore) AppendAudit(ctx context.Context, e auditEntry) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		s.rebind(`INSERT INTO audit_log (id, at, actor, action, entry) VALUES (?, ?, ?, ?, ?)`),
+		e.ID, e.At.UTC(), e.Actor, e.Action, string(body))
+	return err
+}
+
+func (s *sqlStore) Audit(ctx context.Context, since time.Time, limit int) ([]auditEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		s.rebind(`SELECT entry FROM audit_log WHERE at >= ? ORDER BY at, seq LIMIT ?`), since.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []auditEntry
+	for rows.Next() {
+		var body string
+		if err := rows.Scan(&body); err != nil {
+			return nil, err
+		}
+		var e auditEntry
+		if err := json.Unmarshal([]byte(body), &e); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// Backup reads every table in one repeatable-read transaction, so the
+// copy is consistent while writes continue.
+func (s *sqlStore) Backup(ctx context.Context) (storeSnapshot, error) {
+	snap := storeSnapshot{Ledgers: map[string][]LedgerEntry{}, ReferralCodes: map[string]string{}}
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return snap, err
+	}
+	defer tx.Rollback()
+
+	query := func(q string, scan func(*sql.Rows) error) error {
+		rows, err := tx.QueryContext(ctx, q)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+	err = query(`SELECT `+receiptColumns+` FROM receipts ORDER BY processed_at`, func(rows *sql.Rows) error {
+		rec, err := s.scanReceipt(ctx, rows)
+		if err != nil {
+			return err
+		}
+		snap.Receipts = append(snap.Receipts, rec)
+		return nil
+	})
+	if err == nil {
+		err = query(`SELECT `+ledgerColumns+` FROM ledger ORDER BY seq`, func(rows *sql.Rows) error {
+			var e LedgerEntry
+			if err := rows.Scan(&e.ID, &e.UserID, &e.Type, &e.Points, &e.Balance, &e.ReceiptID, &e.Reason, &e.CreatedAt); err != nil {
+				return err
+			}
+			e.CreatedAt = e.CreatedAt.UTC()
+			snap.Ledgers[e.UserID] = append(snap.Ledgers[e.UserID], e)
+			return nil
+		})
+	}
+	if err == nil {
+		err = query(`SELECT user_id, code FROM referral_codes`, func(rows *sql.Rows) error {
+			var user, code string
+			if err := rows.Scan(&user, &code); err != nil {
+				return err
+			}
+			snap.ReferralCodes[user] = code
+			return nil
+		})
+	}
+	if err == nil {
+		err = query(`SELECT referrer, referee, code, created_at FROM referrals ORDER BY created_at`, func(rows *sql.Rows) error {
+			var r Referral
+			if err := rows.Scan(&r.Referrer, &r.Referee, &r.Code, &r.CreatedAt); err != nil {
+				return err
+			}
+			r.CreatedAt = r.CreatedAt.UTC()
+			snap.Referrals = append(snap.Referrals, r)
+			return nil
+		})
+	}
+	if err == nil {
+		err = query(`SELECT report FROM reports ORDER BY date`, func(rows *sql.Rows) error {
+			var (
+				body string
+				r    DailyReport
+			)
+			if err := rows.Scan(&body); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(body), &r); err != nil {
+				return fmt.Errorf("decode report: %w", err)
+			}
+			snap.Reports = append(snap.Reports, r)
+			return nil
+		})
+	}
+	return snap, err
+}
+
+// restoreTables are emptied by a replacing Restore, in this order. The
+// outbox is left alone: its events have already happened.
+var restoreTables = []string{"receipts", "ledger", "balances", "referrals", "referral_codes", "reports"}
+
+// Restore replaces the contents of the tables in one transaction.
+func (s *sqlStore) Restore(ctx context.Context, snap storeSnapshot, replace bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	defer s.cache.purge()
+	defer s.notifyPeers(ctx, "*")
+
+	for _, table := range restoreTables {
+		if !replace {
+			var n int
+			if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM (SELECT 1 FROM `+table+` LIMIT 1) t`).Scan(&n); err != nil {
+				return err
+			}
+			if n > 0 {
+				return ErrStoreNotEmpty
+			}
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table); err != nil {
+			return err
+		}
+	}
+
+	for _, rec := range snap.Receipts {
+		if err := s.insert(ctx, tx, rec); err != nil {
+			return fmt.Errorf("receipt %s: %w", rec.ID, err)
+		}
+	}
+	for user, entries := range snap.Ledgers {
+		for _, e := range entries {
+			_, err := tx.ExecContext(ctx,
+				s.rebind(`INSERT INTO ledger (`+ledgerColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+				e.ID, e.UserID, e.Type, e.Points, e.Balance, e.ReceiptID, e.Reason, e.CreatedAt.UTC())
+			if err != nil {
+				return fmt.Errorf("ledger entry %s: %w", e.ID, err)
+			}
+		}
+		if len(entries) > 0 {
+			_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO balances (user_id, points) VALUES (?, ?)`), user, entries[len(entries)-1].Balance)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for user, code := range snap.ReferralCodes {
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO referral_codes (user_id, code) VALUES (?, ?)`), user, code); err != nil {
+			return fmt.Errorf("referral code of %s: %w", user, err)
+		}
+	}
+	for _, r := range snap.Referrals {
+		_, err := tx.ExecContext(ctx,
+			s.rebind(`INSERT INTO referrals (referee, referrer, code, created_at) VALUES (?, ?, ?, ?)`),
+			r.Referee, r.Referrer, r.Code, r.CreatedAt.UTC())
+		if err != nil {
+			return fmt.Errorf("referral of %s: %w", r.Referee, err)
+		}
+	}
+	for _, r := range snap.Reports {
+		body, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO reports (date, report, created_at) VALUES (?, ?, ?)`),
+			r.Date, string(body), r.GeneratedAt.UTC())
+		if err != nil {
+			return fmt.Errorf("report for %s: %w", r.Date, err)
+		}
+	}
+	return tx.Commit()
+}
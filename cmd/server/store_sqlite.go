@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order; each entry's index+1 is its
+// schema version, tracked in PRAGMA user_version. Append new migrations,
+// never edit existing ones.
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS receipts (
+		id           TEXT PRIMARY KEY,
+		receipt      TEXT NOT NULL,
+		points       INTEGER NOT NULL,
+		processed_at DATETIME NOT NULL
+	)`,
+	`ALTER TABLE receipts ADD COLUMN owner TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE receipts ADD COLUMN content_hash TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX receipts_owner_hash_idx ON receipts (owner, content_hash)`,
+	`ALTER TABLE receipts ADD COLUMN rules_version TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE receipts ADD COLUMN flags TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE receipts ADD COLUMN fraud_score INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE receipts ADD COLUMN status TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE outbox (
+		seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+		event      TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`ALTER TABLE receipts ADD COLUMN user_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE balances (
+		user_id TEXT PRIMARY KEY,
+		points  INTEGER NOT NULL
+	)`,
+	`CREATE TABLE ledger (
+		seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+		id         TEXT NOT NULL UNIQUE,
+		user_id    TEXT NOT NULL,
+		type       TEXT NOT NULL,
+		points     INTEGER NOT NULL,
+		balance    INTEGER NOT NULL,
+		receipt_id TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	)`,
+	`CREATE INDEX ledger_user_id_idx ON ledger (user_id, seq)`,
+	`ALTER TABLE ledger ADD COLUMN reason TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE receipts ADD COLUMN tier TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE referral_codes (
+		user_id TEXT PRIMARY KEY,
+		code    TEXT NOT NULL UNIQUE
+	)`,
+	`CREATE TABLE referrals (
+		referee    TEXT PRIMARY KEY,
+		referrer   TEXT NOT NULL,
+		code       TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	)`,
+	`CREATE INDEX referrals_referrer_idx ON referrals (referrer, created_at)`,
+	`CREATE TABLE reports (
+		date       TEXT PRIMARY KEY,
+		report     TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	)`,
+	`CREATE TABLE audit_log (
+		seq    INTEGER PRIMARY KEY AUTOINCREMENT,
+		id     TEXT NOT NULL UNIQUE,
+		at     DATETIME NOT NULL,
+		actor  TEXT NOT NULL,
+		action TEXT NOT NULL,
+		entry  TEXT NOT NULL
+	)`,
+	`CREATE INDEX audit_log_at_idx ON audit_log (at, seq)`,
+	// Receipts saved with deduplication are unique per owner and content
+	// hash; see StoredReceipt.Dedupe.
+	`ALTER TABLE receipts ADD COLUMN dedupe BOOLEAN NOT NULL DEFAULT 0`,
+	`CREATE UNIQUE INDEX receipts_owner_hash_dedupe_idx ON receipts (owner, content_hash) WHERE dedupe`,
+}
+
+// newSQLiteStore opens (creating if needed) the SQLite database at path
+// and brings its schema up to date.
+func newSQLiteStore(path string) (*sqlStore, error) {
+	// During an upgrade the old and new processes both write for a
+	// moment; wait for the other's lock rather than failing.
+	dsn := path
+	if !strings.Contains(dsn, "?") {
+		dsn += "?_pragma=busy_timeout(5000)"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite %s: %w", path, err)
+	}
+	// SQLite allows a single writer; serialising through one connection
+	// avoids SQLITE_BUSY errors under concurrent requests.
+	db.SetMaxOpenConns(1)
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db}, nil
+}
+
+// migrateSQLite applies any pending sqliteMigrations in one transaction.
+func migrateSQLite(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current int
+	if err := tx.QueryRow(`PRAGMA user_version`).Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	for i := current; i < len(sqliteMigrations); i++ {
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			return fmt.Errorf("apply migration %d: %w", i+1, err)
+		}
+	}
+	// PRAGMA does not accept bound parameters.
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, len(sqliteMigrations))); err != nil {
+		return fmt.Errorf("record schema version: %w", err)
+	}
+	return tx.Commit()
+}
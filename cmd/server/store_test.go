@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testStores open an empty store of each driver that can run in tests;
+// postgres is skipped unless POSTGRES_TEST_DSN is set.
+var testStores = map[string]func(t *testing.T) ReceiptStore{
+	"memory": func(t *testing.T) ReceiptStore { return newMemoryStore(0, false) },
+	"sqlite": func(t *testing.T) ReceiptStore {
+		s, err := newSQLiteStore(filepath.Join(t.TempDir(), "receipts.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	},
+	"postgres": func(t *testing.T) ReceiptStore { return newTestPostgresStore(t, storeConfig{}) },
+}
+
+// TestStoresSaveDedupedReceiptsOnce saves the same deduplicated receipt
+// from many goroutines at once and checks that exactly one copy is stored,
+// while copies saved without Dedupe are all kept.
+func TestStoresSaveDedupedReceiptsOnce(t *testing.T) {
+	for name, open := range testStores {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			ctx := context.Background()
+			owner, hash := "owner-"+uuid.NewString(), "hash"
+			t.Cleanup(func() { s.DeleteUser(context.Background(), owner) })
+
+			const workers = 16
+			var (
+				wg    sync.WaitGroup
+				mu    sync.Mutex
+				saved int
+			)
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := StoredReceipt{ID: fmt.Sprintf("%s-%d", owner, w), ProcessedAt: time.Now(), Owner: owner, ContentHash: hash, Dedupe: true}
+					err := s.Save(ctx, rec)
+					if err != nil && !errors.Is(err, ErrDuplicateReceipt) {
+						t.Errorf("Save: %v", err)
+					}
+					if err == nil {
+						mu.Lock()
+						saved++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if saved != 1 {
+				t.Errorf("%d concurrent saves of the same receipt succeeded, want 1", saved)
+			}
+
+			// Copies asked for explicitly are still stored.
+			for i := range 2 {
+				rec := StoredReceipt{ID: fmt.Sprintf("%s-copy-%d", owner, i), ProcessedAt: time.Now(), Owner: owner, ContentHash: hash}
+				if err := s.Save(ctx, rec); err != nil {
+					t.Errorf("Save without Dedupe: %v", err)
+				}
+			}
+			if _, err := s.FindByHash(ctx, owner, hash); err != nil {
+				t.Errorf("FindByHash: %v", err)
+			}
+		})
+	}
+}
+
+// TestStoresLimitConcurrentReferrals claims one referrer's code for many
+// users at once and checks that no more than the limit are recorded.
+func TestStoresLimitConcurrentReferrals(t *testing.T) {
+	const max, workers = 3, 16
+	for name, open := range testStores {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			ctx := context.Background()
+			referrer := "referrer-" + uuid.NewString()
+			code, err := s.ReferralCode(ctx, referrer, uuid.NewString())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				for w := range workers {
+					s.DeleteUser(context.Background(), fmt.Sprintf("%s-referee-%d", referrer, w))
+				}
+				s.DeleteUser(context.Background(), referrer)
+			})
+
+			var (
+				wg    sync.WaitGroup
+				mu    sync.Mutex
+				added int
+			)
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r := Referral{Referrer: referrer, Referee: fmt.Sprintf("%s-referee-%d", referrer, w), Code: code, CreatedAt: time.Now()}
+					err := s.AddReferral(ctx, r, max)
+					if err != nil && !errors.Is(err, ErrReferralLimit) {
+						t.Errorf("AddReferral: %v", err)
+					}
+					if err == nil {
+						mu.Lock()
+						added++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if added != max {
+				t.Errorf("%d concurrent referrals were recorded, want %d", added, max)
+			}
+			if refs, err := s.Referrals(ctx, referrer); err != nil || len(refs) != max {
+				t.Errorf("Referrals = %d referrals, %v; want %d", len(refs), err, max)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+)
+
+// Write-ahead log records are lines of the form "<crc> <json>\n", where
+// crc is the CRC-32C of the JSON as 8 hex digits. Records written before
+// checksums were added are bare JSON lines and are still read.
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errWALCorrupt is returned for a damaged record that is followed by valid
+// ones, which a crash part-way through a write cannot explain.
+var errWALCorrupt = errors.New("memory log is corrupt")
+
+// encodeWALRecord returns r as a checksummed log line.
+func encodeWALRecord(r memoryLogRecord) ([]byte, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(body)+10)
+	line = fmt.Appendf(line, "%08x ", crc32.Checksum(body, walTable))
+	line = append(line, body...)
+	return append(line, '\n'), nil
+}
+
+// decodeWALRecord parses a log line without its newline.
+func decodeWALRecord(line []byte) (memoryLogRecord, error) {
+	var r memoryLogRecord
+	body := line
+	if len(line) > 0 && line[0] != '{' {
+		sum, rest, ok := bytes.Cut(line, []byte{' '})
+		want, err := strconv.ParseUint(string(sum), 16, 32)
+		if !ok || err != nil || len(sum) != 8 {
+			return r, errors.New("malformed record")
+		}
+		if crc32.Checksum(rest, walTable) != uint32(want) {
+			return r, errors.New("checksum mismatch")
+		}
+		body = rest
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// readWAL returns the records in the log at name and the offset just past
+// the last of them. Anything after that offset is a record cut short by a
+// crash; if a valid record follows a damaged one, readWAL returns
+// errWALCorrupt instead.
+func readWAL(name string) ([]memoryLogRecord, int64, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	var recs []memoryLogRecord
+	var valid int64
+	for rest := data; len(rest) > 0; {
+		line, after, complete := bytes.Cut(rest, []byte{'\n'})
+		r, err := decodeWALRecord(line)
+		if err != nil || !complete {
+			// Only a torn final write may be damaged.
+			for rest = after; len(rest) > 0; {
+				line, rest, _ = bytes.Cut(rest, []byte{'\n'})
+				if _, err := decodeWALRecord(line); err == nil {
+					return nil, 0, fmt.Errorf("%w: %s at offset %d", errWALCorrupt, name, valid)
+				}
+			}
+			break
+		}
+		recs = append(recs, r)
+		valid += int64(len(line)) + 1
+		rest = after
+	}
+	return recs, valid, nil
+}
+
+// syncDir flushes dir's entries, so that files created or renamed in it
+// survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventStreamBuffer is how many recent events are kept for clients
+	// resuming after a disconnect.
+	eventStreamBuffer = 1000
+	// eventStreamClientBuffer is how many events a client may fall behind
+	// by before it is disconnected; it can resume from where it stopped.
+	eventStreamClientBuffer = 64
+	// eventStreamHeartbeat is how often an idle stream sends a comment to
+	// keep proxies from closing it.
+	eventStreamHeartbeat = 15 * time.Second
+)
+
+// eventStream fans receipt.processed events out to Server-Sent Events
+// clients and keeps the most recent ones for clients that reconnect.
+// Event IDs are "<epoch>-<seq>", where epoch identifies this process, so a
+// client resuming with an ID from before a restart is sent the whole
+// buffer.
+type eventStream struct {
+	epoch string
+
+	mu      sync.Mutex
+	seq     uint64
+	recent  []streamEvent // oldest first
+	clients map[chan streamEvent]struct{}
+	closed  bool
+}
+
+type streamEvent struct {
+	seq  uint64
+	data []byte
+	user string // the event's Data.UserID, for forget
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{
+		epoch:   strconv.FormatInt(time.Now().UnixMilli(), 36),
+		clients: make(map[chan streamEvent]struct{}),
+	}
+}
+
+func (es *eventStream) id(seq uint64) string {
+	return es.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// publish sends ev to every connected client, disconnecting those that
+// have fallen too far behind.
+func (es *eventStream) publish(ev receiptEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Encoding event failed", "event_id", ev.ID, "error", err)
+		return
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.seq++
+	e := streamEvent{seq: es.seq, data: data, user: ev.Data.UserID}
+	if len(es.recent) == eventStreamBuffer {
+		es.recent = append(es.recent[:0], es.recent[1:]...)
+	}
+	es.recent = append(es.recent, e)
+	for ch := range es.clients {
+		select {
+		case ch <- e:
+		default:
+			delete(es.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a client. It returns the buffered events after
+// lastID, none if lastID is empty, and the channel new events arrive on.
+func (es *eventStream) subscribe(lastID string) ([]streamEvent, chan streamEvent) {
+	ch := make(chan streamEvent, eventStreamClientBuffer)
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.closed {
+		close(ch)
+		return nil, ch
+	}
+	es.clients[ch] = struct{}{}
+	if lastID == "" {
+		return nil, ch
+	}
+	var after uint64
+	if epoch, seq, ok := strings.Cut(lastID, "-"); ok && epoch == es.epoch {
+		after, _ = strconv.ParseUint(seq, 10, 64)
+	}
+	var backlog []streamEvent
+	for _, e := range es.recent {
+		if e.seq > after {
+			backlog = append(backlog, e)
+		}
+	}
+	return backlog, ch
+}
+
+// forget drops user's events from the buffer, so clients resuming later
+// are not sent them, and returns how many it dropped.
+func (es *eventStream) forget(user string) int {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	n := len(es.recent)
+	es.recent = slices.DeleteFunc(es.recent, func(e streamEvent) bool { return e.user == user })
+	return n - len(es.recent)
+}
+
+// disconnect ends every stream when the server shuts down, so that clients
+// reconnect to the process taking over instead of holding up the drain.
+func (es *eventStream) disconnect() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.closed = true
+	for ch := range es.clients {
+		delete(es.clients, ch)
+		close(ch)
+	}
+}
+
+func (es *eventStream) unsubscribe(ch chan streamEvent) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if _, ok := es.clients[ch]; ok {
+		delete(es.clients, ch)
+		close(ch)
+	}
+}
+
+// eventStreamHandler handles GET /events/stream
+func (s *server) eventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The stream outlives HTTP_WRITE_TIMEOUT.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	// Browsers resend the last ID in a header when they reconnect; the
+	// query parameter lets a reloaded dashboard resume too.
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	backlog, ch := s.stream.subscribe(lastID)
+	defer s.stream.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	send := func(e streamEvent) error {
+		_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", s.stream.id(e.seq), eventReceiptProcessed, e.data)
+		return err
+	}
+	for _, e := range backlog {
+		if send(e) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-ch:
+			if !ok {
+				// Too far behind; the client reconnects and resumes.
+				return
+			}
+			if send(e) != nil {
+				return
+			}
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
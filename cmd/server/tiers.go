@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"fetch_assessment/points"
+)
+
+// tierWindow is how far back the points that decide a user's tier go.
+const tierWindow = 90 * 24 * time.Hour
+
+// tierStanding is where a user stands among the loyalty tiers.
+type tierStanding struct {
+	Tier points.Tier  `json:"tier"`
+	Next *points.Tier `json:"next,omitempty"`
+	// TrailingPoints are the points earned from receipts within tierWindow.
+	TrailingPoints int `json:"trailingPoints"`
+	PointsToNext   int `json:"pointsToNext,omitempty"`
+}
+
+// tierStanding works out user's tier under rules from their ledger.
+func (s *server) tierStanding(ctx context.Context, rules *points.Engine, user string) (tierStanding, error) {
+	entries, err := s.store.Ledger(ctx, user)
+	if err != nil {
+		return tierStanding{}, err
+	}
+	since := time.Now().Add(-tierWindow)
+	trailing := 0
+	for _, e := range entries {
+		if e.earnedFromReceipt() && !e.CreatedAt.Before(since) {
+			trailing += e.Points
+		}
+	}
+	tier, next := rules.TierFor(trailing)
+	st := tierStanding{Tier: tier, Next: next, TrailingPoints: trailing}
+	if next != nil {
+		st.PointsToNext = next.MinPoints - trailing
+	}
+	return st, nil
+}
+
+// tierHandler handles GET /users/{id}/tier
+func (s *server) tierHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	st, err := s.tierStanding(r.Context(), s.rulesFor(r.Context()), user)
+	if err != nil {
+		log.Printf("Error loading ledger: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to load tier")
+		return
+	}
+
+	response := struct {
+		UserID string `json:"userId"`
+		tierStanding
+	}{user, st}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
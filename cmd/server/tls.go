@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsConfig selects how the server terminates TLS: with a static
+// certificate/key pair, with certificates obtained automatically from
+// Let's Encrypt, or not at all.
+type tlsConfig struct {
+	CertFile string
+	KeyFile  string
+
+	AutocertDomains  []string
+	AutocertCacheDir string
+	AutocertEmail    string
+	// AutocertHTTPAddr serves ACME HTTP-01 challenges (and redirects other
+	// plain HTTP traffic to HTTPS). Empty relies on TLS-ALPN-01 only.
+	AutocertHTTPAddr string
+
+	// ClientCAFile, when set, verifies client certificates against the
+	// CAs in it (mTLS). ClientAuth is "require" to refuse connections
+	// without a certificate, or "optional" to accept them.
+	ClientCAFile string
+	ClientAuth   string
+
+	// HTTP2 is "on" or "off"; empty enables HTTP/2 over TLS but not h2c
+	// in cleartext.
+	HTTP2 string
+
+	// acmeListener is opened on AutocertHTTPAddr before serving, so that
+	// it can be handed over in an upgrade.
+	acmeListener net.Listener
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func (c tlsConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if c.CertFile != "" && len(c.AutocertDomains) > 0 {
+		return errors.New("-tls-cert/-tls-key cannot be combined with -autocert-domains")
+	}
+	if c.ClientCAFile != "" && c.CertFile == "" && len(c.AutocertDomains) == 0 {
+		return errors.New("-tls-client-ca needs -tls-cert/-tls-key or -autocert-domains")
+	}
+	if c.ClientAuth != "require" && c.ClientAuth != "optional" {
+		return errors.New(`-tls-client-auth must be "require" or "optional"`)
+	}
+	if c.HTTP2 != "" {
+		if _, err := parseHTTP2Mode(c.HTTP2); err != nil {
+			return fmt.Errorf("-http2: %v", err)
+		}
+	}
+	return nil
+}
+
+// http2 reports whether HTTP/2 is enabled on the main listener.
+func (c tlsConfig) http2(overTLS bool) bool {
+	if c.HTTP2 == "" {
+		return overTLS
+	}
+	return c.HTTP2 == "on"
+}
+
+// verifyClients configures cfg to verify client certificates, if
+// ClientCAFile is set.
+func (c tlsConfig) verifyClients(cfg *tls.Config) error {
+	if c.ClientCAFile == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return fmt.Errorf("-tls-client-ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("-tls-client-ca: no certificates in %s", c.ClientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if c.ClientAuth == "optional" {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+// serve runs srv on ln, over TLS when configured.
+func (c tlsConfig) serve(srv *http.Server, ln net.Listener) error {
+	switch {
+	case c.CertFile != "":
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if err := c.verifyClients(srv.TLSConfig); err != nil {
+			return err
+		}
+		configureHTTP2(srv, c.http2(true), true)
+		return srv.ServeTLS(ln, c.CertFile, c.KeyFile)
+	case len(c.AutocertDomains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.AutocertDomains...),
+			Cache:      autocert.DirCache(c.AutocertCacheDir),
+			Email:      c.AutocertEmail,
+		}
+		srv.TLSConfig = m.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		if err := c.verifyClients(srv.TLSConfig); err != nil {
+			return err
+		}
+		configureHTTP2(srv, c.http2(true), true)
+		if c.acmeListener != nil {
+			go func() {
+				log.Printf("Serving ACME challenges on %s", c.AutocertHTTPAddr)
+				log.Print(http.Serve(c.acmeListener, m.HTTPHandler(nil)))
+			}()
+		}
+		return srv.ServeTLS(ln, "", "")
+	default:
+		configureHTTP2(srv, c.http2(false), false)
+		return srv.Serve(ln)
+	}
+}
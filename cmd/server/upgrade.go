@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment passed to a process started by an upgrade: the listeners it
+// inherits, as "network:addr" keys of the descriptors from 4 on, and the
+// pipe on descriptor 3 it reports readiness on.
+const (
+	inheritedListenersEnv = "RECEIPTS_INHERITED_LISTENERS"
+	upgradeReadyFD        = 3
+)
+
+// startEnviron is the environment the process started with, before
+// settings and Vault secrets were put in it. An upgrade passes it on, so
+// that the new process reads its configuration afresh.
+var startEnviron = slices.DeleteFunc(os.Environ(), func(kv string) bool {
+	return strings.HasPrefix(kv, inheritedListenersEnv+"=")
+})
+
+// upgrader hands the listening sockets over to a new copy of the binary,
+// so that a deploy can replace the process without refusing connections:
+// on SIGUSR2 the new process starts with the sockets, reports when it is
+// ready to serve, and the old one drains and exits.
+type upgrader struct {
+	// unsupported, if set, is why this process cannot be upgraded.
+	unsupported string
+	// timeout is how long a new process has to become ready.
+	timeout time.Duration
+	pidFile string
+
+	mu sync.Mutex
+	// inherited are the listeners passed by the parent that have not been
+	// claimed by listen yet.
+	inherited map[string]net.Listener
+	// parent is the pipe to report readiness on, if started by an upgrade.
+	parent    *os.File
+	listeners []upgradeListener
+}
+
+type upgradeListener struct {
+	key string
+	ln  net.Listener
+}
+
+// newUpgrader picks up the listeners passed by the process this one
+// replaces, if any.
+func newUpgrader(timeout time.Duration, pidFile string) (*upgrader, error) {
+	u := &upgrader{timeout: timeout, pidFile: pidFile, inherited: make(map[string]net.Listener)}
+	keys := os.Getenv(inheritedListenersEnv)
+	if keys == "" {
+		return u, nil
+	}
+	os.Unsetenv(inheritedListenersEnv)
+	u.parent = os.NewFile(upgradeReadyFD, "upgrade")
+	for i, key := range strings.Split(keys, ",") {
+		f := os.NewFile(uintptr(upgradeReadyFD+1+i), key)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %s: %w", key, err)
+		}
+		u.inherited[key] = ln
+	}
+	return u, nil
+}
+
+// listen opens the listener spec describes, or takes it over from the
+// process this one replaces.
+func (u *upgrader) listen(spec listenerSpec) (net.Listener, error) {
+	key := spec.Network + ":" + spec.Addr
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ln, ok := u.inherited[key]
+	if ok {
+		delete(u.inherited, key)
+		// Remove the socket on a normal stop, as if opened here.
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+	} else {
+		var err error
+		if ln, err = listenOn(spec); err != nil {
+			return nil, err
+		}
+	}
+	u.listeners = append(u.listeners, upgradeListener{key, ln})
+	return ln, nil
+}
+
+// ready closes inherited listeners this process does not use, writes the
+// PID file and tells the process being replaced, if any, to drain.
+func (u *upgrader) ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, ln := range u.inherited {
+		slog.Info("Closing inherited listener no longer configured", "listener", key)
+		ln.Close()
+		delete(u.inherited, key)
+	}
+	if u.pidFile != "" {
+		if err := os.WriteFile(u.pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			return fmt.Errorf("write PID file: %w", err)
+		}
+	}
+	if u.parent == nil {
+		return nil
+	}
+	defer func() { u.parent = nil }()
+	if _, err := u.parent.Write([]byte{1}); err != nil {
+		u.parent.Close()
+		return fmt.Errorf("notify the replaced process: %w", err)
+	}
+	return u.parent.Close()
+}
+
+// upgrade starts the binary at the path this process was started from,
+// which a deploy has replaced, with the same arguments and the listening
+// sockets, and waits until it is ready. On success the caller drains and
+// exits; on failure it carries on serving.
+func (u *upgrader) upgrade() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.unsupported != "" {
+		return errors.New(u.unsupported)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files := []*os.File{w}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	keys := make([]string, len(u.listeners))
+	for i, l := range u.listeners {
+		fl, ok := l.ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s cannot be handed over", l.key)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("listener %s: %w", l.key, err)
+		}
+		files = append(files, f)
+		keys[i] = l.key
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(slices.Clip(startEnviron), inheritedListenersEnv+"="+strings.Join(keys, ","))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %s: %w", exe, err)
+	}
+	// Only the new process may hold the write end, so that reading sees
+	// EOF if it exits before it is ready.
+	w.Close()
+	files = files[1:]
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	readyc := make(chan bool, 1)
+	go func() {
+		var b [1]byte
+		n, _ := r.Read(b[:])
+		readyc <- n == 1
+	}()
+	select {
+	case ok := <-readyc:
+		if !ok {
+			return fmt.Errorf("new process exited before it was ready: %v", <-exited)
+		}
+	case <-time.After(u.timeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process was not ready within %s", u.timeout)
+	}
+	slog.Info("New process is ready", "pid", cmd.Process.Pid)
+
+	// The sockets are the new process's now; closing ours must not
+	// remove them.
+	for _, l := range u.listeners {
+		if ul, ok := l.ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+// waitForStop blocks until the process should drain and exit: on SIGTERM
+// or SIGINT, or on SIGUSR2 once a new process has taken over. It returns
+// early with the error of a server that stopped by itself.
+func (u *upgrader) waitForStop(serveErr <-chan error) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case err := <-serveErr:
+			return err
+		case sig := <-sigs:
+			if sig != syscall.SIGUSR2 {
+				slog.Info("Stopping", "signal", sig.String())
+				return nil
+			}
+			slog.Info("Upgrading")
+			if err := u.upgrade(); err != nil {
+				slog.Error("Upgrade failed; carrying on", "error", err)
+				continue
+			}
+			return nil
+		}
+	}
+}
+
+// drain stops the servers accepting connections and waits for in-flight
+// requests and queued jobs to finish, for at most timeout.
+func drain(servers []*http.Server, jobs *jobQueue, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	slog.Info("Draining connections", "timeout", timeout.String())
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("Closing connections still open after the drain timeout", "error", err)
+				srv.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := jobs.stop(ctx); err != nil {
+		slog.Warn("Queued jobs were not finished before the drain timeout", "error", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// userExport is everything the service holds about one user, as returned
+// by GET /users/{id}/export.
+type userExport struct {
+	UserID       string          `json:"userId"`
+	ExportedAt   time.Time       `json:"exportedAt"`
+	Receipts     []StoredReceipt `json:"receipts"`
+	Balance      int             `json:"balance"`
+	Ledger       []LedgerEntry   `json:"ledger"`
+	ReferralCode string          `json:"referralCode,omitempty"`
+	ReferredBy   *Referral       `json:"referredBy,omitempty"`
+	Referrals    []Referral      `json:"referrals"`
+	// Audit lists the changes made for the user or to their data.
+	Audit []auditEntry `json:"audit"`
+}
+
+// exportUserHandler handles GET /users/{id}/export
+func (s *server) exportUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	ctx := r.Context()
+	out := userExport{UserID: user, ExportedAt: time.Now().UTC(), Receipts: []StoredReceipt{}}
+	fail := func(what string, err error) {
+		log.Printf("Error exporting %s for %s: %v", what, user, err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to export user data")
+	}
+
+	all, err := s.store.List(ctx)
+	if err != nil {
+		fail("receipts", err)
+		return
+	}
+	for _, rec := range all {
+		if rec.belongsTo(user) {
+			out.Receipts = append(out.Receipts, rec)
+		}
+	}
+	if out.Balance, err = s.store.Balance(ctx, user); err != nil {
+		fail("balance", err)
+		return
+	}
+	if out.Ledger, err = s.store.Ledger(ctx, user); err != nil {
+		fail("ledger", err)
+		return
+	}
+	if out.ReferralCode, err = s.store.ReferralCodeOf(ctx, user); err != nil && !errors.Is(err, ErrReferralNotFound) {
+		fail("referral code", err)
+		return
+	}
+	referral, err := s.store.ReferralOf(ctx, user)
+	switch {
+	case err == nil:
+		out.ReferredBy = &referral
+	case !errors.Is(err, ErrReferralNotFound):
+		fail("referral", err)
+		return
+	}
+	if out.Referrals, err = s.store.Referrals(ctx, user); err != nil {
+		fail("referrals", err)
+		return
+	}
+	if out.Audit, err = auditAbout(ctx, s.audit, user); err != nil {
+		fail("audit log", err)
+		return
+	}
+	if out.Ledger == nil {
+		out.Ledger = []LedgerEntry{}
+	}
+	if out.Referrals == nil {
+		out.Referrals = []Referral{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-data-%s.json"`, exportFileName(user)))
+	json.NewEncoder(w).Encode(out)
+}
+
+// exportFileName makes user safe to put in a file name, replacing
+// anything but letters, digits, '-', '_' and '.' with '_'.
+func exportFileName(user string) string {
+	b := []byte(user)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// deleteUserDataHandler handles DELETE /users/{id}/data
+func (s *server) deleteUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	d, err := s.store.DeleteUser(r.Context(), user)
+	if err != nil {
+		log.Printf("Error deleting data of %s: %v", user, err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to delete user data")
+		return
+	}
+	d.Events += s.stream.forget(user)
+	setAuditDetail(r.Context(), fmt.Sprintf("Deleted %d receipts, %d ledger entries, %d referrals and %d events",
+		d.Receipts, d.LedgerEntries, d.Referrals, d.Events))
+
+	response := struct {
+		UserID string `json:"userId"`
+		UserDeletion
+	}{user, d}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// userHeader names the end user a service caller is acting for.
+const userHeader = "X-User-ID"
+
+// maxUserIDLen caps the length of user IDs.
+const maxUserIDLen = 128
+
+// withUser records the end user a request acts for: the subject of its
+// bearer token, or the X-User-ID header sent by a service caller. Token
+// callers may not act for anyone else.
+func withUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.Header.Get(userHeader)
+		if len(user) > maxUserIDLen || strings.ContainsFunc(user, func(c rune) bool { return !unicode.IsPrint(c) || unicode.IsSpace(c) }) {
+			writeProblem(w, r, http.StatusBadRequest, "X-User-ID must be at most 128 printable characters without spaces")
+			return
+		}
+		if id, _ := identityFrom(r.Context()); id.Subject != "" {
+			if user != "" && user != id.Subject {
+				writeProblem(w, r, http.StatusForbidden, "X-User-ID must match the token subject")
+				return
+			}
+			user = id.Subject
+		}
+		if user != "" {
+			r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// userFrom returns the end user the request on ctx acts for, or "" for
+// service callers acting for nobody in particular.
+func userFrom(ctx context.Context) string {
+	user, _ := ctx.Value(userKey).(string)
+	return user
+}
+
+// belongsTo reports whether rec was submitted for user. Receipts stored
+// before user IDs were recorded belong to the token subject that
+// submitted them.
+func (rec StoredReceipt) belongsTo(user string) bool {
+	return rec.UserID == user || (rec.UserID == "" && rec.Owner == user)
+}
+
+// userReceiptHash scopes a receipt hash to user, so users acting through
+// a shared service key are not handed each other's receipts as duplicates.
+func userReceiptHash(user, hash string) string {
+	sum := sha256.Sum256([]byte(user + "\x00" + hash))
+	return hex.EncodeToString(sum[:])
+}
+
+// allowUser reports whether the caller may see user's data, writing a 403
+// response if not. Requests acting for a user may only see their own.
+func allowUser(w http.ResponseWriter, r *http.Request, user string) bool {
+	if caller := userFrom(r.Context()); caller != "" && caller != user {
+		writeProblem(w, r, http.StatusForbidden, "Users may only access their own data")
+		return false
+	}
+	return true
+}
+
+// userReceiptsHandler handles GET /users/{id}/receipts
+func (s *server) userReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("id")
+	if !allowUser(w, r, user) {
+		return
+	}
+	filter, err := parseReceiptFilter(r.URL.Query(), s.rulesFor(r.Context()))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		log.Printf("Error listing receipts: %v", err)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to list receipts")
+		return
+	}
+	receipts := make([]StoredReceipt, 0)
+	for _, rec := range all {
+		if rec.belongsTo(user) && filter.matches(rec) {
+			receipts = append(receipts, rec)
+		}
+	}
+
+	response := map[string][]StoredReceipt{"receipts": receipts}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"fetch_assessment/points"
+)
+
+// Patterns from the receipt processor API schema.
+var (
+	retailerPattern    = regexp.MustCompile(`^[\w\s\-&]+$`)
+	descriptionPattern = regexp.MustCompile(`^[\w\s\-]+$`)
+	amountPattern      = regexp.MustCompile(`^\d+\.\d{2}$`)
+)
+
+// maxAmountDigits bounds the dollars of a total or price, so that amounts
+// and the sum of a receipt's prices fit in points.Cents.
+const maxAmountDigits = 9
+
+// fieldError describes one invalid field of a submitted receipt.
+type fieldError struct {
+	Field string `json:"field"`
+	// Code classifies the failure for clients, which should not parse
+	// Message.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Codes of fieldError.
+const (
+	codeRequired          = "REQUIRED"
+	codeInvalidFormat     = "INVALID_FORMAT"
+	codeInvalidCharacters = "INVALID_CHARACTERS"
+	codeTotalMismatch     = "TOTAL_MISMATCH"
+	codeInvalidType       = "INVALID_TYPE"
+	codeUnknownField      = "UNKNOWN_FIELD"
+)
+
+// validateReceipt checks r against the receipt schema and returns every
+// problem found, or nil if the receipt is valid.
+func validateReceipt(r points.Receipt) []fieldError {
+	var errs []fieldError
+	add := func(field, code, message string) {
+		errs = append(errs, fieldError{Field: field, Code: code, Message: message})
+	}
+	// check adds an error for a required field that is missing, or else
+	// for one that does not have the right form.
+	check := func(field, value string, ok bool, code, message string) {
+		switch {
+		case value == "":
+			add(field, codeRequired, "is required")
+		case !ok:
+			add(field, code, message)
+		}
+	}
+	checkAmount := func(field, value string) {
+		whole, _, _ := strings.Cut(value, ".")
+		if amountPattern.MatchString(value) && len(strings.TrimLeft(whole, "0")) > maxAmountDigits {
+			add(field, codeInvalidFormat, "must be less than 1000000000.00")
+			return
+		}
+		check(field, value, amountPattern.MatchString(value),
+			codeInvalidFormat, "must be a dollar amount with two decimal places, e.g. 12.34")
+	}
+
+	check("retailer", r.Retailer, retailerPattern.MatchString(r.Retailer),
+		codeInvalidCharacters, "must contain only letters, digits, spaces, '-' and '&'")
+	_, err := time.Parse("2006-01-02", r.PurchaseDate)
+	check("purchaseDate", r.PurchaseDate, err == nil, codeInvalidFormat, "must be a date in YYYY-MM-DD format")
+	_, err = time.Parse("15:04", r.PurchaseTime)
+	check("purchaseTime", r.PurchaseTime, err == nil, codeInvalidFormat, "must be a 24-hour time in HH:MM format")
+	checkAmount("total", r.Total)
+	if len(r.Items) == 0 {
+		add("items", codeRequired, "must contain at least one item")
+	}
+	for i, item := range r.Items {
+		check(fmt.Sprintf("items[%d].shortDescription", i), item.ShortDescription, descriptionPattern.MatchString(item.ShortDescription),
+			codeInvalidCharacters, "must contain only letters, digits, spaces and '-'")
+		checkAmount(fmt.Sprintf("items[%d].price", i), item.Price)
+		if item.Category != "" && !descriptionPattern.MatchString(item.Category) {
+			add(fmt.Sprintf("items[%d].category", i), codeInvalidCharacters, "must contain only letters, digits, spaces and '-'")
+		}
+	}
+	return errs
+}
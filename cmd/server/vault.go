@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultClient talks to HashiCorp Vault's HTTP API. It authenticates with
+// VAULT_TOKEN or, with VAULT_ROLE_ID and VAULT_SECRET_ID, by AppRole login,
+// and keeps the token alive (see renew).
+type vaultClient struct {
+	addr      string
+	namespace string
+	http      *http.Client
+
+	// roleID and secretID log in again when the token cannot be renewed.
+	roleID       string
+	secretID     string
+	approleMount string
+
+	mu    sync.Mutex
+	token string
+	// renewAt is when the token should be renewed; zero for tokens that
+	// do not expire.
+	renewAt time.Time
+}
+
+// vaultResponse is the envelope Vault wraps every response in.
+type vaultResponse struct {
+	Data          json.RawMessage `json:"data"`
+	LeaseDuration int             `json:"lease_duration"`
+	Renewable     bool            `json:"renewable"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// vaultClientFromEnv connects to the Vault at VAULT_ADDR and logs in. It
+// returns nil when VAULT_ADDR is not set.
+func vaultClientFromEnv(ctx context.Context) (*vaultClient, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, nil
+	}
+	v := &vaultClient{
+		addr:         addr,
+		namespace:    os.Getenv("VAULT_NAMESPACE"),
+		http:         &http.Client{Timeout: 10 * time.Second},
+		roleID:       os.Getenv("VAULT_ROLE_ID"),
+		secretID:     os.Getenv("VAULT_SECRET_ID"),
+		approleMount: os.Getenv("VAULT_APPROLE_MOUNT"),
+		token:        os.Getenv("VAULT_TOKEN"),
+	}
+	if v.approleMount == "" {
+		v.approleMount = "approle"
+	}
+	switch {
+	case v.roleID != "" && v.secretID != "":
+		if err := v.login(ctx); err != nil {
+			return nil, err
+		}
+	case v.token != "":
+		// Learn the token's TTL so it is renewed in time.
+		var self struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		}
+		resp, err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(resp.Data, &self); err != nil {
+			return nil, fmt.Errorf("vault token lookup: %w", err)
+		}
+		if self.Renewable {
+			v.setRenewal(self.TTL)
+		}
+	default:
+		return nil, fmt.Errorf("VAULT_ADDR needs VAULT_TOKEN, or VAULT_ROLE_ID and VAULT_SECRET_ID")
+	}
+	return v, nil
+}
+
+// login exchanges the AppRole credentials for a token.
+func (v *vaultClient) login(ctx context.Context) error {
+	resp, err := v.do(ctx, http.MethodPost, "auth/"+v.approleMount+"/login",
+		map[string]string{"role_id": v.roleID, "secret_id": v.secretID})
+	if err != nil {
+		return err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return fmt.Errorf("vault approle login returned no token")
+	}
+	v.mu.Lock()
+	v.token = resp.Auth.ClientToken
+	v.mu.Unlock()
+	v.setRenewal(resp.Auth.LeaseDuration)
+	return nil
+}
+
+// setRenewal schedules renewal two thirds of the way through a token's
+// ttl, in seconds.
+func (v *vaultClient) setRenewal(ttl int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if ttl <= 0 {
+		v.renewAt = time.Time{}
+		return
+	}
+	v.renewAt = time.Now().Add(time.Duration(ttl) * time.Second * 2 / 3)
+}
+
+// renew renews the token if it is due, logging in again when renewal fails
+// and AppRole credentials are configured.
+func (v *vaultClient) renew(ctx context.Context) error {
+	v.mu.Lock()
+	due := !v.renewAt.IsZero() && !time.Now().Before(v.renewAt)
+	v.mu.Unlock()
+	if !due {
+		return nil
+	}
+	resp, err := v.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]any{})
+	if err == nil && resp.Auth != nil {
+		v.setRenewal(resp.Auth.LeaseDuration)
+		return nil
+	}
+	if v.roleID == "" {
+		return fmt.Errorf("renew vault token: %w", err)
+	}
+	slog.Warn("Could not renew the Vault token; logging in again", "error", err)
+	return v.login(ctx)
+}
+
+// read returns the secret at path. For a KV version 2 engine path is the
+// full API path, such as "secret/data/receipts"; the versioned envelope is
+// removed. lease is zero for secrets without a lease.
+func (v *vaultClient) read(ctx context.Context, path string) (data map[string]any, lease time.Duration, err error) {
+	resp, err := v.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, 0, fmt.Errorf("vault %s: %w", path, err)
+	}
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	return data, time.Duration(resp.LeaseDuration) * time.Second, nil
+}
+
+// write POSTs body to path and decodes the response's data into out.
+func (v *vaultClient) write(ctx context.Context, path string, body, out any) error {
+	resp, err := v.do(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(resp.Data, out); err != nil {
+		return fmt.Errorf("vault %s: %w", path, err)
+	}
+	return nil
+}
+
+func (v *vaultClient) do(ctx context.Context, method, path string, body any) (vaultResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return vaultResponse{}, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+path, reader)
+	if err != nil {
+		return vaultResponse{}, err
+	}
+	v.mu.Lock()
+	token := v.token
+	v.mu.Unlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return vaultResponse{}, fmt.Errorf("vault %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return vaultResponse{}, fmt.Errorf("vault %s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var out vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return vaultResponse{}, fmt.Errorf("vault %s: %w", path, err)
+	}
+	return out, nil
+}
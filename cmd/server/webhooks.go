@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	mrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxWebhooksPerKey bounds the subscriptions one API key may hold.
+	maxWebhooksPerKey = 20
+	// webhookWorkers deliver events concurrently; webhookQueueSize
+	// deliveries may wait for them before new ones are dropped.
+	webhookWorkers   = 4
+	webhookQueueSize = 1000
+	// Failed deliveries are retried after webhookBaseDelay, doubling up to
+	// webhookMaxDelay.
+	webhookBaseDelay = time.Second
+	webhookMaxDelay  = 5 * time.Minute
+	// After a secret rotation the previous secret keeps signing for
+	// defaultSecretOverlap, or the requested overlap up to maxSecretOverlap.
+	defaultSecretOverlap = 24 * time.Hour
+	maxSecretOverlap     = 7 * 24 * time.Hour
+)
+
+// webhook is a URL registered by an API key to receive receipt events.
+type webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Secret signs deliveries. It is only shown when the webhook is
+	// created or its secret rotated.
+	Secret string `json:"secret,omitempty"`
+	// PreviousSecretExpiresAt is set while the secret replaced by the last
+	// rotation still signs deliveries too.
+	PreviousSecretExpiresAt *time.Time `json:"previousSecretExpiresAt,omitempty"`
+
+	apiKey         string
+	previousSecret string
+}
+
+// signingSecrets returns the secrets that sign deliveries at now, newest
+// first.
+func (h webhook) signingSecrets(now time.Time) []string {
+	secrets := []string{h.Secret}
+	if h.PreviousSecretExpiresAt != nil && now.Before(*h.PreviousSecretExpiresAt) {
+		secrets = append(secrets, h.previousSecret)
+	}
+	return secrets
+}
+
+// newWebhookSecret returns a random signing secret.
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// delivery is one attempt, or retry, to send an event to a webhook.
+type delivery struct {
+	hookID    string
+	eventID   string
+	eventType string
+	requestID string
+	body      []byte
+	attempt   int
+}
+
+// blockedWebhookPrefixes are ranges webhooks may not reach besides the
+// loopback, link-local, private, multicast and unspecified ones: "this
+// network", and carrier-grade NAT, where some clouds serve instance
+// metadata.
+var blockedWebhookPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// publicAddr reports whether ip is a public unicast address, which
+// webhooks may be delivered to.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range blockedWebhookPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDispatcher holds the registered webhooks and delivers events to
+// them in the background. Registrations live in process memory, so they
+// are lost on restart and each replica has its own.
+type webhookDispatcher struct {
+	client      *http.Client
+	maxAttempts int
+	queue       chan delivery
+	// allowPrivate lets webhooks reach addresses that are not public
+	// (WEBHOOK_ALLOW_PRIVATE_NETWORKS). Otherwise they are refused when a
+	// webhook is registered and again, once resolved, for each delivery.
+	allowPrivate bool
+
+	mu    sync.Mutex
+	hooks map[string]*webhook
+}
+
+func newWebhookDispatcher(timeout time.Duration, maxAttempts int, allowPrivate bool) *webhookDispatcher {
+	d := &webhookDispatcher{
+		client:       &http.Client{Timeout: timeout},
+		maxAttempts:  maxAttempts,
+		queue:        make(chan delivery, webhookQueueSize),
+		allowPrivate: allowPrivate,
+		hooks:        make(map[string]*webhook),
+	}
+	if !allowPrivate {
+		// The address is checked after it is resolved, so a name that
+		// passed when the webhook was registered cannot later point
+		// inside the network. Deliveries do not go through HTTP_PROXY,
+		// which would hide the receiver's address.
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				addr, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return err
+				}
+				if !publicAddr(addr.Addr()) {
+					return fmt.Errorf("webhook address %s is not public", addr.Addr())
+				}
+				return nil
+			},
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+		d.client.Transport = transport
+	}
+	for range webhookWorkers {
+		go func() {
+			for dl := range d.queue {
+				d.deliver(dl)
+			}
+		}()
+	}
+	return d
+}
+
+// publish queues ev for every webhook subscribed to its type that was
+// registered by the API key that caused it, so that no key sees events
+// about another's receipts or users.
+func (d *webhookDispatcher) publish(ev receiptEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Encoding webhook event failed", "event_id", ev.ID, "error", err)
+		return
+	}
+	d.mu.Lock()
+	var ids []string
+	for _, h := range d.hooks {
+		if h.apiKey == ev.APIKey && slices.Contains(h.Events, ev.Type) {
+			ids = append(ids, h.ID)
+		}
+	}
+	d.mu.Unlock()
+	for _, id := range ids {
+		d.enqueue(delivery{hookID: id, eventID: ev.ID, eventType: ev.Type, requestID: ev.RequestID, body: body, attempt: 1})
+	}
+}
+
+func (d *webhookDispatcher) enqueue(dl delivery) {
+	select {
+	case d.queue <- dl:
+	default:
+		webhookDropped.Add(1)
+		slog.Warn("Webhook queue full; event dropped", "webhook_id", dl.hookID, "event_id", dl.eventID)
+	}
+}
+
+// deliver sends dl and schedules a retry if it fails in a way that might
+// succeed later.
+func (d *webhookDispatcher) deliver(dl delivery) {
+	d.mu.Lock()
+	h, ok := d.hooks[dl.hookID]
+	var hook webhook
+	if ok {
+		hook = *h
+	}
+	d.mu.Unlock()
+	if !ok {
+		return // deleted since the event was queued
+	}
+
+	status, err := d.send(hook, dl)
+	if err == nil && status >= 200 && status < 300 {
+		webhookDeliveries.Add(1)
+		return
+	}
+	// Client errors other than rate limiting will not go away on retry.
+	retryable := err != nil || status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+	if !retryable || dl.attempt >= d.maxAttempts {
+		webhookFailures.Add(1)
+		slog.Warn("Webhook delivery failed", "webhook_id", hook.ID, "event_id", dl.eventID,
+			"attempts", dl.attempt, "status", status, "error", err)
+		return
+	}
+	delay := webhookBackoff(dl.attempt)
+	dl.attempt++
+	time.AfterFunc(delay, func() { d.enqueue(dl) })
+}
+
+// send POSTs the event body to the webhook, signed with its secrets.
+func (d *webhookDispatcher) send(hook webhook, dl delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(dl.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "receipt-processor-webhooks")
+	req.Header.Set("X-Event-ID", dl.eventID)
+	req.Header.Set("X-Event-Type", dl.eventType)
+	if dl.requestID != "" {
+		req.Header.Set(requestIDHeader, dl.requestID)
+	}
+	// While a rotation overlaps, the body is signed with both secrets so
+	// that receivers can switch to the new one at their own pace.
+	var sigs []string
+	for _, secret := range hook.signingSecrets(time.Now()) {
+		sigs = append(sigs, "sha256="+signPayload(secret, dl.body))
+	}
+	req.Header.Set("X-Signature", strings.Join(sigs, ","))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// signPayload returns the hex HMAC-SHA256 of body under secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the delay before retrying a delivery that failed on
+// the given attempt: exponential, capped and jittered so that a recovering
+// receiver is not hit by every retry at once.
+func webhookBackoff(attempt int) time.Duration {
+	delay := webhookMaxDelay
+	if attempt < 20 {
+		delay = min(webhookBaseDelay<<(attempt-1), webhookMaxDelay)
+	}
+	return delay/2 + mrand.N(delay/2+1)
+}
+
+// checkHost refuses a webhook host unless all of its addresses are
+// public.
+func (d *webhookDispatcher) checkHost(ctx context.Context, host string) error {
+	if d.allowPrivate {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("url host %s cannot be resolved", host)
+	}
+	for _, addr := range addrs {
+		if publicAddr(addr) {
+			continue
+		}
+		if ip, err := netip.ParseAddr(host); err == nil && ip == addr.Unmap() {
+			return fmt.Errorf("url host %s is not a public address", host)
+		}
+		return fmt.Errorf("url host %s resolves to %s, which is not a public address", host, addr.Unmap())
+	}
+	return nil
+}
+
+// requireAPIKey limits next to API key callers, who own webhooks.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, _ := identityFrom(r.Context()); id.APIKey == "" {
+			writeProblem(w, r, http.StatusForbidden, "Webhooks can only be managed with an API key")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// createWebhookHandler handles POST /webhooks
+func (s *server) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	if status, err := decodeJSONBody(r, &req); err != nil {
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeProblem(w, r, http.StatusBadRequest, "url must be an absolute http or https URL")
+		return
+	}
+	if err := s.webhooks.checkHost(r.Context(), u.Hostname()); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Events) == 0 {
+		req.Events = eventTypes
+	}
+	for _, e := range req.Events {
+		if !slices.Contains(eventTypes, e) {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown event type %q", e))
+			return
+		}
+	}
+
+	id, _ := identityFrom(r.Context())
+	hook := &webhook{
+		ID:        uuid.New().String(),
+		URL:       u.String(),
+		Events:    slices.Compact(slices.Sorted(slices.Values(req.Events))),
+		CreatedAt: time.Now().UTC(),
+		Secret:    newWebhookSecret(),
+		apiKey:    id.APIKey,
+	}
+
+	d := s.webhooks
+	d.mu.Lock()
+	n := 0
+	for _, h := range d.hooks {
+		if h.apiKey == id.APIKey {
+			n++
+		}
+	}
+	if n >= maxWebhooksPerKey {
+		d.mu.Unlock()
+		writeProblem(w, r, http.StatusConflict, fmt.Sprintf("An API key may register at most %d webhooks", maxWebhooksPerKey))
+		return
+	}
+	d.hooks[hook.ID] = hook
+	d.mu.Unlock()
+
+	slog.Info("Webhook registered", "audit", true, "api_key", id.APIKey, "webhook_id", hook.ID, "url", hook.URL)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/webhooks/"+hook.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// listWebhooksHandler handles GET /webhooks
+func (s *server) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := identityFrom(r.Context())
+	d := s.webhooks
+	d.mu.Lock()
+	hooks := make([]webhook, 0)
+	for _, h := range d.hooks {
+		if h.apiKey == id.APIKey {
+			hook := *h
+			hook.Secret, hook.previousSecret = "", ""
+			hooks = append(hooks, hook)
+		}
+	}
+	d.mu.Unlock()
+	slices.SortFunc(hooks, func(a, b webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	response := map[string][]webhook{"webhooks": hooks}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// deleteWebhookHandler handles DELETE /webhooks/{id}
+func (s *server) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hookID := r.PathValue("id")
+	id, _ := identityFrom(r.Context())
+	d := s.webhooks
+	d.mu.Lock()
+	h, ok := d.hooks[hookID]
+	if ok && h.apiKey == id.APIKey {
+		delete(d.hooks, hookID)
+	}
+	d.mu.Unlock()
+	if !ok || h.apiKey != id.APIKey {
+		writeProblem(w, r, http.StatusNotFound, "Webhook not found")
+		return
+	}
+	slog.Info("Webhook deleted", "audit", true, "api_key", id.APIKey, "webhook_id", hookID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rotateWebhookSecretHandler handles POST /webhooks/{id}/rotate-secret
+func (s *server) rotateWebhookSecretHandler(w http.ResponseWriter, r *http.Request) {
+	overlap := defaultSecretOverlap
+	if v := r.URL.Query().Get("overlap"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxSecretOverlap {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("overlap must be a duration from 0s to %s", maxSecretOverlap))
+			return
+		}
+		overlap = d
+	}
+
+	hookID := r.PathValue("id")
+	id, _ := identityFrom(r.Context())
+	d := s.webhooks
+	d.mu.Lock()
+	h, ok := d.hooks[hookID]
+	if !ok || h.apiKey != id.APIKey {
+		d.mu.Unlock()
+		writeProblem(w, r, http.StatusNotFound, "Webhook not found")
+		return
+	}
+	// Only one previous secret is kept: rotating again during an overlap
+	// retires the oldest secret at once.
+	h.previousSecret, h.PreviousSecretExpiresAt = "", nil
+	if overlap > 0 {
+		expires := time.Now().UTC().Add(overlap)
+		h.previousSecret, h.PreviousSecretExpiresAt = h.Secret, &expires
+	}
+	h.Secret = newWebhookSecret()
+	hook := *h
+	d.mu.Unlock()
+
+	slog.Info("Webhook secret rotated", "audit", true, "api_key", id.APIKey, "webhook_id", hookID, "overlap", overlap.String())
+	hook.previousSecret = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWebhooksOnlyReceiveOwnKeysEvents registers a webhook for each of two
+// API keys and checks that neither is sent the other's events.
+func TestWebhooksOnlyReceiveOwnKeysEvents(t *testing.T) {
+	// The receivers listen on loopback.
+	d := newWebhookDispatcher(5*time.Second, 1, true)
+	received := make(map[string]chan receiptEvent)
+	for _, key := range []string{"partner-a", "partner-b"} {
+		ch := make(chan receiptEvent, 10)
+		received[key] = ch
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var ev receiptEvent
+			if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+				t.Errorf("decoding delivery: %v", err)
+			}
+			ch <- ev
+		}))
+		t.Cleanup(srv.Close)
+		d.hooks[key] = &webhook{ID: key, URL: srv.URL, Events: eventTypes, Secret: newWebhookSecret(), apiKey: key}
+	}
+
+	sent := make(map[string]string) // event ID to the key that caused it
+	for _, key := range []string{"partner-a", "partner-b"} {
+		ctx := withIdentity(context.Background(), identity{APIKey: key})
+		rec := StoredReceipt{ID: "receipt-of-" + key, UserID: "user-of-" + key}
+		for _, ev := range []receiptEvent{
+			newReceiptEvent(ctx, eventReceiptProcessed, rec),
+			newReceiptEvent(ctx, eventReceiptRescored, rec),
+			newPointsEvent(ctx, eventPointsRedeemed, LedgerEntry{ID: "entry-of-" + key, UserID: rec.UserID}),
+		} {
+			sent[ev.ID] = key
+			d.publish(ev)
+		}
+	}
+	// An end user's event has no API key and goes to no webhook.
+	d.publish(newReceiptEvent(withIdentity(context.Background(), identity{Subject: "someone"}), eventReceiptProcessed, StoredReceipt{ID: "users-receipt"}))
+
+	for key, ch := range received {
+		for range 3 {
+			select {
+			case ev := <-ch:
+				if sent[ev.ID] != key {
+					t.Errorf("webhook of %s received event %s (%s) caused by %q", key, ev.ID, ev.Type, sent[ev.ID])
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("webhook of %s: timed out waiting for its events", key)
+			}
+		}
+	}
+	// Give any stray deliveries time to arrive.
+	time.Sleep(200 * time.Millisecond)
+	for key, ch := range received {
+		select {
+		case ev := <-ch:
+			t.Errorf("webhook of %s received extra event %s (%s) caused by %q", key, ev.ID, ev.Type, sent[ev.ID])
+		default:
+		}
+	}
+}
+
+// TestWebhooksRefusePrivateAddresses checks that webhooks cannot target
+// the server's own network, neither when registered nor when delivered.
+func TestWebhooksRefusePrivateAddresses(t *testing.T) {
+	d := newWebhookDispatcher(5*time.Second, 1, false)
+	ctx := context.Background()
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "169.254.169.254", "10.0.0.1", "192.168.1.10", "100.100.100.200", "0.0.0.0", "::ffff:127.0.0.1", "fd00::1"} {
+		if err := d.checkHost(ctx, host); err == nil {
+			t.Errorf("checkHost(%q) = nil, want an error", host)
+		}
+	}
+	for _, host := range []string{"203.0.114.7", "2606:4700::1"} {
+		if err := d.checkHost(ctx, host); err != nil {
+			t.Errorf("checkHost(%q) = %v, want nil", host, err)
+		}
+	}
+
+	// A webhook whose host resolved to a public address when it was
+	// registered is still refused once it resolves to a private one.
+	delivered := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+	}))
+	defer srv.Close()
+	status, err := d.send(webhook{ID: "hook", URL: srv.URL, Secret: newWebhookSecret()}, delivery{eventID: "event", body: []byte("{}")})
+	if err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Errorf("delivery to %s: status %d, error %v; want it refused", srv.URL, status, err)
+	}
+	select {
+	case <-delivered:
+		t.Error("the loopback receiver was reached")
+	default:
+	}
+}
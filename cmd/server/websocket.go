@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+
+	"fetch_assessment/points"
+)
+
+const (
+	// wsMaxInFlight is how many requests one connection may have in
+	// progress; further messages wait to be read.
+	wsMaxInFlight = 8
+	// wsOutbox is how many messages may wait to be written to a client.
+	wsOutbox = 64
+	// wsWatchLimit is how many receipts submitted on a connection are
+	// watched for re-scoring; the oldest are forgotten first.
+	wsWatchLimit   = 1000
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+)
+
+// wsRequest is a message from a WebSocket client.
+type wsRequest struct {
+	Type string `json:"type"` // "process" or "getPoints"
+	// RequestID is echoed in the reply so clients can match it up.
+	RequestID string `json:"requestId,omitempty"`
+	// For "process".
+	Receipt *points.Receipt `json:"receipt,omitempty"`
+	Dedupe  *bool           `json:"dedupe,omitempty"`
+	// For "getPoints".
+	ReceiptID string `json:"receiptId,omitempty"`
+}
+
+// wsMessage is a message to a WebSocket client: "processed", "points" or
+// "error" in reply to the request with the same RequestID, or "rescored"
+// when a receipt submitted on the connection is given new points.
+type wsMessage struct {
+	Type         string `json:"type"`
+	RequestID    string `json:"requestId,omitempty"`
+	ReceiptID    string `json:"receiptId,omitempty"`
+	Points       *int   `json:"points,omitempty"`
+	RulesVersion string `json:"rulesVersion,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Duplicate    bool   `json:"duplicate,omitempty"`
+	// Set on errors: the HTTP status the same failure gets over REST.
+	Code   int          `json:"code,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Fields []fieldError `json:"fields,omitempty"`
+}
+
+func wsError(req wsRequest, code int, msg string) wsMessage {
+	return wsMessage{Type: "error", RequestID: req.RequestID, Code: code, Error: msg}
+}
+
+// decodeWSRequest decodes a client message, rejecting unknown fields like
+// the REST endpoints. On failure it returns the error reply, with the
+// message's requestId if it can be read and the field at fault, if any.
+// Fields of the receipt are named as its validation errors name them.
+func decodeWSRequest(data []byte) (wsRequest, *wsMessage) {
+	var req wsRequest
+	err := decodeStrict(data, &req)
+	if err == nil {
+		return req, nil
+	}
+	var id struct {
+		RequestID string `json:"requestId"`
+	}
+	// A decoder, unlike json.Unmarshal, reads past trailing data.
+	json.NewDecoder(bytes.NewReader(data)).Decode(&id)
+	msg := wsError(wsRequest{RequestID: id.RequestID}, http.StatusBadRequest, "Invalid message JSON: "+err.Error())
+	msg.Fields = decodeFieldErrors(err)
+	for i := range msg.Fields {
+		msg.Fields[i].Field = strings.TrimPrefix(msg.Fields[i].Field, "receipt.")
+	}
+	return wsRequest{}, &msg
+}
+
+// wsConn is one client connection's state.
+type wsConn struct {
+	out  chan wsMessage
+	done <-chan struct{}
+
+	mu      sync.Mutex
+	watched map[string]struct{}
+	order   []string // watched receipt IDs, oldest first
+}
+
+// send queues msg, giving up if the connection closes first.
+func (c *wsConn) send(msg wsMessage) {
+	select {
+	case c.out <- msg:
+	case <-c.done:
+	}
+}
+
+func (c *wsConn) watch(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.watched[id]; ok {
+		return
+	}
+	if len(c.order) == wsWatchLimit {
+		delete(c.watched, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.watched[id] = struct{}{}
+	c.order = append(c.order, id)
+}
+
+func (c *wsConn) watching(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.watched[id]
+	return ok
+}
+
+// wsHub tracks open WebSocket connections so that re-scored receipts can
+// be pushed to the connections they were submitted on.
+type wsHub struct {
+	mu    sync.Mutex
+	conns map[*wsConn]struct{}
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{conns: make(map[*wsConn]struct{})}
+}
+
+func (h *wsHub) add(c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conns[c] = struct{}{}
+}
+
+func (h *wsHub) remove(c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns, c)
+}
+
+// publish pushes receipt.rescored events to the connections watching the
+// receipt. Connections too far behind miss the push.
+func (h *wsHub) publish(ev receiptEvent) {
+	if ev.Type != eventReceiptRescored {
+		return
+	}
+	points := ev.Data.Points
+	msg := wsMessage{
+		Type:         "rescored",
+		ReceiptID:    ev.Data.ReceiptID,
+		Points:       &points,
+		RulesVersion: ev.Data.RulesVersion,
+		Status:       ev.Data.Status,
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.conns {
+		if !c.watching(msg.ReceiptID) {
+			continue
+		}
+		select {
+		case c.out <- msg:
+		default:
+		}
+	}
+}
+
+// webSocketHandler handles GET /ws
+func (s *server) webSocketHandler(w http.ResponseWriter, r *http.Request) {
+	// The connection outlives the server's read and write timeouts.
+	rc := http.NewResponseController(w)
+	if rc.SetReadDeadline(time.Time{}) != nil || rc.SetWriteDeadline(time.Time{}) != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "WebSockets are not supported")
+		return
+	}
+	conn, err := websocket.Accept(hijacker{w}, r, nil)
+	if err != nil {
+		// Accept has already answered the request.
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(s.maxBodyBytes)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	c := &wsConn{out: make(chan wsMessage, wsOutbox), done: ctx.Done(), watched: make(map[string]struct{})}
+	s.sockets.add(c)
+	defer s.sockets.remove(c)
+	go c.write(ctx, cancel, conn)
+
+	var (
+		inFlight = make(chan struct{}, wsMaxInFlight)
+		wg       sync.WaitGroup
+	)
+	defer wg.Wait()
+	for {
+		typ, data, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		if typ != websocket.MessageText {
+			c.send(wsMessage{Type: "error", Code: http.StatusBadRequest, Error: "Messages must be JSON objects"})
+			continue
+		}
+		req, errMsg := decodeWSRequest(data)
+		if errMsg != nil {
+			c.send(*errMsg)
+			continue
+		}
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-inFlight; wg.Done() }()
+			c.send(s.handleWS(ctx, c, req))
+		}()
+	}
+}
+
+// hijacker lets websocket.Accept, which needs an http.Hijacker, take over
+// the connection from behind the middleware's ResponseWriter wrappers.
+type hijacker struct {
+	http.ResponseWriter
+}
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(h.ResponseWriter).Hijack()
+}
+
+// write sends queued messages and keeps the connection alive with pings,
+// cancelling the connection if either fails.
+func (c *wsConn) write(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn) {
+	defer cancel()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			conn.Close(websocket.StatusNormalClosure, "")
+			return
+		case msg := <-c.out:
+			wctx, done := context.WithTimeout(ctx, wsWriteTimeout)
+			err := wsjson.Write(wctx, conn, msg)
+			done()
+			if err != nil {
+				return
+			}
+		case <-ping.C:
+			pctx, done := context.WithTimeout(ctx, wsWriteTimeout)
+			err := conn.Ping(pctx)
+			done()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleWS answers one request with the same checks as the REST routes.
+func (s *server) handleWS(ctx context.Context, c *wsConn, req wsRequest) wsMessage {
+	switch req.Type {
+	case "process":
+		if err := checkScope(ctx, scopeReceiptsWrite); err != nil {
+			return wsError(req, http.StatusForbidden, err.Error())
+		}
+		if req.Receipt == nil {
+			return wsError(req, http.StatusBadRequest, "receipt is required")
+		}
+		if errs := s.validate(*req.Receipt); errs != nil {
+			msg := wsError(req, http.StatusBadRequest, "The receipt is invalid.")
+			msg.Fields = errs
+			return msg
+		}
+		rec, created, err := s.processReceipt(ctx, *req.Receipt, req.Dedupe == nil || *req.Dedupe)
+		if errors.Is(err, ErrStoreFull) {
+			return wsError(req, http.StatusInsufficientStorage, "The receipt store is full; try again later")
+		}
+		if err != nil {
+			log.Printf("Error saving receipt: %v", err)
+			return wsError(req, http.StatusInternalServerError, "Failed to save receipt")
+		}
+		recordAudit(ctx, s.audit, auditEntry{Action: "ws processReceipt", Target: rec.ID})
+		c.watch(rec.ID)
+		return wsMessage{
+			Type:         "processed",
+			RequestID:    req.RequestID,
+			ReceiptID:    rec.ID,
+			Points:       &rec.Points,
+			RulesVersion: rec.RulesVersion,
+			Status:       statusText(rec.Status),
+			Duplicate:    !created,
+		}
+
+	case "getPoints":
+		if err := checkScope(ctx, scopeReceiptsRead); err != nil {
+			return wsError(req, http.StatusForbidden, err.Error())
+		}
+		if req.ReceiptID == "" {
+			return wsError(req, http.StatusBadRequest, "receiptId is required")
+		}
+		rec, err := s.store.GetReceipt(ctx, req.ReceiptID)
+		if errors.Is(err, ErrReceiptNotFound) || (err == nil && !canAccess(ctx, rec)) {
+			return wsError(req, http.StatusNotFound, "Receipt ID not found")
+		}
+		if err != nil {
+			log.Printf("Error loading receipt: %v", err)
+			return wsError(req, http.StatusInternalServerError, "Failed to load receipt")
+		}
+		return wsMessage{
+			Type:         "points",
+			RequestID:    req.RequestID,
+			ReceiptID:    rec.ID,
+			Points:       &rec.Points,
+			RulesVersion: rec.RulesVersion,
+			Status:       statusText(rec.Status),
+		}
+
+	default:
+		return wsError(req, http.StatusBadRequest, fmt.Sprintf("Unknown message type %q; expected process or getPoints", req.Type))
+	}
+}
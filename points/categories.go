@@ -0,0 +1,79 @@
+package points
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// categoryMatch maps descriptions containing keyword to category.
+type categoryMatch struct {
+	keyword  string // lower case
+	category string
+}
+
+// compileCategories validates a RuleSet's category map and orders it so that
+// the longest matching keyword wins, e.g. "pizza sauce" over "pizza".
+func compileCategories(m map[string]string) ([]categoryMatch, error) {
+	out := make([]categoryMatch, 0, len(m))
+	seen := make(map[string]string)
+	for keyword, category := range m {
+		k := strings.ToLower(strings.TrimSpace(keyword))
+		if k == "" {
+			return nil, errors.New("categories: keywords must not be empty")
+		}
+		if strings.TrimSpace(category) == "" {
+			return nil, fmt.Errorf("categories: keyword %q has no category", keyword)
+		}
+		if prev, ok := seen[k]; ok {
+			return nil, fmt.Errorf("categories: keywords %q and %q differ only in case", prev, keyword)
+		}
+		seen[k] = keyword
+		out = append(out, categoryMatch{k, strings.TrimSpace(category)})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].keyword) != len(out[j].keyword) {
+			return len(out[i].keyword) > len(out[j].keyword)
+		}
+		return out[i].keyword < out[j].keyword
+	})
+	return out, nil
+}
+
+// categorize returns each item's category: its own Category if set, or
+// else the category of the longest keyword its description contains.
+func categorize(items []Item, matches []categoryMatch) []string {
+	out := make([]string, len(items))
+	for i, item := range items {
+		if item.Category != "" {
+			out[i] = item.Category
+			continue
+		}
+		desc := strings.ToLower(item.ShortDescription)
+		for _, m := range matches {
+			if strings.Contains(desc, m.keyword) {
+				out[i] = m.category
+				break
+			}
+		}
+	}
+	return out
+}
+
+// buildItemCategoryRule awards c.Points for every item in c.Category.
+// Categories compare case-insensitively.
+func buildItemCategoryRule(c RuleConfig) (rule, error) {
+	if strings.TrimSpace(c.Category) == "" {
+		return nil, errors.New("category is required")
+	}
+	return func(r *scoredReceipt) int {
+		n := 0
+		for _, category := range r.categories {
+			if strings.EqualFold(category, c.Category) {
+				n++
+			}
+		}
+		return n * c.Points
+	}, nil
+}
@@ -0,0 +1,87 @@
+package points
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/expr-lang/expr"
+)
+
+// exprEnv is what an expression rule can see of a receipt. Expressions run
+// in the expr sandbox: they have no access to I/O or the clock, and the
+// interpreter bounds the memory a single evaluation may use.
+type exprEnv struct {
+	Retailer     string     `expr:"retailer"`
+	Total        float64    `expr:"total"`
+	TotalCents   int        `expr:"totalCents"`
+	Items        []exprItem `expr:"items"`
+	ItemCount    int        `expr:"itemCount"`
+	PurchaseDate string     `expr:"purchaseDate"`
+	PurchaseTime string     `expr:"purchaseTime"`
+	Year         int        `expr:"year"`
+	Month        int        `expr:"month"`
+	Day          int        `expr:"day"`
+	Weekday      string     `expr:"weekday"`
+	Hour         int        `expr:"hour"`
+	Minute       int        `expr:"minute"`
+}
+
+type exprItem struct {
+	Description string  `expr:"description"`
+	Price       float64 `expr:"price"`
+	PriceCents  int     `expr:"priceCents"`
+	Category    string  `expr:"category"`
+}
+
+func newExprEnv(r *scoredReceipt) exprEnv {
+	env := exprEnv{
+		Retailer:     r.Retailer,
+		Total:        float64(r.total) / 100,
+		TotalCents:   int(r.total),
+		Items:        make([]exprItem, len(r.Items)),
+		ItemCount:    len(r.Items),
+		PurchaseDate: r.PurchaseDate,
+		PurchaseTime: r.PurchaseTime,
+		Year:         r.purchaseDate.Year(),
+		Month:        int(r.purchaseDate.Month()),
+		Day:          r.purchaseDate.Day(),
+		Weekday:      r.purchaseDate.Weekday().String(),
+		Hour:         r.purchaseTime.Hour(),
+		Minute:       r.purchaseTime.Minute(),
+	}
+	for i, item := range r.Items {
+		env.Items[i] = exprItem{
+			Description: item.ShortDescription,
+			Price:       float64(r.prices[i]) / 100,
+			PriceCents:  int(r.prices[i]),
+			Category:    r.categories[i],
+		}
+	}
+	return env
+}
+
+// buildExpressionRule compiles c.Expression, which must evaluate to a
+// number of points (fractions are truncated). An expression that fails at
+// run time (for example by indexing past the last item) awards no points.
+func buildExpressionRule(c RuleConfig) (rule, error) {
+	if c.Expression == "" {
+		return nil, errors.New("expression is required")
+	}
+	program, err := expr.Compile(c.Expression,
+		expr.Env(exprEnv{}),
+		expr.AsInt(),
+		// Scoring must not depend on when it runs.
+		expr.DisableBuiltin("now"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("expression: %w", err)
+	}
+	return func(r *scoredReceipt) int {
+		out, err := expr.Run(program, newExprEnv(r))
+		if err != nil {
+			return 0
+		}
+		n, _ := out.(int)
+		return n
+	}, nil
+}
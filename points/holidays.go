@@ -0,0 +1,215 @@
+package points
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// calendarTTL is how long Compile reuses a loaded calendar before
+	// reading it again. Compiled engines keep the dates they were built with.
+	calendarTTL = time.Hour
+	// maxCalendarBytes bounds the size of a calendar file or download.
+	maxCalendarBytes = 1 << 20
+)
+
+var (
+	// calendarMu guards calendars. It is not held while a calendar is
+	// read, so a slow download does not hold up other calendars;
+	// calendarLoads makes concurrent loads of the same one share a read.
+	calendarMu    sync.Mutex
+	calendars     = make(map[string]cachedCalendar)
+	calendarLoads singleflight.Group
+	// calendarClient fetches calendars given by URL.
+	calendarClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+type cachedCalendar struct {
+	days   map[string]bool // "YYYY-MM-DD"
+	loaded time.Time
+}
+
+// buildHolidayRule awards c.Points for receipts purchased on a day listed in
+// c.Calendar.
+func buildHolidayRule(c RuleConfig) (rule, error) {
+	if c.Calendar == "" {
+		return nil, errors.New("calendar is required")
+	}
+	days, err := loadCalendar(c.Calendar)
+	if err != nil {
+		return nil, fmt.Errorf("calendar: %w", err)
+	}
+	return func(r *scoredReceipt) int {
+		if days[r.purchaseDate.Format("2006-01-02")] {
+			return c.Points
+		}
+		return 0
+	}, nil
+}
+
+// loadCalendar returns the days in the calendar at src, a file path or an
+// http(s) URL, from the cache if it was loaded recently.
+func loadCalendar(src string) (map[string]bool, error) {
+	calendarMu.Lock()
+	c, ok := calendars[src]
+	calendarMu.Unlock()
+	if ok && time.Since(c.loaded) < calendarTTL {
+		return c.days, nil
+	}
+	days, err, _ := calendarLoads.Do(src, func() (any, error) {
+		data, err := readCalendar(src)
+		if err != nil {
+			return nil, err
+		}
+		days, err := parseCalendar(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", src, err)
+		}
+		calendarMu.Lock()
+		calendars[src] = cachedCalendar{days: days, loaded: time.Now()}
+		calendarMu.Unlock()
+		return days, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return days.(map[string]bool), nil
+}
+
+func readCalendar(src string) ([]byte, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readLimited(f, src)
+	}
+	resp, err := calendarClient.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", src, resp.Status)
+	}
+	return readLimited(resp.Body, src)
+}
+
+func readLimited(r io.Reader, src string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxCalendarBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCalendarBytes {
+		return nil, fmt.Errorf("%s: calendar exceeds %d bytes", src, maxCalendarBytes)
+	}
+	return data, nil
+}
+
+// parseCalendar reads either an iCalendar (RFC 5545) file or a list of
+// YYYY-MM-DD dates, one per line, where anything after the date and "#"
+// comments are ignored.
+func parseCalendar(data []byte) (map[string]bool, error) {
+	days := make(map[string]bool)
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("BEGIN:VCALENDAR")) {
+		err = parseICal(data, days)
+	} else {
+		err = parseDateList(data, days)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(days) == 0 {
+		return nil, errors.New("calendar lists no dates")
+	}
+	return days, nil
+}
+
+func parseDateList(data []byte, days map[string]bool) error {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %q is not a YYYY-MM-DD date", n, fields[0])
+		}
+		days[day.Format("2006-01-02")] = true
+	}
+	return sc.Err()
+}
+
+// parseICal adds the days covered by each VEVENT's DTSTART and DTEND. Only
+// the date part of each is used, and DTEND is exclusive as RFC 5545
+// specifies for all-day events. Recurrence rules are not expanded.
+func parseICal(data []byte, days map[string]bool) error {
+	// Undo line folding: a line starting with a space or tab continues the
+	// previous one.
+	text := strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(string(data))
+	var start, end time.Time
+	inEvent := false
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, ";") // drop parameters such as VALUE=DATE
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				inEvent, start, end = true, time.Time{}, time.Time{}
+			}
+		case "DTSTART", "DTEND":
+			if !inEvent {
+				continue
+			}
+			if len(value) < 8 {
+				return fmt.Errorf("line %d: invalid %s %q", n+1, name, value)
+			}
+			day, err := time.Parse("20060102", value[:8])
+			if err != nil {
+				return fmt.Errorf("line %d: invalid %s %q", n+1, name, value)
+			}
+			if strings.EqualFold(name, "DTSTART") {
+				start = day
+			} else {
+				end = day
+			}
+		case "END":
+			if !strings.EqualFold(value, "VEVENT") || !inEvent {
+				continue
+			}
+			inEvent = false
+			if start.IsZero() {
+				return fmt.Errorf("line %d: event has no DTSTART", n+1)
+			}
+			if !end.After(start) {
+				end = start.AddDate(0, 0, 1)
+			}
+			// Guard against runaway events; no holiday lasts a year.
+			if end.Sub(start) > 366*24*time.Hour {
+				return fmt.Errorf("line %d: event spans more than a year", n+1)
+			}
+			for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+				days[d.Format("2006-01-02")] = true
+			}
+		}
+	}
+	return nil
+}
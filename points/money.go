@@ -0,0 +1,52 @@
+package points
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Cents is an amount of money in hundredths of a dollar. Amounts are kept
+// as integers so rules such as "multiple of 0.25" are exact.
+type Cents int64
+
+// errBadAmount is returned by ParseCents for malformed amounts.
+var errBadAmount = errors.New("not a dollar amount")
+
+// ParseCents parses a non-negative dollar amount such as "35.10", "35.1"
+// or "35" without going through floating point. More than two decimal
+// places is an error.
+func ParseCents(s string) (Cents, error) {
+	whole, frac, hasPoint := strings.Cut(s, ".")
+	if whole == "" || len(frac) > 2 || (hasPoint && frac == "") || !allDigits(whole) || !allDigits(frac) {
+		return 0, errBadAmount
+	}
+	dollars, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || dollars > math.MaxInt64/100-1 {
+		return 0, errBadAmount
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	cents, _ := strconv.ParseInt(frac, 10, 64)
+	return Cents(dollars*100 + cents), nil
+}
+
+func allDigits(s string) bool {
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats c as dollars with two decimal places, e.g. "35.10".
+func (c Cents) String() string {
+	sign := ""
+	if c < 0 {
+		sign, c = "-", -c
+	}
+	return sign + strconv.FormatInt(int64(c/100), 10) + "." + strconv.FormatInt(int64(c%100)/10, 10) + strconv.FormatInt(int64(c%10), 10)
+}
@@ -0,0 +1,148 @@
+package points
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Plugin rules run a WebAssembly module for each receipt. The module must
+// export its memory as "memory" and two functions:
+//
+//	alloc(size i32) i32          returns a buffer of size bytes
+//	score(ptr i32, size i32) i32 scores the receipt JSON in that buffer
+//
+// The receipt is encoded as in the API. Each receipt gets a fresh instance,
+// so plugins cannot carry state between receipts. WASI is available with no
+// files, environment, network or real clock; other imports fail to link.
+const (
+	// pluginMemoryLimitPages caps a plugin's memory, in 64 KiB pages.
+	pluginMemoryLimitPages = 1024
+	// pluginTimeout bounds one receipt's instantiation and scoring.
+	pluginTimeout = 250 * time.Millisecond
+)
+
+var (
+	pluginMu      sync.Mutex
+	pluginRuntime wazero.Runtime
+	// pluginModules caches compiled modules by content so recompiling a rule
+	// set does not recompile its plugins.
+	pluginModules = make(map[[sha256.Size]byte]wazero.CompiledModule)
+)
+
+// loadPlugin compiles the module at path and checks its exports.
+func loadPlugin(path string) (wazero.CompiledModule, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(code)
+
+	pluginMu.Lock()
+	defer pluginMu.Unlock()
+	if m, ok := pluginModules[sum]; ok {
+		return m, nil
+	}
+	ctx := context.Background()
+	if pluginRuntime == nil {
+		rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+			WithMemoryLimitPages(pluginMemoryLimitPages).
+			WithCloseOnContextDone(true))
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+			return nil, err
+		}
+		pluginRuntime = rt
+	}
+	m, err := pluginRuntime.CompileModule(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := checkPluginExports(m); err != nil {
+		m.Close(ctx)
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	pluginModules[sum] = m
+	return m, nil
+}
+
+func checkPluginExports(m wazero.CompiledModule) error {
+	if _, ok := m.ExportedMemories()["memory"]; !ok {
+		return errors.New(`module does not export "memory"`)
+	}
+	fns := m.ExportedFunctions()
+	for name, params := range map[string][]api.ValueType{
+		"alloc": {api.ValueTypeI32},
+		"score": {api.ValueTypeI32, api.ValueTypeI32},
+	} {
+		fn, ok := fns[name]
+		if !ok {
+			return fmt.Errorf("module does not export %q", name)
+		}
+		if !slices.Equal(fn.ParamTypes(), params) || !slices.Equal(fn.ResultTypes(), []api.ValueType{api.ValueTypeI32}) {
+			return fmt.Errorf("export %q has the wrong signature", name)
+		}
+	}
+	return nil
+}
+
+// buildPluginRule loads c.Module. A plugin that traps, runs out of memory or
+// time, or returns a bad pointer awards no points.
+func buildPluginRule(c RuleConfig) (rule, error) {
+	if c.Module == "" {
+		return nil, errors.New("module is required")
+	}
+	m, err := loadPlugin(c.Module)
+	if err != nil {
+		return nil, fmt.Errorf("module: %w", err)
+	}
+	return func(r *scoredReceipt) int {
+		n, err := runPlugin(m, r.Receipt)
+		if err != nil {
+			return 0
+		}
+		return n
+	}, nil
+}
+
+// runPlugin instantiates m and scores r with it.
+func runPlugin(m wazero.CompiledModule, r Receipt) (int, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	// Reactor modules (e.g. Go's -buildmode=c-shared) initialise themselves
+	// in _initialize; modules without it are used as they are.
+	mod, err := pluginRuntime.InstantiateModule(ctx, m, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return 0, err
+	}
+	defer mod.Close(context.Background())
+
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(body)))
+	if err != nil {
+		return 0, err
+	}
+	ptr := uint32(res[0])
+	if !mod.ExportedMemory("memory").Write(ptr, body) {
+		return 0, errors.New("alloc returned an out of range buffer")
+	}
+	res, err = mod.ExportedFunction("score").Call(ctx, uint64(ptr), uint64(len(body)))
+	if err != nil {
+		return 0, err
+	}
+	return int(api.DecodeI32(res[0])), nil
+}
@@ -0,0 +1,64 @@
+// Package points scores receipts according to the receipt processor rules.
+//
+// It has no dependencies on the HTTP server, so other services can score
+// receipts in-process:
+//
+//	total, breakdown, err := points.Calculate(receipt)
+//
+// The rules are data: a RuleSet (typically loaded from YAML or JSON with
+// LoadRuleSet) is compiled into an Engine, and DefaultRuleSet holds the
+// rules from the original challenge spec.
+package points
+
+import "errors"
+
+// Item is a line item on a receipt. Category is optional; items without one
+// may be categorised by the rule set's category map.
+type Item struct {
+	ShortDescription string `json:"shortDescription"`
+	Price            string `json:"price"`
+	Category         string `json:"category,omitempty"`
+}
+
+// Receipt is a purchase receipt as described by the challenge spec.
+type Receipt struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"` // Expected format: "2006-01-02"
+	PurchaseTime string `json:"purchaseTime"` // Expected format: "15:04"
+	Items        []Item `json:"items"`
+	Total        string `json:"total"`
+}
+
+// RuleResult is the number of points a single rule contributed to a receipt.
+type RuleResult struct {
+	Rule        string `json:"rule"`
+	Description string `json:"description"`
+	Points      int    `json:"points"`
+}
+
+// Breakdown lists every rule's contribution to a receipt's score.
+type Breakdown []RuleResult
+
+// Total returns the sum of all rule contributions.
+func (b Breakdown) Total() int {
+	total := 0
+	for _, res := range b {
+		total += res.Points
+	}
+	return total
+}
+
+// ErrInvalidReceipt is returned (wrapped) by Calculate when a field it needs
+// cannot be parsed.
+var ErrInvalidReceipt = errors.New("points: invalid receipt")
+
+// Calculate scores a receipt with DefaultRuleSet and returns its total
+// together with the contribution of each rule. Every rule is listed in the
+// breakdown, including those that awarded no points. Use Compile to score
+// with a different rule set.
+//
+// Calculate only parses what the rules need; callers accepting untrusted
+// input should validate receipts against the API schema first.
+func Calculate(r Receipt) (int, Breakdown, error) {
+	return defaultEngine.Calculate(r)
+}
@@ -0,0 +1,110 @@
+package points
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Promotion adjusts a receipt's score while a campaign runs: it multiplies
+// the points awarded by the rules, adds a fixed bonus, or both. The
+// conditions are optional and all must hold for the promotion to apply:
+//
+//	From, To  first and last purchase dates of the campaign (YYYY-MM-DD)
+//	Weekdays  purchase weekdays, e.g. ["Saturday", "Sunday"]
+//	Retailer  retailer name, compared case-insensitively
+//
+// Promotions are evaluated against the rules' total, not against each
+// other, so two 2x promotions give 3x points.
+type Promotion struct {
+	Name        string   `json:"name" yaml:"name"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty"`
+	From        string   `json:"from,omitempty" yaml:"from,omitempty"`
+	To          string   `json:"to,omitempty" yaml:"to,omitempty"`
+	Weekdays    []string `json:"weekdays,omitempty" yaml:"weekdays,omitempty"`
+	Retailer    string   `json:"retailer,omitempty" yaml:"retailer,omitempty"`
+	// Multiplier scales the rules' total; the extra points are rounded up.
+	Multiplier float64 `json:"multiplier,omitempty" yaml:"multiplier,omitempty"`
+	Bonus      int     `json:"bonus,omitempty" yaml:"bonus,omitempty"`
+}
+
+// promotion is a compiled Promotion.
+type promotion struct {
+	from, to   time.Time // zero when open-ended
+	weekdays   map[time.Weekday]bool
+	retailer   string
+	multiplier float64
+	bonus      int
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday,
+	"wednesday": time.Wednesday, "thursday": time.Thursday, "friday": time.Friday,
+	"saturday": time.Saturday,
+}
+
+func compilePromotion(p Promotion) (promotion, error) {
+	c := promotion{
+		retailer:   strings.ToLower(strings.TrimSpace(p.Retailer)),
+		multiplier: p.Multiplier,
+		bonus:      p.Bonus,
+	}
+	if p.Multiplier < 0 || math.IsNaN(p.Multiplier) || math.IsInf(p.Multiplier, 0) {
+		return c, errors.New("multiplier must not be negative")
+	}
+	if p.Multiplier == 0 && p.Bonus == 0 {
+		return c, errors.New("multiplier or bonus is required")
+	}
+	var err error
+	if p.From != "" {
+		if c.from, err = time.Parse("2006-01-02", p.From); err != nil {
+			return c, fmt.Errorf("from %q must be a YYYY-MM-DD date", p.From)
+		}
+	}
+	if p.To != "" {
+		if c.to, err = time.Parse("2006-01-02", p.To); err != nil {
+			return c, fmt.Errorf("to %q must be a YYYY-MM-DD date", p.To)
+		}
+	}
+	if !c.from.IsZero() && !c.to.IsZero() && c.to.Before(c.from) {
+		return c, errors.New("to must not be before from")
+	}
+	if len(p.Weekdays) > 0 {
+		c.weekdays = make(map[time.Weekday]bool)
+		for _, name := range p.Weekdays {
+			day, ok := weekdayNames[strings.ToLower(name)]
+			if !ok {
+				return c, fmt.Errorf("weekday %q is not a day of the week", name)
+			}
+			c.weekdays[day] = true
+		}
+	}
+	return c, nil
+}
+
+// applies reports whether the promotion covers r.
+func (p promotion) applies(r *scoredReceipt) bool {
+	switch {
+	case !p.from.IsZero() && r.purchaseDate.Before(p.from):
+		return false
+	case !p.to.IsZero() && r.purchaseDate.After(p.to):
+		return false
+	case p.weekdays != nil && !p.weekdays[r.purchaseDate.Weekday()]:
+		return false
+	case p.retailer != "" && strings.ToLower(strings.TrimSpace(r.Retailer)) != p.retailer:
+		return false
+	}
+	return true
+}
+
+// points returns the points the promotion adds to a receipt whose rules
+// awarded base.
+func (p promotion) points(base int) int {
+	n := p.bonus
+	if p.multiplier != 0 {
+		n += int(math.Ceil(float64(base) * (p.multiplier - 1)))
+	}
+	return n
+}
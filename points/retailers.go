@@ -0,0 +1,54 @@
+package points
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// retailerKey normalises a retailer name for alias lookup: case and runs of
+// white space do not matter.
+func retailerKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// compileRetailers turns a RuleSet's canonical name → aliases table into a
+// lookup from each normalised alias, and the canonical name itself, to the
+// canonical name.
+func compileRetailers(table map[string][]string) (map[string]string, error) {
+	out := make(map[string]string)
+	add := func(alias, canonical string) error {
+		key := retailerKey(alias)
+		if key == "" {
+			return fmt.Errorf("retailers: %q has an empty alias", canonical)
+		}
+		if prev, ok := out[key]; ok && prev != canonical {
+			return fmt.Errorf("retailers: %q is an alias of both %q and %q", alias, prev, canonical)
+		}
+		out[key] = canonical
+		return nil
+	}
+	for canonical, aliases := range table {
+		if strings.TrimSpace(canonical) == "" {
+			return nil, errors.New("retailers: canonical names must not be empty")
+		}
+		if err := add(canonical, canonical); err != nil {
+			return nil, err
+		}
+		for _, alias := range aliases {
+			if err := add(alias, canonical); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// CanonicalRetailer returns the canonical name for a retailer according to
+// the rule set's retailer table, or name unchanged if it is not listed.
+func (e *Engine) CanonicalRetailer(name string) string {
+	if canonical, ok := e.aliases[retailerKey(name)]; ok {
+		return canonical
+	}
+	return name
+}
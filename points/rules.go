@@ -0,0 +1,468 @@
+package points
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuleSet is a scoring configuration: an ordered list of rules whose points
+// are summed, any promotions applied on top, a category map that assigns
+// items without a category one by keyword, a table of retailer aliases and
+// the loyalty tiers.
+// It is usually loaded from a YAML or JSON file with LoadRuleSet and turned
+// into an Engine with Compile.
+type RuleSet struct {
+	// Version identifies this configuration and is recorded with every
+	// receipt it scores. If empty, Compile derives one from the content.
+	Version    string       `json:"version,omitempty" yaml:"version,omitempty"`
+	Rules      []RuleConfig `json:"rules" yaml:"rules"`
+	Promotions []Promotion  `json:"promotions,omitempty" yaml:"promotions,omitempty"`
+	// Categories maps keywords to categories: an item whose description
+	// contains a keyword (ignoring case) is in its category.
+	Categories map[string]string `json:"categories,omitempty" yaml:"categories,omitempty"`
+	// Retailers maps canonical retailer names to their aliases. Receipts
+	// from an alias are scored as if from the canonical name; aliases
+	// match ignoring case and runs of white space.
+	Retailers map[string][]string `json:"retailers,omitempty" yaml:"retailers,omitempty"`
+	// Tiers are the loyalty levels, in any order. If empty, DefaultTiers
+	// are used.
+	Tiers []Tier `json:"tiers,omitempty" yaml:"tiers,omitempty"`
+}
+
+// RuleConfig configures one rule. Type selects the kind of rule; the other
+// fields are its parameters, and which ones apply depends on the type:
+//
+//	retailerAlphanumeric   Points per letter or digit in the retailer name
+//	totalMultipleOf        Points if the total is a multiple of Amount
+//	totalGreaterThan       Points if the total is greater than Amount
+//	itemCount              Points for every Every items
+//	itemDescriptionLength  Percent of the price, rounded up, for each item whose
+//	                       trimmed description length is a multiple of Every
+//	purchaseDayParity      Points if the day of the month is Parity ("odd" or "even")
+//	purchaseTimeWindow     Points if the purchase time is in [From, To) ("HH:MM")
+//	expression             Points computed by Expression, e.g. "total > 10.00 ? 5 : 0"
+//	wasm                   Points returned by the WebAssembly plugin in Module
+//	holiday                Points if the purchase date is listed in Calendar, an
+//	                       iCalendar or date list file, or an http(s) URL
+//	itemCategory           Points for each item in Category
+//
+// Amounts are dollar strings such as "0.25".
+type RuleConfig struct {
+	Name        string `json:"name" yaml:"name"`
+	Type        string `json:"type" yaml:"type"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+
+	Points  int    `json:"points,omitempty" yaml:"points,omitempty"`
+	Amount  string `json:"amount,omitempty" yaml:"amount,omitempty"`
+	Every   int    `json:"every,omitempty" yaml:"every,omitempty"`
+	Percent int    `json:"percent,omitempty" yaml:"percent,omitempty"`
+	Parity  string `json:"parity,omitempty" yaml:"parity,omitempty"`
+	From    string `json:"from,omitempty" yaml:"from,omitempty"`
+	To      string `json:"to,omitempty" yaml:"to,omitempty"`
+
+	Expression string `json:"expression,omitempty" yaml:"expression,omitempty"`
+	Module     string `json:"module,omitempty" yaml:"module,omitempty"`
+	Calendar   string `json:"calendar,omitempty" yaml:"calendar,omitempty"`
+	Category   string `json:"category,omitempty" yaml:"category,omitempty"`
+}
+
+// DefaultRuleSet returns the rules from the original challenge spec.
+func DefaultRuleSet() RuleSet {
+	return RuleSet{Version: "builtin-1", Rules: []RuleConfig{
+		{Name: "retailerName", Type: "retailerAlphanumeric", Points: 1,
+			Description: "1 point per alphanumeric character in the retailer name"},
+		{Name: "roundDollarTotal", Type: "totalMultipleOf", Amount: "1.00", Points: 50,
+			Description: "50 points if the total is a round dollar amount"},
+		{Name: "quarterMultipleTotal", Type: "totalMultipleOf", Amount: "0.25", Points: 25,
+			Description: "25 points if the total is a multiple of 0.25"},
+		{Name: "itemPairs", Type: "itemCount", Every: 2, Points: 5,
+			Description: "5 points for every two items"},
+		{Name: "itemDescriptions", Type: "itemDescriptionLength", Every: 3, Percent: 20,
+			Description: "20% of the price (rounded up) for items whose trimmed description length is a multiple of 3"},
+		{Name: "totalOverTen", Type: "totalGreaterThan", Amount: "10.00", Points: 5,
+			Description: "5 points if the total is greater than 10.00"},
+		{Name: "oddPurchaseDay", Type: "purchaseDayParity", Parity: "odd", Points: 6,
+			Description: "6 points if the day in the purchase date is odd"},
+		{Name: "afternoonPurchase", Type: "purchaseTimeWindow", From: "14:00", To: "16:00", Points: 10,
+			Description: "10 points if the purchase time is between 2:00pm and 4:00pm"},
+	}}
+}
+
+// WithOverrides returns a copy of rs in which each override replaces the
+// rule with the same name, or is appended if no rule has that name. The
+// copy has no version, so Compile derives one from its content.
+func (rs RuleSet) WithOverrides(overrides []RuleConfig) RuleSet {
+	out := RuleSet{
+		Rules:      append([]RuleConfig(nil), rs.Rules...),
+		Promotions: rs.Promotions,
+		Categories: rs.Categories,
+		Retailers:  rs.Retailers,
+		Tiers:      rs.Tiers,
+	}
+	for _, o := range overrides {
+		replaced := false
+		for i := range out.Rules {
+			if out.Rules[i].Name == o.Name {
+				out.Rules[i], replaced = o, true
+				break
+			}
+		}
+		if !replaced {
+			out.Rules = append(out.Rules, o)
+		}
+	}
+	return out
+}
+
+// LoadRuleSet reads a rule set from a YAML (.yaml, .yml) or JSON file.
+// Unknown fields are rejected so that typos do not silently change scoring.
+// Relative plugin module and calendar paths are resolved against the file's
+// directory.
+func LoadRuleSet(path string) (RuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RuleSet{}, err
+	}
+	var rs RuleSet
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		err = dec.Decode(&rs)
+	case ".json":
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&rs)
+	default:
+		return RuleSet{}, fmt.Errorf("rule set %s: unsupported file extension, expected .yaml, .yml or .json", path)
+	}
+	if err != nil {
+		return RuleSet{}, fmt.Errorf("rule set %s: %w", path, err)
+	}
+	for i, c := range rs.Rules {
+		if c.Module != "" && !filepath.IsAbs(c.Module) {
+			rs.Rules[i].Module = filepath.Join(filepath.Dir(path), c.Module)
+		}
+		if c.Calendar != "" && !filepath.IsAbs(c.Calendar) && !strings.Contains(c.Calendar, "://") {
+			rs.Rules[i].Calendar = filepath.Join(filepath.Dir(path), c.Calendar)
+		}
+	}
+	return rs, nil
+}
+
+// scoredReceipt is a receipt with the fields rules need already parsed.
+type scoredReceipt struct {
+	Receipt
+	total        Cents
+	prices       []Cents
+	purchaseDate time.Time
+	purchaseTime time.Time
+	categories   []string // per item, "" if uncategorised
+}
+
+// rule scores one aspect of a receipt.
+type rule func(r *scoredReceipt) int
+
+// ruleBuilders compiles each rule type's configuration into a rule.
+var ruleBuilders = map[string]func(c RuleConfig) (rule, error){
+	"retailerAlphanumeric": func(c RuleConfig) (rule, error) {
+		return func(r *scoredReceipt) int {
+			n := 0
+			for _, ch := range r.Retailer {
+				if (ch >= '0' && ch <= '9') || (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') {
+					n++
+				}
+			}
+			return n * c.Points
+		}, nil
+	},
+	"totalMultipleOf": func(c RuleConfig) (rule, error) {
+		amount, err := ParseCents(c.Amount)
+		if err != nil || amount == 0 {
+			return nil, fmt.Errorf("amount %q must be a positive dollar amount", c.Amount)
+		}
+		return func(r *scoredReceipt) int {
+			if r.total%amount == 0 {
+				return c.Points
+			}
+			return 0
+		}, nil
+	},
+	"totalGreaterThan": func(c RuleConfig) (rule, error) {
+		amount, err := ParseCents(c.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("amount %q must be a dollar amount", c.Amount)
+		}
+		return func(r *scoredReceipt) int {
+			if r.total > amount {
+				return c.Points
+			}
+			return 0
+		}, nil
+	},
+	"itemCount": func(c RuleConfig) (rule, error) {
+		if c.Every <= 0 {
+			return nil, errors.New("every must be positive")
+		}
+		return func(r *scoredReceipt) int {
+			return len(r.Items) / c.Every * c.Points
+		}, nil
+	},
+	"itemDescriptionLength": func(c RuleConfig) (rule, error) {
+		if c.Every <= 0 || c.Percent <= 0 {
+			return nil, errors.New("every and percent must be positive")
+		}
+		return func(r *scoredReceipt) int {
+			n := 0
+			for i, item := range r.Items {
+				if len(strings.TrimSpace(item.ShortDescription))%c.Every == 0 {
+					// Percent of a price in cents, as whole points (dollars), rounded up.
+					n += int((int64(r.prices[i])*int64(c.Percent) + 9999) / 10000)
+				}
+			}
+			return n
+		}, nil
+	},
+	"purchaseDayParity": func(c RuleConfig) (rule, error) {
+		if c.Parity != "odd" && c.Parity != "even" {
+			return nil, fmt.Errorf("parity %q must be \"odd\" or \"even\"", c.Parity)
+		}
+		want := 0
+		if c.Parity == "odd" {
+			want = 1
+		}
+		return func(r *scoredReceipt) int {
+			if r.purchaseDate.Day()%2 == want {
+				return c.Points
+			}
+			return 0
+		}, nil
+	},
+	"purchaseTimeWindow": func(c RuleConfig) (rule, error) {
+		from, err := time.Parse("15:04", c.From)
+		if err != nil {
+			return nil, fmt.Errorf("from %q must be an HH:MM time", c.From)
+		}
+		to, err := time.Parse("15:04", c.To)
+		if err != nil {
+			return nil, fmt.Errorf("to %q must be an HH:MM time", c.To)
+		}
+		if !from.Before(to) {
+			return nil, errors.New("from must be before to")
+		}
+		return func(r *scoredReceipt) int {
+			if !r.purchaseTime.Before(from) && r.purchaseTime.Before(to) {
+				return c.Points
+			}
+			return 0
+		}, nil
+	},
+	"expression":   buildExpressionRule,
+	"wasm":         buildPluginRule,
+	"holiday":      buildHolidayRule,
+	"itemCategory": buildItemCategoryRule,
+}
+
+// Engine scores receipts with a compiled RuleSet. It is immutable and safe
+// for concurrent use.
+type Engine struct {
+	version    string
+	configs    []RuleConfig
+	rules      []rule
+	promoSpecs []Promotion
+	promotions []promotion
+	categories map[string]string
+	matches    []categoryMatch
+	retailers  map[string][]string
+	aliases    map[string]string // normalised alias → canonical name
+	tierSpecs  []Tier            // as configured; nil for DefaultTiers
+	tiers      []Tier            // by MinPoints
+}
+
+// Compile validates rs and prepares it for scoring.
+func Compile(rs RuleSet) (*Engine, error) {
+	if len(rs.Rules) == 0 {
+		return nil, errors.New("rule set has no rules")
+	}
+	e := &Engine{}
+	seen := make(map[string]bool)
+	for i, c := range rs.Rules {
+		if c.Name == "" {
+			return nil, fmt.Errorf("rules[%d]: name is required", i)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("rules[%d]: duplicate rule name %q", i, c.Name)
+		}
+		seen[c.Name] = true
+		build, ok := ruleBuilders[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("rule %q: unknown type %q", c.Name, c.Type)
+		}
+		r, err := build(c)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", c.Name, err)
+		}
+		if c.Description == "" {
+			c.Description = c.Type
+		}
+		e.configs = append(e.configs, c)
+		e.rules = append(e.rules, r)
+	}
+	for i, p := range rs.Promotions {
+		if p.Name == "" {
+			return nil, fmt.Errorf("promotions[%d]: name is required", i)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("promotions[%d]: duplicate name %q", i, p.Name)
+		}
+		seen[p.Name] = true
+		compiled, err := compilePromotion(p)
+		if err != nil {
+			return nil, fmt.Errorf("promotion %q: %w", p.Name, err)
+		}
+		if p.Description == "" {
+			p.Description = "promotion"
+		}
+		e.promoSpecs = append(e.promoSpecs, p)
+		e.promotions = append(e.promotions, compiled)
+	}
+	var err error
+	if e.matches, err = compileCategories(rs.Categories); err != nil {
+		return nil, err
+	}
+	if len(rs.Categories) > 0 {
+		e.categories = maps.Clone(rs.Categories)
+	}
+	if e.aliases, err = compileRetailers(rs.Retailers); err != nil {
+		return nil, err
+	}
+	if len(rs.Retailers) > 0 {
+		e.retailers = maps.Clone(rs.Retailers)
+	}
+	tiers := rs.Tiers
+	if len(tiers) == 0 {
+		tiers = DefaultTiers()
+	} else {
+		e.tierSpecs = slices.Clone(rs.Tiers)
+	}
+	if e.tiers, err = compileTiers(tiers, seen); err != nil {
+		return nil, err
+	}
+	e.version = rs.Version
+	if e.version == "" {
+		// Rule sets with only rules hash as they did before the other
+		// sections existed, so their derived versions are unchanged.
+		var content any = rs.Rules
+		if len(rs.Promotions) > 0 || len(rs.Categories) > 0 || len(rs.Retailers) > 0 || len(rs.Tiers) > 0 {
+			content = RuleSet{Rules: rs.Rules, Promotions: rs.Promotions, Categories: rs.Categories, Retailers: rs.Retailers, Tiers: rs.Tiers}
+		}
+		body, _ := json.Marshal(content)
+		sum := sha256.Sum256(body)
+		e.version = "sha256:" + hex.EncodeToString(sum[:6])
+	}
+	return e, nil
+}
+
+// defaultEngine scores with DefaultRuleSet.
+var defaultEngine = func() *Engine {
+	e, err := Compile(DefaultRuleSet())
+	if err != nil {
+		panic(err)
+	}
+	return e
+}()
+
+// DefaultEngine returns the engine for DefaultRuleSet.
+func DefaultEngine() *Engine {
+	return defaultEngine
+}
+
+// Version returns the rule set's version.
+func (e *Engine) Version() string {
+	return e.version
+}
+
+// RuleSet returns the configuration e was compiled from.
+func (e *Engine) RuleSet() RuleSet {
+	return RuleSet{
+		Version:    e.version,
+		Rules:      append([]RuleConfig(nil), e.configs...),
+		Promotions: append([]Promotion(nil), e.promoSpecs...),
+		Categories: maps.Clone(e.categories),
+		Retailers:  maps.Clone(e.retailers),
+		Tiers:      slices.Clone(e.tierSpecs),
+	}
+}
+
+// Calculate scores a receipt and returns its total together with the
+// contribution of each rule. Every rule is listed in the breakdown,
+// including those that awarded no points, followed by the promotions that
+// applied to the receipt. Rules see the retailer's canonical name (see
+// RuleSet.Retailers).
+//
+// Calculate only parses what the rules need; callers accepting untrusted
+// input should validate receipts against the API schema first.
+func (e *Engine) Calculate(r Receipt) (int, Breakdown, error) {
+	return e.CalculateForTier(r, "")
+}
+
+// CalculateForTier is like Calculate for a receipt from a user in the named
+// tier. If the tier has a multiplier it is applied last, and listed in the
+// breakdown under the tier's name. Unknown tiers, such as one removed from
+// the rule set since, are ignored.
+func (e *Engine) CalculateForTier(r Receipt, tier string) (int, Breakdown, error) {
+	r.Retailer = e.CanonicalRetailer(r.Retailer)
+	sr, err := parse(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	sr.categories = categorize(r.Items, e.matches)
+	b := make(Breakdown, len(e.rules))
+	for i, rule := range e.rules {
+		b[i] = RuleResult{Rule: e.configs[i].Name, Description: e.configs[i].Description, Points: rule(sr)}
+	}
+	base := b.Total()
+	for i, p := range e.promotions {
+		if p.applies(sr) {
+			b = append(b, RuleResult{Rule: e.promoSpecs[i].Name, Description: e.promoSpecs[i].Description, Points: p.points(base)})
+		}
+	}
+	if i := slices.IndexFunc(e.tiers, func(t Tier) bool { return t.Name == tier }); tier != "" && i >= 0 {
+		if extra := e.tiers[i].extra(b.Total()); extra != 0 {
+			b = append(b, RuleResult{Rule: e.tiers[i].Name, Description: e.tiers[i].Description, Points: extra})
+		}
+	}
+	return b.Total(), b, nil
+}
+
+// parse extracts the amounts, date and time from r.
+func parse(r Receipt) (*scoredReceipt, error) {
+	sr := &scoredReceipt{Receipt: r, prices: make([]Cents, len(r.Items))}
+	var err error
+	if sr.total, err = ParseCents(r.Total); err != nil {
+		return nil, fmt.Errorf("%w: total %q is not a dollar amount", ErrInvalidReceipt, r.Total)
+	}
+	for i, item := range r.Items {
+		if sr.prices[i], err = ParseCents(item.Price); err != nil {
+			return nil, fmt.Errorf("%w: items[%d].price %q is not a dollar amount", ErrInvalidReceipt, i, item.Price)
+		}
+	}
+	if sr.purchaseDate, err = time.Parse("2006-01-02", r.PurchaseDate); err != nil {
+		return nil, fmt.Errorf("%w: purchaseDate %q is not a YYYY-MM-DD date", ErrInvalidReceipt, r.PurchaseDate)
+	}
+	if sr.purchaseTime, err = time.Parse("15:04", r.PurchaseTime); err != nil {
+		return nil, fmt.Errorf("%w: purchaseTime %q is not an HH:MM time", ErrInvalidReceipt, r.PurchaseTime)
+	}
+	return sr, nil
+}
@@ -0,0 +1,87 @@
+package points
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Tier is a loyalty level. A user is in the highest tier whose MinPoints
+// they have reached, counting the points they earned recently, and their
+// receipts are scored with the tier's Multiplier applied to the total.
+type Tier struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	MinPoints   int    `json:"minPoints" yaml:"minPoints"`
+	// Multiplier scales the total after promotions; the extra points are
+	// rounded up. Zero or one leaves the total unchanged.
+	Multiplier float64 `json:"multiplier,omitempty" yaml:"multiplier,omitempty"`
+}
+
+// DefaultTiers returns the tiers used by rule sets that define none. They
+// carry no multipliers, so they do not change any score.
+func DefaultTiers() []Tier {
+	return []Tier{
+		{Name: "bronze", MinPoints: 0},
+		{Name: "silver", MinPoints: 1000},
+		{Name: "gold", MinPoints: 5000},
+	}
+}
+
+// compileTiers validates tiers and returns them ordered by MinPoints. The
+// lowest tier must start at zero so every user is in one.
+func compileTiers(tiers []Tier, seen map[string]bool) ([]Tier, error) {
+	out := slices.Clone(tiers)
+	for i, t := range out {
+		if t.Name == "" {
+			return nil, fmt.Errorf("tiers[%d]: name is required", i)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("tiers[%d]: duplicate name %q", i, t.Name)
+		}
+		seen[t.Name] = true
+		if t.Multiplier < 0 || math.IsNaN(t.Multiplier) || math.IsInf(t.Multiplier, 0) {
+			return nil, fmt.Errorf("tier %q: multiplier must not be negative", t.Name)
+		}
+		if out[i].Description == "" {
+			out[i].Description = "tier"
+		}
+	}
+	slices.SortStableFunc(out, func(a, b Tier) int { return a.MinPoints - b.MinPoints })
+	for i := 1; i < len(out); i++ {
+		if out[i].MinPoints == out[i-1].MinPoints {
+			return nil, fmt.Errorf("tiers %q and %q have the same minPoints", out[i-1].Name, out[i].Name)
+		}
+	}
+	if len(out) > 0 && out[0].MinPoints != 0 {
+		return nil, errors.New("the lowest tier must have minPoints 0")
+	}
+	return out, nil
+}
+
+// Tiers returns the engine's tiers, lowest first.
+func (e *Engine) Tiers() []Tier {
+	return slices.Clone(e.tiers)
+}
+
+// TierFor returns the tier for a user who earned points recently, and the
+// next tier up if there is one.
+func (e *Engine) TierFor(points int) (tier Tier, next *Tier) {
+	for i, t := range e.tiers {
+		if points < t.MinPoints {
+			next := e.tiers[i]
+			return tier, &next
+		}
+		tier = t
+	}
+	return tier, nil
+}
+
+// extra returns the points the tier adds to a receipt scored total.
+func (t Tier) extra(total int) int {
+	if t.Multiplier == 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(total) * (t.Multiplier - 1)))
+}